@@ -1,24 +1,183 @@
 package config
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
+	DBDriver   string // mysql、postgres、sqlite 或 memory
 	DBUser     string
 	DBPassword string
 	DBHost     string
 	DBPort     string
 	DBName     string
+	DBPath     string // SQLite数据库文件路径
+	DBSSLMode  string // PostgreSQL的sslmode
+
+	DBAutoMigrate bool // 启动时自动执行数据库迁移
+
+	DBQueryTimeout    time.Duration // 单条SQL的超时时间
+	DBConnectTimeout  time.Duration // 启动时等待数据库可用的最长时间
+	DBConnectBackoff  time.Duration // 首次重试前的等待时间，之后指数增长
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration // 0表示不限制
+	DBConnMaxIdleTime time.Duration // 0表示不限制
+
+	DBReplicas             []string      // 只读副本的连接串，格式与驱动一致
+	DBReplicaCheckInterval time.Duration // 副本健康检查间隔
+	DBReplicaMaxLag        time.Duration // 副本可能落后主库的最长时间，写入后这段时间内需要一致性的读走主库
+
+	AccessTokenTTL time.Duration // 单个访问token的最长有效期，不超过会话的空闲超时
+	TokenHashKey   string        // 计算token摘要的HMAC密钥，为空时使用SHA-256；更换后所有会话失效
+
+	SessionIdleTimeout             time.Duration // 会话超过该时间未使用即失效，每次使用后顺延
+	SessionAbsoluteTimeout         time.Duration // 自登录起会话的最长有效期
+	SessionRememberIdleTimeout     time.Duration // 登录时选择记住我的会话，0表示不支持记住我
+	SessionRememberAbsoluteTimeout time.Duration
+	SessionRolePolicies            string // 按角色覆盖，如 admin=30m/8h/0/0
+
+	TokenFormat       string        // opaque（随机字符串，每次请求查库）或 jwt
+	JWTAlg            string        // EdDSA 或 RS256
+	JWTIssuer         string        // iss声明
+	JWTKeyDir         string        // 签名密钥目录，多个实例需共享；为空时密钥只在内存中
+	JWTKeyRotation    time.Duration // 密钥轮换周期，0表示不轮换
+	JWTKeyPrepublish  time.Duration // 新密钥提前发布到JWKS的时间
+	JWTRevocationSync time.Duration // 吊销列表的同步间隔
+
+	MFAIssuer       string        // 验证器App中显示的发行方
+	MFAChallengeTTL time.Duration // 密码正确后提交两步验证码的期限
+	MFAMaxFailures  int           // 同一用户累计的验证码错误次数上限，成功验证后清零
+	MFALockout      time.Duration // 达到上限后锁定两步验证的时长
+
+	WebAuthnEnabled bool
+	WebAuthnRPID    string   // 凭证绑定的域名，上线后不能修改，否则已注册的凭证全部失效
+	WebAuthnRPName  string   // 认证器中显示的名称
+	WebAuthnOrigins []string // 允许发起仪式的页面来源，如 https://example.com
+
+	WebAuthnLoginIPLimit int // 同一IP最多同时持有几个未完成的无密码登录挑战
+
+	MailDriver       string // off（默认）、smtp 或 outbox（写入本地目录，仅供开发）
+	MailOutboxDir    string
+	MailFrom         string
+	SMTPAddr         string // host:port
+	SMTPUsername     string // 为空时不认证
+	SMTPPassword     string
+	PasswordResetURL string        // 前端的重置密码页面，邮件中的链接为该地址加token参数
+	PasswordResetTTL time.Duration // 重置链接的有效期
+
+	EmailVerification          bool          // 新注册的用户需要验证邮箱
+	EmailVerificationBlock     bool          // 验证邮箱前不能登录
+	EmailVerificationURL       string        // 前端的验证邮箱页面
+	EmailVerificationTTL       time.Duration // 验证链接的有效期
+	EmailVerificationKey       string        // 验证链接的签名密钥，多个实例需一致；开启邮箱验证时必填
+	EmailVerificationResendGap time.Duration // 同一用户两次重发验证邮件的最短间隔
+
+	MagicLinkLogin    bool          // 允许通过邮件中的链接免密码登录
+	MagicLinkURL      string        // 前端的登录链接页面
+	MagicLinkTTL      time.Duration // 登录链接的有效期
+	MagicLinkInterval time.Duration // 同一用户两次发送登录链接的最短间隔
+	MagicLinkIPLimit  int           // 同一IP在MagicLinkIPWindow内最多申请几次
+	MagicLinkIPWindow time.Duration
+
+	SchedulerEnabled     bool
+	JobTokenCleanup      string        // 清理过期token的执行计划（cron表达式），off表示关闭
+	JobPurgeDeletedUsers string        // 硬删除已标记删除的用户
+	JobStatsRollup       string        // 生成前一天的用户统计
+	DeletedUserRetention time.Duration // 标记删除后保留多久才硬删除
 }
 
 func GetDatabaseInfo() *Config {
+	driver := getEnv("DB_DRIVER", "mysql")
+	defaultPort := "3306"
+	if driver == "postgres" {
+		defaultPort = "5432"
+	}
 	return &Config{
+		DBDriver:   driver,
 		DBUser:     getEnv("DB_USER", "root"),
 		DBPassword: getEnv("DB_PASSWORD", "123456"),
 		DBHost:     getEnv("DB_HOST", "localhost"),
-		DBPort:     getEnv("DB_PORT", "3306"),
+		DBPort:     getEnv("DB_PORT", defaultPort),
 		DBName:     getEnv("DB_NAME", "usersystem"),
+		DBPath:     getEnv("DB_PATH", "usersystem.db"),
+		DBSSLMode:  getEnv("DB_SSLMODE", "disable"),
+
+		DBAutoMigrate: getEnv("DB_AUTO_MIGRATE", "true") == "true",
+
+		DBQueryTimeout:    getEnvDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+		DBConnectTimeout:  getEnvDuration("DB_CONNECT_TIMEOUT", 30*time.Second),
+		DBConnectBackoff:  getEnvDuration("DB_CONNECT_BACKOFF", 500*time.Millisecond),
+		DBMaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 25),
+		DBMaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 5),
+		DBConnMaxLifetime: getEnvDuration("DB_CONN_MAX_LIFETIME", 0),
+		DBConnMaxIdleTime: getEnvDuration("DB_CONN_MAX_IDLE_TIME", 0),
+
+		DBReplicas:             getEnvList("DB_REPLICAS"),
+		DBReplicaCheckInterval: getEnvDuration("DB_REPLICA_CHECK_INTERVAL", 5*time.Second),
+		DBReplicaMaxLag:        getEnvDuration("DB_REPLICA_MAX_LAG", 5*time.Second),
+
+		AccessTokenTTL: getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		TokenHashKey:   getEnv("TOKEN_HASH_KEY", ""),
+
+		SessionIdleTimeout:             getEnvDuration("SESSION_IDLE_TIMEOUT", 2*time.Hour),
+		SessionAbsoluteTimeout:         getEnvDuration("SESSION_ABSOLUTE_TIMEOUT", 24*time.Hour),
+		SessionRememberIdleTimeout:     getEnvDuration("SESSION_REMEMBER_IDLE_TIMEOUT", 30*24*time.Hour),
+		SessionRememberAbsoluteTimeout: getEnvDuration("SESSION_REMEMBER_ABSOLUTE_TIMEOUT", 90*24*time.Hour),
+		SessionRolePolicies:            getEnv("SESSION_ROLE_POLICIES", ""),
+
+		TokenFormat:       getEnv("TOKEN_FORMAT", "opaque"),
+		JWTAlg:            getEnv("JWT_ALG", "EdDSA"),
+		JWTIssuer:         getEnv("JWT_ISSUER", "user_system"),
+		JWTKeyDir:         getEnv("JWT_KEY_DIR", ""),
+		JWTKeyRotation:    getEnvDuration("JWT_KEY_ROTATION", 24*time.Hour),
+		JWTKeyPrepublish:  getEnvDuration("JWT_KEY_PREPUBLISH", time.Hour),
+		JWTRevocationSync: getEnvDuration("JWT_REVOCATION_SYNC", 5*time.Second),
+
+		MFAIssuer:       getEnv("MFA_ISSUER", "user_system"),
+		MFAChallengeTTL: getEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute),
+		MFAMaxFailures:  getEnvInt("MFA_MAX_FAILURES", 10),
+		MFALockout:      getEnvDuration("MFA_LOCKOUT", 15*time.Minute),
+
+		WebAuthnEnabled: getEnv("WEBAUTHN_ENABLED", "false") == "true",
+		WebAuthnRPID:    getEnv("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnRPName:  getEnv("WEBAUTHN_RP_NAME", "user_system"),
+		WebAuthnOrigins: getEnvList("WEBAUTHN_ORIGINS"),
+
+		WebAuthnLoginIPLimit: getEnvInt("WEBAUTHN_LOGIN_IP_LIMIT", 10),
+
+		MailDriver:       getEnv("MAIL_DRIVER", "off"),
+		MailOutboxDir:    getEnv("MAIL_OUTBOX_DIR", "outbox"),
+		MailFrom:         getEnv("MAIL_FROM", "user_system <no-reply@localhost>"),
+		SMTPAddr:         getEnv("SMTP_ADDR", "localhost:25"),
+		SMTPUsername:     getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:     getEnv("SMTP_PASSWORD", ""),
+		PasswordResetURL: getEnv("PASSWORD_RESET_URL", "http://localhost:8080/reset_password"),
+		PasswordResetTTL: getEnvDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+
+		EmailVerification:          getEnv("EMAIL_VERIFICATION", "false") == "true",
+		EmailVerificationBlock:     getEnv("EMAIL_VERIFICATION_BLOCK_LOGIN", "false") == "true",
+		EmailVerificationURL:       getEnv("EMAIL_VERIFICATION_URL", "http://localhost:8080/verify_email"),
+		EmailVerificationTTL:       getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour),
+		EmailVerificationKey:       getEnv("EMAIL_VERIFICATION_KEY", ""),
+		EmailVerificationResendGap: getEnvDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", time.Minute),
+
+		MagicLinkLogin:    getEnv("MAGIC_LINK_LOGIN", "false") == "true",
+		MagicLinkURL:      getEnv("MAGIC_LINK_URL", "http://localhost:8080/magic_login"),
+		MagicLinkTTL:      getEnvDuration("MAGIC_LINK_TTL", 15*time.Minute),
+		MagicLinkInterval: getEnvDuration("MAGIC_LINK_INTERVAL", time.Minute),
+		MagicLinkIPLimit:  getEnvInt("MAGIC_LINK_IP_LIMIT", 10),
+		MagicLinkIPWindow: getEnvDuration("MAGIC_LINK_IP_WINDOW", time.Hour),
+
+		SchedulerEnabled:     getEnv("SCHEDULER_ENABLED", "true") == "true",
+		JobTokenCleanup:      getEnv("JOB_TOKEN_CLEANUP_SCHEDULE", "*/10 * * * *"),
+		JobPurgeDeletedUsers: getEnv("JOB_PURGE_DELETED_USERS_SCHEDULE", "30 3 * * *"),
+		JobStatsRollup:       getEnv("JOB_STATS_ROLLUP_SCHEDULE", "5 0 * * *"),
+		DeletedUserRetention: getEnvDuration("DELETED_USER_RETENTION", 30*24*time.Hour),
 	}
 }
 
@@ -28,3 +187,39 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s %q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration { //格式如 500ms、5s、1m
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Invalid %s %q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+func getEnvList(key string) []string { //逗号分隔，忽略空项
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
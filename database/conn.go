@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conn 包装*sql.DB，在执行前把?占位符改写成当前方言的格式，让上层SQL保持一份
+// 通过WithTx得到的Conn绑定在事务上，语句都在该事务中执行
+// ReadOnly/ReadConsistent得到的Conn可能指向只读副本，副本不可用时自动回到主库
+type Conn struct {
+	*sql.DB
+	Driver    string
+	Timeout   time.Duration //单条语句的超时时间，0表示只受调用方ctx限制
+	Replicas  *ReplicaSet   //为nil时所有读写都走主库
+	tx        *sql.Tx
+	primary   *Conn //指向副本时记录主库，用于故障转移和写操作
+	untracked bool  //写入不记录时间，不影响ReadConsistent的选择
+}
+
+func NewConn(db *sql.DB, driver string) *Conn {
+	if db == nil {
+		return nil
+	}
+	return &Conn{DB: db, Driver: driver}
+}
+
+func (c *Conn) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+func (c *Conn) ReadOnly() *Conn { //读取可以容忍副本延迟时使用
+	if c.tx != nil || c.primary != nil || c.Replicas == nil {
+		return c
+	}
+	db := c.Replicas.pick()
+	if db == nil {
+		return c
+	}
+	return &Conn{DB: db, Driver: c.Driver, Timeout: c.Timeout, primary: c}
+}
+
+func (c *Conn) ReadConsistent() *Conn { //本进程最近有写入时走主库，保证读到自己的写入
+	if c.Replicas == nil || !c.Replicas.fresh() {
+		return c
+	}
+	return c.ReadOnly()
+}
+
+// Untracked 返回写入不需要立即可见的Conn，例如请求中顺带更新的最后使用时间
+// 这类写入很频繁，记录下来会让ReadConsistent在几乎所有时间都走主库
+func (c *Conn) Untracked() *Conn {
+	copied := *c.Primary()
+	copied.untracked = true
+	return &copied
+}
+
+func (c *Conn) IsReplica() bool {
+	return c.primary != nil
+}
+
+func (c *Conn) Primary() *Conn {
+	if c.primary != nil {
+		return c.primary
+	}
+	return c
+}
+
+func (c *Conn) failover(ctx context.Context, err error) bool { //副本连接失败且调用方未取消时改用主库
+	if c.primary == nil || ctx.Err() != nil || !IsUnavailable(err) {
+		return false
+	}
+	c.primary.Replicas.markDown(c.DB, err)
+	return true
+}
+
+func (c *Conn) Exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if c.primary != nil { //写操作总是走主库
+		return c.primary.Exec(ctx, query, args...)
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	var result sql.Result
+	var err error
+	if c.tx != nil {
+		result, err = c.tx.ExecContext(ctx, Rebind(c.Driver, query), args...)
+	} else {
+		result, err = c.DB.ExecContext(ctx, Rebind(c.Driver, query), args...)
+	}
+	if err == nil && c.Replicas != nil && !c.untracked { //记录写入时间，之后maxLag内ReadConsistent走主库
+		c.Replicas.lastWrite.Store(time.Now().UnixNano())
+	}
+	return result, err
+}
+
+// Rows 在Close时释放超时的context，调用方必须Close
+type Rows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *Rows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+func (c *Conn) Query(ctx context.Context, query string, args ...any) (*Rows, error) {
+	queryCtx, cancel := c.withTimeout(ctx)
+	var rows *sql.Rows
+	var err error
+	if c.tx != nil {
+		rows, err = c.tx.QueryContext(queryCtx, Rebind(c.Driver, query), args...)
+	} else {
+		rows, err = c.DB.QueryContext(queryCtx, Rebind(c.Driver, query), args...)
+	}
+	if err != nil {
+		cancel()
+		if c.failover(ctx, err) {
+			return c.primary.Query(ctx, query, args...)
+		}
+		return nil, err
+	}
+	return &Rows{Rows: rows, cancel: cancel}, nil
+}
+
+// Row 在Scan之后释放超时的context；QueryRow的错误要到Scan时才知道，故障转移也在Scan中进行
+type Row struct {
+	*sql.Row
+	cancel   context.CancelFunc
+	failover func(err error) *Row
+}
+
+func (r *Row) Scan(dest ...any) error {
+	err := r.Row.Scan(dest...)
+	r.cancel()
+	if err != nil && r.failover != nil {
+		if row := r.failover(err); row != nil {
+			return row.Scan(dest...)
+		}
+	}
+	return err
+}
+
+func (c *Conn) QueryRow(ctx context.Context, query string, args ...any) *Row {
+	queryCtx, cancel := c.withTimeout(ctx)
+	if c.tx != nil {
+		return &Row{Row: c.tx.QueryRowContext(queryCtx, Rebind(c.Driver, query), args...), cancel: cancel}
+	}
+	row := &Row{Row: c.DB.QueryRowContext(queryCtx, Rebind(c.Driver, query), args...), cancel: cancel}
+	if c.primary != nil {
+		row.failover = func(err error) *Row {
+			if !c.failover(ctx, err) {
+				return nil
+			}
+			return c.primary.QueryRow(ctx, query, args...)
+		}
+	}
+	return row
+}
+
+func (c *Conn) InTx() bool {
+	return c.tx != nil
+}
+
+// WithTx 在事务中执行fn，fn返回错误或panic时回滚；已经在事务中时直接加入外层事务
+func (c *Conn) WithTx(ctx context.Context, fn func(tx *Conn) error) (err error) {
+	if c.tx != nil {
+		return fn(c)
+	}
+	if c.primary != nil { //事务总是在主库上执行
+		return c.primary.WithTx(ctx, fn)
+	}
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err = fn(&Conn{DB: c.DB, Driver: c.Driver, Timeout: c.Timeout, Replicas: c.Replicas, tx: tx}); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (c *Conn) ForUpdate() string { //SELECT ... FOR UPDATE锁住读到的行；SQLite的事务一开始就持有写锁，不需要
+	if c.Driver == DriverSQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+func Rebind(driver, query string) string { //PostgreSQL使用$1、$2...作为占位符
+	if driver != DriverPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	inQuote := false
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'':
+			inQuote = !inQuote //字符串字面量中的?不是占位符
+		case ch == '?' && !inQuote:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+func IsUniqueViolation(err error) bool { //判断是否违反唯一约束，例如用户名重复
+	return err != nil && (isMySQLUniqueViolation(err) || isSQLiteUniqueViolation(err) || isPostgresUniqueViolation(err))
+}
+
+func IsUnavailable(err error) bool { //连接断开、数据库繁忙或超时等暂时性故障，稍后重试可能成功
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) || isMySQLUnavailable(err) || isSQLiteUnavailable(err) || isPostgresUnavailable(err)
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T, name string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE t (id INTEGER PRIMARY KEY, v INTEGER)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	return db
+}
+
+// 只有需要立即可见的写入才让ReadConsistent改走主库
+func TestReadConsistentAfterWrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		write       func(c *Conn) *Conn
+		wantReplica bool
+	}{
+		{"no write", nil, true},
+		{"tracked write", func(c *Conn) *Conn { return c }, false},
+		{"untracked write", func(c *Conn) *Conn { return c.Untracked() }, true},
+		{"untracked write through replica", func(c *Conn) *Conn { return c.ReadOnly().Untracked() }, true},
+		{"tracked write through replica", func(c *Conn) *Conn { return c.ReadOnly() }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &replica{name: "replica", db: openSQLite(t, "replica.db")}
+			r.healthy.Store(true)
+			conn := NewConn(openSQLite(t, "primary.db"), DriverSQLite)
+			conn.Replicas = &ReplicaSet{replicas: []*replica{r}, maxLag: time.Minute}
+			if tt.write != nil {
+				if _, err := tt.write(conn).Exec(context.Background(), `INSERT INTO t (v) VALUES (?)`, 1); err != nil {
+					t.Fatalf("Exec: %v", err)
+				}
+			}
+			if got := conn.ReadConsistent().IsReplica(); got != tt.wantReplica {
+				t.Errorf("ReadConsistent().IsReplica() = %v, want %v", got, tt.wantReplica)
+			}
+		})
+	}
+}
@@ -1,18 +1,96 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"strings"
+	"time"
 	"user_system/config"
 
-	_ "github.com/go-sql-driver/mysql" //空白导入
+	"github.com/go-sql-driver/mysql"
 )
 
-var DB *sql.DB
+const (
+	DriverMySQL    = "mysql"
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMemory   = "memory" //不使用数据库，数据保存在进程内存中
+)
+
+var (
+	DB     *sql.DB
+	Driver string //当前连接使用的驱动
+)
 
 func InitDB() error {
 	cfg := config.GetDatabaseInfo()
+	var init func(ctx context.Context, cfg *config.Config) error
+	switch cfg.DBDriver {
+	case DriverMySQL:
+		init = initMySQL
+	case DriverSQLite:
+		init = initSQLite
+	case DriverPostgres:
+		init = initPostgres
+	default:
+		return fmt.Errorf("Unsupported database driver %q", cfg.DBDriver)
+	}
+	if err := connectWithRetry(cfg, init); err != nil {
+		return err
+	}
+	DB.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	DB.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	DB.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	DB.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
+	if err := initReplicas(cfg); err != nil {
+		DB.Close()
+		DB = nil
+		return err
+	}
+	Driver = cfg.DBDriver
+	log.Println("Database connection established successfully")
+	return nil
+}
+
+const maxConnectBackoff = 10 * time.Second
+
+// connectWithRetry 数据库暂时不可用时（例如docker-compose中MySQL还没启动完成）按指数退避重试，
+// 等待时间加入随机抖动，避免多个实例同时重连；认证失败等其他错误直接返回
+func connectWithRetry(cfg *config.Config, init func(ctx context.Context, cfg *config.Config) error) error {
+	if cfg.DBConnectTimeout <= 0 { //不重试
+		return init(context.Background(), cfg)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DBConnectTimeout)
+	defer cancel()
+	backoff := max(cfg.DBConnectBackoff, 100*time.Millisecond)
+	for attempt := 1; ; attempt++ {
+		err := init(ctx, cfg)
+		if err == nil {
+			return nil
+		}
+		if DB != nil { //失败的连接池不再使用
+			DB.Close()
+			DB = nil
+		}
+		if !IsUnavailable(err) {
+			return err
+		}
+		wait := backoff/2 + rand.N(backoff/2+1)
+		log.Printf("Database is not available (attempt %d): %v, retrying in %s", attempt, err, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Database is still not available after %s: %w", cfg.DBConnectTimeout, err)
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+func initMySQL(ctx context.Context, cfg *config.Config) error {
 	var err error
 	DB, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
 		cfg.DBUser, cfg.DBPassword, cfg.DBHost, cfg.DBPort, cfg.DBName,
@@ -21,11 +99,7 @@ func InitDB() error {
 		return fmt.Errorf("Failed to connect to database: %w", err)
 	}
 
-	DB.SetMaxOpenConns(25)
-	DB.SetMaxIdleConns(5)
-	DB.SetConnMaxLifetime(0)
-
-	if err := DB.Ping(); err != nil { //如果连接失败，尝试创建数据库
+	if err := DB.PingContext(ctx); err != nil { //如果连接失败，尝试创建数据库
 		DB.Close() //关闭连接
 		DB, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/mysql?charset=utf8mb4&parseTime=True&loc=Local",
 			cfg.DBUser, cfg.DBPassword, cfg.DBHost, cfg.DBPort,
@@ -33,7 +107,7 @@ func InitDB() error {
 		if err != nil {
 			return fmt.Errorf("Failed to connect to MySQL server: %w", err)
 		}
-		_, err = DB.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci", cfg.DBName))
+		_, err = DB.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s` CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci", strings.ReplaceAll(cfg.DBName, "`", "``")))
 		if err != nil {
 			return fmt.Errorf("failed to create database: %w", err)
 		}
@@ -46,14 +120,30 @@ func InitDB() error {
 		}
 	}
 
-	if err := DB.Ping(); err != nil { //再次尝试连接
+	if err := DB.PingContext(ctx); err != nil { //再次尝试连接
 		return fmt.Errorf("Failed to ping database: %w", err)
 	}
-	log.Println("Database connection established successfully")
 	return nil
 }
 
+func isMySQLUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 //ER_DUP_ENTRY
+}
+
+func isMySQLUnavailable(err error) bool {
+	if errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1040 || mysqlErr.Number == 1053) //ER_CON_COUNT_ERROR、ER_SERVER_SHUTDOWN
+}
+
 func CloseDB() error {
+	if Replicas != nil {
+		Replicas.close()
+		Replicas = nil
+	}
 	if DB != nil {
 		if err := DB.Close(); err != nil {
 			return fmt.Errorf("Failed to close database: %w", err)
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"user_system/config"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" //注册pgx驱动
+)
+
+const (
+	pgUniqueViolation    = "23505"
+	pgInvalidCatalogName = "3D000" //数据库不存在
+)
+
+func postgresDSN(cfg *config.Config, dbname string) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, dbname, cfg.DBSSLMode,
+	)
+}
+
+func initPostgres(ctx context.Context, cfg *config.Config) error {
+	var err error
+	DB, err = sql.Open("pgx", postgresDSN(cfg, cfg.DBName))
+	if err != nil {
+		return fmt.Errorf("Failed to connect to database: %w", err)
+	}
+
+	err = DB.PingContext(ctx)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgInvalidCatalogName { //数据库不存在，尝试创建数据库
+		DB.Close() //关闭连接
+		DB, err = sql.Open("pgx", postgresDSN(cfg, "postgres"))
+		if err != nil {
+			return fmt.Errorf("Failed to connect to PostgreSQL server: %w", err)
+		}
+		//PostgreSQL不支持CREATE DATABASE IF NOT EXISTS，先查询是否存在
+		var exists bool
+		err = DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, cfg.DBName).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check database: %w", err)
+		}
+		if !exists {
+			//数据库名来自配置，按标识符转义后再拼接
+			_, err = DB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE %s ENCODING 'UTF8'`, pgx.Identifier{cfg.DBName}.Sanitize()))
+			if err != nil && !isPostgresCode(err, "42P04") { //42P04: 其他实例已经创建
+				return fmt.Errorf("failed to create database: %w", err)
+			}
+		}
+		DB.Close()                                              //关闭连接
+		DB, err = sql.Open("pgx", postgresDSN(cfg, cfg.DBName)) //重新连接到新创建的数据库
+		if err != nil {
+			return fmt.Errorf("Failed to connect to database after creating it: %w", err)
+		}
+	}
+
+	if err := DB.PingContext(ctx); err != nil { //再次尝试连接
+		return fmt.Errorf("Failed to ping database: %w", err)
+	}
+	return nil
+}
+
+func isPostgresCode(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
+func isPostgresUniqueViolation(err error) bool {
+	return isPostgresCode(err, pgUniqueViolation)
+}
+
+func isPostgresUnavailable(err error) bool {
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	//08xxx为连接异常，57P01~57P03为服务器关闭或启动中，53300为连接数已满
+	return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03" || pgErr.Code == "53300"
+}
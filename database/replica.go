@@ -0,0 +1,151 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"user_system/config"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var Replicas *ReplicaSet //未配置只读副本时为nil
+
+type replica struct {
+	name    string //用于日志，不含密码
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// ReplicaSet 管理只读副本：轮询选择健康的副本，后台定期检查，查询失败时标记为不可用
+type ReplicaSet struct {
+	replicas  []*replica
+	next      atomic.Uint64
+	maxLag    time.Duration
+	lastWrite atomic.Int64 //本进程最近一次需要立即可见的写入（unix纳秒）
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func driverName(driver string) string {
+	if driver == DriverPostgres {
+		return "pgx"
+	}
+	return driver
+}
+
+func initReplicas(cfg *config.Config) error {
+	if len(cfg.DBReplicas) == 0 {
+		return nil
+	}
+	if cfg.DBDriver != DriverMySQL && cfg.DBDriver != DriverPostgres {
+		return fmt.Errorf("Read replicas are not supported by driver %q", cfg.DBDriver)
+	}
+	set := &ReplicaSet{maxLag: cfg.DBReplicaMaxLag, stop: make(chan struct{})}
+	for i, dsn := range cfg.DBReplicas {
+		name := fmt.Sprintf("replica#%d", i+1) //PostgreSQL的连接串可能含密码，日志中只用序号
+		dsn = strings.TrimSpace(dsn)
+		if cfg.DBDriver == DriverMySQL {
+			parsed, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				set.close()
+				return fmt.Errorf("Invalid replica DSN #%d: %w", i+1, err)
+			}
+			parsed.ParseTime = true //与主库连接保持一致，否则无法扫描时间字段
+			parsed.Loc = time.Local
+			dsn, name = parsed.FormatDSN(), parsed.Addr
+		}
+		db, err := sql.Open(driverName(cfg.DBDriver), dsn)
+		if err != nil {
+			set.close()
+			return fmt.Errorf("Failed to open replica %s: %w", name, err)
+		}
+		db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+		db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+		db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+		db.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
+		set.replicas = append(set.replicas, &replica{name: name, db: db})
+	}
+	set.check() //副本不可用不影响启动，读请求会回到主库
+	interval := cfg.DBReplicaCheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	set.wg.Add(1)
+	go set.monitor(interval)
+	Replicas = set
+	return nil
+}
+
+func (s *ReplicaSet) check() {
+	for _, r := range s.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := r.db.PingContext(ctx)
+		cancel()
+		healthy := err == nil
+		if r.healthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Printf("Replica %s is available", r.name)
+			} else {
+				log.Printf("Replica %s is unavailable: %v", r.name, err)
+			}
+		}
+	}
+}
+
+func (s *ReplicaSet) monitor(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+func (s *ReplicaSet) pick() *sql.DB { //轮询健康的副本，没有时返回nil
+	n := len(s.replicas)
+	start := int(s.next.Add(1))
+	for i := 0; i < n; i++ {
+		r := s.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return nil
+}
+
+func (s *ReplicaSet) markDown(db *sql.DB, err error) {
+	for _, r := range s.replicas {
+		if r.db == db && r.healthy.Swap(false) {
+			log.Printf("Replica %s is unavailable: %v", r.name, err)
+		}
+	}
+}
+
+func (s *ReplicaSet) fresh() bool { //最近的写入已超过最大延迟，可以认为副本已经同步
+	return time.Since(time.Unix(0, s.lastWrite.Load())) > s.maxLag
+}
+
+func (s *ReplicaSet) close() {
+	if s.stop != nil {
+		select {
+		case <-s.stop:
+		default:
+			close(s.stop)
+		}
+	}
+	s.wg.Wait()
+	for _, r := range s.replicas {
+		r.db.Close()
+	}
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"user_system/config"
+
+	"modernc.org/sqlite" //纯Go实现的SQLite驱动，无需CGO
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+func initSQLite(ctx context.Context, cfg *config.Config) error {
+	var err error
+	//时间统一以微秒级unix时间戳存储，避免文本格式在不同时区下比较出错
+	//_txlock=immediate 让事务一开始就拿写锁，避免多个连接升级锁时互相等待
+	DB, err = sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_integer_format=unix_micro&_inttotime=1&_txlock=immediate",
+		cfg.DBPath,
+	)) //文件不存在时会自动创建
+	if err != nil {
+		return fmt.Errorf("Failed to open SQLite database: %w", err)
+	}
+
+	if err := DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("Failed to ping database: %w", err)
+	}
+	return nil
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+func isSQLiteUnavailable(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff { //扩展错误码的低8位是基本错误码
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_CANTOPEN:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+// Package webauthntest 提供软件实现的WebAuthn认证器，只供测试使用
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"user_system/webauthn"
+)
+
+// authenticatorData中的标志位
+const (
+	flagUP = 0x01
+	flagUV = 0x04
+	flagAT = 0x40
+)
+
+// COSE_Key参数
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+)
+
+// Authenticator 是软件实现的认证器（ES256），私钥只保存在内存中
+// 它按浏览器的方式生成clientDataJSON，返回的结构可以直接作为注册、登录接口的请求体
+type Authenticator struct {
+	Origin       string
+	AAGUID       [16]byte
+	Attestation  string //none（默认）或 packed（自签名证明）
+	UserVerified bool   //是否声明完成了用户验证
+	ZeroCounter  bool   //签名计数始终为0，模拟不支持计数的认证器
+
+	mu          sync.Mutex
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, UserVerified: true}
+}
+
+// Clone 复制认证器及其私钥与当前的签名计数，模拟被克隆的安全密钥
+func (a *Authenticator) Clone() *Authenticator {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	clone := &Authenticator{Origin: a.Origin, AAGUID: a.AAGUID, Attestation: a.Attestation, UserVerified: a.UserVerified, ZeroCounter: a.ZeroCounter}
+	for _, c := range a.credentials {
+		copied := *c
+		clone.credentials = append(clone.credentials, &copied)
+	}
+	return clone
+}
+
+func (a *Authenticator) clientData(typ, challenge string) []byte {
+	raw, _ := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.Origin, "crossOrigin": false})
+	return raw
+}
+
+func (a *Authenticator) flags() byte {
+	flags := byte(flagUP)
+	if a.UserVerified {
+		flags |= flagUV
+	}
+	return flags
+}
+
+func (c *credential) nextCount(zero bool) uint32 {
+	if !zero {
+		c.signCount++
+	}
+	return c.signCount
+}
+
+func (c *credential) coseKey() []byte {
+	x := c.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := c.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	return encodeCBOR([]cborPair{{coseKty, 2}, {coseAlg, webauthn.AlgES256}, {coseCrv, 1}, {coseX, x}, {coseY, y}})
+}
+
+func (c *credential) sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return ecdsa.SignASN1(rand.Reader, c.key, digest[:])
+}
+
+// Create 模拟navigator.credentials.create()
+func (a *Authenticator) Create(options *webauthn.CreationOptions) (*webauthn.AttestationResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	supported := false
+	for _, p := range options.PubKeyCredParams {
+		supported = supported || p.Alg == webauthn.AlgES256
+	}
+	if !supported {
+		return nil, fmt.Errorf("Authenticator: ES256 is not allowed")
+	}
+	for _, d := range options.ExcludeCredentials {
+		for _, c := range a.credentials {
+			if c.rpID == options.RP.ID && webauthn.Encoding.EncodeToString(c.id) == d.ID {
+				return nil, fmt.Errorf("Authenticator: Credential already registered")
+			}
+		}
+	}
+	userHandle, err := webauthn.Encoding.DecodeString(options.User.ID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c := &credential{id: make([]byte, 32), rpID: options.RP.ID, userHandle: userHandle, key: key}
+	if _, err := rand.Read(c.id); err != nil {
+		return nil, err
+	}
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	authData := append(rpIDHash[:], a.flags()|flagAT)
+	authData = binary.BigEndian.AppendUint32(authData, c.nextCount(a.ZeroCounter))
+	authData = append(authData, a.AAGUID[:]...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(c.id)))
+	authData = append(authData, c.id...)
+	authData = append(authData, c.coseKey()...)
+	clientDataJSON := a.clientData("webauthn.create", options.Challenge)
+	attStmt := []cborPair{}
+	format := "none"
+	if a.Attestation == "packed" {
+		clientDataHash := sha256.Sum256(clientDataJSON)
+		sig, err := c.sign(append(append([]byte(nil), authData...), clientDataHash[:]...))
+		if err != nil {
+			return nil, err
+		}
+		format, attStmt = "packed", []cborPair{{"alg", webauthn.AlgES256}, {"sig", sig}}
+	}
+	a.credentials = append(a.credentials, c)
+	resp := &webauthn.AttestationResponse{ID: webauthn.Encoding.EncodeToString(c.id), RawID: webauthn.Encoding.EncodeToString(c.id), Type: "public-key"}
+	resp.Response.ClientDataJSON = webauthn.Encoding.EncodeToString(clientDataJSON)
+	resp.Response.AttestationObject = webauthn.Encoding.EncodeToString(encodeCBOR([]cborPair{{"fmt", format}, {"attStmt", attStmt}, {"authData", authData}}))
+	resp.Response.Transports = []string{"internal"}
+	return resp, nil
+}
+
+// Get 模拟navigator.credentials.get()，allowCredentials为空时使用该RP的第一个凭证（可发现凭证）
+func (a *Authenticator) Get(options *webauthn.RequestOptions) (*webauthn.AssertionResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var c *credential
+	for _, candidate := range a.credentials {
+		if candidate.rpID != options.RPID {
+			continue
+		}
+		allowed := len(options.AllowCredentials) == 0
+		for _, d := range options.AllowCredentials {
+			allowed = allowed || d.ID == webauthn.Encoding.EncodeToString(candidate.id)
+		}
+		if allowed {
+			c = candidate
+			break
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("Authenticator: No matching credential")
+	}
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	authData := append(rpIDHash[:], a.flags())
+	authData = binary.BigEndian.AppendUint32(authData, c.nextCount(a.ZeroCounter))
+	clientDataJSON := a.clientData("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	sig, err := c.sign(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	if err != nil {
+		return nil, err
+	}
+	resp := &webauthn.AssertionResponse{ID: webauthn.Encoding.EncodeToString(c.id), RawID: webauthn.Encoding.EncodeToString(c.id), Type: "public-key"}
+	resp.Response.ClientDataJSON = webauthn.Encoding.EncodeToString(clientDataJSON)
+	resp.Response.AuthenticatorData = webauthn.Encoding.EncodeToString(authData)
+	resp.Response.Signature = webauthn.Encoding.EncodeToString(sig)
+	resp.Response.UserHandle = webauthn.Encoding.EncodeToString(c.userHandle)
+	return resp, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+	"user_system/config"
+	"user_system/database"
+	"user_system/repositories"
+	"user_system/scheduler"
+	"user_system/utils"
+)
+
+// startScheduler 注册维护任务并启动调度器；多个实例通过数据库中的租约保证每个任务每次只在一个实例上运行
+func startScheduler(cfg *config.Config, users repositories.UserStore, tokens utils.TokenStore) (*scheduler.Scheduler, error) {
+	var leases scheduler.LeaseStore
+	if cfg.DBDriver == database.DriverMemory {
+		leases = scheduler.NewMemoryLeaseStore()
+	} else {
+		conn := database.NewConn(database.DB, database.Driver)
+		if conn != nil {
+			conn.Timeout = cfg.DBQueryTimeout
+			conn.Replicas = database.Replicas
+		}
+		store, err := scheduler.NewDBLeaseStore(conn)
+		if err != nil {
+			return nil, err
+		}
+		leases = store
+	}
+	s := scheduler.New(leases)
+	jobs := []scheduler.Job{
+		{
+			Name: "token_cleanup",
+			Spec: jobSpec(cfg.JobTokenCleanup),
+			Run: func(ctx context.Context) error { //过期的token、两步验证登录挑战、重置密码链接与登录链接
+				if err := tokens.DeleteExpiredTokens(ctx); err != nil {
+					return err
+				}
+				if _, err := users.DeleteExpiredMFAChallenges(ctx); err != nil {
+					return err
+				}
+				if _, err := users.DeleteExpiredPasswordResets(ctx); err != nil {
+					return err
+				}
+				_, err := users.DeleteExpiredMagicLinks(ctx)
+				return err
+			},
+		},
+		{
+			Name: "purge_deleted_users",
+			Spec: jobSpec(cfg.JobPurgeDeletedUsers),
+			Run: func(ctx context.Context) error {
+				n, err := users.PurgeDeletedUsers(ctx, time.Now().Add(-cfg.DeletedUserRetention))
+				if n > 0 {
+					log.Printf("Purged %d deleted users", n)
+				}
+				return err
+			},
+		},
+		{
+			Name: "stats_rollup",
+			Spec: jobSpec(cfg.JobStatsRollup),
+			Run: func(ctx context.Context) error { //默认在零点后运行，统计前一天
+				_, err := users.RollupStats(ctx, time.Now().AddDate(0, 0, -1))
+				return err
+			},
+		},
+	}
+	for _, job := range jobs {
+		if err := s.Register(job); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func jobSpec(spec string) string { //off表示关闭该任务
+	if spec == "off" {
+		return ""
+	}
+	return spec
+}
@@ -0,0 +1,138 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+)
+
+var (
+	ErrMalformed    = errors.New("Malformed token")
+	ErrUnknownKey   = errors.New("Token signed by unknown key")
+	ErrBadSignature = errors.New("Invalid token signature")
+	ErrExpired      = errors.New("Token expired")
+	ErrNotYetValid  = errors.New("Token not yet valid")
+	ErrWrongIssuer  = errors.New("Token issued by another issuer")
+)
+
+const leeway = 30 * time.Second //允许各服务之间的时钟误差
+
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` //用户名
+	Role      string `json:"role"`
+	ID        string `json:"jti"` //对应tokens表中的会话，用于吊销
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+func (s *KeySet) Sign(claims *Claims) (string, error) {
+	key := s.signingKey()
+	if key == nil {
+		return "", fmt.Errorf("Sign: No active signing key")
+	}
+	h, err := json.Marshal(header{Alg: key.Alg, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	var sig []byte
+	switch key.Alg {
+	case EdDSA:
+		sig = ed25519.Sign(key.private.(ed25519.PrivateKey), []byte(signingInput))
+	case RS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		sig, err = rsa.SignPKCS1v15(nil, key.private.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Sign: Unsupported algorithm %q", key.Alg)
+	}
+	return signingInput + "." + encoding.EncodeToString(sig), nil
+}
+
+// Verify 校验签名、有效期与签发者，alg必须与kid对应的密钥一致，不接受none
+func (s *KeySet) Verify(token string, issuer string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrMalformed
+	}
+	key := s.find(h.Kid)
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	if h.Alg != key.Alg {
+		return nil, ErrBadSignature
+	}
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signingInput := parts[0] + "." + parts[1]
+	switch key.Alg {
+	case EdDSA:
+		if !ed25519.Verify(key.public.(ed25519.PublicKey), []byte(signingInput), sig) {
+			return nil, ErrBadSignature
+		}
+	case RS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		if rsa.VerifyPKCS1v15(key.public.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) != nil {
+			return nil, ErrBadSignature
+		}
+	default:
+		return nil, ErrBadSignature
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformed
+	}
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, ErrNotYetValid
+	}
+	if issuer != "" && claims.Issuer != issuer {
+		return nil, ErrWrongIssuer
+	}
+	return &claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := encoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,270 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Key struct {
+	ID         string
+	Alg        string
+	ActivateAt time.Time //从这个时间开始用于签名，之前只发布公钥
+	private    crypto.Signer
+	public     crypto.PublicKey
+}
+
+// KeySet 管理签名密钥：新密钥提前发布到JWKS，到期后接替旧密钥签名，旧密钥在Retain内继续用于验证
+// 配置了Dir时密钥保存为PEM文件，多个实例共享同一目录即可使用同一组密钥
+type KeySet struct {
+	Alg        string
+	Dir        string        //为空时密钥只保存在内存中，重启后之前签发的token失效
+	Rotation   time.Duration //0表示不轮换
+	Prepublish time.Duration //新密钥提前发布的时间，最多为Rotation的一半
+	Retain     time.Duration //被替换后继续用于验证的时间，应不小于访问token的有效期
+
+	mu   sync.RWMutex
+	keys []*Key //按ActivateAt升序
+}
+
+func NewKeySet(alg, dir string, rotation, prepublish, retain time.Duration) (*KeySet, error) {
+	if alg != EdDSA && alg != RS256 {
+		return nil, fmt.Errorf("NewKeySet: Unsupported algorithm %q, use %s or %s", alg, EdDSA, RS256)
+	}
+	if rotation > 0 && prepublish > rotation/2 {
+		prepublish = rotation / 2
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("Failed to create key directory: %w", err)
+		}
+	}
+	s := &KeySet{Alg: alg, Dir: dir, Rotation: rotation, Prepublish: prepublish, Retain: retain}
+	if err := s.Rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CheckInterval 是调用Rotate的建议间隔
+func (s *KeySet) CheckInterval() time.Duration {
+	interval := time.Minute
+	if s.Rotation > 0 && s.Rotation/10 < interval {
+		interval = max(s.Rotation/10, time.Second)
+	}
+	return interval
+}
+
+// Rotate 重新加载密钥目录，按需生成下一个密钥并删除已过保留期的旧密钥
+func (s *KeySet) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Dir != "" { //其他实例可能已经生成或删除了密钥
+		keys, err := loadKeys(s.Dir)
+		if err != nil {
+			return err
+		}
+		s.keys = keys
+	}
+	now := time.Now()
+	active, pending := s.activeLocked(now), s.pendingLocked(now)
+	switch {
+	case active == nil:
+		if err := s.generateLocked(now); err != nil {
+			return err
+		}
+	case s.Rotation > 0 && pending == nil && now.Sub(active.ActivateAt) >= s.Rotation-s.Prepublish:
+		if err := s.generateLocked(active.ActivateAt.Add(s.Rotation)); err != nil {
+			return err
+		}
+	}
+	//被接替超过Retain的密钥不再需要
+	kept := s.keys[:0]
+	for i, key := range s.keys {
+		if i+1 < len(s.keys) && s.keys[i+1].ActivateAt.Before(now) && now.Sub(s.keys[i+1].ActivateAt) > s.Retain && key != s.activeLocked(now) {
+			log.Printf("Retiring signing key %s", key.ID)
+			if s.Dir != "" {
+				if err := os.Remove(filepath.Join(s.Dir, key.ID+".pem")); err != nil && !os.IsNotExist(err) {
+					log.Printf("Failed to remove key %s: %v", key.ID, err)
+				}
+			}
+			continue
+		}
+		kept = append(kept, key)
+	}
+	s.keys = kept
+	return nil
+}
+
+func (s *KeySet) activeLocked(now time.Time) *Key { //已生效的最新密钥
+	var active *Key
+	for _, key := range s.keys {
+		if key.Alg == s.Alg && !key.ActivateAt.After(now) {
+			active = key
+		}
+	}
+	return active
+}
+
+func (s *KeySet) pendingLocked(now time.Time) *Key { //已发布但尚未生效的密钥
+	for _, key := range s.keys {
+		if key.Alg == s.Alg && key.ActivateAt.After(now) {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s *KeySet) signingKey() *Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.activeLocked(time.Now())
+}
+
+func (s *KeySet) find(kid string) *Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s *KeySet) generateLocked(activateAt time.Time) error {
+	var private crypto.Signer
+	var err error
+	switch s.Alg {
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to generate signing key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(der)
+	key := &Key{ID: hex.EncodeToString(sum[:8]), Alg: s.Alg, ActivateAt: activateAt.Truncate(time.Second), private: private, public: private.Public()}
+	if s.Dir != "" {
+		if err := saveKey(s.Dir, key); err != nil {
+			return err
+		}
+	}
+	s.keys = append(s.keys, key)
+	sort.SliceStable(s.keys, func(i, j int) bool { return s.keys[i].ActivateAt.Before(s.keys[j].ActivateAt) })
+	log.Printf("Generated signing key %s, active from %s", key.ID, key.ActivateAt.Format(time.RFC3339))
+	return nil
+}
+
+func saveKey(dir string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{"Algorithm": key.Alg, "Activate-At": key.ActivateAt.Format(time.RFC3339)},
+		Bytes:   der,
+	})
+	//先写临时文件再改名，其他实例不会读到写了一半的文件
+	tmp := filepath.Join(dir, "."+key.ID+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("Failed to save key %s: %w", key.ID, err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, key.ID+".pem"))
+}
+
+func loadKeys(dir string) ([]*Key, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read key directory: %w", err)
+	}
+	var keys []*Key
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read key %s: %w", entry.Name(), err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("Invalid key file %s", entry.Name())
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key file %s: %w", entry.Name(), err)
+		}
+		private, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("Invalid key file %s: unsupported key type", entry.Name())
+		}
+		activateAt, err := time.Parse(time.RFC3339, block.Headers["Activate-At"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key file %s: %w", entry.Name(), err)
+		}
+		keys = append(keys, &Key{
+			ID:         strings.TrimSuffix(entry.Name(), ".pem"),
+			Alg:        block.Headers["Algorithm"],
+			ActivateAt: activateAt,
+			private:    private,
+			public:     private.Public(),
+		})
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].ActivateAt.Before(keys[j].ActivateAt) })
+	return keys, nil
+}
+
+// JWK 是RFC 7517格式的公钥
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS 返回所有仍可能用于签名或验证的公钥，包括提前发布的下一个密钥
+func (s *KeySet) JWKS() []JWK {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]JWK, 0, len(s.keys))
+	for _, key := range s.keys {
+		jwk := JWK{Kid: key.ID, Alg: key.Alg, Use: "sig"}
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", encoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encoding.EncodeToString(public.N.Bytes())
+			jwk.E = encoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
@@ -0,0 +1,85 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTP 通过SMTP服务器发送邮件，服务器支持STARTTLS时自动加密；Username为空时不认证
+type SMTP struct {
+	Addr     string //host:port
+	Username string
+	Password string
+	From     string
+	Timeout  time.Duration //连接与整个发送过程的超时时间
+}
+
+func NewSMTP(addr, username, password, from string) *SMTP {
+	return &SMTP{Addr: addr, Username: username, Password: password, From: from, Timeout: 30 * time.Second}
+}
+
+func (s *SMTP) Send(ctx context.Context, msg *Message) error {
+	raw, err := encode(s.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("Invalid sender address: %w", err)
+	}
+	to, _ := mail.ParseAddress(msg.To) //encode中已经校验过
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("Invalid SMTP address: %w", err)
+	}
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Failed to connect to SMTP server: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("Failed to start TLS: %w", err)
+		}
+	}
+	if s.Username != "" { //PlainAuth只允许在TLS连接或localhost上发送密码
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return fmt.Errorf("Failed to send mail: %w", err)
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("Failed to send mail: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("Failed to send mail: %w", err)
+	}
+	if _, err := w.Write(raw); err != nil {
+		return fmt.Errorf("Failed to send mail: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Failed to send mail: %w", err)
+	}
+	return c.Quit()
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
 	"log"
+	"os"
+	"time"
+	"user_system/config"
 	"user_system/database"
+	"user_system/jwt"
+	"user_system/mailer"
 	"user_system/middleware"
+	"user_system/repositories"
 	"user_system/userhandler"
+	"user_system/utils"
+	"user_system/webauthn"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,25 +26,133 @@ func main() {
 
 	gin.SetMode(gin.ReleaseMode)
 
-	//初始化数据库连接
-	err := database.InitDB()
+	cfg := config.GetDatabaseInfo()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" { //数据库迁移子命令
+		if err := runMigrate(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	if cfg.DBDriver != database.DriverMemory { //内存存储不需要数据库连接
+		//初始化数据库连接
+		err := database.InitDB()
+		if err != nil {
+			log.Fatalf("%v", err)
+			log.Printf("Failed to initialize database: %v", err)
+			panic(err)
+		}
+		//确保在程序结束时关闭数据库连接
+		defer func() {
+			if err := database.CloseDB(); err != nil {
+				log.Fatalf("%v", err)
+				panic(err)
+			}
+		}()
+		err = migrateOnStart(cfg) //执行数据库迁移
+		if err != nil {
+			log.Fatalf("%v", err)
+			panic(err)
+		}
+	}
+	utils.AccessTokenTTL = cfg.AccessTokenTTL
+	utils.Sessions = &utils.SessionPolicies{ //会话的空闲超时与绝对超时
+		Default:  utils.SessionPolicy{IdleTimeout: cfg.SessionIdleTimeout, AbsoluteTimeout: cfg.SessionAbsoluteTimeout},
+		Remember: utils.SessionPolicy{IdleTimeout: cfg.SessionRememberIdleTimeout, AbsoluteTimeout: cfg.SessionRememberAbsoluteTimeout},
+	}
+	if err := utils.Sessions.ParseRoles(cfg.SessionRolePolicies); err != nil {
+		log.Fatalf("%v", err)
+	}
+	repositories.MFAIssuer = cfg.MFAIssuer
+	repositories.MFAChallengeTTL = cfg.MFAChallengeTTL
+	repositories.MFAMaxFailures = cfg.MFAMaxFailures
+	repositories.MFALockout = cfg.MFALockout
+	if cfg.WebAuthnEnabled {
+		origins := cfg.WebAuthnOrigins
+		if len(origins) == 0 {
+			origins = []string{"http://localhost" + ServerPort}
+		}
+		repositories.WebAuthn = &webauthn.RelyingParty{ID: cfg.WebAuthnRPID, Name: cfg.WebAuthnRPName, Origins: origins}
+	}
+	repositories.WebAuthnLoginIPLimit = cfg.WebAuthnLoginIPLimit
+	repositories.PasswordResetTTL = cfg.PasswordResetTTL
+	repositories.EmailVerification = cfg.EmailVerification
+	repositories.BlockUnverifiedLogin = cfg.EmailVerificationBlock
+	repositories.EmailVerificationTTL = cfg.EmailVerificationTTL
+	repositories.VerificationResendInterval = cfg.EmailVerificationResendGap
+	if cfg.EmailVerificationKey != "" {
+		repositories.EmailVerificationKey = []byte(cfg.EmailVerificationKey)
+	} else if cfg.EmailVerification { //随机密钥在重启后丢失，多个实例之间也不一致，已发出的链接会失效
+		log.Fatalf("EMAIL_VERIFICATION_KEY is required when EMAIL_VERIFICATION=true")
+	} else { //未开启邮箱验证时不会签发链接
+		repositories.EmailVerificationKey = make([]byte, 32)
+		if _, err := rand.Read(repositories.EmailVerificationKey); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	repositories.MagicLinkLogin = cfg.MagicLinkLogin
+	repositories.MagicLinkTTL = cfg.MagicLinkTTL
+	repositories.MagicLinkInterval = cfg.MagicLinkInterval
+	repositories.MagicLinkIPLimit = cfg.MagicLinkIPLimit
+	repositories.MagicLinkIPWindow = cfg.MagicLinkIPWindow
+	if cfg.TokenHashKey != "" {
+		utils.TokenHashKey = []byte(cfg.TokenHashKey)
+	}
+	users, tokens, err := repositories.NewStore(cfg) //初始化存储
 	if err != nil {
 		log.Fatalf("%v", err)
-		log.Printf("Failed to initialize database: %v", err)
 		panic(err)
 	}
-	//确保在程序结束时关闭数据库连接
-	defer func() {
-		if err := database.CloseDB(); err != nil {
+	if db, ok := tokens.(*utils.AuthDBHandler); ok { //把升级前以明文保存的token转换为摘要
+		n, err := db.HashStoredTokens(context.Background())
+		if err != nil {
+			log.Fatalf("%v", err)
+			panic(err)
+		}
+		if n > 0 {
+			log.Printf("Hashed %d stored tokens", n)
+		}
+		utils.LegacyTokens = n > 0 //没有明文行时不再在查询时尝试转换
+	}
+	if cfg.TokenFormat == "jwt" { //签发JWT，其他服务可以用JWKS中的公钥自行验证
+		//旧密钥被替换后至少保留一个访问token有效期，保证用它签发的token仍能通过验证
+		keys, err := jwt.NewKeySet(cfg.JWTAlg, cfg.JWTKeyDir, cfg.JWTKeyRotation, cfg.JWTKeyPrepublish, cfg.AccessTokenTTL+5*time.Minute)
+		if err != nil {
+			log.Fatalf("%v", err)
+			panic(err)
+		}
+		utils.JWT = utils.NewJWTIssuer(keys, cfg.JWTIssuer, tokens)
+		if err := utils.JWT.Start(context.Background(), cfg.JWTRevocationSync); err != nil {
 			log.Fatalf("%v", err)
 			panic(err)
 		}
-	}()
-	err = userhandler.Init() //初始化数据库连接
+		defer utils.JWT.Close()
+	} else if cfg.TokenFormat != "opaque" {
+		log.Fatalf("Unsupported TOKEN_FORMAT %q", cfg.TokenFormat)
+	}
+	err = userhandler.Init(users, tokens)
+	if err != nil {
+		log.Fatalf("%v", err)
+		panic(err)
+	}
+	mail, err := newMailer(cfg)
 	if err != nil {
 		log.Fatalf("%v", err)
 		panic(err)
 	}
+	userhandler.SetMailer(mail, userhandler.MailLinks{
+		PasswordReset:     cfg.PasswordResetURL,
+		EmailVerification: cfg.EmailVerificationURL,
+		MagicLogin:        cfg.MagicLinkURL,
+	})
+	if cfg.SchedulerEnabled { //定时清理过期token、硬删除用户与生成统计
+		jobs, err := startScheduler(cfg, users, tokens)
+		if err != nil {
+			log.Fatalf("%v", err)
+			panic(err)
+		}
+		defer jobs.Close()
+		userhandler.SetScheduler(jobs)
+	}
 
 	//创建Gin路由
 
@@ -43,17 +162,55 @@ func main() {
 
 	router.Use(middleware.RecoveryMiddleware(), middleware.LoggerMiddleware()) //使用日志与恢复中间件
 
+	router.GET("/.well-known/jwks.json", userhandler.JWKS)
+
 	public := router.Group("/api") //公开路由组
 	{
 		public.POST("/register", userhandler.RegisterUser)
 		public.POST("/login", userhandler.LoginUser)
+		public.POST("/login/mfa", userhandler.LoginMFA) //开启两步验证的用户登录第二步
+		public.POST("/login/mfa/webauthn/begin", userhandler.BeginWebAuthnMFA)
+		public.POST("/login/mfa/webauthn/finish", userhandler.FinishWebAuthnMFA)
+		public.POST("/webauthn/login/begin", userhandler.BeginWebAuthnLogin) //无密码登录
+		public.POST("/webauthn/login/finish", userhandler.FinishWebAuthnLogin)
+		public.POST("/token/refresh", userhandler.RefreshToken) //访问token过期后也能刷新，不经过认证中间件
+		public.POST("/password/forgot", userhandler.ForgotPassword)
+		public.POST("/password/reset", userhandler.ResetPassword)
+		public.POST("/email/verify", userhandler.VerifyEmail)
+		public.POST("/email/verify/resend", userhandler.ResendVerification)
+		public.POST("/login/magic", userhandler.RequestMagicLink) //通过邮件中的链接免密码登录
+		public.POST("/login/magic/verify", userhandler.MagicLogin)
 	}
-	private := router.Group("/api") //私有路由组
-	private.Use(middleware.AuthMiddleware())
+	private := router.Group("/api") //私有路由组，个人访问令牌只能访问声明了scope的路由
 	{
-		private.POST("/delete", userhandler.DeleteUser)
-		private.POST("/change_password", userhandler.ChangePassword)
-		private.GET("/users", userhandler.GetUser)
+		private.POST("/delete", middleware.AuthMiddleware(tokens, "users:write"), userhandler.DeleteUser)
+		private.POST("/change_password", middleware.AuthMiddleware(tokens, "users:write"), userhandler.ChangePassword)
+		private.GET("/users", middleware.AuthMiddleware(tokens, "users:read"), userhandler.GetUser)
+		private.GET("/users/export", middleware.AuthMiddleware(tokens, "users:read"), userhandler.ExportUsers)
+		private.GET("/users/search", middleware.AuthMiddleware(tokens, "users:read"), userhandler.SearchUsers)
+		private.GET("/sessions", middleware.AuthMiddleware(tokens, "sessions:read"), userhandler.ListSessions)
+		private.GET("/admin/jobs", middleware.AuthMiddleware(tokens, "admin:read"), userhandler.ListJobs)
+		private.GET("/admin/stats", middleware.AuthMiddleware(tokens, "admin:read"), userhandler.GetStats)
+	}
+	session := router.Group("/api") //只接受登录会话的路由，个人访问令牌不能管理会话和令牌
+	session.Use(middleware.AuthMiddleware(tokens))
+	{
+		session.DELETE("/sessions/:id", userhandler.DeleteSession)
+		session.POST("/logout", userhandler.Logout)
+		session.POST("/logout/all", userhandler.LogoutAll)
+		session.POST("/tokens", userhandler.CreateAccessToken)
+		session.GET("/tokens", userhandler.ListAccessTokens)
+		session.DELETE("/tokens/:id", userhandler.DeleteAccessToken)
+		session.GET("/mfa", userhandler.GetMFA)
+		session.POST("/mfa/totp", userhandler.EnrollTOTP)
+		session.POST("/mfa/totp/confirm", userhandler.ConfirmTOTP)
+		session.POST("/mfa/recovery_codes", userhandler.RegenerateRecoveryCodes)
+		session.POST("/mfa/disable", userhandler.DisableMFA)
+		session.POST("/admin/mfa/reset", userhandler.ResetMFA)
+		session.POST("/webauthn/register/begin", userhandler.BeginWebAuthnRegistration)
+		session.POST("/webauthn/register/finish", userhandler.FinishWebAuthnRegistration)
+		session.GET("/webauthn/credentials", userhandler.ListWebAuthnCredentials)
+		session.DELETE("/webauthn/credentials/:id", userhandler.DeleteWebAuthnCredential)
 	}
 	//启动服务器
 	if err := router.Run(ServerPort); err != nil {
@@ -61,3 +218,17 @@ func main() {
 	}
 
 }
+
+func newMailer(cfg *config.Config) (mailer.Mailer, error) { //根据配置选择发送邮件的方式，off时返回nil
+	switch cfg.MailDriver {
+	case "outbox":
+		//邮件中的重置密码链接与登录链接可以直接使用，目录对其他人可读时任何人都能接管账号
+		log.Printf("Warning: MAIL_DRIVER=outbox writes emails including password reset and login links to %s, do not use it in production", cfg.MailOutboxDir)
+		return mailer.NewOutbox(cfg.MailOutboxDir, cfg.MailFrom)
+	case "smtp":
+		return mailer.NewSMTP(cfg.SMTPAddr, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom), nil
+	case "off":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unsupported MAIL_DRIVER %q", cfg.MailDriver)
+}
@@ -27,7 +27,9 @@ func LoggerMiddleware() gin.HandlerFunc {
 	}
 }
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware 校验会话token、JWT或个人访问令牌
+// 个人访问令牌只能访问声明了scope的路由，且需要拥有其中一个scope；未声明scope的路由只接受会话
+func AuthMiddleware(tokens utils.TokenStore, scopes ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		//在处理请求前检查Authorization头
 		authHeader := c.GetHeader("Authorization")
@@ -36,23 +38,64 @@ func AuthMiddleware() gin.HandlerFunc {
 			c.Set("message", "Unauthorized: Missing Authorization header")
 			c.JSON(401, gin.H{"message": "Unauthorized: Missing Authorization header"})
 			c.Abort()
+			return
 		}
 		token := authHeader[7:]
-		info, err := utils.GetInfobyToken(token)
+		personal := utils.IsAccessToken(token)
+		stateless := !personal && utils.JWT != nil && utils.IsJWT(token)
+		var info *utils.TokenInfo
+		var err error
+		if personal {
+			info, err = tokens.GetInfoByAccessToken(c.Request.Context(), token)
+		} else if stateless { //JWT只校验签名和吊销列表，不查询数据库
+			info, err = utils.JWT.Verify(token)
+		} else {
+			info, err = tokens.GetInfobyToken(c.Request.Context(), token)
+		}
 		if err != nil {
 			c.Set("message", err.Error())
 			c.JSON(401, gin.H{"message": err.Error()})
 			c.Abort()
-		} else if info.ExpiredAt.Before(time.Now()) {
+			return
+		} else if !info.ExpiredAt.IsZero() && info.ExpiredAt.Before(time.Now()) { //永不过期的个人访问令牌ExpiredAt为零值
 			c.Set("message", "Unauthorized: Token expired")
 			c.JSON(401, gin.H{"message": "Unauthorized: Invalid token"})
 			c.Abort()
+			return
+		}
+		if personal && !allowed(info, scopes) {
+			c.Set("message", "Forbidden: Access token scope is insufficient")
+			c.JSON(403, gin.H{"message": "Forbidden: Access token scope is insufficient"})
+			c.Abort()
+			return
+		}
+		//记录最近使用时间，失败不影响本次请求
+		if stateless {
+			err = utils.JWT.Touch(c.Request.Context(), info, c.ClientIP())
+		} else if info.LastUsedAt == nil || time.Since(*info.LastUsedAt) > utils.TouchInterval {
+			if personal {
+				err = tokens.TouchAccessToken(c.Request.Context(), info, c.ClientIP())
+			} else {
+				err = tokens.TouchToken(c.Request.Context(), info, c.ClientIP())
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to update session last used time: %v", err)
 		}
 		c.Set("info", info)
 		c.Next()
 	}
 }
 
+func allowed(info *utils.TokenInfo, scopes []string) bool {
+	for _, scope := range scopes {
+		if info.HasScope(scope) {
+			return true
+		}
+	}
+	return false
+}
+
 func RecoveryMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		defer func() {
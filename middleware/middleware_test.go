@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"user_system/jwt"
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRouter 的/me只接受会话，/users同时接受有users:read的个人访问令牌
+func newRouter(tokens utils.TokenStore) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	handler := func(c *gin.Context) {
+		info, _ := c.Get("info")
+		c.JSON(200, gin.H{"username": info.(*utils.TokenInfo).Username})
+	}
+	router.GET("/me", AuthMiddleware(tokens), handler)
+	router.GET("/users", AuthMiddleware(tokens, "users:read"), handler)
+	return router
+}
+
+func get(router *gin.Engine, bearer string) int {
+	return getPath(router, "/me", bearer)
+}
+
+func getPath(router *gin.Engine, path, bearer string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func jwtID(t *testing.T, token string) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("not a JWT: %q", token)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	var claims struct {
+		ID string `json:"jti"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("unmarshal claims: %v", err)
+	}
+	return claims.ID
+}
+
+// 从JWT中取出的jti不能当作不透明token使用
+func TestAuthMiddlewareRejectsJWTID(t *testing.T) {
+	keys, err := jwt.NewKeySet(jwt.EdDSA, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	tokens := utils.NewAuthMemoryHandler()
+	utils.JWT = utils.NewJWTIssuer(keys, "test", tokens)
+	t.Cleanup(func() { utils.JWT = nil })
+
+	pair, err := utils.IssueTokenPair(context.Background(), tokens, &utils.CreateTokenRequset{Username: "alice", Role: "user"})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	jti := jwtID(t, pair.AccessToken)
+	router := newRouter(tokens)
+
+	tests := []struct {
+		name   string
+		bearer string
+		want   int
+	}{
+		{"jwt", pair.AccessToken, 200},
+		{"decoded jti", jti, 401},
+		{"refresh token", pair.RefreshToken, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := get(router, tt.bearer); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	//不开启JWT时jti同样不能通过认证
+	utils.JWT = nil
+	if got := get(router, jti); got != 401 {
+		t.Errorf("opaque mode: status = %d, want 401", got)
+	}
+}
+
+// 退出登录后jti进入吊销列表，JWT立即失效
+func TestAuthMiddlewareRevokedJWT(t *testing.T) {
+	keys, err := jwt.NewKeySet(jwt.EdDSA, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	tokens := utils.NewAuthMemoryHandler()
+	utils.JWT = utils.NewJWTIssuer(keys, "test", tokens)
+	t.Cleanup(func() { utils.JWT = nil })
+
+	ctx := context.Background()
+	pair, err := utils.IssueTokenPair(ctx, tokens, &utils.CreateTokenRequset{Username: "alice", Role: "user"})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	router := newRouter(tokens)
+	if got := get(router, pair.AccessToken); got != 200 {
+		t.Fatalf("before logout: status = %d, want 200", got)
+	}
+	if err := tokens.DeleteTokenByToken(ctx, utils.HashToken(jwtID(t, pair.AccessToken))); err != nil {
+		t.Fatalf("DeleteTokenByToken: %v", err)
+	}
+	if err := utils.JWT.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if got := get(router, pair.AccessToken); got != 401 {
+		t.Errorf("after logout: status = %d, want 401", got)
+	}
+}
+
+// JWT请求不查询会话，但仍然记录会话最近使用的时间
+func TestAuthMiddlewareTouchesJWTSession(t *testing.T) {
+	keys, err := jwt.NewKeySet(jwt.EdDSA, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	tokens := utils.NewAuthMemoryHandler()
+	utils.JWT = utils.NewJWTIssuer(keys, "test", tokens)
+	t.Cleanup(func() { utils.JWT = nil })
+
+	ctx := context.Background()
+	pair, err := utils.IssueTokenPair(ctx, tokens, &utils.CreateTokenRequset{Username: "alice", Role: "user"})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	if got := get(newRouter(tokens), pair.AccessToken); got != 200 {
+		t.Fatalf("status = %d, want 200", got)
+	}
+	sessions, err := tokens.GetTokensByUsername(ctx, "alice")
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("GetTokensByUsername: %v, %v", sessions, err)
+	}
+	if sessions[0].LastUsedAt == nil {
+		t.Error("JWT request did not record the session's last used time")
+	}
+}
+
+// 个人访问令牌只能访问声明了scope的路由，过期或吊销后失效，使用时记录最近使用时间
+func TestAuthMiddlewareAccessToken(t *testing.T) {
+	ctx := context.Background()
+	tokens := utils.NewAuthMemoryHandler()
+	create := func(scope string, expiredAt *time.Time) (string, *utils.AccessToken) {
+		t.Helper()
+		token, created, err := tokens.CreateAccessToken(ctx, &utils.CreateAccessTokenRequest{Name: "ci", Scopes: []string{scope}, ExpiredAt: expiredAt, Username: "alice", Role: "user"})
+		if err != nil {
+			t.Fatalf("CreateAccessToken: %v", err)
+		}
+		return token, created
+	}
+	past := time.Now().Add(-time.Minute)
+	read, readToken := create("users:read", nil)
+	write, _ := create("users:write", nil)
+	expired, _ := create("users:read", &past)
+	session, err := utils.IssueTokenPair(ctx, tokens, &utils.CreateTokenRequset{Username: "alice", Role: "user"})
+	if err != nil {
+		t.Fatalf("IssueTokenPair: %v", err)
+	}
+	router := newRouter(tokens)
+
+	tests := []struct {
+		name   string
+		path   string
+		bearer string
+		want   int
+	}{
+		{"scope granted", "/users", read, 200},
+		{"scope missing", "/users", write, 403},
+		{"route without scopes", "/me", read, 403},
+		{"expired", "/users", expired, 401},
+		{"session", "/users", session.AccessToken, 200},
+		{"unknown token", "/users", "pat_unknown", 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getPath(router, tt.path, tt.bearer); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	list, err := tokens.GetAccessTokensByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetAccessTokensByUsername: %v", err)
+	}
+	for _, a := range list {
+		if used := a.LastUsedAt != nil; used != (a.ID == readToken.ID) {
+			t.Errorf("token %d: last used %v", a.ID, a.LastUsedAt)
+		}
+	}
+
+	if err := tokens.DeleteAccessToken(ctx, "alice", readToken.ID); err != nil {
+		t.Fatalf("DeleteAccessToken: %v", err)
+	}
+	if got := getPath(router, "/users", read); got != 401 {
+		t.Errorf("revoked: status = %d, want 401", got)
+	}
+}
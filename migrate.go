@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"user_system/config"
+	"user_system/database"
+	"user_system/migrations"
+)
+
+const migrateUsage = "usage: migrate up|down [steps]|status|redo"
+
+func runMigrate(cfg *config.Config, args []string) error { //处理 migrate 子命令
+	if len(args) == 0 {
+		return fmt.Errorf(migrateUsage)
+	}
+	switch args[0] {
+	case "up", "down", "redo", "status":
+	default:
+		return fmt.Errorf(migrateUsage)
+	}
+	if cfg.DBDriver == database.DriverMemory {
+		return fmt.Errorf("migrate: memory driver has no schema to migrate")
+	}
+	if err := database.InitDB(); err != nil {
+		return err
+	}
+	defer database.CloseDB()
+	migrator, err := migrations.NewMigrator(database.NewConn(database.DB, database.Driver))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		count, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migration(s)\n", count)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("migrate: invalid steps %q", args[1])
+			}
+		}
+		count, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back %d migration(s)\n", count)
+	case "redo":
+		migration, err := migrator.Redo(ctx)
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Println("No applied migration to redo")
+			return nil
+		}
+		fmt.Printf("Redid migration %04d_%s\n", migration.Version, migration.Name)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, status := range statuses {
+			state, appliedAt := "pending", "-"
+			if status.Applied {
+				state, appliedAt = "applied", status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", status.Version, status.Name, state, appliedAt)
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+func migrateOnStart(cfg *config.Config) error { //启动时执行迁移，关闭自动迁移时只检查
+	migrator, err := migrations.NewMigrator(database.NewConn(database.DB, database.Driver))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if !cfg.DBAutoMigrate {
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if !status.Applied {
+				return fmt.Errorf("Database schema is out of date (migration %04d_%s pending), run \"migrate up\"", status.Version, status.Name)
+			}
+		}
+		return nil
+	}
+	count, err := migrator.Up(ctx)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		log.Printf("Applied %d migration(s)", count)
+	}
+	return nil
+}
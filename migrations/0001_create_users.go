@@ -0,0 +1,78 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 1,
+		Name:    "create_users",
+		Up: map[string][]string{
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS users (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+        username VARCHAR(50) NOT NULL UNIQUE,
+        password VARCHAR(64) NOT NULL,
+		fullname VARCHAR(50) NOT NULL,
+		email VARCHAR(100) NOT NULL,
+		role VARCHAR(5) NOT NULL DEFAULT 'user',
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS users (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        username VARCHAR(50) NOT NULL UNIQUE,
+        password VARCHAR(64) NOT NULL,
+		fullname VARCHAR(50) NOT NULL,
+		email VARCHAR(100) NOT NULL,
+		role VARCHAR(5) NOT NULL DEFAULT 'user',
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		updated_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER))
+    )
+	`, `
+	CREATE TRIGGER IF NOT EXISTS users_updated_at AFTER UPDATE ON users
+	FOR EACH ROW WHEN NEW.updated_at = OLD.updated_at
+	BEGIN
+		UPDATE users SET updated_at = CAST(unixepoch('subsec') * 1000000 AS INTEGER) WHERE id = NEW.id;
+	END
+	`}, //SQLite没有ON UPDATE CURRENT_TIMESTAMP，用触发器代替
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS users (
+        id BIGSERIAL PRIMARY KEY,
+        username VARCHAR(50) NOT NULL UNIQUE,
+        password VARCHAR(64) NOT NULL,
+		fullname VARCHAR(50) NOT NULL,
+		email VARCHAR(100) NOT NULL,
+		role VARCHAR(5) NOT NULL DEFAULT 'user',
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    )
+	`, `
+	CREATE OR REPLACE FUNCTION set_updated_at() RETURNS TRIGGER AS $$
+	BEGIN
+		NEW.updated_at = CURRENT_TIMESTAMP;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql
+	`, `
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'users_updated_at') THEN
+			CREATE TRIGGER users_updated_at BEFORE UPDATE ON users
+			FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+		END IF;
+	END
+	$$
+	`}, //PostgreSQL同样用触发器维护updated_at
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS users`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS users`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS users`, `DROP FUNCTION IF EXISTS set_updated_at()`},
+		},
+	})
+}
@@ -0,0 +1,69 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 2,
+		Name:    "create_tokens",
+		Up: map[string][]string{
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS tokens (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+		token VARCHAR(64) NOT NULL UNIQUE,
+        username VARCHAR(50) NOT NULL UNIQUE,
+		role VARCHAR(5) NOT NULL DEFAULT 'user',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		expired_at TIMESTAMP
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`}, //FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS tokens (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token VARCHAR(64) NOT NULL UNIQUE,
+        username VARCHAR(50) NOT NULL UNIQUE,
+		role VARCHAR(5) NOT NULL DEFAULT 'user',
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		expired_at TIMESTAMP
+    )
+	`, `
+	CREATE TRIGGER IF NOT EXISTS tokens_created_at AFTER UPDATE ON tokens
+	FOR EACH ROW WHEN NEW.created_at = OLD.created_at
+	BEGIN
+		UPDATE tokens SET created_at = CAST(unixepoch('subsec') * 1000000 AS INTEGER) WHERE id = NEW.id;
+	END
+	`},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS tokens (
+        id BIGSERIAL PRIMARY KEY,
+		token VARCHAR(64) NOT NULL UNIQUE,
+        username VARCHAR(50) NOT NULL UNIQUE,
+		role VARCHAR(5) NOT NULL DEFAULT 'user',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		expired_at TIMESTAMPTZ
+    )
+	`, `
+	CREATE OR REPLACE FUNCTION set_created_at() RETURNS TRIGGER AS $$
+	BEGIN
+		NEW.created_at = CURRENT_TIMESTAMP;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql
+	`, `
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'tokens_created_at') THEN
+			CREATE TRIGGER tokens_created_at BEFORE UPDATE ON tokens
+			FOR EACH ROW EXECUTE FUNCTION set_created_at();
+		END IF;
+	END
+	$$
+	`},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS tokens`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS tokens`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS tokens`, `DROP FUNCTION IF EXISTS set_created_at()`},
+		},
+	})
+}
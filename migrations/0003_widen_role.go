@@ -0,0 +1,32 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 3,
+		Name:    "widen_role",
+		Up: map[string][]string{
+			database.DriverMySQL: {
+				`ALTER TABLE users MODIFY role VARCHAR(20) NOT NULL DEFAULT 'user'`,
+				`ALTER TABLE tokens MODIFY role VARCHAR(20) NOT NULL DEFAULT 'user'`,
+			},
+			database.DriverSQLite: {}, //SQLite不限制VARCHAR长度
+			database.DriverPostgres: {
+				`ALTER TABLE users ALTER COLUMN role TYPE VARCHAR(20)`,
+				`ALTER TABLE tokens ALTER COLUMN role TYPE VARCHAR(20)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL: {
+				`ALTER TABLE users MODIFY role VARCHAR(5) NOT NULL DEFAULT 'user'`,
+				`ALTER TABLE tokens MODIFY role VARCHAR(5) NOT NULL DEFAULT 'user'`,
+			},
+			database.DriverSQLite: {},
+			database.DriverPostgres: {
+				`ALTER TABLE users ALTER COLUMN role TYPE VARCHAR(5)`,
+				`ALTER TABLE tokens ALTER COLUMN role TYPE VARCHAR(5)`,
+			},
+		},
+	})
+}
@@ -0,0 +1,23 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 4,
+		Name:    "users_fulltext",
+		Up: map[string][]string{
+			//ngram分词支持中文和单词的部分匹配，需要MySQL 5.7.6+
+			database.DriverMySQL: {
+				`ALTER TABLE users ADD FULLTEXT INDEX users_fulltext (username, fullname, email) WITH PARSER ngram`,
+			},
+			database.DriverSQLite:   {}, //其他方言在进程内做模糊匹配
+			database.DriverPostgres: {},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`ALTER TABLE users DROP INDEX users_fulltext`},
+			database.DriverSQLite:   {},
+			database.DriverPostgres: {},
+		},
+	})
+}
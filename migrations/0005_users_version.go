@@ -0,0 +1,21 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 5,
+		Name:    "users_version",
+		Up: map[string][]string{
+			//乐观锁版本号，每次更新加一
+			database.DriverMySQL:    {`ALTER TABLE users ADD COLUMN version INT UNSIGNED NOT NULL DEFAULT 1`},
+			database.DriverSQLite:   {`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1`},
+			database.DriverPostgres: {`ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1`},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`ALTER TABLE users DROP COLUMN version`},
+			database.DriverSQLite:   {`ALTER TABLE users DROP COLUMN version`},
+			database.DriverPostgres: {`ALTER TABLE users DROP COLUMN version`},
+		},
+	})
+}
@@ -0,0 +1,113 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 6,
+		Name:    "token_sessions",
+		Up: map[string][]string{
+			//每次登录一行会话，去掉username的唯一约束；created_at改为会话创建时间，不再随更新变化
+			database.DriverMySQL: {`
+	ALTER TABLE tokens
+		DROP INDEX username,
+		ADD INDEX idx_tokens_username (username),
+		MODIFY created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		ADD COLUMN device VARCHAR(100) NOT NULL DEFAULT '',
+		ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '',
+		ADD COLUMN last_used_at TIMESTAMP NULL
+	`},
+			//SQLite不能删除列上的约束，重建表
+			database.DriverSQLite: {`
+    CREATE TABLE tokens_new (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token VARCHAR(64) NOT NULL UNIQUE,
+        username VARCHAR(50) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		expired_at TIMESTAMP,
+		device VARCHAR(100) NOT NULL DEFAULT '',
+		user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		ip VARCHAR(45) NOT NULL DEFAULT '',
+		last_used_at TIMESTAMP
+    )
+	`,
+				`INSERT INTO tokens_new (id, token, username, role, created_at, expired_at) SELECT id, token, username, role, created_at, expired_at FROM tokens`,
+				`DROP TABLE tokens`,
+				`ALTER TABLE tokens_new RENAME TO tokens`,
+				`CREATE INDEX idx_tokens_username ON tokens (username)`,
+			},
+			database.DriverPostgres: {
+				`ALTER TABLE tokens DROP CONSTRAINT tokens_username_key`,
+				`CREATE INDEX idx_tokens_username ON tokens (username)`,
+				`DROP TRIGGER IF EXISTS tokens_created_at ON tokens`,
+				`DROP FUNCTION IF EXISTS set_created_at()`,
+				`
+	ALTER TABLE tokens
+		ADD COLUMN device VARCHAR(100) NOT NULL DEFAULT '',
+		ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '',
+		ADD COLUMN last_used_at TIMESTAMPTZ
+	`},
+		},
+		Down: map[string][]string{
+			//恢复唯一约束前每个用户只保留最新的会话
+			database.DriverMySQL: {
+				`DELETE t1 FROM tokens t1 JOIN tokens t2 ON t1.username = t2.username AND t1.id < t2.id`,
+				`
+	ALTER TABLE tokens
+		DROP COLUMN last_used_at,
+		DROP COLUMN ip,
+		DROP COLUMN user_agent,
+		DROP COLUMN device,
+		MODIFY created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		DROP INDEX idx_tokens_username,
+		ADD UNIQUE INDEX username (username)
+	`},
+			database.DriverSQLite: {
+				`DELETE FROM tokens WHERE id NOT IN (SELECT MAX(id) FROM tokens GROUP BY username)`,
+				`
+    CREATE TABLE tokens_old (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token VARCHAR(64) NOT NULL UNIQUE,
+        username VARCHAR(50) NOT NULL UNIQUE,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		expired_at TIMESTAMP
+    )
+	`,
+				`INSERT INTO tokens_old (id, token, username, role, created_at, expired_at) SELECT id, token, username, role, created_at, expired_at FROM tokens`,
+				`DROP TABLE tokens`,
+				`ALTER TABLE tokens_old RENAME TO tokens`,
+				`
+	CREATE TRIGGER IF NOT EXISTS tokens_created_at AFTER UPDATE ON tokens
+	FOR EACH ROW WHEN NEW.created_at = OLD.created_at
+	BEGIN
+		UPDATE tokens SET created_at = CAST(unixepoch('subsec') * 1000000 AS INTEGER) WHERE id = NEW.id;
+	END
+	`},
+			database.DriverPostgres: {
+				`DELETE FROM tokens t1 USING tokens t2 WHERE t1.username = t2.username AND t1.id < t2.id`,
+				`
+	ALTER TABLE tokens
+		DROP COLUMN last_used_at,
+		DROP COLUMN ip,
+		DROP COLUMN user_agent,
+		DROP COLUMN device
+	`,
+				`DROP INDEX IF EXISTS idx_tokens_username`,
+				`ALTER TABLE tokens ADD CONSTRAINT tokens_username_key UNIQUE (username)`,
+				`
+	CREATE OR REPLACE FUNCTION set_created_at() RETURNS TRIGGER AS $$
+	BEGIN
+		NEW.created_at = CURRENT_TIMESTAMP;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql
+	`,
+				`CREATE TRIGGER tokens_created_at BEFORE UPDATE ON tokens FOR EACH ROW EXECUTE FUNCTION set_created_at()`,
+			},
+		},
+	})
+}
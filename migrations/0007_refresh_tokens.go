@@ -0,0 +1,84 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 7,
+		Name:    "refresh_tokens",
+		Up: map[string][]string{
+			//同一次登录轮换出的refresh token属于同一个family，访问token记录所属family以便一起吊销
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS refresh_tokens (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+		token VARCHAR(64) NOT NULL UNIQUE,
+		family VARCHAR(64) NOT NULL,
+        username VARCHAR(50) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		device VARCHAR(100) NOT NULL DEFAULT '',
+		user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expired_at TIMESTAMP NULL,
+		used_at TIMESTAMP NULL,
+		INDEX idx_refresh_tokens_family (family),
+		INDEX idx_refresh_tokens_username (username)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`,
+				`ALTER TABLE tokens ADD COLUMN family VARCHAR(64) NOT NULL DEFAULT '', ADD INDEX idx_tokens_family (family)`,
+			},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS refresh_tokens (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token VARCHAR(64) NOT NULL UNIQUE,
+		family VARCHAR(64) NOT NULL,
+        username VARCHAR(50) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		device VARCHAR(100) NOT NULL DEFAULT '',
+		user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		expired_at TIMESTAMP,
+		used_at TIMESTAMP
+    )
+	`,
+				`CREATE INDEX idx_refresh_tokens_family ON refresh_tokens (family)`,
+				`CREATE INDEX idx_refresh_tokens_username ON refresh_tokens (username)`,
+				`ALTER TABLE tokens ADD COLUMN family VARCHAR(64) NOT NULL DEFAULT ''`,
+				`CREATE INDEX idx_tokens_family ON tokens (family)`,
+			},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS refresh_tokens (
+        id BIGSERIAL PRIMARY KEY,
+		token VARCHAR(64) NOT NULL UNIQUE,
+		family VARCHAR(64) NOT NULL,
+        username VARCHAR(50) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		device VARCHAR(100) NOT NULL DEFAULT '',
+		user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		expired_at TIMESTAMPTZ,
+		used_at TIMESTAMPTZ
+    )
+	`,
+				`CREATE INDEX idx_refresh_tokens_family ON refresh_tokens (family)`,
+				`CREATE INDEX idx_refresh_tokens_username ON refresh_tokens (username)`,
+				`ALTER TABLE tokens ADD COLUMN family VARCHAR(64) NOT NULL DEFAULT ''`,
+				`CREATE INDEX idx_tokens_family ON tokens (family)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL: {
+				`ALTER TABLE tokens DROP INDEX idx_tokens_family, DROP COLUMN family`,
+				`DROP TABLE IF EXISTS refresh_tokens`,
+			},
+			database.DriverSQLite: {
+				`DROP INDEX IF EXISTS idx_tokens_family`,
+				`ALTER TABLE tokens DROP COLUMN family`,
+				`DROP TABLE IF EXISTS refresh_tokens`,
+			},
+			database.DriverPostgres: {
+				`ALTER TABLE tokens DROP COLUMN family`,
+				`DROP TABLE IF EXISTS refresh_tokens`,
+			},
+		},
+	})
+}
@@ -0,0 +1,52 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 8,
+		Name:    "revoked_tokens",
+		Up: map[string][]string{
+			//JWT无需查库即可验证，提前删除的会话记入吊销列表，各实例定期同步
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS revoked_tokens (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+		jti VARCHAR(64) NOT NULL,
+		expired_at TIMESTAMP NULL,
+		revoked_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6),
+		INDEX idx_revoked_tokens_revoked_at (revoked_at)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`,
+				//以JWT签发的会话，随机token只作为jti，不能当作不透明token使用
+				`ALTER TABLE tokens ADD COLUMN stateless TINYINT(1) NOT NULL DEFAULT 0`,
+			},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS revoked_tokens (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		jti VARCHAR(64) NOT NULL,
+		expired_at TIMESTAMP,
+		revoked_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER))
+    )
+	`,
+				`CREATE INDEX idx_revoked_tokens_revoked_at ON revoked_tokens (revoked_at)`,
+				`ALTER TABLE tokens ADD COLUMN stateless INTEGER NOT NULL DEFAULT 0`,
+			},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS revoked_tokens (
+        id BIGSERIAL PRIMARY KEY,
+		jti VARCHAR(64) NOT NULL,
+		expired_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    )
+	`,
+				`CREATE INDEX idx_revoked_tokens_revoked_at ON revoked_tokens (revoked_at)`,
+				`ALTER TABLE tokens ADD COLUMN stateless BOOLEAN NOT NULL DEFAULT FALSE`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`ALTER TABLE tokens DROP COLUMN stateless`, `DROP TABLE IF EXISTS revoked_tokens`},
+			database.DriverSQLite:   {`ALTER TABLE tokens DROP COLUMN stateless`, `DROP TABLE IF EXISTS revoked_tokens`},
+			database.DriverPostgres: {`ALTER TABLE tokens DROP COLUMN stateless`, `DROP TABLE IF EXISTS revoked_tokens`},
+		},
+	})
+}
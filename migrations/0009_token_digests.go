@@ -0,0 +1,59 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 9,
+		Name:    "token_digests",
+		Up: map[string][]string{
+			//token改为只保存摘要；已有的明文记录hashed为0，启动时由utils.HashStoredTokens逐行转换
+			database.DriverMySQL: {
+				`ALTER TABLE tokens ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT '', ADD COLUMN hashed TINYINT(1) NOT NULL DEFAULT 0`,
+				`ALTER TABLE refresh_tokens ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT '', ADD COLUMN hashed TINYINT(1) NOT NULL DEFAULT 0`,
+				`ALTER TABLE revoked_tokens ADD COLUMN hashed TINYINT(1) NOT NULL DEFAULT 0`,
+			},
+			database.DriverSQLite: {
+				`ALTER TABLE tokens ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT ''`,
+				`ALTER TABLE tokens ADD COLUMN hashed INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE refresh_tokens ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT ''`,
+				`ALTER TABLE refresh_tokens ADD COLUMN hashed INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE revoked_tokens ADD COLUMN hashed INTEGER NOT NULL DEFAULT 0`,
+			},
+			database.DriverPostgres: {
+				`ALTER TABLE tokens ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT '', ADD COLUMN hashed SMALLINT NOT NULL DEFAULT 0`,
+				`ALTER TABLE refresh_tokens ADD COLUMN token_prefix VARCHAR(8) NOT NULL DEFAULT '', ADD COLUMN hashed SMALLINT NOT NULL DEFAULT 0`,
+				`ALTER TABLE revoked_tokens ADD COLUMN hashed SMALLINT NOT NULL DEFAULT 0`,
+			},
+		},
+		Down: map[string][]string{
+			//摘要无法还原为明文，回滚时删除已转换的会话，用户需要重新登录
+			database.DriverMySQL: {
+				`DELETE FROM tokens WHERE hashed = 1`,
+				`DELETE FROM refresh_tokens WHERE hashed = 1`,
+				`DELETE FROM revoked_tokens WHERE hashed = 1`,
+				`ALTER TABLE tokens DROP COLUMN hashed, DROP COLUMN token_prefix`,
+				`ALTER TABLE refresh_tokens DROP COLUMN hashed, DROP COLUMN token_prefix`,
+				`ALTER TABLE revoked_tokens DROP COLUMN hashed`,
+			},
+			database.DriverSQLite: {
+				`DELETE FROM tokens WHERE hashed = 1`,
+				`DELETE FROM refresh_tokens WHERE hashed = 1`,
+				`DELETE FROM revoked_tokens WHERE hashed = 1`,
+				`ALTER TABLE tokens DROP COLUMN hashed`,
+				`ALTER TABLE tokens DROP COLUMN token_prefix`,
+				`ALTER TABLE refresh_tokens DROP COLUMN hashed`,
+				`ALTER TABLE refresh_tokens DROP COLUMN token_prefix`,
+				`ALTER TABLE revoked_tokens DROP COLUMN hashed`,
+			},
+			database.DriverPostgres: {
+				`DELETE FROM tokens WHERE hashed = 1`,
+				`DELETE FROM refresh_tokens WHERE hashed = 1`,
+				`DELETE FROM revoked_tokens WHERE hashed = 1`,
+				`ALTER TABLE tokens DROP COLUMN hashed, DROP COLUMN token_prefix`,
+				`ALTER TABLE refresh_tokens DROP COLUMN hashed, DROP COLUMN token_prefix`,
+				`ALTER TABLE revoked_tokens DROP COLUMN hashed`,
+			},
+		},
+	})
+}
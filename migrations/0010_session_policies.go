@@ -0,0 +1,49 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 10,
+		Name:    "session_policies",
+		Up: map[string][]string{
+			//会话的绝对截止时间随token保存，刷新时沿用；已有记录以原过期时间为截止时间
+			database.DriverMySQL: {
+				`ALTER TABLE tokens ADD COLUMN remember TINYINT(1) NOT NULL DEFAULT 0, ADD COLUMN session_expired_at TIMESTAMP NULL`,
+				`ALTER TABLE refresh_tokens ADD COLUMN remember TINYINT(1) NOT NULL DEFAULT 0, ADD COLUMN session_expired_at TIMESTAMP NULL`,
+				`UPDATE tokens SET session_expired_at = expired_at`,
+				`UPDATE refresh_tokens SET session_expired_at = expired_at`,
+			},
+			database.DriverSQLite: {
+				`ALTER TABLE tokens ADD COLUMN remember INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE tokens ADD COLUMN session_expired_at TIMESTAMP`,
+				`ALTER TABLE refresh_tokens ADD COLUMN remember INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE refresh_tokens ADD COLUMN session_expired_at TIMESTAMP`,
+				`UPDATE tokens SET session_expired_at = expired_at`,
+				`UPDATE refresh_tokens SET session_expired_at = expired_at`,
+			},
+			database.DriverPostgres: {
+				`ALTER TABLE tokens ADD COLUMN remember BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN session_expired_at TIMESTAMPTZ`,
+				`ALTER TABLE refresh_tokens ADD COLUMN remember BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN session_expired_at TIMESTAMPTZ`,
+				`UPDATE tokens SET session_expired_at = expired_at`,
+				`UPDATE refresh_tokens SET session_expired_at = expired_at`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL: {
+				`ALTER TABLE tokens DROP COLUMN session_expired_at, DROP COLUMN remember`,
+				`ALTER TABLE refresh_tokens DROP COLUMN session_expired_at, DROP COLUMN remember`,
+			},
+			database.DriverSQLite: {
+				`ALTER TABLE tokens DROP COLUMN session_expired_at`,
+				`ALTER TABLE tokens DROP COLUMN remember`,
+				`ALTER TABLE refresh_tokens DROP COLUMN session_expired_at`,
+				`ALTER TABLE refresh_tokens DROP COLUMN remember`,
+			},
+			database.DriverPostgres: {
+				`ALTER TABLE tokens DROP COLUMN session_expired_at, DROP COLUMN remember`,
+				`ALTER TABLE refresh_tokens DROP COLUMN session_expired_at, DROP COLUMN remember`,
+			},
+		},
+	})
+}
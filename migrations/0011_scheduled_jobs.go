@@ -0,0 +1,90 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 11,
+		Name:    "scheduled_jobs",
+		Up: map[string][]string{
+			//scheduled_jobs保存定时任务的租约和最近一次运行结果；user_stats是每天的用户统计
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS scheduled_jobs (
+        name VARCHAR(50) PRIMARY KEY,
+		last_slot TIMESTAMP NULL,
+		last_run_at TIMESTAMP NULL,
+		last_duration_ms BIGINT NOT NULL DEFAULT 0,
+		last_status VARCHAR(20) NOT NULL DEFAULT '',
+		last_error VARCHAR(500) NOT NULL DEFAULT '',
+		last_runner VARCHAR(100) NOT NULL DEFAULT '',
+		lease_owner VARCHAR(100) NOT NULL DEFAULT '',
+		lease_expires_at TIMESTAMP NULL
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`, `
+    CREATE TABLE IF NOT EXISTS user_stats (
+        day VARCHAR(10) PRIMARY KEY,
+		total INT NOT NULL,
+		active INT NOT NULL,
+		inactive INT NOT NULL,
+		deleted INT NOT NULL,
+		admins INT NOT NULL,
+		registered INT NOT NULL,
+		computed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS scheduled_jobs (
+        name VARCHAR(50) PRIMARY KEY,
+		last_slot TIMESTAMP,
+		last_run_at TIMESTAMP,
+		last_duration_ms INTEGER NOT NULL DEFAULT 0,
+		last_status VARCHAR(20) NOT NULL DEFAULT '',
+		last_error VARCHAR(500) NOT NULL DEFAULT '',
+		last_runner VARCHAR(100) NOT NULL DEFAULT '',
+		lease_owner VARCHAR(100) NOT NULL DEFAULT '',
+		lease_expires_at TIMESTAMP
+    )
+	`, `
+    CREATE TABLE IF NOT EXISTS user_stats (
+        day VARCHAR(10) PRIMARY KEY,
+		total INTEGER NOT NULL,
+		active INTEGER NOT NULL,
+		inactive INTEGER NOT NULL,
+		deleted INTEGER NOT NULL,
+		admins INTEGER NOT NULL,
+		registered INTEGER NOT NULL,
+		computed_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER))
+    )
+	`},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS scheduled_jobs (
+        name VARCHAR(50) PRIMARY KEY,
+		last_slot TIMESTAMPTZ,
+		last_run_at TIMESTAMPTZ,
+		last_duration_ms BIGINT NOT NULL DEFAULT 0,
+		last_status VARCHAR(20) NOT NULL DEFAULT '',
+		last_error VARCHAR(500) NOT NULL DEFAULT '',
+		last_runner VARCHAR(100) NOT NULL DEFAULT '',
+		lease_owner VARCHAR(100) NOT NULL DEFAULT '',
+		lease_expires_at TIMESTAMPTZ
+    )
+	`, `
+    CREATE TABLE IF NOT EXISTS user_stats (
+        day VARCHAR(10) PRIMARY KEY,
+		total INTEGER NOT NULL,
+		active INTEGER NOT NULL,
+		inactive INTEGER NOT NULL,
+		deleted INTEGER NOT NULL,
+		admins INTEGER NOT NULL,
+		registered INTEGER NOT NULL,
+		computed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    )
+	`},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS user_stats`, `DROP TABLE IF EXISTS scheduled_jobs`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS user_stats`, `DROP TABLE IF EXISTS scheduled_jobs`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS user_stats`, `DROP TABLE IF EXISTS scheduled_jobs`},
+		},
+	})
+}
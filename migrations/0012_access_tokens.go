@@ -0,0 +1,68 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 12,
+		Name:    "access_tokens",
+		Up: map[string][]string{
+			//个人访问令牌，与会话token一样只保存摘要；expired_at为NULL表示永不过期
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS access_tokens (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+		token VARCHAR(64) NOT NULL UNIQUE,
+		token_prefix VARCHAR(8) NOT NULL DEFAULT '',
+        username VARCHAR(50) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		name VARCHAR(100) NOT NULL,
+		scopes VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expired_at TIMESTAMP NULL,
+		last_used_at TIMESTAMP NULL,
+		last_used_ip VARCHAR(45) NOT NULL DEFAULT '',
+		INDEX idx_access_tokens_username (username)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS access_tokens (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token VARCHAR(64) NOT NULL UNIQUE,
+		token_prefix VARCHAR(8) NOT NULL DEFAULT '',
+        username VARCHAR(50) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		name VARCHAR(100) NOT NULL,
+		scopes VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		expired_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		last_used_ip VARCHAR(45) NOT NULL DEFAULT ''
+    )
+	`,
+				`CREATE INDEX idx_access_tokens_username ON access_tokens (username)`,
+			},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS access_tokens (
+        id BIGSERIAL PRIMARY KEY,
+		token VARCHAR(64) NOT NULL UNIQUE,
+		token_prefix VARCHAR(8) NOT NULL DEFAULT '',
+        username VARCHAR(50) NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		name VARCHAR(100) NOT NULL,
+		scopes VARCHAR(255) NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		expired_at TIMESTAMPTZ,
+		last_used_at TIMESTAMPTZ,
+		last_used_ip VARCHAR(45) NOT NULL DEFAULT ''
+    )
+	`,
+				`CREATE INDEX idx_access_tokens_username ON access_tokens (username)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS access_tokens`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS access_tokens`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS access_tokens`},
+		},
+	})
+}
@@ -0,0 +1,111 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 13,
+		Name:    "mfa",
+		Up: map[string][]string{
+			//user_mfa保存TOTP密钥，confirmed_at为NULL表示尚未确认；恢复码与登录挑战只保存摘要
+			//failed_attempts为跨登录挑战累计的验证码错误次数，只在验证成功后清零；达到上限后锁定到locked_until
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS user_mfa (
+        username VARCHAR(50) PRIMARY KEY,
+		secret VARCHAR(64) NOT NULL,
+		last_used_step BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		confirmed_at TIMESTAMP NULL,
+		failed_attempts INT NOT NULL DEFAULT 0,
+		locked_until TIMESTAMP NULL
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`, `
+    CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		code VARCHAR(64) NOT NULL,
+		used_at TIMESTAMP NULL,
+		INDEX idx_mfa_recovery_codes_username (username)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`, `
+    CREATE TABLE IF NOT EXISTS mfa_challenges (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		remember TINYINT(1) NOT NULL DEFAULT 0,
+		device VARCHAR(100) NOT NULL DEFAULT '',
+		attempts INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expired_at TIMESTAMP NOT NULL,
+		INDEX idx_mfa_challenges_username (username)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS user_mfa (
+        username VARCHAR(50) PRIMARY KEY,
+		secret VARCHAR(64) NOT NULL,
+		last_used_step INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		confirmed_at TIMESTAMP,
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		locked_until TIMESTAMP
+    )
+	`, `
+    CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        username VARCHAR(50) NOT NULL,
+		code VARCHAR(64) NOT NULL,
+		used_at TIMESTAMP
+    )
+	`,
+				`CREATE INDEX idx_mfa_recovery_codes_username ON mfa_recovery_codes (username)`, `
+    CREATE TABLE IF NOT EXISTS mfa_challenges (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		remember INTEGER NOT NULL DEFAULT 0,
+		device VARCHAR(100) NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		expired_at TIMESTAMP NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_mfa_challenges_username ON mfa_challenges (username)`,
+			},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS user_mfa (
+        username VARCHAR(50) PRIMARY KEY,
+		secret VARCHAR(64) NOT NULL,
+		last_used_step BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		confirmed_at TIMESTAMPTZ,
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		locked_until TIMESTAMPTZ
+    )
+	`, `
+    CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+        id BIGSERIAL PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		code VARCHAR(64) NOT NULL,
+		used_at TIMESTAMPTZ
+    )
+	`,
+				`CREATE INDEX idx_mfa_recovery_codes_username ON mfa_recovery_codes (username)`, `
+    CREATE TABLE IF NOT EXISTS mfa_challenges (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		remember BOOLEAN NOT NULL DEFAULT FALSE,
+		device VARCHAR(100) NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		expired_at TIMESTAMPTZ NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_mfa_challenges_username ON mfa_challenges (username)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS mfa_challenges`, `DROP TABLE IF EXISTS mfa_recovery_codes`, `DROP TABLE IF EXISTS user_mfa`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS mfa_challenges`, `DROP TABLE IF EXISTS mfa_recovery_codes`, `DROP TABLE IF EXISTS user_mfa`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS mfa_challenges`, `DROP TABLE IF EXISTS mfa_recovery_codes`, `DROP TABLE IF EXISTS user_mfa`},
+		},
+	})
+}
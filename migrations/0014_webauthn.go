@@ -0,0 +1,90 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 14,
+		Name:    "webauthn",
+		Up: map[string][]string{
+			//凭证按users.id关联；挑战在仪式完成或过期后删除，kind为register、login或mfa
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS webauthn_credentials (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+        user_id BIGINT UNSIGNED NOT NULL,
+		credential_id VARCHAR(512) NOT NULL UNIQUE,
+		public_key TEXT NOT NULL,
+		sign_count BIGINT NOT NULL DEFAULT 0,
+		aaguid VARCHAR(36) NOT NULL DEFAULT '',
+		attestation VARCHAR(20) NOT NULL DEFAULT 'none',
+		transports VARCHAR(100) NOT NULL DEFAULT '',
+		name VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP NULL,
+		INDEX idx_webauthn_credentials_user_id (user_id)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`, `
+    CREATE TABLE IF NOT EXISTS webauthn_challenges (
+        challenge VARCHAR(64) PRIMARY KEY,
+		kind VARCHAR(20) NOT NULL,
+        user_id BIGINT UNSIGNED NOT NULL DEFAULT 0,
+		mfa_token VARCHAR(64) NOT NULL DEFAULT '',
+		expired_at TIMESTAMP NOT NULL
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS webauthn_credentials (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        user_id INTEGER NOT NULL,
+		credential_id VARCHAR(512) NOT NULL UNIQUE,
+		public_key TEXT NOT NULL,
+		sign_count INTEGER NOT NULL DEFAULT 0,
+		aaguid VARCHAR(36) NOT NULL DEFAULT '',
+		attestation VARCHAR(20) NOT NULL DEFAULT 'none',
+		transports VARCHAR(100) NOT NULL DEFAULT '',
+		name VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER)),
+		last_used_at TIMESTAMP
+    )
+	`,
+				`CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id)`, `
+    CREATE TABLE IF NOT EXISTS webauthn_challenges (
+        challenge VARCHAR(64) PRIMARY KEY,
+		kind VARCHAR(20) NOT NULL,
+        user_id INTEGER NOT NULL DEFAULT 0,
+		mfa_token VARCHAR(64) NOT NULL DEFAULT '',
+		expired_at TIMESTAMP NOT NULL
+    )
+	`},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS webauthn_credentials (
+        id BIGSERIAL PRIMARY KEY,
+        user_id BIGINT NOT NULL,
+		credential_id VARCHAR(512) NOT NULL UNIQUE,
+		public_key TEXT NOT NULL,
+		sign_count BIGINT NOT NULL DEFAULT 0,
+		aaguid VARCHAR(36) NOT NULL DEFAULT '',
+		attestation VARCHAR(20) NOT NULL DEFAULT 'none',
+		transports VARCHAR(100) NOT NULL DEFAULT '',
+		name VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMPTZ
+    )
+	`,
+				`CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials (user_id)`, `
+    CREATE TABLE IF NOT EXISTS webauthn_challenges (
+        challenge VARCHAR(64) PRIMARY KEY,
+		kind VARCHAR(20) NOT NULL,
+        user_id BIGINT NOT NULL DEFAULT 0,
+		mfa_token VARCHAR(64) NOT NULL DEFAULT '',
+		expired_at TIMESTAMPTZ NOT NULL
+    )
+	`},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS webauthn_challenges`, `DROP TABLE IF EXISTS webauthn_credentials`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS webauthn_challenges`, `DROP TABLE IF EXISTS webauthn_credentials`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS webauthn_challenges`, `DROP TABLE IF EXISTS webauthn_credentials`},
+		},
+	})
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 15,
+		Name:    "password_resets",
+		Up: map[string][]string{
+			//token为重置链接中令牌的摘要，使用后立即删除
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS password_resets (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expired_at TIMESTAMP NOT NULL,
+		INDEX idx_password_resets_username (username)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS password_resets (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expired_at TIMESTAMP NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_password_resets_username ON password_resets (username)`,
+			},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS password_resets (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		expired_at TIMESTAMPTZ NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_password_resets_username ON password_resets (username)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS password_resets`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS password_resets`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS password_resets`},
+		},
+	})
+}
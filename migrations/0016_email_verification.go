@@ -0,0 +1,30 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 16,
+		Name:    "email_verification",
+		Up: map[string][]string{
+			//email_verified_at在修改邮箱时清空；verification_sent_at用于限制重发验证邮件的频率
+			database.DriverMySQL: {
+				`ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP NULL`,
+				`ALTER TABLE users ADD COLUMN verification_sent_at TIMESTAMP NULL`,
+			},
+			database.DriverSQLite: {
+				`ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP`,
+				`ALTER TABLE users ADD COLUMN verification_sent_at TIMESTAMP`,
+			},
+			database.DriverPostgres: {
+				`ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ`,
+				`ALTER TABLE users ADD COLUMN verification_sent_at TIMESTAMPTZ`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`ALTER TABLE users DROP COLUMN verification_sent_at`, `ALTER TABLE users DROP COLUMN email_verified_at`},
+			database.DriverSQLite:   {`ALTER TABLE users DROP COLUMN verification_sent_at`, `ALTER TABLE users DROP COLUMN email_verified_at`},
+			database.DriverPostgres: {`ALTER TABLE users DROP COLUMN verification_sent_at`, `ALTER TABLE users DROP COLUMN email_verified_at`},
+		},
+	})
+}
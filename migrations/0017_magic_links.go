@@ -0,0 +1,74 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 17,
+		Name:    "magic_links",
+		Up: map[string][]string{
+			//token为登录链接中令牌的摘要，device_token为申请链接的设备持有的令牌摘要，使用后立即删除
+			//magic_link_requests记录每次申请的来源IP，用于按IP限流
+			database.DriverMySQL: {`
+    CREATE TABLE IF NOT EXISTS magic_links (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		device_token VARCHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expired_at TIMESTAMP NOT NULL,
+		INDEX idx_magic_links_username (username)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`, `
+    CREATE TABLE IF NOT EXISTS magic_link_requests (
+        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+		ip VARCHAR(45) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		INDEX idx_magic_link_requests_ip (ip, created_at)
+    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`},
+			database.DriverSQLite: {`
+    CREATE TABLE IF NOT EXISTS magic_links (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		device_token VARCHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expired_at TIMESTAMP NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_magic_links_username ON magic_links (username)`,
+				`
+    CREATE TABLE IF NOT EXISTS magic_link_requests (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ip VARCHAR(45) NOT NULL,
+		created_at TIMESTAMP NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_magic_link_requests_ip ON magic_link_requests (ip, created_at)`,
+			},
+			database.DriverPostgres: {`
+    CREATE TABLE IF NOT EXISTS magic_links (
+        token VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(50) NOT NULL,
+		device_token VARCHAR(64) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		expired_at TIMESTAMPTZ NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_magic_links_username ON magic_links (username)`,
+				`
+    CREATE TABLE IF NOT EXISTS magic_link_requests (
+        id BIGSERIAL PRIMARY KEY,
+		ip VARCHAR(45) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+    )
+	`,
+				`CREATE INDEX idx_magic_link_requests_ip ON magic_link_requests (ip, created_at)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP TABLE IF EXISTS magic_link_requests`, `DROP TABLE IF EXISTS magic_links`},
+			database.DriverSQLite:   {`DROP TABLE IF EXISTS magic_link_requests`, `DROP TABLE IF EXISTS magic_links`},
+			database.DriverPostgres: {`DROP TABLE IF EXISTS magic_link_requests`, `DROP TABLE IF EXISTS magic_links`},
+		},
+	})
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 18,
+		Name:    "users_trigram",
+		Up: map[string][]string{
+			database.DriverMySQL: {}, //已有ngram全文索引
+			//FTS5的trigram分词按三字符子串索引，触发器随users表同步；模糊搜索只从这里取候选，不再扫描全表
+			database.DriverSQLite: {
+				`CREATE VIRTUAL TABLE users_fts USING fts5(username, fullname, email, content='users', content_rowid='id', tokenize='trigram')`,
+				`
+	CREATE TRIGGER users_fts_insert AFTER INSERT ON users BEGIN
+		INSERT INTO users_fts (rowid, username, fullname, email) VALUES (NEW.id, NEW.username, NEW.fullname, NEW.email);
+	END
+	`, `
+	CREATE TRIGGER users_fts_delete AFTER DELETE ON users BEGIN
+		INSERT INTO users_fts (users_fts, rowid, username, fullname, email) VALUES ('delete', OLD.id, OLD.username, OLD.fullname, OLD.email);
+	END
+	`, `
+	CREATE TRIGGER users_fts_update AFTER UPDATE OF username, fullname, email ON users BEGIN
+		INSERT INTO users_fts (users_fts, rowid, username, fullname, email) VALUES ('delete', OLD.id, OLD.username, OLD.fullname, OLD.email);
+		INSERT INTO users_fts (rowid, username, fullname, email) VALUES (NEW.id, NEW.username, NEW.fullname, NEW.email);
+	END
+	`,
+				`INSERT INTO users_fts (users_fts) VALUES ('rebuild')`,
+			},
+			//pg_trgm的GiST索引支持按相似度取最近的候选（KNN），与进程内的三元组算法一致
+			database.DriverPostgres: {
+				`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+				`CREATE INDEX idx_users_trgm ON users USING GIST ((username || ' ' || fullname || ' ' || email) gist_trgm_ops)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL: {},
+			database.DriverSQLite: {
+				`DROP TRIGGER IF EXISTS users_fts_update`,
+				`DROP TRIGGER IF EXISTS users_fts_delete`,
+				`DROP TRIGGER IF EXISTS users_fts_insert`,
+				`DROP TABLE IF EXISTS users_fts`,
+			},
+			database.DriverPostgres: {`DROP INDEX IF EXISTS idx_users_trgm`},
+		},
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import "user_system/database"
+
+func init() {
+	register(Migration{
+		Version: 19,
+		Name:    "webauthn_challenge_ip",
+		Up: map[string][]string{
+			//无密码登录不需要认证，按来源IP限制未完成的挑战数量
+			database.DriverMySQL: {
+				`ALTER TABLE webauthn_challenges ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT ''`,
+				`CREATE INDEX idx_webauthn_challenges_ip ON webauthn_challenges (ip, expired_at)`,
+			},
+			database.DriverSQLite: {
+				`ALTER TABLE webauthn_challenges ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT ''`,
+				`CREATE INDEX idx_webauthn_challenges_ip ON webauthn_challenges (ip, expired_at)`,
+			},
+			database.DriverPostgres: {
+				`ALTER TABLE webauthn_challenges ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT ''`,
+				`CREATE INDEX idx_webauthn_challenges_ip ON webauthn_challenges (ip, expired_at)`,
+			},
+		},
+		Down: map[string][]string{
+			database.DriverMySQL:    {`DROP INDEX idx_webauthn_challenges_ip ON webauthn_challenges`, `ALTER TABLE webauthn_challenges DROP COLUMN ip`},
+			database.DriverSQLite:   {`DROP INDEX IF EXISTS idx_webauthn_challenges_ip`, `ALTER TABLE webauthn_challenges DROP COLUMN ip`},
+			database.DriverPostgres: {`DROP INDEX IF EXISTS idx_webauthn_challenges_ip`, `ALTER TABLE webauthn_challenges DROP COLUMN ip`},
+		},
+	})
+}
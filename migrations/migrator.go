@@ -0,0 +1,313 @@
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"user_system/database"
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      map[string][]string //按方言区分的语句，某方言无需变更时给空切片
+	Down    map[string][]string
+}
+
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Checksum  string
+}
+
+var registry []Migration
+
+func register(m Migration) { //每个编号文件在init中注册自己的迁移
+	registry = append(registry, m)
+}
+
+func All() []Migration {
+	migrations := append([]Migration(nil), registry...)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations
+}
+
+func (m Migration) Checksum(driver string) string { //迁移发布后不允许再修改，用校验和发现被改动的迁移
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", m.Version, m.Name)
+	for _, stmt := range m.Up[driver] {
+		h.Write([]byte(strings.TrimSpace(stmt)))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte{1})
+	for _, stmt := range m.Down[driver] {
+		h.Write([]byte(strings.TrimSpace(stmt)))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var migrationsTable = map[string]string{
+	database.DriverMySQL: `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
+	`,
+	database.DriverSQLite: `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		applied_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000000 AS INTEGER))
+	)
+	`,
+	database.DriverPostgres: `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		applied_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)
+	`,
+}
+
+const lockName = "usersystem_schema_migrations"
+
+type Migrator struct {
+	DB          *database.Conn
+	LockTimeout time.Duration
+}
+
+func NewMigrator(db *database.Conn) (*Migrator, error) {
+	if db == nil {
+		return nil, fmt.Errorf("NewMigrator: Database connection is not initialized")
+	}
+	if _, ok := migrationsTable[db.Driver]; !ok {
+		return nil, fmt.Errorf("NewMigrator: Unsupported database driver %q", db.Driver)
+	}
+	return &Migrator{DB: db, LockTimeout: time.Minute}, nil
+}
+
+// withLock 在一个固定连接上加锁后执行fn，避免多个实例同时启动时重复迁移
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.DB.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to get database connection: %w", err)
+	}
+	defer conn.Close()
+	switch m.DB.Driver {
+	case database.DriverMySQL:
+		var ok sql.NullInt64
+		err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lockName, int(m.LockTimeout.Seconds())).Scan(&ok)
+		if err != nil {
+			return fmt.Errorf("Failed to acquire migration lock: %w", err)
+		}
+		if ok.Int64 != 1 {
+			return fmt.Errorf("Failed to acquire migration lock: timed out after %s", m.LockTimeout)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, lockName)
+	case database.DriverPostgres:
+		lockCtx, cancel := context.WithTimeout(ctx, m.LockTimeout)
+		defer cancel()
+		if _, err = conn.ExecContext(lockCtx, `SELECT pg_advisory_lock(hashtext($1))`, lockName); err != nil {
+			return fmt.Errorf("Failed to acquire migration lock: %w", err)
+		}
+		defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext($1))`, lockName)
+	case database.DriverSQLite:
+		//SQLite以_txlock=immediate打开，每个迁移事务开始时就持有整个文件的写锁，事务内再确认一次版本即可
+	}
+	if _, err := conn.ExecContext(ctx, migrationsTable[m.DB.Driver]); err != nil {
+		return fmt.Errorf("Failed to create schema_migrations table: %w", err)
+	}
+	return fn(conn)
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func (m *Migrator) applied(ctx context.Context, q queryer) (map[int]Status, error) {
+	rows, err := q.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]Status)
+	for rows.Next() {
+		var status Status
+		var appliedAt sql.NullTime
+		if err := rows.Scan(&status.Version, &status.Name, &status.Checksum, &appliedAt); err != nil {
+			return nil, fmt.Errorf("Failed to scan schema_migrations: %w", err)
+		}
+		status.Applied = true
+		status.AppliedAt = appliedAt.Time
+		applied[status.Version] = status
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) verify(applied map[int]Status) error { //已执行的迁移被修改时拒绝继续
+	for _, migration := range All() {
+		status, ok := applied[migration.Version]
+		if ok && status.Checksum != migration.Checksum(m.DB.Driver) {
+			return fmt.Errorf("Checksum mismatch for migration %04d_%s: it was modified after being applied", migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, up bool) (bool, error) { //返回是否真正执行
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	//拿到锁之后再确认一次，另一个实例可能已经执行过了
+	var count int
+	err = tx.QueryRowContext(ctx, database.Rebind(m.DB.Driver, `SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), migration.Version).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if (count > 0) == up {
+		return false, tx.Commit()
+	}
+	statements := migration.Down[m.DB.Driver]
+	if up {
+		statements = migration.Up[m.DB.Driver]
+	}
+	for _, stmt := range statements { //注意：MySQL的DDL会隐式提交，无法随事务回滚
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return false, err
+		}
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, database.Rebind(m.DB.Driver, `INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)`),
+			migration.Version, migration.Name, migration.Checksum(m.DB.Driver))
+	} else {
+		_, err = tx.ExecContext(ctx, database.Rebind(m.DB.Driver, `DELETE FROM schema_migrations WHERE version = ?`), migration.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (m *Migrator) Up(ctx context.Context) (int, error) { //执行所有未执行的迁移，返回执行数量
+	count := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+		for _, migration := range All() {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			ran, err := m.run(ctx, conn, migration, true)
+			if err != nil {
+				return fmt.Errorf("Failed to apply migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if ran {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) { //按版本倒序回滚steps个迁移
+	count := 0
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+		migrations := All()
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			migration := migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			ran, err := m.run(ctx, conn, migration, false)
+			if err != nil {
+				return fmt.Errorf("Failed to roll back migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if ran {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (m *Migrator) Redo(ctx context.Context) (*Migration, error) { //回滚并重新执行最后一个已执行的迁移
+	var redone *Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(applied); err != nil {
+			return err
+		}
+		migrations := All()
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[migrations[i].Version]; ok {
+				redone = &migrations[i]
+				break
+			}
+		}
+		if redone == nil {
+			return nil
+		}
+		if _, err := m.run(ctx, conn, *redone, false); err != nil {
+			return fmt.Errorf("Failed to roll back migration %04d_%s: %w", redone.Version, redone.Name, err)
+		}
+		if _, err := m.run(ctx, conn, *redone, true); err != nil {
+			return fmt.Errorf("Failed to apply migration %04d_%s: %w", redone.Version, redone.Name, err)
+		}
+		return nil
+	})
+	return redone, err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range All() {
+			status, ok := applied[migration.Version]
+			if !ok {
+				status = Status{Version: migration.Version, Name: migration.Name}
+			}
+			status.Checksum = migration.Checksum(m.DB.Driver)
+			if ok && applied[migration.Version].Checksum != status.Checksum {
+				status.Name += " (checksum mismatch)"
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
@@ -1,17 +1,21 @@
 package models
 
-import "time"
+import (
+	"time"
+	"user_system/webauthn"
+)
 
 type User struct {
 	ID        uint      `json:"id"`
 	Username  string    `json:"username"`
-	Password  string    `json:"password"` //hashed password
-	Role      string    `json:"role"`     //admin user
+	Password  string    `json:"-"`    //hashed password，不随JSON输出
+	Role      string    `json:"role"` //admin user
 	Email     string    `json:"email"`
 	FullName  string    `json:"fullname"`
-	Status    string    `json:"status"` // active, inactive or deleted
+	Status    string    `json:"status"` // active, inactive, deleted or pending_verification
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Version   uint      `json:"version"` //每次更新加一，用作ETag
 }
 
 type CreateUserRequest struct {
@@ -29,14 +33,158 @@ type UpdateUserRequest struct {
 	Email    *string `json:"email,omitempty" binding:"omitempty,email,max=100"`
 	FullName *string `json:"fullname,omitempty" binding:"omitempty,max=50"`
 	Status   *string `json:"status,omitempty" binding:"omitempty,oneof=active inactive deleted"`
+	Version  *uint   `json:"-"` //来自If-Match，为nil时不检查版本
 }
 
 type LoginRequest struct {
-	Username string `json:"username" binding:"required"`
+	Username  string `json:"username" binding:"required"`
+	Password  string `json:"password" binding:"required,min=6,max=50"`
+	Device    string `json:"device" binding:"max=100"` //客户端自定义的设备名，用于会话列表
+	Remember  bool   `json:"remember_me"`              //记住我，按角色的会话策略使用更长的有效期
+	UserAgent string `json:"-"`                        //以下由服务端根据请求填写
+	IP        string `json:"-"`
+}
+
+type MFAChallenge struct { //开启两步验证的用户密码正确后返回，凭mfa_token提交验证码完成登录
+	Token     string    `json:"mfa_token"`
+	ExpiredAt time.Time `json:"expired_at"`
+	Methods   []string  `json:"methods"` //可用的验证方式：totp、webauthn
+}
+
+type MFALoginRequest struct {
+	Token     string `json:"mfa_token" binding:"required,max=64"`
+	Code      string `json:"code" binding:"required,max=20"` //验证器App中的6位数字，或一个恢复码
+	UserAgent string `json:"-"`
+	IP        string `json:"-"`
+}
+
+type MFAEnrollment struct {
+	Secret string `json:"secret"`      //base32编码，无法扫码时手动输入
+	URI    string `json:"otpauth_uri"` //二维码的内容
+}
+
+type MFAStatus struct {
+	Enabled           bool       `json:"enabled"`
+	Pending           bool       `json:"pending"` //已生成密钥但尚未确认
+	ConfirmedAt       *time.Time `json:"confirmed_at"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+}
+
+type WebAuthnCredential struct { //返回给用户的WebAuthn凭证信息，不包含公钥
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	AAGUID      string     `json:"aaguid"` //认证器型号
+	Attestation string     `json:"attestation"`
+	Transports  []string   `json:"transports"`
+	SignCount   uint32     `json:"sign_count"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+}
+
+type WebAuthnLoginRequest struct {
+	MFAToken   string                     `json:"mfa_token" binding:"max=64"` //作为第二步验证时填写，device与remember_me沿用第一步的值
+	Credential webauthn.AssertionResponse `json:"credential"`
+	Device     string                     `json:"device" binding:"max=100"`
+	Remember   bool                       `json:"remember_me"`
+	UserAgent  string                     `json:"-"`
+	IP         string                     `json:"-"`
+}
+
+type PasswordReset struct { //发给用户的重置链接，Token只出现在邮件中
+	Username  string
+	Email     string
+	Token     string
+	ExpiredAt time.Time
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email,max=100"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required,max=64"`
 	Password string `json:"password" binding:"required,min=6,max=50"`
 }
 
+type EmailVerification struct { //发给用户的验证链接，Token是带签名的令牌
+	Username  string
+	Email     string
+	Token     string
+	ExpiredAt time.Time
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required,max=300"`
+}
+
+type ResendVerificationRequest struct {
+	Username string `json:"username" binding:"required,max=50"`
+}
+
+type MagicLinkRequest struct {
+	Username    string `json:"username" binding:"required,max=50"`
+	DeviceToken string `json:"-"` //以下由服务端填写，DeviceToken随响应返回给申请链接的设备
+	IP          string `json:"-"`
+}
+
+type MagicLink struct { //发给用户的登录链接，Token只出现在邮件中
+	Username  string
+	Email     string
+	Token     string
+	ExpiredAt time.Time
+}
+
+type MagicLoginRequest struct {
+	Token       string `json:"token" binding:"required,max=64"`
+	DeviceToken string `json:"device_token" binding:"required,max=64"` //申请链接时返回的device_token，其他设备打开链接无法登录
+	Device      string `json:"device" binding:"max=100"`
+	Remember    bool   `json:"remember_me"`
+	UserAgent   string `json:"-"`
+	IP          string `json:"-"`
+}
+
 type Response struct {
 	Message string `json:"message" binding:"required"`
 	Type    int    `json:"-" binding:"required"` // HTTP status code, not included in JSON response
 }
+
+type UserFilter struct { //组合查询条件，零值字段不参与过滤
+	Role           string     `form:"role" binding:"omitempty,oneof=admin user"`
+	Status         string     `form:"status" binding:"omitempty,oneof=active inactive deleted pending_verification"`
+	Email          string     `form:"email" binding:"omitempty,max=100"`
+	EmailPrefix    string     `form:"email_prefix" binding:"omitempty,max=100"`
+	FullName       string     `form:"fullname" binding:"omitempty,max=50"`
+	FullNamePrefix string     `form:"fullname_prefix" binding:"omitempty,max=50"`
+	CreatedFrom    *time.Time `form:"created_from" time_format:"2006-01-02T15:04:05Z07:00"` //包含边界
+	CreatedTo      *time.Time `form:"created_to" time_format:"2006-01-02T15:04:05Z07:00"`
+	UpdatedFrom    *time.Time `form:"updated_from" time_format:"2006-01-02T15:04:05Z07:00"`
+	UpdatedTo      *time.Time `form:"updated_to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Sort           string     `form:"sort" binding:"omitempty,oneof=id username email fullname created_at updated_at"`
+	Order          string     `form:"order" binding:"omitempty,oneof=asc desc"`
+	Limit          int        `form:"limit" binding:"omitempty,min=1,max=100"` //0表示不限制
+	Offset         int        `form:"offset" binding:"omitempty,min=0"`
+	Cursor         string     `form:"cursor"` //上一页返回的next_cursor，使用时忽略offset
+}
+
+type UserPage struct {
+	Users      []*User `json:"users"`
+	Total      int     `json:"total"`                 //满足条件的总数，不受分页影响
+	NextCursor string  `json:"next_cursor,omitempty"` //为空表示没有下一页
+}
+
+type UserSearchHit struct {
+	User       *User             `json:"user"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"` //字段名 -> 带<mark>标记的文本
+}
+
+type UserStats struct { //每天一条的用户统计，由定时任务生成
+	Day        string    `json:"day"` //YYYY-MM-DD，本地时区
+	Total      int       `json:"total"`
+	Active     int       `json:"active"`
+	Inactive   int       `json:"inactive"`
+	Deleted    int       `json:"deleted"`
+	Admins     int       `json:"admins"`
+	Registered int       `json:"registered"` //当天注册的用户数
+	ComputedAt time.Time `json:"computed_at"`
+}
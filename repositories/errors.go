@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"user_system/database"
+)
+
+// 存储层返回的错误类型，调用方用errors.Is判断，HTTP状态码的映射在userhandler中统一处理
+var (
+	ErrUserNotFound       = errors.New("User not found")
+	ErrDuplicateUsername  = errors.New("Username already exists")
+	ErrAccountDisabled    = errors.New("User account is disabled")
+	ErrInvalidCredentials = errors.New("Invalid username or password")
+	ErrStoreUnavailable   = errors.New("User store is unavailable")
+	ErrVersionConflict    = errors.New("User has been modified")
+	ErrInvalidInput       = errors.New("Invalid input")
+
+	ErrInvalidMFACode      = errors.New("Invalid verification code")
+	ErrInvalidMFAChallenge = errors.New("Invalid or expired MFA challenge")
+	ErrMFAAlreadyEnabled   = errors.New("MFA is already enabled")
+	ErrMFANotEnabled       = errors.New("MFA is not enabled")
+	ErrMFANotEnrolled      = errors.New("MFA enrollment has not been started")
+	ErrMFALocked           = errors.New("Too many invalid verification codes, try again later")
+
+	ErrWebAuthnFailed             = errors.New("WebAuthn verification failed")
+	ErrWebAuthnCredentialNotFound = errors.New("WebAuthn credential not found")
+	ErrDuplicateCredential        = errors.New("WebAuthn credential is already registered")
+	ErrWebAuthnThrottled          = errors.New("Too many pending WebAuthn login requests")
+
+	ErrInvalidResetToken = errors.New("Invalid or expired password reset token")
+
+	ErrEmailNotVerified         = errors.New("Email address is not verified")
+	ErrEmailAlreadyVerified     = errors.New("Email address is already verified")
+	ErrInvalidVerificationToken = errors.New("Invalid or expired email verification link")
+	ErrVerificationThrottled    = errors.New("Verification email was sent recently")
+
+	ErrInvalidMagicLink   = errors.New("Invalid or expired login link")
+	ErrMagicLinkThrottled = errors.New("Too many login link requests")
+)
+
+// storeError 包装数据库错误，连接类故障额外标记为ErrStoreUnavailable
+func storeError(action string, err error) error {
+	if database.IsUnavailable(err) {
+		return fmt.Errorf("%s: %w: %w", action, ErrStoreUnavailable, err)
+	}
+	return fmt.Errorf("%s: %w", action, err)
+}
+
+func invalidInput(message string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidInput, message)
+}
+
+var errNotInitialized = fmt.Errorf("%w: Database connection is not initialized", ErrStoreUnavailable)
@@ -0,0 +1,160 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"user_system/database"
+	"user_system/models"
+	"user_system/search"
+)
+
+const fulltextCandidates = 200 //从索引中取出的候选数量，之后在进程内重新排序
+
+func userFields(user *models.User) []search.Field {
+	return []search.Field{
+		{Name: "username", Value: user.Username, Weight: 1},
+		{Name: "fullname", Value: user.FullName, Weight: 1},
+		{Name: "email", Value: user.Email, Weight: 0.8},
+	}
+}
+
+type hitRanker struct { //只保留得分最高的limit个结果
+	query string
+	limit int
+	hits  []*models.UserSearchHit
+}
+
+func (r *hitRanker) add(user *models.User) {
+	match, ok := search.Rank(r.query, userFields(user))
+	if !ok {
+		return
+	}
+	r.hits = append(r.hits, &models.UserSearchHit{User: user, Score: match.Score, Highlights: match.Highlights})
+	if len(r.hits) >= 4*r.limit { //定期裁剪，内存占用有上限
+		r.trim()
+	}
+}
+
+func (r *hitRanker) trim() []*models.UserSearchHit {
+	sort.SliceStable(r.hits, func(i, j int) bool {
+		if r.hits[i].Score != r.hits[j].Score {
+			return r.hits[i].Score > r.hits[j].Score
+		}
+		return r.hits[i].User.ID < r.hits[j].User.ID
+	})
+	if len(r.hits) > r.limit {
+		r.hits = r.hits[:r.limit]
+	}
+	return r.hits
+}
+
+func (h *DBHandler) FuzzySearchUsers(ctx context.Context, query string, limit int) ([]*models.UserSearchHit, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	if len(search.Tokens(query)) == 0 {
+		return nil, invalidInput("Search query is empty")
+	}
+	//各方言都先用索引取出有限的候选，之后在进程内重新排序
+	db := h.DB.ReadOnly()
+	var rows *database.Rows
+	var err error
+	switch h.DB.Driver {
+	case database.DriverMySQL: //ngram全文索引，索引随UPDATE自动维护
+		rows, err = db.Query(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE MATCH(username, fullname, email) AGAINST (? IN NATURAL LANGUAGE MODE)
+		ORDER BY MATCH(username, fullname, email) AGAINST (? IN NATURAL LANGUAGE MODE) DESC
+		LIMIT ?`, query, query, fulltextCandidates,
+		)
+	case database.DriverPostgres: //pg_trgm的GiST索引按相似度取最近的候选
+		rows, err = db.Query(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		ORDER BY ? <<-> (username || ' ' || fullname || ' ' || email)
+		LIMIT ?`, query, fulltextCandidates,
+		)
+	default:
+		rows, err = ftsCandidates(ctx, db, query)
+	}
+	if err != nil {
+		return nil, storeError("Failed to search users", err)
+	}
+	defer rows.Close()
+	ranker := &hitRanker{query: query, limit: limit}
+	for rows.Next() {
+		var userInfo models.User
+		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt, &userInfo.Version)
+		if err != nil {
+			return nil, storeError("Failed to scan user", err)
+		}
+		ranker.add(&userInfo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeError("Error during iteration", err)
+	}
+	return ranker.trim(), nil
+}
+
+// ftsCandidates 从SQLite的FTS5 trigram索引中取候选：包含查询中任一三字符子串的用户按相关度取前若干个
+// 不足三个字的词（如两个汉字的姓名）无法使用trigram索引，只有这类词时退回LIKE，候选数量同样有上限
+func ftsCandidates(ctx context.Context, db *database.Conn, query string) (*database.Rows, error) {
+	var grams, short []string
+	seen := make(map[string]bool)
+	for _, word := range search.Tokens(query) {
+		runes := []rune(word)
+		if len(runes) < 3 {
+			short = append(short, word)
+			continue
+		}
+		for i := 0; i+3 <= len(runes); i++ {
+			if gram := string(runes[i : i+3]); !seen[gram] {
+				seen[gram] = true
+				grams = append(grams, `"`+gram+`"`) //词中只有字母和数字，不需要转义
+			}
+		}
+	}
+	if len(grams) > 0 {
+		return db.Query(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE id IN (SELECT rowid FROM users_fts WHERE users_fts MATCH ? ORDER BY rank LIMIT ?)`, strings.Join(grams, " OR "), fulltextCandidates,
+		)
+	}
+	var where []string
+	var args []any
+	for _, word := range short {
+		where = append(where, `username LIKE ? OR fullname LIKE ? OR email LIKE ?`)
+		pattern := "%" + word + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	args = append(args, fulltextCandidates)
+	return db.Query(ctx, `
+		SELECT `+userColumns+`
+		FROM users
+		WHERE `+strings.Join(where, " OR ")+`
+		LIMIT ?`, args...,
+	)
+}
+
+func (h *MemoryHandler) FuzzySearchUsers(ctx context.Context, query string, limit int) ([]*models.UserSearchHit, error) {
+	if len(search.Tokens(query)) == 0 {
+		return nil, invalidInput("Search query is empty")
+	}
+	ranker := &hitRanker{query: query, limit: limit}
+	for _, id := range h.index.Candidates(query, fulltextCandidates) {
+		h.mu.RLock()
+		user, ok := h.users[id]
+		var userInfo models.User
+		if ok {
+			userInfo = *user
+		}
+		h.mu.RUnlock()
+		if ok {
+			ranker.add(&userInfo)
+		}
+	}
+	return ranker.trim(), nil
+}
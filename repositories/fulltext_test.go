@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"user_system/models"
+)
+
+func TestFuzzySearchUsers(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			createUser(t, store, "alicia", "alicia@example.com")
+			createUser(t, store, "bob", "bob@example.com")
+			err := store.CreateUser(ctx, &models.CreateUserRequest{Username: "zhangsan", Password: testPassword, Role: "user", Email: "zs@example.com", FullName: "张三"})
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			fullname := "Robert Brown"
+			if err := store.UpdateUser(ctx, &models.UpdateUserRequest{Username: "bob", FullName: &fullname}); err != nil {
+				t.Fatalf("UpdateUser: %v", err)
+			}
+
+			tests := []struct {
+				query string
+				want  []string //按得分排序的前几个结果
+			}{
+				{"alice", []string{"alice"}},
+				{"alic", []string{"alice", "alicia"}},
+				{"robert", []string{"bob"}}, //修改后的姓名立即可以搜到
+				{"张", []string{"zhangsan"}},
+			}
+			for _, tt := range tests {
+				hits, err := store.FuzzySearchUsers(ctx, tt.query, 10)
+				if err != nil {
+					t.Fatalf("FuzzySearchUsers(%q): %v", tt.query, err)
+				}
+				if len(hits) < len(tt.want) {
+					t.Errorf("FuzzySearchUsers(%q) returned %d hits, want at least %d", tt.query, len(hits), len(tt.want))
+					continue
+				}
+				for i, username := range tt.want {
+					if hits[i].User.Username != username {
+						t.Errorf("FuzzySearchUsers(%q)[%d] = %s, want %s", tt.query, i, hits[i].User.Username, username)
+					}
+				}
+			}
+			if _, err := store.FuzzySearchUsers(ctx, "@.", 10); err == nil {
+				t.Error("query without words accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"user_system/database"
+	"user_system/migrations"
+	"user_system/models"
+	"user_system/utils"
+
+	_ "modernc.org/sqlite"
+)
+
+const testPassword = "secret1"
+
+func newMemoryStore(t *testing.T) *MemoryHandler {
+	t.Helper()
+	return NewMemoryHandler(utils.NewAuthMemoryHandler())
+}
+
+// newSQLiteStore 在临时目录中创建SQLite数据库并执行全部迁移
+func newSQLiteStore(t *testing.T) *DBHandler {
+	t.Helper()
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_integer_format=unix_micro&_inttotime=1&_txlock=immediate",
+		filepath.Join(t.TempDir(), "test.db"),
+	))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	conn := database.NewConn(db, database.DriverSQLite)
+	migrator, err := migrations.NewMigrator(conn)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	tokens, err := utils.NewAuthDBHandler(conn)
+	if err != nil {
+		t.Fatalf("NewAuthDBHandler: %v", err)
+	}
+	store, err := NewDBHandler(conn, tokens)
+	if err != nil {
+		t.Fatalf("NewDBHandler: %v", err)
+	}
+	return store
+}
+
+// stores 返回需要保持一致行为的UserStore实现
+func stores(t *testing.T) map[string]UserStore {
+	t.Helper()
+	return map[string]UserStore{
+		"memory": newMemoryStore(t),
+		"sqlite": newSQLiteStore(t),
+	}
+}
+
+// tokensOf 返回存储使用的TokenStore
+func tokensOf(t *testing.T, store UserStore) utils.TokenStore {
+	t.Helper()
+	switch s := store.(type) {
+	case *MemoryHandler:
+		return s.Tokens
+	case *DBHandler:
+		return s.Tokens
+	}
+	t.Fatalf("unknown store %T", store)
+	return nil
+}
+
+func createUser(t *testing.T, store UserStore, username, email string) {
+	t.Helper()
+	err := store.CreateUser(context.Background(), &models.CreateUserRequest{
+		Username: username,
+		Password: testPassword,
+		Role:     "user",
+		Email:    email,
+		FullName: username,
+	})
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+}
+
+func login(t *testing.T, store UserStore, username string) (*utils.TokenPair, *models.MFAChallenge) {
+	t.Helper()
+	pair, challenge, err := store.UserLogin(context.Background(), &models.LoginRequest{Username: username, Password: testPassword})
+	if err != nil {
+		t.Fatalf("UserLogin(%s): %v", username, err)
+	}
+	return pair, challenge
+}
+
+// set 在测试期间修改包级配置，结束后恢复
+func set[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
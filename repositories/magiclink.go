@@ -0,0 +1,312 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+	"user_system/models"
+	"user_system/utils"
+)
+
+var (
+	MagicLinkLogin    = false            //允许通过邮件中的链接免密码登录
+	MagicLinkTTL      = 15 * time.Minute //登录链接的有效期
+	MagicLinkInterval = time.Minute      //同一用户两次发送登录链接的最短间隔
+	MagicLinkIPLimit  = 10               //同一IP在MagicLinkIPWindow内最多申请几次
+	MagicLinkIPWindow = time.Hour
+)
+
+type magicLink struct {
+	Username    string
+	DeviceToken string //申请链接的设备持有的令牌摘要
+	CreatedAt   time.Time
+	ExpiredAt   time.Time
+}
+
+func newMagicLink(username, email string, now time.Time) (string, *models.MagicLink, error) { //返回摘要与发给用户的链接
+	token, err := utils.GernerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	return utils.HashToken(token), &models.MagicLink{
+		Username:  username,
+		Email:     email,
+		Token:     token,
+		ExpiredAt: now.Add(MagicLinkTTL),
+	}, nil
+}
+
+// CreateMagicLink 为用户生成登录链接，链接只能由持有req.DeviceToken的设备使用，旧的链接随之失效
+// 同一IP申请过于频繁时返回ErrMagicLinkThrottled；用户不存在、不能登录或刚发送过时返回nil，调用方不应向用户透露区别
+func (h *DBHandler) CreateMagicLink(ctx context.Context, req *models.MagicLinkRequest) (*models.MagicLink, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	var link *models.MagicLink
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		now := time.Now()
+		var count int
+		err := tx.DB.QueryRow(ctx, `
+			SELECT COUNT(*) FROM magic_link_requests WHERE ip = ? AND created_at > ?`, req.IP, now.Add(-MagicLinkIPWindow),
+		).Scan(&count)
+		if err != nil {
+			return storeError("Failed to query magic link requests", err)
+		}
+		if count >= MagicLinkIPLimit {
+			return ErrMagicLinkThrottled
+		}
+		//不论用户是否存在都计入，限流结果不会透露用户名是否存在
+		if _, err := tx.DB.Exec(ctx, `INSERT INTO magic_link_requests (ip, created_at) VALUES (?, ?)`, req.IP, now); err != nil {
+			return storeError("Failed to record magic link request", err)
+		}
+		var email, status string
+		err = tx.DB.QueryRow(ctx, `SELECT email, status FROM users WHERE username = ?`+tx.DB.ForUpdate(), req.Username).Scan(&email, &status)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return storeError("Failed to query user", err)
+		}
+		if loginAllowed(status) != nil {
+			return nil
+		}
+		err = tx.DB.QueryRow(ctx, `
+			SELECT COUNT(*) FROM magic_links WHERE username = ? AND created_at > ?`, req.Username, now.Add(-MagicLinkInterval),
+		).Scan(&count)
+		if err != nil {
+			return storeError("Failed to query magic links", err)
+		}
+		if count > 0 {
+			return nil
+		}
+		digest, l, err := newMagicLink(req.Username, email, now)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.DB.Exec(ctx, `DELETE FROM magic_links WHERE username = ?`, req.Username); err != nil {
+			return storeError("Failed to delete magic links", err)
+		}
+		_, err = tx.DB.Exec(ctx, `
+			INSERT INTO magic_links (token, username, device_token, created_at, expired_at) VALUES (?, ?, ?, ?, ?)`,
+			digest, req.Username, utils.HashToken(req.DeviceToken), now, l.ExpiredAt,
+		)
+		if err != nil {
+			return storeError("Failed to create magic link", err)
+		}
+		link = l
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// MagicLogin 用登录链接中的令牌登录，令牌只能使用一次；之后与密码登录相同，开启了两步验证时只返回挑战
+func (h *DBHandler) MagicLogin(ctx context.Context, req *models.MagicLoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
+	if h.DB == nil {
+		return nil, nil, errNotInitialized
+	}
+	var pair *utils.TokenPair
+	var challenge *models.MFAChallenge
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var err error
+		pair, challenge, err = tx.magicLogin(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return pair, challenge, nil
+}
+
+func (h *DBHandler) magicLogin(ctx context.Context, req *models.MagicLoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
+	digest := utils.HashToken(req.Token)
+	var username, deviceToken string
+	var expiredAt time.Time
+	err := h.DB.QueryRow(ctx, `
+		SELECT username, device_token, expired_at FROM magic_links WHERE token = ?`, digest,
+	).Scan(&username, &deviceToken, &expiredAt)
+	if err == sql.ErrNoRows || (err == nil && expiredAt.Before(time.Now())) {
+		return nil, nil, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return nil, nil, storeError("Failed to query magic link", err)
+	}
+	if deviceToken != utils.HashToken(req.DeviceToken) { //在其他设备上打开的链接
+		return nil, nil, ErrInvalidMagicLink
+	}
+	//先锁用户行再删除链接，与申请链接的事务加锁顺序一致
+	var status, role string
+	err = h.DB.QueryRow(ctx, `SELECT status, role FROM users WHERE username = ?`+h.DB.ForUpdate(), username).Scan(&status, &role)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrInvalidMagicLink
+	}
+	if err != nil {
+		return nil, nil, storeError("Failed to query user", err)
+	}
+	if err := loginAllowed(status); err != nil {
+		return nil, nil, err
+	}
+	result, err := h.DB.Exec(ctx, `DELETE FROM magic_links WHERE token = ?`, digest)
+	if err != nil {
+		return nil, nil, storeError("Failed to delete magic link", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, nil, storeError("Failed to get affected rows", err)
+	}
+	if rows == 0 { //并发请求已经使用了该链接
+		return nil, nil, ErrInvalidMagicLink
+	}
+	return h.issueLogin(ctx, &models.LoginRequest{
+		Username:  username,
+		Device:    req.Device,
+		Remember:  req.Remember,
+		UserAgent: req.UserAgent,
+		IP:        req.IP,
+	}, role)
+}
+
+// DeleteExpiredMagicLinks 清理过期的登录链接与超出限流窗口的申请记录，返回删除的链接数量
+func (h *DBHandler) DeleteExpiredMagicLinks(ctx context.Context) (int, error) {
+	if h.DB == nil {
+		return 0, errNotInitialized
+	}
+	now := time.Now()
+	if _, err := h.DB.Exec(ctx, `DELETE FROM magic_link_requests WHERE created_at < ?`, now.Add(-MagicLinkIPWindow)); err != nil {
+		return 0, storeError("Failed to delete magic link requests", err)
+	}
+	result, err := h.DB.Exec(ctx, `DELETE FROM magic_links WHERE expired_at < ?`, now)
+	if err != nil {
+		return 0, storeError("Failed to delete magic links", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, storeError("Failed to get affected rows", err)
+	}
+	return int(rows), nil
+}
+
+func (h *MemoryHandler) CreateMagicLink(ctx context.Context, req *models.MagicLinkRequest) (*models.MagicLink, error) {
+	var link *models.MagicLink
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		now := time.Now()
+		if !tx.allowMagicLinkRequest(req.IP, now) {
+			return ErrMagicLinkThrottled
+		}
+		user := tx.findByUsername(req.Username)
+		if user == nil || loginAllowed(user.Status) != nil {
+			return nil
+		}
+		for _, l := range tx.magicLinks {
+			if l.Username == user.Username && l.CreatedAt.After(now.Add(-MagicLinkInterval)) {
+				return nil
+			}
+		}
+		digest, l, err := newMagicLink(user.Username, user.Email, now)
+		if err != nil {
+			return err
+		}
+		tx.deleteMagicLinks(user.Username)
+		tx.saveMagicLink(digest)
+		tx.magicLinks[digest] = &magicLink{Username: user.Username, DeviceToken: utils.HashToken(req.DeviceToken), CreatedAt: now, ExpiredAt: l.ExpiredAt}
+		link = l
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// allowMagicLinkRequest 按IP限流并记录本次申请，调用方持有写锁
+func (h *MemoryHandler) allowMagicLinkRequest(ip string, now time.Time) bool {
+	recent := make([]time.Time, 0, len(h.magicRequests[ip])+1)
+	for _, t := range h.magicRequests[ip] {
+		if t.After(now.Add(-MagicLinkIPWindow)) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= MagicLinkIPLimit {
+		h.magicRequests[ip] = recent
+		return false
+	}
+	h.magicRequests[ip] = append(recent, now)
+	return true
+}
+
+func (h *MemoryHandler) deleteMagicLinks(username string) { //调用方持有写锁
+	for digest, l := range h.magicLinks {
+		if l.Username == username {
+			h.saveMagicLink(digest)
+			delete(h.magicLinks, digest)
+		}
+	}
+}
+
+func (h *MemoryHandler) MagicLogin(ctx context.Context, req *models.MagicLoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
+	var pair *utils.TokenPair
+	var challenge *models.MFAChallenge
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		var err error
+		pair, challenge, err = tx.magicLogin(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return pair, challenge, nil
+}
+
+func (h *MemoryHandler) magicLogin(ctx context.Context, req *models.MagicLoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
+	digest := utils.HashToken(req.Token)
+	h.mu.Lock()
+	l := h.magicLinks[digest]
+	if l == nil || l.ExpiredAt.Before(time.Now()) || l.DeviceToken != utils.HashToken(req.DeviceToken) {
+		h.mu.Unlock()
+		return nil, nil, ErrInvalidMagicLink
+	}
+	user := h.findByUsername(l.Username)
+	if user == nil {
+		h.mu.Unlock()
+		return nil, nil, ErrInvalidMagicLink
+	}
+	if err := loginAllowed(user.Status); err != nil {
+		h.mu.Unlock()
+		return nil, nil, err
+	}
+	h.saveMagicLink(digest)
+	delete(h.magicLinks, digest)
+	role := user.Role
+	h.mu.Unlock()
+	return h.issueLogin(ctx, &models.LoginRequest{
+		Username:  l.Username,
+		Device:    req.Device,
+		Remember:  req.Remember,
+		UserAgent: req.UserAgent,
+		IP:        req.IP,
+	}, role)
+}
+
+func (h *MemoryHandler) DeleteExpiredMagicLinks(ctx context.Context) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for ip, times := range h.magicRequests {
+		if len(times) == 0 || times[len(times)-1].Before(now.Add(-MagicLinkIPWindow)) { //按时间顺序追加，最后一次也已超出窗口
+			delete(h.magicRequests, ip)
+		}
+	}
+	deleted := 0
+	for digest, l := range h.magicLinks {
+		if l.ExpiredAt.Before(now) {
+			h.saveMagicLink(digest)
+			delete(h.magicLinks, digest)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
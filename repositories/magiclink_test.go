@@ -0,0 +1,126 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"user_system/models"
+	"user_system/utils"
+)
+
+func requestMagicLink(t *testing.T, store UserStore, username string) (*models.MagicLink, string) {
+	t.Helper()
+	device, err := utils.GernerateToken()
+	if err != nil {
+		t.Fatalf("GernerateToken: %v", err)
+	}
+	link, err := store.CreateMagicLink(context.Background(), &models.MagicLinkRequest{Username: username, DeviceToken: device, IP: "192.0.2.1"})
+	if err != nil || link == nil {
+		t.Fatalf("CreateMagicLink = %v, %v", link, err)
+	}
+	return link, device
+}
+
+// 登录链接只能由申请它的设备使用一次
+func TestMagicLogin(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			link, device := requestMagicLink(t, store, "alice")
+			//发送间隔内的重复申请不生成新链接，原来的链接仍然有效
+			again, err := store.CreateMagicLink(ctx, &models.MagicLinkRequest{Username: "alice", DeviceToken: "other", IP: "192.0.2.1"})
+			if err != nil || again != nil {
+				t.Fatalf("CreateMagicLink again = %v, %v, want nil", again, err)
+			}
+			other, _ := utils.GernerateToken()
+
+			tests := []struct {
+				name    string
+				token   string
+				device  string
+				wantErr error
+			}{
+				{"unknown link", "unknown", device, ErrInvalidMagicLink},
+				{"other device", link.Token, other, ErrInvalidMagicLink},
+				{"without device token", link.Token, "", ErrInvalidMagicLink},
+				{"requesting device", link.Token, device, nil},
+				{"used link", link.Token, device, ErrInvalidMagicLink},
+			}
+			for _, tt := range tests {
+				pair, _, err := store.MagicLogin(ctx, &models.MagicLoginRequest{Token: tt.token, DeviceToken: tt.device})
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+				}
+				if err == nil && pair == nil {
+					t.Fatalf("%s: no token pair issued", tt.name)
+				}
+			}
+		})
+	}
+}
+
+// 同一个链接被并发使用时只有一个请求能登录
+func TestMagicLoginConcurrent(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			createUser(t, store, "alice", "alice@example.com")
+			link, device := requestMagicLink(t, store, "alice")
+
+			const n = 8
+			var wg sync.WaitGroup
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, _, err := store.MagicLogin(context.Background(), &models.MagicLoginRequest{Token: link.Token, DeviceToken: device})
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			succeeded := 0
+			for err := range errs {
+				switch {
+				case err == nil:
+					succeeded++
+				case !errors.Is(err, ErrInvalidMagicLink):
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if succeeded != 1 {
+				t.Errorf("%d logins succeeded, want 1", succeeded)
+			}
+		})
+	}
+}
+
+// 同一IP的申请次数不论用户是否存在都计入限流
+func TestMagicLinkIPLimit(t *testing.T) {
+	set(t, &MagicLinkIPLimit, 2)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			tests := []struct {
+				username string
+				ip       string
+				wantErr  error
+			}{
+				{"nobody", "192.0.2.1", nil},
+				{"alice", "192.0.2.1", nil},
+				{"alice", "192.0.2.1", ErrMagicLinkThrottled},
+				{"nobody", "192.0.2.1", ErrMagicLinkThrottled},
+				{"nobody", "192.0.2.2", nil},
+			}
+			for i, tt := range tests {
+				_, err := store.CreateMagicLink(ctx, &models.MagicLinkRequest{Username: tt.username, DeviceToken: "device", IP: tt.ip})
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("request #%d (%s from %s): err = %v, want %v", i+1, tt.username, tt.ip, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"time"
+	"user_system/database"
+	"user_system/models"
+)
+
+const statsDayLayout = "2006-01-02"
+
+// PurgeDeletedUsers 硬删除在before之前被标记为deleted的用户，返回删除的数量
+// 标记删除时该用户的Token已经吊销，这里只需要删除用户数据、两步验证的密钥、WebAuthn凭证、重置链接与登录链接
+func (h *DBHandler) PurgeDeletedUsers(ctx context.Context, before time.Time) (int, error) {
+	if h.DB == nil {
+		return 0, errNotInitialized
+	}
+	purged := 0
+	err := h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		for _, table := range []string{"user_mfa", "mfa_recovery_codes", "mfa_challenges", "password_resets", "magic_links"} {
+			_, err := tx.Exec(ctx, `
+			DELETE FROM `+table+` WHERE username IN (SELECT username FROM users WHERE status = 'deleted' AND updated_at < ?)`, before,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+		DELETE FROM webauthn_credentials WHERE user_id IN (SELECT id FROM users WHERE status = 'deleted' AND updated_at < ?)`, before,
+		)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec(ctx, `
+		DELETE FROM users WHERE status = 'deleted' AND updated_at < ?`, before,
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		purged = int(rows)
+		return err
+	})
+	if err != nil {
+		return 0, storeError("Failed to purge deleted users", err)
+	}
+	return purged, nil
+}
+
+// RollupStats 统计当前各状态的用户数与day当天的注册数，覆盖day已有的统计
+func (h *DBHandler) RollupStats(ctx context.Context, day time.Time) (*models.UserStats, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	stats := &models.UserStats{Day: from.Format(statsDayLayout), ComputedAt: time.Now()}
+	err := h.DB.QueryRow(ctx, `
+		SELECT COUNT(*),
+			COALESCE(SUM(CASE WHEN status = 'active' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'inactive' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'deleted' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN role = 'admin' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN created_at >= ? AND created_at < ? THEN 1 ELSE 0 END), 0)
+		FROM users`, from, from.AddDate(0, 0, 1),
+	).Scan(&stats.Total, &stats.Active, &stats.Inactive, &stats.Deleted, &stats.Admins, &stats.Registered)
+	if err != nil {
+		return nil, storeError("Failed to query user stats", err)
+	}
+	err = h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM user_stats WHERE day = ?`, stats.Day); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `
+		INSERT INTO user_stats (day, total, active, inactive, deleted, admins, registered, computed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			stats.Day, stats.Total, stats.Active, stats.Inactive, stats.Deleted, stats.Admins, stats.Registered, stats.ComputedAt,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, storeError("Failed to save user stats", err)
+	}
+	return stats, nil
+}
+
+func (h *DBHandler) GetStats(ctx context.Context, limit int) ([]*models.UserStats, error) { //按日期倒序返回最近limit天
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	rows, err := h.DB.ReadOnly().Query(ctx, `
+		SELECT day, total, active, inactive, deleted, admins, registered, computed_at
+		FROM user_stats ORDER BY day DESC LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, storeError("Failed to query user stats", err)
+	}
+	defer rows.Close()
+	list := make([]*models.UserStats, 0)
+	for rows.Next() {
+		var s models.UserStats
+		if err := rows.Scan(&s.Day, &s.Total, &s.Active, &s.Inactive, &s.Deleted, &s.Admins, &s.Registered, &s.ComputedAt); err != nil {
+			return nil, storeError("Failed to scan user stats", err)
+		}
+		list = append(list, &s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeError("Failed to iterate user stats", err)
+	}
+	return list, nil
+}
+
+func (h *MemoryHandler) PurgeDeletedUsers(ctx context.Context, before time.Time) (int, error) {
+	purged := 0
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		for _, user := range tx.users {
+			if user.Status == "deleted" && user.UpdatedAt.Before(before) {
+				tx.deleteUser(user)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+func (h *MemoryHandler) RollupStats(ctx context.Context, day time.Time) (*models.UserStats, error) {
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	to := from.AddDate(0, 0, 1)
+	stats := &models.UserStats{Day: from.Format(statsDayLayout), ComputedAt: time.Now()}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, user := range h.users {
+		stats.Total++
+		switch user.Status {
+		case "active":
+			stats.Active++
+		case "inactive":
+			stats.Inactive++
+		case "deleted":
+			stats.Deleted++
+		}
+		if user.Role == "admin" {
+			stats.Admins++
+		}
+		if !user.CreatedAt.Before(from) && user.CreatedAt.Before(to) {
+			stats.Registered++
+		}
+	}
+	saved := *stats
+	h.stats[stats.Day] = &saved
+	return stats, nil
+}
+
+func (h *MemoryHandler) GetStats(ctx context.Context, limit int) ([]*models.UserStats, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]*models.UserStats, 0, len(h.stats))
+	for _, s := range h.stats {
+		copied := *s
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Day > list[j].Day })
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
@@ -0,0 +1,357 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"user_system/models"
+	"user_system/search"
+	"user_system/utils"
+)
+
+type memoryState struct {
+	mu     sync.RWMutex
+	txMu   sync.Mutex     //写操作与事务互斥，回滚时不会覆盖其他请求的修改
+	undo   *utils.UndoLog //事务进行中记录修改，不在事务中为nil
+	nextID uint
+	users  map[uint]*models.User
+	index  *search.Index //模糊搜索用的三元组索引，随增删改同步更新
+	stats  map[string]*models.UserStats
+
+	mfa        map[string]*mfaSecret    //用户名 -> TOTP密钥与恢复码
+	challenges map[string]*mfaChallenge //挑战摘要 -> 登录挑战
+
+	nextCredentialID   int
+	credentials        map[int]*webauthnCredential
+	webauthnChallenges map[string]*webauthnChallenge //不参与事务回滚
+
+	resets map[string]*passwordReset //重置令牌摘要 -> 重置链接
+	emails map[string]*emailState    //用户名 -> 邮箱验证状态
+
+	magicLinks    map[string]*magicLink  //登录令牌摘要 -> 登录链接
+	magicRequests map[string][]time.Time //IP -> 申请登录链接的时间，不参与事务回滚
+}
+
+// MemoryHandler 是UserStore的内存实现，进程退出后数据丢失，用于测试、演示与临时环境
+type MemoryHandler struct {
+	*memoryState
+	inTx   bool //WithTx中得到的副本，再次开启事务时直接加入
+	Tokens utils.TokenStore
+}
+
+func NewMemoryHandler(tokens utils.TokenStore) *MemoryHandler {
+	state := &memoryState{
+		users:      make(map[uint]*models.User),
+		index:      search.NewIndex(),
+		stats:      make(map[string]*models.UserStats),
+		mfa:        make(map[string]*mfaSecret),
+		challenges: make(map[string]*mfaChallenge),
+
+		credentials:        make(map[int]*webauthnCredential),
+		webauthnChallenges: make(map[string]*webauthnChallenge),
+
+		resets: make(map[string]*passwordReset),
+		emails: make(map[string]*emailState),
+
+		magicLinks:    make(map[string]*magicLink),
+		magicRequests: make(map[string][]time.Time),
+	}
+	return &MemoryHandler{memoryState: state, Tokens: tokens}
+}
+
+func (h *MemoryHandler) findByUsername(username string) *models.User {
+	for _, user := range h.users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+// filter 按id顺序返回满足条件的用户副本
+func (h *MemoryHandler) filter(match func(user *models.User) bool) []*models.User {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	users := make([]*models.User, 0)
+	for _, user := range h.users {
+		if match(user) {
+			userInfo := *user
+			users = append(users, &userInfo)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+func (h *MemoryHandler) CreateUser(ctx context.Context, userInfo *models.CreateUserRequest) error {
+	//bcrypt加密密码
+	hashedPassword, err := utils.HashPassword(userInfo.Password)
+	if err != nil {
+		return fmt.Errorf("Failed to hash password: %w", err)
+	}
+	return h.withTx(ctx, func(tx *MemoryHandler) error {
+		return tx.createUser(ctx, userInfo, hashedPassword)
+	})
+}
+
+func (h *MemoryHandler) createUser(ctx context.Context, userInfo *models.CreateUserRequest, hashedPassword string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.findByUsername(userInfo.Username) != nil { //模拟唯一索引
+		return ErrDuplicateUsername
+	}
+	h.nextID++
+	now := time.Now()
+	h.saveUser(h.nextID)
+	h.users[h.nextID] = &models.User{
+		ID:        h.nextID,
+		Username:  userInfo.Username,
+		Password:  hashedPassword,
+		Role:      userInfo.Role,
+		Email:     userInfo.Email,
+		FullName:  userInfo.FullName,
+		Status:    newUserStatus(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+	}
+	h.index.Put(h.nextID, userInfo.Username, userInfo.FullName, userInfo.Email)
+	return nil
+}
+
+func (h *MemoryHandler) UserLogin(ctx context.Context, userInfo *models.LoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
+	//查询用户与签发token在同一事务中，避免与删除、改角色交错
+	var pair *utils.TokenPair
+	var challenge *models.MFAChallenge
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		var err error
+		pair, challenge, err = tx.userLogin(ctx, userInfo)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return pair, challenge, nil
+}
+
+func (h *MemoryHandler) userLogin(ctx context.Context, userInfo *models.LoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
+	user, err := h.GetUserByUsername(ctx, userInfo.Username)
+	if errors.Is(err, ErrUserNotFound) { //与SQL实现一致，不区分用户不存在和密码错误
+		return nil, nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	//检查密码
+	if !utils.CheckPasswordHash(userInfo.Password, user.Password) {
+		return nil, nil, ErrInvalidCredentials
+	}
+	if err := loginAllowed(user.Status); err != nil {
+		return nil, nil, err
+	}
+	return h.issueLogin(ctx, userInfo, user.Role)
+}
+
+// issueLogin 是验证身份后的共同路径，与SQL实现一致；调用方不能持有锁
+func (h *MemoryHandler) issueLogin(ctx context.Context, userInfo *models.LoginRequest, role string) (*utils.TokenPair, *models.MFAChallenge, error) {
+	h.mu.Lock()
+	challenge, err := h.createMFAChallenge(userInfo)
+	h.mu.Unlock()
+	if err != nil || challenge != nil { //开启了两步验证，提交验证码后才签发token
+		return nil, challenge, err
+	}
+	Request := utils.CreateTokenRequset{
+		Role:      role,
+		Username:  userInfo.Username,
+		Device:    userInfo.Device,
+		UserAgent: userInfo.UserAgent,
+		IP:        userInfo.IP,
+		Remember:  userInfo.Remember,
+	}
+	pair, err := utils.IssueTokenPair(ctx, h.Tokens, &Request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create token: %w", err)
+	}
+	return pair, nil, nil
+}
+
+func (h *MemoryHandler) UpdateUser(ctx context.Context, userInfo *models.UpdateUserRequest) error {
+	var hashedPassword string
+	if userInfo.Password != nil {
+		//bcrypt加密新密码
+		var err error
+		hashedPassword, err = utils.HashPassword(*userInfo.Password)
+		if err != nil {
+			return fmt.Errorf("Failed to hash password: %w", err)
+		}
+	}
+	if userInfo.Password == nil && userInfo.Role == nil && userInfo.Email == nil && userInfo.FullName == nil && userInfo.Status == nil {
+		return invalidInput("No fields to update")
+	}
+	return h.withTx(ctx, func(tx *MemoryHandler) error {
+		if err := tx.updateUser(ctx, userInfo, hashedPassword); err != nil {
+			return err
+		}
+		return revokeOnChange(ctx, userInfo, tx.Tokens)
+	})
+}
+
+func (h *MemoryHandler) updateUser(ctx context.Context, userInfo *models.UpdateUserRequest, hashedPassword string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	user := h.findByUsername(userInfo.Username)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if userInfo.Version != nil && *userInfo.Version != user.Version {
+		return versionConflict(user.Version)
+	}
+	h.saveUser(user.ID)
+	if userInfo.Password != nil {
+		user.Password = hashedPassword
+	}
+	if userInfo.Role != nil {
+		user.Role = *userInfo.Role
+	}
+	if userInfo.Email != nil {
+		if user.Email != *userInfo.Email { //新邮箱需要重新验证
+			h.deleteEmailState(user.Username)
+		}
+		user.Email = *userInfo.Email
+	}
+	if userInfo.FullName != nil {
+		user.FullName = *userInfo.FullName
+	}
+	if userInfo.Status != nil {
+		user.Status = *userInfo.Status
+	}
+	user.UpdatedAt = time.Now()
+	user.Version++
+	h.index.Put(user.ID, user.Username, user.FullName, user.Email)
+	return nil
+}
+
+func (h *MemoryHandler) RemoveUser(ctx context.Context, ID int) error { //硬删除用户数据，慎用
+	return h.withTx(ctx, func(tx *MemoryHandler) error {
+		username, err := tx.removeUser(ID)
+		if err != nil {
+			return err
+		}
+		return revokeAll(ctx, username, tx.Tokens)
+	})
+}
+
+func (h *MemoryHandler) removeUser(ID int) (string, error) { //同时删除该用户的MFA、通行密钥、重置与登录链接、邮箱验证状态
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	user := h.users[uint(ID)]
+	if ID <= 0 || user == nil {
+		return "", ErrUserNotFound
+	}
+	h.deleteUser(user)
+	return user.Username, nil
+}
+
+// deleteUser 删除用户及以用户名或ID关联的状态，调用方持有写锁
+func (h *MemoryHandler) deleteUser(user *models.User) {
+	h.saveUser(user.ID)
+	delete(h.users, user.ID)
+	h.index.Delete(user.ID)
+	h.resetMFA(user.Username)
+	h.deleteCredentials(user.ID)
+	h.deletePasswordResets(user.Username)
+	h.deleteMagicLinks(user.Username)
+	h.deleteEmailState(user.Username)
+}
+
+func (h *MemoryHandler) GetUserCount(ctx context.Context, filter *models.UserFilter) (int, error) { //filter为nil时统计全部用户
+	if filter == nil {
+		filter = &models.UserFilter{}
+	}
+	users := h.filter(func(user *models.User) bool { return matchUser(user, filter) })
+	return len(users), nil
+}
+
+func (h *MemoryHandler) GetUserInfoByID(ctx context.Context, ID uint) (*models.User, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	user, ok := h.users[ID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	userInfo := *user
+	return &userInfo, nil
+}
+
+func (h *MemoryHandler) GetAllUsers(ctx context.Context) ([]*models.User, error) {
+	users := h.filter(func(user *models.User) bool { return true })
+	return users, nil
+}
+
+func (h *MemoryHandler) IterateUsers(ctx context.Context, afterID uint, batchSize int, fn func(user *models.User) error) error {
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := h.filter(func(user *models.User) bool { return user.ID > afterID })
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		for _, user := range batch { //回调时不持有锁，fn里可以再访问存储
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		afterID = batch[len(batch)-1].ID
+	}
+}
+
+func (h *MemoryHandler) GetUsersByStatus(ctx context.Context, status string) ([]*models.User, error) {
+	users := h.filter(func(user *models.User) bool { return user.Status == status })
+	return users, nil
+}
+
+func (h *MemoryHandler) GetUsersByRole(ctx context.Context, role string) ([]*models.User, error) {
+	users := h.filter(func(user *models.User) bool { return user.Role == role })
+	return users, nil
+}
+
+func (h *MemoryHandler) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	user := h.findByUsername(username)
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	userInfo := *user
+	return &userInfo, nil
+}
+
+func (h *MemoryHandler) GetUsersByFullname(ctx context.Context, fullname string) ([]*models.User, error) {
+	users := h.filter(func(user *models.User) bool { return user.FullName == fullname })
+	return users, nil
+}
+
+func (h *MemoryHandler) GetUsersByEmail(ctx context.Context, email string) ([]*models.User, error) {
+	users := h.filter(func(user *models.User) bool { return user.Email == email })
+	return users, nil
+}
+
+func (h *MemoryHandler) GetUsersByCreatedAt(ctx context.Context, createdAt time.Time) ([]*models.User, error) {
+	users := h.filter(func(user *models.User) bool { return user.CreatedAt.Equal(createdAt) })
+	return users, nil
+}
+
+func (h *MemoryHandler) GetUsersByUpdateAt(ctx context.Context, updateAt time.Time) ([]*models.User, error) {
+	users := h.filter(func(user *models.User) bool { return user.UpdatedAt.Equal(updateAt) })
+	return users, nil
+}
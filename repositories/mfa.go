@@ -0,0 +1,800 @@
+package repositories
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+	"user_system/models"
+	"user_system/totp"
+	"user_system/utils"
+)
+
+var (
+	MFAIssuer       = "user_system"    //验证器App中显示的发行方
+	MFAChallengeTTL = 5 * time.Minute  //密码正确后提交验证码的期限
+	MFAMaxFailures  = 10               //同一用户跨登录挑战累计的错误次数上限，达到后锁定
+	MFALockout      = 15 * time.Minute //达到上限后的锁定时长，期间正确的验证码也不接受
+)
+
+const (
+	recoveryCodeCount = 10
+	maxMFAAttempts    = 5 //同一个登录挑战最多提交几次错误的验证码，跨挑战的累计见MFAMaxFailures
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes 生成一组形如 abcde-fghij 的一次性恢复码，返回明文与摘要
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	digests := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(raw))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		digests[i] = utils.HashToken(code)
+	}
+	return codes, digests, nil
+}
+
+func normalizeCode(code string) string { //忽略用户输入中的空格和连字符
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totp.Digits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func newMFAChallenge(methods []string) (string, *models.MFAChallenge, error) { //返回摘要与给用户的挑战
+	token, err := utils.GernerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	return utils.HashToken(token), &models.MFAChallenge{Token: token, Methods: methods, ExpiredAt: time.Now().Add(MFAChallengeTTL)}, nil
+}
+
+func mfaMethods(totpEnabled, passkey bool) []string { //第二步可以使用的验证方式
+	methods := []string{}
+	if totpEnabled {
+		methods = append(methods, "totp")
+	}
+	if passkey {
+		methods = append(methods, "webauthn")
+	}
+	return methods
+}
+
+// createMFAChallenge 用户已开启TOTP或注册了WebAuthn凭证时创建登录挑战，都没有时返回nil
+func (h *DBHandler) createMFAChallenge(ctx context.Context, userInfo *models.LoginRequest) (*models.MFAChallenge, error) {
+	var count int
+	err := h.DB.QueryRow(ctx, `
+		SELECT COUNT(*) FROM user_mfa WHERE username = ? AND confirmed_at IS NOT NULL`, userInfo.Username,
+	).Scan(&count)
+	if err != nil {
+		return nil, storeError("Failed to query MFA", err)
+	}
+	passkey, err := h.hasWebAuthn(ctx, userInfo.Username)
+	if err != nil {
+		return nil, err
+	}
+	methods := mfaMethods(count > 0, passkey)
+	if len(methods) == 0 {
+		return nil, nil
+	}
+	digest, challenge, err := newMFAChallenge(methods)
+	if err != nil {
+		return nil, err
+	}
+	_, err = h.DB.Exec(ctx, `
+		INSERT INTO mfa_challenges (token, username, remember, device, expired_at) VALUES (?, ?, ?, ?, ?)`,
+		digest, userInfo.Username, userInfo.Remember, userInfo.Device, challenge.ExpiredAt,
+	)
+	if err != nil {
+		return nil, storeError("Failed to create MFA challenge", err)
+	}
+	return challenge, nil
+}
+
+// VerifyMFALogin 校验登录挑战与验证码，通过后签发token
+// 验证码错误时失败次数需要提交，因此事务内返回nil表示验证码错误
+func (h *DBHandler) VerifyMFALogin(ctx context.Context, req *models.MFALoginRequest) (*utils.TokenPair, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	var pair *utils.TokenPair
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var err error
+		pair, err = tx.verifyMFALogin(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, ErrInvalidMFACode
+	}
+	return pair, nil
+}
+
+func (h *DBHandler) verifyMFALogin(ctx context.Context, req *models.MFALoginRequest) (*utils.TokenPair, error) {
+	digest := utils.HashToken(req.Token)
+	var username, device string
+	var remember bool
+	var attempts int
+	var expiredAt time.Time
+	err := h.DB.QueryRow(ctx, `
+		SELECT username, remember, device, attempts, expired_at FROM mfa_challenges WHERE token = ?`+h.DB.ForUpdate(), digest,
+	).Scan(&username, &remember, &device, &attempts, &expiredAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, storeError("Failed to query MFA challenge", err)
+	}
+	if expiredAt.Before(time.Now()) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	//与登录一样锁住用户行，挑战创建后被禁用的用户不能完成登录
+	var status, role string
+	err = h.DB.QueryRow(ctx, `
+		SELECT status, role FROM users WHERE username = ?`+h.DB.ForUpdate(), username,
+	).Scan(&status, &role)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, storeError("Failed to query user", err)
+	}
+	if err := loginAllowed(status); err != nil {
+		return nil, err
+	}
+	ok, err := h.checkMFACode(ctx, username, req.Code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if attempts+1 >= maxMFAAttempts { //失败次数过多，需要重新输入密码
+			_, err = h.DB.Exec(ctx, `DELETE FROM mfa_challenges WHERE token = ?`, digest)
+		} else {
+			_, err = h.DB.Exec(ctx, `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token = ?`, digest)
+		}
+		if err != nil {
+			return nil, storeError("Failed to update MFA challenge", err)
+		}
+		return nil, nil
+	}
+	if _, err := h.DB.Exec(ctx, `DELETE FROM mfa_challenges WHERE token = ?`, digest); err != nil {
+		return nil, storeError("Failed to delete MFA challenge", err)
+	}
+	Request := utils.CreateTokenRequset{
+		Role:      role,
+		Username:  username,
+		Device:    device,
+		UserAgent: req.UserAgent,
+		IP:        req.IP,
+		Remember:  remember,
+	}
+	pair, err := utils.IssueTokenPair(ctx, h.Tokens, &Request)
+	if err != nil {
+		return nil, storeError("Failed to create token", err)
+	}
+	return pair, nil
+}
+
+// checkMFACode 校验TOTP验证码或恢复码，用过的验证码与恢复码不能再次使用；需在事务中调用
+// 错误次数按用户累计，验证码错误时调用方需要提交事务，锁定期间返回ErrMFALocked
+func (h *DBHandler) checkMFACode(ctx context.Context, username, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	var failures int
+	var lockedUntil *time.Time
+	err := h.DB.QueryRow(ctx, `
+		SELECT secret, last_used_step, failed_attempts, locked_until FROM user_mfa WHERE username = ? AND confirmed_at IS NOT NULL`+h.DB.ForUpdate(), username,
+	).Scan(&secret, &lastStep, &failures, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return false, ErrMFANotEnabled
+	}
+	if err != nil {
+		return false, storeError("Failed to query MFA", err)
+	}
+	if lockedUntil != nil && lockedUntil.After(time.Now()) {
+		return false, ErrMFALocked
+	}
+	var ok bool
+	code = normalizeCode(code)
+	if isTOTPCode(code) {
+		ok, err = h.useTOTP(ctx, username, secret, lastStep, code)
+	} else {
+		ok, err = h.useRecoveryCode(ctx, username, code)
+	}
+	if err != nil {
+		return false, err
+	}
+	if ok && failures == 0 && lockedUntil == nil {
+		return true, nil
+	}
+	failures, lockedUntil = mfaFailure(ok, failures)
+	_, err = h.DB.Exec(ctx, `UPDATE user_mfa SET failed_attempts = ?, locked_until = ? WHERE username = ?`, failures, lockedUntil, username)
+	if err != nil {
+		return false, storeError("Failed to update MFA", err)
+	}
+	return ok, nil
+}
+
+// mfaFailure 返回一次校验后的错误次数与锁定截止时间：成功时清零，达到上限后每次错误都重新锁定
+func mfaFailure(ok bool, failures int) (int, *time.Time) {
+	if ok {
+		return 0, nil
+	}
+	failures++
+	if failures < MFAMaxFailures {
+		return failures, nil
+	}
+	lockedUntil := time.Now().Add(MFALockout)
+	return failures, &lockedUntil
+}
+
+func (h *DBHandler) useRecoveryCode(ctx context.Context, username, code string) (bool, error) {
+	result, err := h.DB.Exec(ctx, `
+		UPDATE mfa_recovery_codes SET used_at = ? WHERE username = ? AND code = ? AND used_at IS NULL`,
+		time.Now(), username, utils.HashToken(code),
+	)
+	if err != nil {
+		return false, storeError("Failed to use recovery code", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, storeError("Failed to get affected rows", err)
+	}
+	return rows == 1, nil
+}
+
+func (h *DBHandler) useTOTP(ctx context.Context, username, secret string, lastStep int64, code string) (bool, error) {
+	step, ok := totp.Validate(secret, code, time.Now(), lastStep)
+	if !ok {
+		return false, nil
+	}
+	if _, err := h.DB.Exec(ctx, `UPDATE user_mfa SET last_used_step = ? WHERE username = ?`, step, username); err != nil {
+		return false, storeError("Failed to update MFA", err)
+	}
+	return true, nil
+}
+
+func (h *DBHandler) replaceRecoveryCodes(ctx context.Context, username string) ([]string, error) {
+	codes, digests, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.DB.Exec(ctx, `DELETE FROM mfa_recovery_codes WHERE username = ?`, username); err != nil {
+		return nil, storeError("Failed to delete recovery codes", err)
+	}
+	for _, digest := range digests {
+		_, err := h.DB.Exec(ctx, `INSERT INTO mfa_recovery_codes (username, code) VALUES (?, ?)`, username, digest)
+		if err != nil {
+			return nil, storeError("Failed to save recovery codes", err)
+		}
+	}
+	return codes, nil
+}
+
+// EnrollTOTP 生成新的TOTP密钥，确认之前不生效；重复调用会替换未确认的密钥
+func (h *DBHandler) EnrollTOTP(ctx context.Context, username string) (*models.MFAEnrollment, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = h.withTx(ctx, func(tx *DBHandler) error {
+		var confirmedAt *time.Time
+		err := tx.DB.QueryRow(ctx, `
+			SELECT confirmed_at FROM user_mfa WHERE username = ?`+tx.DB.ForUpdate(), username,
+		).Scan(&confirmedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return storeError("Failed to query MFA", err)
+		}
+		if confirmedAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		if _, err := tx.DB.Exec(ctx, `DELETE FROM user_mfa WHERE username = ?`, username); err != nil {
+			return storeError("Failed to delete MFA", err)
+		}
+		if _, err := tx.DB.Exec(ctx, `INSERT INTO user_mfa (username, secret) VALUES (?, ?)`, username, secret); err != nil {
+			return storeError("Failed to save MFA", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &models.MFAEnrollment{Secret: secret, URI: totp.URI(MFAIssuer, username, secret)}, nil
+}
+
+// ConfirmTOTP 用验证器App生成的验证码确认密钥，开启两步验证并返回恢复码
+func (h *DBHandler) ConfirmTOTP(ctx context.Context, username, code string) ([]string, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	var codes []string
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var secret string
+		var lastStep int64
+		var confirmedAt *time.Time
+		err := tx.DB.QueryRow(ctx, `
+			SELECT secret, last_used_step, confirmed_at FROM user_mfa WHERE username = ?`+tx.DB.ForUpdate(), username,
+		).Scan(&secret, &lastStep, &confirmedAt)
+		if err == sql.ErrNoRows {
+			return ErrMFANotEnrolled
+		}
+		if err != nil {
+			return storeError("Failed to query MFA", err)
+		}
+		if confirmedAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		ok, err := tx.useTOTP(ctx, username, secret, lastStep, normalizeCode(code))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		if _, err := tx.DB.Exec(ctx, `UPDATE user_mfa SET confirmed_at = ? WHERE username = ?`, time.Now(), username); err != nil {
+			return storeError("Failed to update MFA", err)
+		}
+		codes, err = tx.replaceRecoveryCodes(ctx, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes 校验验证码后生成新的恢复码，旧的全部作废
+func (h *DBHandler) RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	var codes []string
+	var ok bool
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var err error
+		ok, err = tx.checkMFACode(ctx, username, code)
+		if err != nil || !ok { //验证码错误时也提交，错误次数需要累计
+			return err
+		}
+		codes, err = tx.replaceRecoveryCodes(ctx, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	return codes, nil
+}
+
+// DisableMFA 用户校验验证码后自行关闭两步验证
+func (h *DBHandler) DisableMFA(ctx context.Context, username, code string) error {
+	if h.DB == nil {
+		return errNotInitialized
+	}
+	var ok bool
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var err error
+		ok, err = tx.checkMFACode(ctx, username, code)
+		if err != nil || !ok {
+			return err
+		}
+		return tx.resetMFA(ctx, username)
+	})
+	if err == nil && !ok {
+		return ErrInvalidMFACode
+	}
+	return err
+}
+
+// ResetMFA 删除用户的密钥、恢复码、WebAuthn凭证与未完成的登录挑战，供管理员在用户丢失设备时使用
+func (h *DBHandler) ResetMFA(ctx context.Context, username string) error {
+	if h.DB == nil {
+		return errNotInitialized
+	}
+	return h.withTx(ctx, func(tx *DBHandler) error {
+		_, err := tx.DB.Exec(ctx, `
+			DELETE FROM webauthn_credentials WHERE user_id IN (SELECT id FROM users WHERE username = ?)`, username,
+		)
+		if err != nil {
+			return storeError("Failed to delete WebAuthn credentials", err)
+		}
+		return tx.resetMFA(ctx, username)
+	})
+}
+
+func (h *DBHandler) resetMFA(ctx context.Context, username string) error {
+	for _, table := range []string{"user_mfa", "mfa_recovery_codes", "mfa_challenges"} {
+		if _, err := h.DB.Exec(ctx, `DELETE FROM `+table+` WHERE username = ?`, username); err != nil {
+			return storeError("Failed to reset MFA", err)
+		}
+	}
+	return nil
+}
+
+func (h *DBHandler) GetMFAStatus(ctx context.Context, username string) (*models.MFAStatus, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	db := h.DB.ReadConsistent()
+	status := &models.MFAStatus{}
+	err := db.QueryRow(ctx, `SELECT confirmed_at FROM user_mfa WHERE username = ?`, username).Scan(&status.ConfirmedAt)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	if err != nil {
+		return nil, storeError("Failed to query MFA", err)
+	}
+	status.Enabled, status.Pending = status.ConfirmedAt != nil, status.ConfirmedAt == nil
+	err = db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM mfa_recovery_codes WHERE username = ? AND used_at IS NULL`, username,
+	).Scan(&status.RecoveryCodesLeft)
+	if err != nil {
+		return nil, storeError("Failed to query recovery codes", err)
+	}
+	return status, nil
+}
+
+// DeleteExpiredMFAChallenges 清理过期的登录挑战与WebAuthn挑战，返回删除的数量
+func (h *DBHandler) DeleteExpiredMFAChallenges(ctx context.Context) (int, error) {
+	if h.DB == nil {
+		return 0, errNotInitialized
+	}
+	deleted := 0
+	for _, table := range []string{"mfa_challenges", "webauthn_challenges"} {
+		result, err := h.DB.Exec(ctx, `DELETE FROM `+table+` WHERE expired_at < ?`, time.Now())
+		if err != nil {
+			return 0, storeError("Failed to delete MFA challenges", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return 0, storeError("Failed to get affected rows", err)
+		}
+		deleted += int(rows)
+	}
+	return deleted, nil
+}
+
+type mfaSecret struct {
+	Secret        string
+	LastStep      int64
+	ConfirmedAt   *time.Time
+	RecoveryCodes map[string]*time.Time //恢复码摘要 -> 使用时间
+	Failures      int
+	LockedUntil   *time.Time
+}
+
+type mfaChallenge struct {
+	Username  string
+	Remember  bool
+	Device    string
+	Attempts  int
+	ExpiredAt time.Time
+}
+
+func (s *mfaSecret) copy() *mfaSecret {
+	copied := *s
+	copied.RecoveryCodes = make(map[string]*time.Time, len(s.RecoveryCodes))
+	for digest, usedAt := range s.RecoveryCodes {
+		copied.RecoveryCodes[digest] = usedAt
+	}
+	return &copied
+}
+
+// createMFAChallenge 调用方持有写锁
+func (h *MemoryHandler) createMFAChallenge(userInfo *models.LoginRequest) (*models.MFAChallenge, error) {
+	s := h.mfa[userInfo.Username]
+	passkey := false
+	if user := h.findByUsername(userInfo.Username); user != nil && WebAuthn != nil {
+		passkey = len(h.credentialsOf(user.ID)) > 0
+	}
+	methods := mfaMethods(s != nil && s.ConfirmedAt != nil, passkey)
+	if len(methods) == 0 {
+		return nil, nil
+	}
+	digest, challenge, err := newMFAChallenge(methods)
+	if err != nil {
+		return nil, err
+	}
+	h.saveMFAChallenge(digest)
+	h.challenges[digest] = &mfaChallenge{
+		Username:  userInfo.Username,
+		Remember:  userInfo.Remember,
+		Device:    userInfo.Device,
+		ExpiredAt: challenge.ExpiredAt,
+	}
+	return challenge, nil
+}
+
+func (h *MemoryHandler) VerifyMFALogin(ctx context.Context, req *models.MFALoginRequest) (*utils.TokenPair, error) {
+	var pair *utils.TokenPair
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		var err error
+		pair, err = tx.verifyMFALogin(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, ErrInvalidMFACode
+	}
+	return pair, nil
+}
+
+func (h *MemoryHandler) verifyMFALogin(ctx context.Context, req *models.MFALoginRequest) (*utils.TokenPair, error) {
+	Request, err := h.useMFAChallenge(req)
+	if err != nil || Request == nil {
+		return nil, err
+	}
+	pair, err := utils.IssueTokenPair(ctx, h.Tokens, Request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create token: %w", err)
+	}
+	return pair, nil
+}
+
+// useMFAChallenge 校验挑战与验证码，通过时删除挑战并返回签发token的请求，验证码错误时返回nil
+func (h *MemoryHandler) useMFAChallenge(req *models.MFALoginRequest) (*utils.CreateTokenRequset, error) {
+	digest := utils.HashToken(req.Token)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	challenge := h.challenges[digest]
+	if challenge == nil || challenge.ExpiredAt.Before(time.Now()) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	user := h.findByUsername(challenge.Username)
+	if user == nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err := loginAllowed(user.Status); err != nil {
+		return nil, err
+	}
+	ok, err := h.checkMFACode(challenge.Username, req.Code)
+	if err != nil {
+		return nil, err
+	}
+	h.saveMFAChallenge(digest)
+	if !ok {
+		challenge.Attempts++
+		if challenge.Attempts >= maxMFAAttempts {
+			delete(h.challenges, digest)
+		}
+		return nil, nil
+	}
+	delete(h.challenges, digest)
+	return &utils.CreateTokenRequset{
+		Role:      user.Role,
+		Username:  user.Username,
+		Device:    challenge.Device,
+		UserAgent: req.UserAgent,
+		IP:        req.IP,
+		Remember:  challenge.Remember,
+	}, nil
+}
+
+// checkMFACode 调用方持有写锁
+func (h *MemoryHandler) checkMFACode(username, code string) (bool, error) {
+	s := h.mfa[username]
+	if s == nil || s.ConfirmedAt == nil {
+		return false, ErrMFANotEnabled
+	}
+	if s.LockedUntil != nil && s.LockedUntil.After(time.Now()) {
+		return false, ErrMFALocked
+	}
+	h.saveMFA(username)
+	ok := s.useCode(normalizeCode(code))
+	s.Failures, s.LockedUntil = mfaFailure(ok, s.Failures)
+	return ok, nil
+}
+
+func (s *mfaSecret) useCode(code string) bool {
+	if isTOTPCode(code) {
+		step, ok := totp.Validate(s.Secret, code, time.Now(), s.LastStep)
+		if ok {
+			s.LastStep = step
+		}
+		return ok
+	}
+	digest := utils.HashToken(code)
+	if usedAt, exist := s.RecoveryCodes[digest]; !exist || usedAt != nil {
+		return false
+	}
+	now := time.Now()
+	s.RecoveryCodes[digest] = &now
+	return true
+}
+
+func (s *mfaSecret) replaceRecoveryCodes() ([]string, error) {
+	codes, digests, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	s.RecoveryCodes = make(map[string]*time.Time, len(digests))
+	for _, digest := range digests {
+		s.RecoveryCodes[digest] = nil
+	}
+	return codes, nil
+}
+
+func (h *MemoryHandler) EnrollTOTP(ctx context.Context, username string) (*models.MFAEnrollment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		if s := tx.mfa[username]; s != nil && s.ConfirmedAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		tx.saveMFA(username)
+		tx.mfa[username] = &mfaSecret{Secret: secret}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &models.MFAEnrollment{Secret: secret, URI: totp.URI(MFAIssuer, username, secret)}, nil
+}
+
+func (h *MemoryHandler) ConfirmTOTP(ctx context.Context, username, code string) ([]string, error) {
+	var codes []string
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		s := tx.mfa[username]
+		if s == nil {
+			return ErrMFANotEnrolled
+		}
+		if s.ConfirmedAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		step, ok := totp.Validate(s.Secret, normalizeCode(code), time.Now(), s.LastStep)
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		tx.saveMFA(username)
+		now := time.Now()
+		s.LastStep, s.ConfirmedAt = step, &now
+		var err error
+		codes, err = s.replaceRecoveryCodes()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (h *MemoryHandler) RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error) {
+	var codes []string
+	var ok bool
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		var err error
+		ok, err = tx.checkMFACode(username, code)
+		if err != nil || !ok {
+			return err
+		}
+		codes, err = tx.mfa[username].replaceRecoveryCodes() //checkMFACode已记录原值
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	return codes, nil
+}
+
+func (h *MemoryHandler) DisableMFA(ctx context.Context, username, code string) error {
+	var ok bool
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		var err error
+		ok, err = tx.checkMFACode(username, code)
+		if err != nil || !ok {
+			return err
+		}
+		tx.resetMFA(username)
+		return nil
+	})
+	if err == nil && !ok {
+		return ErrInvalidMFACode
+	}
+	return err
+}
+
+func (h *MemoryHandler) ResetMFA(ctx context.Context, username string) error {
+	return h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		if user := tx.findByUsername(username); user != nil {
+			tx.deleteCredentials(user.ID)
+		}
+		tx.resetMFA(username)
+		return nil
+	})
+}
+
+func (h *MemoryHandler) resetMFA(username string) { //调用方持有写锁
+	h.saveMFA(username)
+	delete(h.mfa, username)
+	h.deleteMFAChallenges(username)
+}
+
+func (h *MemoryHandler) deleteMFAChallenges(username string) { //调用方持有写锁
+	for digest, challenge := range h.challenges {
+		if challenge.Username == username {
+			h.saveMFAChallenge(digest)
+			delete(h.challenges, digest)
+		}
+	}
+}
+
+func (h *MemoryHandler) GetMFAStatus(ctx context.Context, username string) (*models.MFAStatus, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := &models.MFAStatus{}
+	s := h.mfa[username]
+	if s == nil {
+		return status, nil
+	}
+	status.ConfirmedAt = s.ConfirmedAt
+	status.Enabled, status.Pending = s.ConfirmedAt != nil, s.ConfirmedAt == nil
+	for _, usedAt := range s.RecoveryCodes {
+		if usedAt == nil {
+			status.RecoveryCodesLeft++
+		}
+	}
+	return status, nil
+}
+
+func (h *MemoryHandler) DeleteExpiredMFAChallenges(ctx context.Context) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	deleted := 0
+	now := time.Now()
+	for digest, challenge := range h.challenges {
+		if challenge.ExpiredAt.Before(now) {
+			h.saveMFAChallenge(digest)
+			delete(h.challenges, digest)
+			deleted++
+		}
+	}
+	for challenge, c := range h.webauthnChallenges {
+		if c.ExpiredAt.Before(now) {
+			delete(h.webauthnChallenges, challenge)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,188 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"user_system/models"
+	"user_system/totp"
+)
+
+// enableTOTP 为用户开启两步验证，返回密钥与恢复码
+func enableTOTP(t *testing.T, store UserStore, username string) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+	enrollment, err := store.EnrollTOTP(ctx, username)
+	if err != nil {
+		t.Fatalf("EnrollTOTP: %v", err)
+	}
+	code, _ := totp.Code(enrollment.Secret, time.Now())
+	codes, err := store.ConfirmTOTP(ctx, username, code)
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	return enrollment.Secret, codes
+}
+
+const wrongRecoveryCode = "aaaaa-aaaaa"
+
+// 错误次数跨登录挑战累计，只有验证成功才清零
+func TestMFALockout(t *testing.T) {
+	set(t, &MFAMaxFailures, 3)
+	set(t, &MFALockout, time.Hour)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			_, codes := enableTOTP(t, store, "alice")
+
+			var challenge *models.MFAChallenge
+			steps := []struct {
+				name    string
+				login   bool //重新输入密码取得新的挑战
+				code    string
+				wantErr error
+			}{
+				{"first failure", true, wrongRecoveryCode, ErrInvalidMFACode},
+				{"second failure", false, wrongRecoveryCode, ErrInvalidMFACode},
+				{"success resets the counter", true, codes[0], nil},
+				{"failure after reset", true, wrongRecoveryCode, ErrInvalidMFACode},
+				{"second failure after reset", false, wrongRecoveryCode, ErrInvalidMFACode},
+				{"failure on a new challenge locks", true, wrongRecoveryCode, ErrInvalidMFACode},
+				{"valid code while locked", false, codes[1], ErrMFALocked},
+				{"valid code on a new challenge while locked", true, codes[1], ErrMFALocked},
+			}
+			for _, step := range steps {
+				if step.login {
+					_, challenge = login(t, store, "alice")
+				}
+				_, err := store.VerifyMFALogin(ctx, &models.MFALoginRequest{Token: challenge.Token, Code: step.code})
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("%s: err = %v, want %v", step.name, err, step.wantErr)
+				}
+			}
+			if err := store.DisableMFA(ctx, "alice", codes[1]); !errors.Is(err, ErrMFALocked) {
+				t.Errorf("DisableMFA while locked: err = %v, want %v", err, ErrMFALocked)
+			}
+			//锁定期间提交的恢复码没有被消耗
+			status, err := store.GetMFAStatus(ctx, "alice")
+			if err != nil || status.RecoveryCodesLeft != len(codes)-1 {
+				t.Errorf("GetMFAStatus = %+v, %v, want %d recovery codes left", status, err, len(codes)-1)
+			}
+		})
+	}
+}
+
+// 锁定结束后错误次数不清零，再次输错立即重新锁定；关闭两步验证时的校验同样计数
+func TestMFALockoutExpiry(t *testing.T) {
+	set(t, &MFAMaxFailures, 3)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			_, codes := enableTOTP(t, store, "alice")
+
+			set(t, &MFALockout, -time.Minute) //锁定立即结束
+			for i := 0; i < 3; i++ {
+				if err := store.DisableMFA(ctx, "alice", wrongRecoveryCode); !errors.Is(err, ErrInvalidMFACode) {
+					t.Fatalf("DisableMFA #%d: err = %v, want %v", i+1, err, ErrInvalidMFACode)
+				}
+			}
+			set(t, &MFALockout, time.Hour)
+			_, challenge := login(t, store, "alice")
+			_, err := store.VerifyMFALogin(ctx, &models.MFALoginRequest{Token: challenge.Token, Code: wrongRecoveryCode})
+			if !errors.Is(err, ErrInvalidMFACode) {
+				t.Fatalf("failure after lockout: err = %v, want %v", err, ErrInvalidMFACode)
+			}
+			if _, err := store.RegenerateRecoveryCodes(ctx, "alice", codes[0]); !errors.Is(err, ErrMFALocked) {
+				t.Errorf("RegenerateRecoveryCodes: err = %v, want %v", err, ErrMFALocked)
+			}
+		})
+	}
+}
+
+// 登录时TOTP验证码只能使用一次，也不能使用比已用过的更早的验证码
+func TestMFALoginTOTPReplay(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			secret, _ := enableTOTP(t, store, "alice")
+			confirmed := time.Now() //确认时已用过当前时间步
+			code := func(offset time.Duration) string {
+				c, _ := totp.Code(secret, confirmed.Add(offset))
+				return c
+			}
+
+			tests := []struct {
+				name    string
+				code    string
+				wantErr error
+			}{
+				{"next step", code(totp.Period), nil},
+				{"same code again", code(totp.Period), ErrInvalidMFACode},
+				{"older code", code(0), ErrInvalidMFACode},
+				{"too far ahead", code(3 * totp.Period), ErrInvalidMFACode},
+			}
+			for _, tt := range tests {
+				_, challenge := login(t, store, "alice")
+				pair, err := store.VerifyMFALogin(ctx, &models.MFALoginRequest{Token: challenge.Token, Code: tt.code})
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+				}
+				if err == nil && pair == nil {
+					t.Fatalf("%s: no token pair issued", tt.name)
+				}
+			}
+		})
+	}
+}
+
+// 恢复码只能使用一次，重新生成后旧的全部作废
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			_, codes := enableTOTP(t, store, "alice")
+			verify := func(code string) error {
+				_, challenge := login(t, store, "alice")
+				_, err := store.VerifyMFALogin(ctx, &models.MFALoginRequest{Token: challenge.Token, Code: code})
+				return err
+			}
+
+			tests := []struct {
+				name    string
+				code    string
+				wantErr error
+			}{
+				{"formatted input", " " + strings.ToUpper(codes[0]) + " ", nil},
+				{"used code", codes[0], ErrInvalidMFACode},
+				{"without hyphen", strings.ReplaceAll(codes[1], "-", ""), nil},
+				{"unknown code", wrongRecoveryCode, ErrInvalidMFACode},
+			}
+			for _, tt := range tests {
+				if err := verify(tt.code); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+				}
+			}
+			status, err := store.GetMFAStatus(ctx, "alice")
+			if err != nil || status.RecoveryCodesLeft != len(codes)-2 {
+				t.Errorf("GetMFAStatus = %+v, %v, want %d recovery codes left", status, err, len(codes)-2)
+			}
+
+			fresh, err := store.RegenerateRecoveryCodes(ctx, "alice", codes[2])
+			if err != nil {
+				t.Fatalf("RegenerateRecoveryCodes: %v", err)
+			}
+			if err := verify(codes[3]); !errors.Is(err, ErrInvalidMFACode) {
+				t.Errorf("old code after regeneration: err = %v, want %v", err, ErrInvalidMFACode)
+			}
+			if err := verify(fresh[0]); err != nil {
+				t.Errorf("new code: %v", err)
+			}
+		})
+	}
+}
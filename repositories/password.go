@@ -0,0 +1,279 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"user_system/models"
+	"user_system/utils"
+)
+
+var (
+	PasswordResetTTL      = 30 * time.Minute //重置链接的有效期
+	PasswordResetInterval = time.Minute      //同一用户两次发送重置邮件的最短间隔
+)
+
+const maxPasswordResets = 5 //同一个邮箱最多为几个账户发送重置链接
+
+type passwordReset struct {
+	Username  string
+	CreatedAt time.Time
+	ExpiredAt time.Time
+}
+
+func newPasswordReset(user *models.User, now time.Time) (string, *models.PasswordReset, error) { //返回摘要与发给用户的链接
+	token, err := utils.GernerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	return utils.HashToken(token), &models.PasswordReset{
+		Username:  user.Username,
+		Email:     user.Email,
+		Token:     token,
+		ExpiredAt: now.Add(PasswordResetTTL),
+	}, nil
+}
+
+// CreatePasswordResets 为使用该邮箱的每个有效账户生成重置链接，旧的链接随之失效
+// 邮箱不存在或刚发送过时返回空列表，调用方不应向用户透露区别
+func (h *DBHandler) CreatePasswordResets(ctx context.Context, email string) ([]*models.PasswordReset, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	resets := make([]*models.PasswordReset, 0)
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		rows, err := tx.DB.Query(ctx, `
+			SELECT username, email FROM users WHERE LOWER(email) = ? AND status IN ('active', 'pending_verification') ORDER BY id LIMIT ?`,
+			strings.ToLower(email), maxPasswordResets,
+		)
+		if err != nil {
+			return storeError("Failed to query users", err)
+		}
+		var accounts []*models.User
+		for rows.Next() {
+			var user models.User
+			if err := rows.Scan(&user.Username, &user.Email); err != nil {
+				rows.Close()
+				return storeError("Failed to scan user", err)
+			}
+			accounts = append(accounts, &user)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return storeError("Failed to iterate users", err)
+		}
+		now := time.Now()
+		for _, user := range accounts {
+			var recent int
+			err := tx.DB.QueryRow(ctx, `
+				SELECT COUNT(*) FROM password_resets WHERE username = ? AND created_at > ?`, user.Username, now.Add(-PasswordResetInterval),
+			).Scan(&recent)
+			if err != nil {
+				return storeError("Failed to query password resets", err)
+			}
+			if recent > 0 {
+				continue
+			}
+			digest, reset, err := newPasswordReset(user, now)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.DB.Exec(ctx, `DELETE FROM password_resets WHERE username = ?`, user.Username); err != nil {
+				return storeError("Failed to delete password resets", err)
+			}
+			_, err = tx.DB.Exec(ctx, `
+				INSERT INTO password_resets (token, username, created_at, expired_at) VALUES (?, ?, ?, ?)`,
+				digest, user.Username, now, reset.ExpiredAt,
+			)
+			if err != nil {
+				return storeError("Failed to create password reset", err)
+			}
+			resets = append(resets, reset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resets, nil
+}
+
+// ResetPassword 用重置链接中的令牌设置新密码，令牌只能使用一次
+// 成功后吊销该用户的所有会话、个人访问令牌、登录链接与未完成的两步验证登录，返回用户名
+func (h *DBHandler) ResetPassword(ctx context.Context, token, password string) (string, error) {
+	if h.DB == nil {
+		return "", errNotInitialized
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return "", fmt.Errorf("Failed to hash password: %w", err)
+	}
+	digest := utils.HashToken(token)
+	var username string
+	err = h.withTx(ctx, func(tx *DBHandler) error {
+		var expiredAt time.Time
+		err := tx.DB.QueryRow(ctx, `
+			SELECT username, expired_at FROM password_resets WHERE token = ?`+tx.DB.ForUpdate(), digest,
+		).Scan(&username, &expiredAt)
+		if err == sql.ErrNoRows || (err == nil && expiredAt.Before(time.Now())) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return storeError("Failed to query password reset", err)
+		}
+		var status string
+		err = tx.DB.QueryRow(ctx, `SELECT status FROM users WHERE username = ?`+tx.DB.ForUpdate(), username).Scan(&status)
+		if err == sql.ErrNoRows {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return storeError("Failed to query user", err)
+		}
+		if status != "active" && status != statusPendingVerification {
+			return ErrAccountDisabled
+		}
+		if _, err := tx.DB.Exec(ctx, `UPDATE users SET password = ?, version = version + 1 WHERE username = ?`, hashedPassword, username); err != nil {
+			return storeError("Failed to update user", err)
+		}
+		for _, table := range []string{"password_resets", "magic_links", "mfa_challenges"} {
+			if _, err := tx.DB.Exec(ctx, `DELETE FROM `+table+` WHERE username = ?`, username); err != nil {
+				return storeError("Failed to reset password", err)
+			}
+		}
+		return revokeAll(ctx, username, tx.Tokens)
+	})
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// revokeAll 吊销用户的所有会话与个人访问令牌
+func revokeAll(ctx context.Context, username string, tokens utils.TokenStore) error {
+	if err := tokens.DeleteTokenByUsername(ctx, username); err != nil {
+		return storeError("Failed to revoke tokens", err)
+	}
+	if err := tokens.DeleteAccessTokensByUsername(ctx, username); err != nil {
+		return storeError("Failed to revoke access tokens", err)
+	}
+	return nil
+}
+
+// DeleteExpiredPasswordResets 清理过期的重置链接，返回删除的数量
+func (h *DBHandler) DeleteExpiredPasswordResets(ctx context.Context) (int, error) {
+	if h.DB == nil {
+		return 0, errNotInitialized
+	}
+	result, err := h.DB.Exec(ctx, `DELETE FROM password_resets WHERE expired_at < ?`, time.Now())
+	if err != nil {
+		return 0, storeError("Failed to delete password resets", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, storeError("Failed to get affected rows", err)
+	}
+	return int(rows), nil
+}
+
+func (h *MemoryHandler) CreatePasswordResets(ctx context.Context, email string) ([]*models.PasswordReset, error) {
+	accounts := h.filter(func(user *models.User) bool {
+		return strings.EqualFold(user.Email, email) && (user.Status == "active" || user.Status == statusPendingVerification)
+	})
+	if len(accounts) > maxPasswordResets {
+		accounts = accounts[:maxPasswordResets]
+	}
+	resets := make([]*models.PasswordReset, 0)
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		now := time.Now()
+		for _, user := range accounts {
+			recent := false
+			for _, r := range tx.resets {
+				recent = recent || (r.Username == user.Username && r.CreatedAt.After(now.Add(-PasswordResetInterval)))
+			}
+			if recent {
+				continue
+			}
+			digest, reset, err := newPasswordReset(user, now)
+			if err != nil {
+				return err
+			}
+			tx.deletePasswordResets(user.Username)
+			tx.saveReset(digest)
+			tx.resets[digest] = &passwordReset{Username: user.Username, CreatedAt: now, ExpiredAt: reset.ExpiredAt}
+			resets = append(resets, reset)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resets, nil
+}
+
+func (h *MemoryHandler) deletePasswordResets(username string) { //调用方持有写锁
+	for digest, r := range h.resets {
+		if r.Username == username {
+			h.saveReset(digest)
+			delete(h.resets, digest)
+		}
+	}
+}
+
+func (h *MemoryHandler) ResetPassword(ctx context.Context, token, password string) (string, error) {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return "", fmt.Errorf("Failed to hash password: %w", err)
+	}
+	digest := utils.HashToken(token)
+	var username string
+	err = h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		r := tx.resets[digest]
+		if r == nil || r.ExpiredAt.Before(time.Now()) {
+			tx.mu.Unlock()
+			return ErrInvalidResetToken
+		}
+		user := tx.findByUsername(r.Username)
+		if user == nil {
+			tx.mu.Unlock()
+			return ErrInvalidResetToken
+		}
+		if user.Status != "active" && user.Status != statusPendingVerification {
+			tx.mu.Unlock()
+			return ErrAccountDisabled
+		}
+		username = user.Username
+		tx.saveUser(user.ID)
+		user.Password = hashedPassword
+		user.UpdatedAt = time.Now()
+		user.Version++
+		tx.deletePasswordResets(username)
+		tx.deleteMagicLinks(username)
+		tx.deleteMFAChallenges(username)
+		tx.mu.Unlock()
+		return revokeAll(ctx, username, tx.Tokens)
+	})
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func (h *MemoryHandler) DeleteExpiredPasswordResets(ctx context.Context) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	deleted := 0
+	now := time.Now()
+	for digest, r := range h.resets {
+		if r.ExpiredAt.Before(now) {
+			h.saveReset(digest)
+			delete(h.resets, digest)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
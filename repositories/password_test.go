@@ -0,0 +1,89 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"user_system/models"
+	"user_system/utils"
+)
+
+const newPassword = "secret2"
+
+// 重置链接只能使用一次，成功后吊销所有会话与个人访问令牌
+func TestResetPassword(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			tokens := tokensOf(t, store)
+			createUser(t, store, "alice", "alice@example.com")
+			pair, _ := login(t, store, "alice")
+			pat, _, err := tokens.CreateAccessToken(ctx, &utils.CreateAccessTokenRequest{Name: "ci", Scopes: []string{"users:read"}, Username: "alice", Role: "user"})
+			if err != nil {
+				t.Fatalf("CreateAccessToken: %v", err)
+			}
+
+			resets, err := store.CreatePasswordResets(ctx, "ALICE@example.com")
+			if err != nil || len(resets) != 1 || resets[0].Username != "alice" {
+				t.Fatalf("CreatePasswordResets = %v, %v", resets, err)
+			}
+			//发送间隔内不再生成新的链接
+			if again, err := store.CreatePasswordResets(ctx, "alice@example.com"); err != nil || len(again) != 0 {
+				t.Fatalf("CreatePasswordResets again = %v, %v, want none", again, err)
+			}
+
+			tests := []struct {
+				name    string
+				token   string
+				wantErr error
+			}{
+				{"unknown token", "unknown", ErrInvalidResetToken},
+				{"valid token", resets[0].Token, nil},
+				{"used token", resets[0].Token, ErrInvalidResetToken},
+			}
+			for _, tt := range tests {
+				username, err := store.ResetPassword(ctx, tt.token, newPassword)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+				}
+				if err == nil && username != "alice" {
+					t.Errorf("%s: username = %q, want alice", tt.name, username)
+				}
+			}
+
+			if _, err := tokens.GetInfobyToken(ctx, pair.AccessToken); err == nil {
+				t.Error("session still valid after password reset")
+			}
+			if _, err := tokens.RotateRefreshToken(ctx, pair.RefreshToken, ""); err == nil {
+				t.Error("refresh token still valid after password reset")
+			}
+			if _, err := tokens.GetInfoByAccessToken(ctx, pat); err == nil {
+				t.Error("personal access token still valid after password reset")
+			}
+			for password, wantErr := range map[string]error{testPassword: ErrInvalidCredentials, newPassword: nil} {
+				_, _, err := store.UserLogin(ctx, &models.LoginRequest{Username: "alice", Password: password})
+				if !errors.Is(err, wantErr) {
+					t.Errorf("UserLogin(%s): err = %v, want %v", password, err, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestResetPasswordExpired(t *testing.T) {
+	set(t, &PasswordResetTTL, -time.Minute)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			resets, err := store.CreatePasswordResets(ctx, "alice@example.com")
+			if err != nil || len(resets) != 1 {
+				t.Fatalf("CreatePasswordResets = %v, %v", resets, err)
+			}
+			if _, err := store.ResetPassword(ctx, resets[0].Token, newPassword); !errors.Is(err, ErrInvalidResetToken) {
+				t.Errorf("err = %v, want %v", err, ErrInvalidResetToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package repositories
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"user_system/models"
+)
+
+const userColumns = `id, username, password, fullname, email, role, status, created_at, updated_at, version`
+
+const defaultBatchSize = 500
+
+var sortColumns = map[string]bool{ //允许排序的字段，防止拼接任意列名
+	"id": true, "username": true, "email": true, "fullname": true, "created_at": true, "updated_at": true,
+}
+
+type userCursor struct { //游标记录上一页最后一行的排序值和id
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func normalizeFilter(filter *models.UserFilter) (*models.UserFilter, *userCursor, error) {
+	f := models.UserFilter{}
+	if filter != nil {
+		f = *filter
+	}
+	if f.Sort == "" {
+		f.Sort = "id"
+	}
+	if f.Order == "" {
+		f.Order = "asc"
+	}
+	if !sortColumns[f.Sort] || (f.Order != "asc" && f.Order != "desc") {
+		return nil, nil, invalidInput(fmt.Sprintf("Invalid sort %q %q", f.Sort, f.Order))
+	}
+	if f.Cursor == "" {
+		return &f, nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(f.Cursor)
+	if err != nil {
+		return nil, nil, invalidInput("Invalid cursor")
+	}
+	var cursor userCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, nil, invalidInput("Invalid cursor")
+	}
+	if cursor.Sort != f.Sort || cursor.Order != f.Order { //游标只能在相同的排序下使用
+		return nil, nil, invalidInput("Cursor does not match sort order")
+	}
+	f.Offset = 0
+	return &f, &cursor, nil
+}
+
+func sortValue(user *models.User, field string) string {
+	switch field {
+	case "username":
+		return user.Username
+	case "email":
+		return user.Email
+	case "fullname":
+		return user.FullName
+	case "created_at":
+		return user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "updated_at":
+		return user.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return strconv.FormatUint(uint64(user.ID), 10)
+}
+
+func encodeCursor(user *models.User, filter *models.UserFilter) string {
+	raw, _ := json.Marshal(userCursor{Sort: filter.Sort, Order: filter.Order, Value: sortValue(user, filter.Sort), ID: user.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func cursorArg(cursor *userCursor) (any, error) { //把游标中的字符串还原成列对应的类型
+	switch cursor.Sort {
+	case "created_at", "updated_at":
+		return time.Parse(time.RFC3339Nano, cursor.Value)
+	case "id":
+		return strconv.ParseUint(cursor.Value, 10, 64)
+	}
+	return cursor.Value, nil
+}
+
+func escapeLike(prefix string) string { //用!作为转义符，各数据库对反斜杠的处理不一致
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return r.Replace(strings.ToLower(prefix)) + "%"
+}
+
+// whereClause 生成过滤条件，不含游标
+func whereClause(filter *models.UserFilter) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if filter.Role != "" {
+		add("role = ?", filter.Role)
+	}
+	if filter.Status != "" {
+		add("status = ?", filter.Status)
+	}
+	if filter.Email != "" {
+		add("email = ?", filter.Email)
+	}
+	if filter.EmailPrefix != "" {
+		add("LOWER(email) LIKE ? ESCAPE '!'", escapeLike(filter.EmailPrefix))
+	}
+	if filter.FullName != "" {
+		add("fullname = ?", filter.FullName)
+	}
+	if filter.FullNamePrefix != "" {
+		add("LOWER(fullname) LIKE ? ESCAPE '!'", escapeLike(filter.FullNamePrefix))
+	}
+	if filter.CreatedFrom != nil {
+		add("created_at >= ?", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		add("created_at <= ?", *filter.CreatedTo)
+	}
+	if filter.UpdatedFrom != nil {
+		add("updated_at >= ?", *filter.UpdatedFrom)
+	}
+	if filter.UpdatedTo != nil {
+		add("updated_at <= ?", *filter.UpdatedTo)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func (h *DBHandler) SearchUsers(ctx context.Context, filter *models.UserFilter) (*models.UserPage, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	f, cursor, err := normalizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	total, err := h.GetUserCount(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	users, err := h.queryUsers(ctx, f, cursor)
+	if err != nil {
+		return nil, err
+	}
+	return buildPage(users, total, f), nil
+}
+
+func (h *DBHandler) queryUsers(ctx context.Context, f *models.UserFilter, cursor *userCursor) ([]*models.User, error) {
+	where, args := whereClause(f)
+	if cursor != nil {
+		value, err := cursorArg(cursor)
+		if err != nil {
+			return nil, invalidInput("Invalid cursor")
+		}
+		op := ">"
+		if f.Order == "desc" {
+			op = "<"
+		}
+		cond := fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", f.Sort, op, f.Sort, op)
+		args = append(args, value, value, cursor.ID)
+		if where == "" {
+			where = " WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+	}
+	query := "SELECT " + userColumns + " FROM users" + where + fmt.Sprintf(" ORDER BY %s %s, id %s", f.Sort, f.Order, f.Order)
+	if f.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit+1, f.Offset) //多取一行判断是否还有下一页
+	}
+	rows, err := h.DB.ReadOnly().Query(ctx, query, args...)
+	if err != nil {
+		return nil, storeError("Failed to query users", err)
+	}
+	defer rows.Close()
+	users := make([]*models.User, 0)
+	for rows.Next() {
+		var userInfo models.User
+		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt, &userInfo.Version)
+		if err != nil {
+			return nil, storeError("Failed to scan user", err)
+		}
+		users = append(users, &userInfo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeError("Error during iteration", err)
+	}
+	return users, nil
+}
+
+func buildPage(users []*models.User, total int, filter *models.UserFilter) *models.UserPage {
+	page := &models.UserPage{Users: users, Total: total}
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		page.Users = users[:filter.Limit]
+		page.NextCursor = encodeCursor(page.Users[filter.Limit-1], filter)
+	}
+	return page
+}
+
+func matchUser(user *models.User, filter *models.UserFilter) bool { //内存实现使用，与whereClause语义保持一致
+	if filter.Role != "" && user.Role != filter.Role {
+		return false
+	}
+	if filter.Status != "" && user.Status != filter.Status {
+		return false
+	}
+	if filter.Email != "" && user.Email != filter.Email {
+		return false
+	}
+	if filter.EmailPrefix != "" && !strings.HasPrefix(strings.ToLower(user.Email), strings.ToLower(filter.EmailPrefix)) {
+		return false
+	}
+	if filter.FullName != "" && user.FullName != filter.FullName {
+		return false
+	}
+	if filter.FullNamePrefix != "" && !strings.HasPrefix(strings.ToLower(user.FullName), strings.ToLower(filter.FullNamePrefix)) {
+		return false
+	}
+	if filter.CreatedFrom != nil && user.CreatedAt.Before(*filter.CreatedFrom) {
+		return false
+	}
+	if filter.CreatedTo != nil && user.CreatedAt.After(*filter.CreatedTo) {
+		return false
+	}
+	if filter.UpdatedFrom != nil && user.UpdatedAt.Before(*filter.UpdatedFrom) {
+		return false
+	}
+	if filter.UpdatedTo != nil && user.UpdatedAt.After(*filter.UpdatedTo) {
+		return false
+	}
+	return true
+}
+
+func compareUsers(a, b *models.User, field string) int { //先比较排序字段，相同时按id
+	var c int
+	switch field {
+	case "username":
+		c = strings.Compare(a.Username, b.Username)
+	case "email":
+		c = strings.Compare(a.Email, b.Email)
+	case "fullname":
+		c = strings.Compare(a.FullName, b.FullName)
+	case "created_at":
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	case "updated_at":
+		c = a.UpdatedAt.Compare(b.UpdatedAt)
+	}
+	if c != 0 {
+		return c
+	}
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+func (h *MemoryHandler) SearchUsers(ctx context.Context, filter *models.UserFilter) (*models.UserPage, error) {
+	f, cursor, err := normalizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	users := h.filter(func(user *models.User) bool { return matchUser(user, f) })
+	total := len(users)
+	sign := 1
+	if f.Order == "desc" {
+		sign = -1
+	}
+	sort.Slice(users, func(i, j int) bool { return sign*compareUsers(users[i], users[j], f.Sort) < 0 })
+	if cursor != nil {
+		value, err := cursorArg(cursor)
+		if err != nil {
+			return nil, invalidInput("Invalid cursor")
+		}
+		last := &models.User{ID: cursor.ID} //用游标还原出上一页最后一行
+		switch v := value.(type) {
+		case time.Time:
+			last.CreatedAt, last.UpdatedAt = v, v
+		case string:
+			last.Username, last.Email, last.FullName = v, v, v
+		}
+		start := sort.Search(len(users), func(i int) bool { return sign*compareUsers(users[i], last, f.Sort) > 0 })
+		users = users[start:]
+	}
+	if f.Offset > 0 {
+		users = users[min(f.Offset, len(users)):]
+	}
+	if f.Limit > 0 && len(users) > f.Limit+1 {
+		users = users[:f.Limit+1]
+	}
+	return buildPage(users, total, f), nil
+}
@@ -0,0 +1,85 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"user_system/config"
+	"user_system/database"
+	"user_system/models"
+	"user_system/utils"
+	"user_system/webauthn"
+)
+
+// UserStore 的方法返回本包定义的错误类型（ErrUserNotFound等），可能包装了底层错误
+type UserStore interface {
+	CreateUser(ctx context.Context, userInfo *models.CreateUserRequest) error
+	UserLogin(ctx context.Context, userInfo *models.LoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) //开启两步验证时只返回挑战
+	VerifyMFALogin(ctx context.Context, req *models.MFALoginRequest) (*utils.TokenPair, error)
+	UpdateUser(ctx context.Context, userInfo *models.UpdateUserRequest) error
+	RemoveUser(ctx context.Context, ID int) error
+	GetUserCount(ctx context.Context, filter *models.UserFilter) (int, error)
+	GetUserInfoByID(ctx context.Context, ID uint) (*models.User, error)
+	GetAllUsers(ctx context.Context) ([]*models.User, error)
+	IterateUsers(ctx context.Context, afterID uint, batchSize int, fn func(user *models.User) error) error
+	GetUsersByStatus(ctx context.Context, status string) ([]*models.User, error)
+	GetUsersByRole(ctx context.Context, role string) ([]*models.User, error)
+	GetUserByUsername(ctx context.Context, username string) (*models.User, error)
+	GetUsersByFullname(ctx context.Context, fullname string) ([]*models.User, error)
+	GetUsersByEmail(ctx context.Context, email string) ([]*models.User, error)
+	GetUsersByCreatedAt(ctx context.Context, createdAt time.Time) ([]*models.User, error)
+	GetUsersByUpdateAt(ctx context.Context, updateAt time.Time) ([]*models.User, error)
+	SearchUsers(ctx context.Context, filter *models.UserFilter) (*models.UserPage, error)
+	FuzzySearchUsers(ctx context.Context, query string, limit int) ([]*models.UserSearchHit, error)
+	PurgeDeletedUsers(ctx context.Context, before time.Time) (int, error)
+	RollupStats(ctx context.Context, day time.Time) (*models.UserStats, error)
+	GetStats(ctx context.Context, limit int) ([]*models.UserStats, error)
+	EnrollTOTP(ctx context.Context, username string) (*models.MFAEnrollment, error)
+	ConfirmTOTP(ctx context.Context, username, code string) ([]string, error)
+	RegenerateRecoveryCodes(ctx context.Context, username, code string) ([]string, error)
+	DisableMFA(ctx context.Context, username, code string) error
+	ResetMFA(ctx context.Context, username string) error
+	GetMFAStatus(ctx context.Context, username string) (*models.MFAStatus, error)
+	DeleteExpiredMFAChallenges(ctx context.Context) (int, error) //同时清理过期的WebAuthn挑战
+	BeginWebAuthnRegistration(ctx context.Context, username string) (*webauthn.CreationOptions, error)
+	FinishWebAuthnRegistration(ctx context.Context, username, name string, resp *webauthn.AttestationResponse) (*models.WebAuthnCredential, error)
+	BeginWebAuthnLogin(ctx context.Context, ip string) (*webauthn.RequestOptions, error) //同一IP未完成的挑战过多时返回ErrWebAuthnThrottled
+	FinishWebAuthnLogin(ctx context.Context, req *models.WebAuthnLoginRequest) (*utils.TokenPair, error)
+	BeginWebAuthnMFA(ctx context.Context, mfaToken string) (*webauthn.RequestOptions, error)
+	FinishWebAuthnMFA(ctx context.Context, req *models.WebAuthnLoginRequest) (*utils.TokenPair, error)
+	GetWebAuthnCredentials(ctx context.Context, username string) ([]*models.WebAuthnCredential, error)
+	DeleteWebAuthnCredential(ctx context.Context, username string, id int) error
+	CreatePasswordResets(ctx context.Context, email string) ([]*models.PasswordReset, error) //邮箱不存在时返回空列表
+	ResetPassword(ctx context.Context, token, password string) (string, error)
+	DeleteExpiredPasswordResets(ctx context.Context) (int, error)
+	CreateEmailVerification(ctx context.Context, username string, throttle bool) (*models.EmailVerification, error)
+	VerifyEmail(ctx context.Context, token string) (string, error)
+	CreateMagicLink(ctx context.Context, req *models.MagicLinkRequest) (*models.MagicLink, error) //用户不存在或刚发送过时返回nil
+	MagicLogin(ctx context.Context, req *models.MagicLoginRequest) (*utils.TokenPair, *models.MFAChallenge, error)
+	DeleteExpiredMagicLinks(ctx context.Context) (int, error)
+	WithTx(ctx context.Context, fn func(tx *Tx) error) error
+}
+
+func NewStore(cfg *config.Config) (UserStore, utils.TokenStore, error) { //根据配置选择存储后端
+	switch cfg.DBDriver {
+	case database.DriverMemory:
+		tokens := utils.NewAuthMemoryHandler()
+		return NewMemoryHandler(tokens), tokens, nil
+	case database.DriverMySQL, database.DriverSQLite, database.DriverPostgres:
+		conn := database.NewConn(database.DB, database.Driver)
+		if conn != nil {
+			conn.Timeout = cfg.DBQueryTimeout
+			conn.Replicas = database.Replicas
+		}
+		tokens, err := utils.NewAuthDBHandler(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		users, err := NewDBHandler(conn, tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		return users, tokens, nil
+	}
+	return nil, nil, fmt.Errorf("NewStore: Unsupported database driver %q", cfg.DBDriver)
+}
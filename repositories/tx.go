@@ -0,0 +1,169 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"user_system/database"
+	"user_system/models"
+	"user_system/utils"
+)
+
+// Tx 是事务中可用的存储，Users与Tokens的修改要么一起提交，要么一起回滚
+type Tx struct {
+	Users  UserStore
+	Tokens utils.TokenStore
+}
+
+// revokeOnChange 角色或状态变化后吊销该用户的token，避免旧token带着旧权限继续使用
+func revokeOnChange(ctx context.Context, userInfo *models.UpdateUserRequest, tokens utils.TokenStore) error {
+	if userInfo.Role == nil && userInfo.Status == nil {
+		return nil
+	}
+	if err := tokens.DeleteTokenByUsername(ctx, userInfo.Username); err != nil {
+		return storeError("Failed to revoke tokens", err)
+	}
+	//个人访问令牌保存的是创建时的角色，同样需要吊销
+	if err := tokens.DeleteAccessTokensByUsername(ctx, userInfo.Username); err != nil {
+		return storeError("Failed to revoke access tokens", err)
+	}
+	return nil
+}
+
+func versionConflict(current uint) error {
+	return fmt.Errorf("%w, current version is %d", ErrVersionConflict, current)
+}
+
+func (h *DBHandler) WithTx(ctx context.Context, fn func(tx *Tx) error) error {
+	return h.withTx(ctx, func(tx *DBHandler) error {
+		return fn(&Tx{Users: tx, Tokens: tx.Tokens})
+	})
+}
+
+func (h *DBHandler) withTx(ctx context.Context, fn func(tx *DBHandler) error) error {
+	if h.DB == nil {
+		return errNotInitialized
+	}
+	tokens, ok := h.Tokens.(*utils.AuthDBHandler)
+	if !ok { //token不在同一个数据库中，无法放进同一个事务
+		return fmt.Errorf("WithTx: Token store does not share the user database")
+	}
+	err := h.DB.WithTx(ctx, func(conn *database.Conn) error {
+		return fn(&DBHandler{DB: conn, Tokens: tokens.WithConn(conn)})
+	})
+	if err != nil && !errors.Is(err, ErrStoreUnavailable) && database.IsUnavailable(err) { //开始或提交事务时连接失败
+		return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	return err
+}
+
+// WithTx 内存实现：事务之间互斥执行，修改前记录原值，fn失败时逆序撤销用户和token的修改
+// 不在事务中的读操作可以看到未提交的修改
+func (h *MemoryHandler) WithTx(ctx context.Context, fn func(tx *Tx) error) error {
+	return h.withTx(ctx, func(tx *MemoryHandler) error {
+		return fn(&Tx{Users: tx, Tokens: tx.Tokens})
+	})
+}
+
+func (h *MemoryHandler) withTx(ctx context.Context, fn func(tx *MemoryHandler) error) (err error) {
+	if h.inTx {
+		return fn(h)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+	commit, rollback := h.begin()
+	if tokens, ok := h.Tokens.(*utils.AuthMemoryHandler); ok {
+		commitUsers, rollbackUsers := commit, rollback
+		commitTokens, rollbackTokens := tokens.Begin()
+		commit = func() {
+			commitUsers()
+			commitTokens()
+		}
+		rollback = func() {
+			rollbackUsers()
+			rollbackTokens()
+		}
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			rollback()
+			panic(p)
+		}
+		if err != nil {
+			rollback()
+		} else {
+			commit()
+		}
+	}()
+	return fn(&MemoryHandler{memoryState: h.memoryState, inTx: true, Tokens: h.Tokens})
+}
+
+// begin 开始记录修改，rollback撤销记录的修改，commit丢弃记录，二者只调用其一
+func (h *MemoryHandler) begin() (commit, rollback func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	undo := &utils.UndoLog{}
+	h.undo = undo
+	nextID, nextCredentialID := h.nextID, h.nextCredentialID
+	commit = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.undo = nil
+	}
+	rollback = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.undo = nil
+		undo.Rollback()
+		h.nextID, h.nextCredentialID = nextID, nextCredentialID
+	}
+	return commit, rollback
+}
+
+// 以下方法在修改对应条目之前调用，事务中记录原值；调用方持有写锁
+
+func (h *MemoryHandler) saveUser(id uint) { //回滚时同时恢复搜索索引
+	if h.undo == nil {
+		return
+	}
+	old := h.users[id]
+	if old != nil {
+		old = utils.Copy(old)
+	}
+	h.undo.Push(func() {
+		if old == nil {
+			delete(h.users, id)
+			h.index.Delete(id)
+			return
+		}
+		h.users[id] = old
+		h.index.Put(id, old.Username, old.FullName, old.Email)
+	})
+}
+
+func (h *MemoryHandler) saveMFA(username string) {
+	utils.Save(h.undo, h.mfa, username, (*mfaSecret).copy)
+}
+
+func (h *MemoryHandler) saveMFAChallenge(digest string) {
+	utils.Save(h.undo, h.challenges, digest, utils.Copy)
+}
+
+func (h *MemoryHandler) saveCredential(id int) {
+	utils.Save(h.undo, h.credentials, id, (*webauthnCredential).copy)
+}
+
+func (h *MemoryHandler) saveReset(digest string) {
+	utils.Save(h.undo, h.resets, digest, utils.Copy)
+}
+
+func (h *MemoryHandler) saveEmailState(username string) {
+	utils.Save(h.undo, h.emails, username, utils.Copy)
+}
+
+func (h *MemoryHandler) saveMagicLink(digest string) {
+	utils.Save(h.undo, h.magicLinks, digest, utils.Copy)
+}
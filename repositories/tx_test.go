@@ -0,0 +1,75 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"user_system/models"
+)
+
+// fn失败时用户、搜索索引与token的修改一起回滚
+func TestWithTxRollback(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			tokens := tokensOf(t, store)
+			createUser(t, store, "alice", "alice@example.com")
+			createUser(t, store, "bob", "bob@example.com")
+			pair, _ := login(t, store, "alice")
+			bob, err := store.GetUserByUsername(ctx, "bob")
+			if err != nil {
+				t.Fatalf("GetUserByUsername: %v", err)
+			}
+
+			errAbort := errors.New("abort")
+			err = store.WithTx(ctx, func(tx *Tx) error {
+				fullname := "Alice Liddell"
+				if err := tx.Users.UpdateUser(ctx, &models.UpdateUserRequest{Username: "alice", FullName: &fullname}); err != nil {
+					return err
+				}
+				if err := tx.Users.RemoveUser(ctx, int(bob.ID)); err != nil {
+					return err
+				}
+				if err := tx.Users.CreateUser(ctx, &models.CreateUserRequest{Username: "carol", Password: testPassword, Role: "user", Email: "carol@example.com", FullName: "carol"}); err != nil {
+					return err
+				}
+				if err := tx.Tokens.DeleteTokenByUsername(ctx, "alice"); err != nil {
+					return err
+				}
+				return errAbort
+			})
+			if !errors.Is(err, errAbort) {
+				t.Fatalf("WithTx: err = %v, want %v", err, errAbort)
+			}
+
+			if user, err := store.GetUserByUsername(ctx, "alice"); err != nil || user.FullName != "alice" || user.Version != 1 {
+				t.Errorf("alice after rollback = %+v, %v", user, err)
+			}
+			if user, err := store.GetUserByUsername(ctx, "bob"); err != nil || user.ID != bob.ID {
+				t.Errorf("bob after rollback = %+v, %v", user, err)
+			}
+			if _, err := store.GetUserByUsername(ctx, "carol"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("carol after rollback: err = %v, want %v", err, ErrUserNotFound)
+			}
+			if _, err := tokens.GetInfobyToken(ctx, pair.AccessToken); err != nil {
+				t.Errorf("session revoked by the rolled back transaction: %v", err)
+			}
+			//搜索索引同样恢复
+			for query, want := range map[string]string{"bob": "bob", "liddell": ""} {
+				hits, err := store.FuzzySearchUsers(ctx, query, 10)
+				if err != nil {
+					t.Fatalf("FuzzySearchUsers(%q): %v", query, err)
+				}
+				got := ""
+				if len(hits) > 0 {
+					got = hits[0].User.Username
+				}
+				if got != want {
+					t.Errorf("FuzzySearchUsers(%q) = %q, want %q", query, got, want)
+				}
+			}
+			//回滚后新的事务正常提交
+			createUser(t, store, "carol", "carol@example.com")
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package repositories
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"time"
 	"user_system/database"
@@ -8,85 +10,109 @@ import (
 	"user_system/utils"
 )
 
-func NewDBHandler() error {
-	if database.DB == nil {
-		return fmt.Errorf("NewDBHandler: Database connection is not initialized")
-	}
-	//新建用户表
-	_, err := database.DB.Exec(`
-    CREATE TABLE IF NOT EXISTS users (
-        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
-        username VARCHAR(50) NOT NULL UNIQUE,
-        password VARCHAR(64) NOT NULL,
-		fullname VARCHAR(50) NOT NULL,
-		email VARCHAR(100) NOT NULL,
-		role VARCHAR(5) NOT NULL DEFAULT 'user',
-		status VARCHAR(20) NOT NULL DEFAULT 'active',
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
-    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
-	`)
-	if err != nil {
-		return fmt.Errorf("Failed to create users table: %w", err)
+type DBHandler struct {
+	DB     *database.Conn
+	Tokens utils.TokenStore
+}
+
+func NewDBHandler(db *database.Conn, tokens utils.TokenStore) (*DBHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("NewDBHandler: Database connection is not initialized")
 	}
-	return nil
+	//表结构由migrations包维护
+	return &DBHandler{DB: db, Tokens: tokens}, nil
 }
 
-func CreateUser(userInfo *models.CreateUserRequest) *models.Response {
-	if database.DB == nil {
-		return &models.Response{Message: "Database connection is not initialized", Type: 400}
+func (h *DBHandler) CreateUser(ctx context.Context, userInfo *models.CreateUserRequest) error {
+	if h.DB == nil {
+		return errNotInitialized
 	}
 	//bcrypt加密密码
 	hashedPassword, err := utils.HashPassword(userInfo.Password)
 	if err != nil {
-		return &models.Response{Message: fmt.Sprintf("Failed to hash password: %v", err), Type: 400}
+		return fmt.Errorf("Failed to hash password: %w", err)
 	}
 	//插入用户数据
-	_, err = database.DB.Exec(`
-		INSERT INTO users (username, password, fullname, email, role) VALUES (?, ?, ?, ?, ?)`,
-		userInfo.Username, hashedPassword, userInfo.FullName, userInfo.Email, userInfo.Role,
+	_, err = h.DB.Exec(ctx, `
+		INSERT INTO users (username, password, fullname, email, role, status) VALUES (?, ?, ?, ?, ?, ?)`,
+		userInfo.Username, hashedPassword, userInfo.FullName, userInfo.Email, userInfo.Role, newUserStatus(),
 	) //这里本来想查询一下是否存在同名用户，但mysql的唯一索引会自动帮我们处理这个问题，如果插入重复用户名会返回错误，我们直接捕获这个错误就行了
+	if database.IsUniqueViolation(err) {
+		return ErrDuplicateUsername
+	}
 	if err != nil {
-		return &models.Response{Message: "Failed to create user", Type: 400}
+		return storeError("Failed to create user", err)
 	}
-	return &models.Response{Message: "User created successfully", Type: 200}
+	return nil
 }
 
-func UserLogin(userInfo *models.LoginRequest) (*models.Response, string) {
-	if database.DB == nil {
-		return &models.Response{Message: "Database connection is not initialized", Type: 400}, ""
+func (h *DBHandler) UserLogin(ctx context.Context, userInfo *models.LoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
+	if h.DB == nil {
+		return nil, nil, errNotInitialized
+	}
+	//锁住用户行再签发token，与删除、改角色的事务串行执行
+	var pair *utils.TokenPair
+	var challenge *models.MFAChallenge
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var err error
+		pair, challenge, err = tx.userLogin(ctx, userInfo)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return pair, challenge, nil
+}
+
+func (h *DBHandler) userLogin(ctx context.Context, userInfo *models.LoginRequest) (*utils.TokenPair, *models.MFAChallenge, error) {
 	//查询用户数据
 	var storedHashedPassword, status, role string
-	err := database.DB.QueryRow(`
-		SELECT password, status, role FROM users WHERE username = ?`,
+	err := h.DB.QueryRow(ctx, `
+		SELECT password, status, role FROM users WHERE username = ?`+h.DB.ForUpdate(),
 		userInfo.Username,
 	).Scan(&storedHashedPassword, &status, &role)
-	if status == "deleted" {
-		return &models.Response{Message: "User account is deleted", Type: 400}, ""
+	if err == sql.ErrNoRows { //不区分用户不存在和密码错误，避免泄露用户名是否存在
+		return nil, nil, ErrInvalidCredentials
 	}
 	if err != nil {
-		return &models.Response{Message: fmt.Sprintf("Failed to query user: %v", err), Type: 404}, ""
+		return nil, nil, storeError("Failed to query user", err)
 	}
 	//检查密码
 	if !utils.CheckPasswordHash(userInfo.Password, storedHashedPassword) {
-		return &models.Response{Message: "Invalid username or password", Type: 400}, ""
+		return nil, nil, ErrInvalidCredentials
+	}
+	//密码正确后再检查状态，只有active的用户（以及允许时未验证邮箱的用户）可以登录
+	if err := loginAllowed(status); err != nil {
+		return nil, nil, err
+	}
+	return h.issueLogin(ctx, userInfo, role)
+}
+
+// issueLogin 是验证身份后的共同路径（密码、登录链接）：开启了两步验证时只返回挑战，否则签发token
+// 调用方需在事务中锁住用户行并检查状态
+func (h *DBHandler) issueLogin(ctx context.Context, userInfo *models.LoginRequest, role string) (*utils.TokenPair, *models.MFAChallenge, error) {
+	challenge, err := h.createMFAChallenge(ctx, userInfo)
+	if err != nil || challenge != nil { //开启了两步验证，提交验证码后才签发token
+		return nil, challenge, err
 	}
 	Request := utils.CreateTokenRequset{
-		ExpiredAt: time.Now().Add(time.Minute * 15),
 		Role:      role,
 		Username:  userInfo.Username,
+		Device:    userInfo.Device,
+		UserAgent: userInfo.UserAgent,
+		IP:        userInfo.IP,
+		Remember:  userInfo.Remember,
 	}
-	token, err := utils.GetToken(&Request)
+	pair, err := utils.IssueTokenPair(ctx, h.Tokens, &Request)
 	if err != nil {
-		return &models.Response{Message: fmt.Sprintf("Failed to create token: %v", err), Type: 400}, ""
+		return nil, nil, storeError("Failed to create token", err)
 	}
-	return &models.Response{Message: "Login successful", Type: 200}, token
+	return pair, nil, nil
 }
 
-func UpdateUser(userInfo *models.UpdateUserRequest) *models.Response {
-	if database.DB == nil {
-		return &models.Response{Message: "Database connection is not initialized", Type: 400}
+func (h *DBHandler) UpdateUser(ctx context.Context, userInfo *models.UpdateUserRequest) error {
+	if h.DB == nil {
+		return errNotInitialized
 	}
 	query := "UPDATE users SET "
 	args := []interface{}{}
@@ -94,7 +120,7 @@ func UpdateUser(userInfo *models.UpdateUserRequest) *models.Response {
 		//bcrypt加密新密码
 		hashedPassword, err := utils.HashPassword(*userInfo.Password)
 		if err != nil {
-			return &models.Response{Message: fmt.Sprintf("Failed to hash password: %v", err), Type: 400}
+			return fmt.Errorf("Failed to hash password: %w", err)
 		}
 		query += "password = ?, "
 		args = append(args, hashedPassword)
@@ -104,8 +130,9 @@ func UpdateUser(userInfo *models.UpdateUserRequest) *models.Response {
 		args = append(args, *userInfo.Role)
 	}
 	if userInfo.Email != nil {
-		query += "email = ?, "
-		args = append(args, *userInfo.Email)
+		//邮箱变化时清空验证时间；放在email之前，MySQL按顺序赋值，这里比较的仍是旧邮箱
+		query += "email_verified_at = CASE WHEN email = ? THEN email_verified_at ELSE NULL END, email = ?, "
+		args = append(args, *userInfo.Email, *userInfo.Email)
 	}
 	if userInfo.FullName != nil {
 		query += "fullname = ?, "
@@ -116,300 +143,230 @@ func UpdateUser(userInfo *models.UpdateUserRequest) *models.Response {
 		args = append(args, *userInfo.Status)
 	}
 	if len(args) == 0 {
-		return &models.Response{Message: "No fields to update", Type: 400}
+		return invalidInput("No fields to update")
 	}
-	//去掉最后一个逗号和空格
-	query = query[:len(query)-2]
+	query += "version = version + 1" //每次更新都递增版本号
 	query += " WHERE username = ?"
 	args = append(args, userInfo.Username)
-	//更新用户数据
-	result, err := database.DB.Exec(query, args...)
-	if err != nil {
-		return &models.Response{Message: fmt.Sprintf("Failed to update user: %v", err), Type: 400}
-	}
-	rows, err := result.RowsAffected()
-	if err != nil {
-		return &models.Response{Message: fmt.Sprintf("Failed to get affected rows: %v", err), Type: 400}
-	}
-	if rows == 0 {
-		return &models.Response{Message: "User does not exist", Type: 400}
-	}
-	return &models.Response{Message: "User updated successfully", Type: 200}
+	if userInfo.Version != nil { //只有版本号一致才更新，否则说明已被其他请求修改
+		query += " AND version = ?"
+		args = append(args, *userInfo.Version)
+	}
+	//更新用户数据，角色或状态变化时在同一事务中吊销token
+	return h.withTx(ctx, func(tx *DBHandler) error {
+		if err := tx.updateUser(ctx, userInfo, query, args); err != nil {
+			return err
+		}
+		return revokeOnChange(ctx, userInfo, tx.Tokens)
+	})
 }
 
-func RemoveUser(ID int) *models.Response { //硬删除用户数据，慎用
-	if database.DB == nil {
-		return &models.Response{Message: "Database connection is not initialized", Type: 400}
-	}
-	//删除用户数据
-	result, err := database.DB.Exec(`
-		DELETE FROM users WHERE id = ?`,
-		ID,
-	)
+func (h *DBHandler) updateUser(ctx context.Context, userInfo *models.UpdateUserRequest, query string, args []interface{}) error {
+	result, err := h.DB.Exec(ctx, query, args...)
 	if err != nil {
-		return &models.Response{Message: fmt.Sprintf("Failed to delete user: %v", err), Type: 400}
+		return storeError("Failed to update user", err)
 	}
 	rows, err := result.RowsAffected()
 	if err != nil {
-		return &models.Response{Message: fmt.Sprintf("Failed to get affected rows: %v", err), Type: 400}
+		return storeError("Failed to get affected rows", err)
+	}
+	if rows == 0 && userInfo.Version != nil {
+		//区分用户不存在和版本冲突
+		var version uint
+		err := h.DB.QueryRow(ctx, `SELECT version FROM users WHERE username = ?`, userInfo.Username).Scan(&version)
+		if err == nil {
+			return versionConflict(version)
+		}
 	}
 	if rows == 0 {
-		return &models.Response{Message: "User does not exist", Type: 400}
+		return ErrUserNotFound
 	}
-	return &models.Response{Message: "User deleted successfully", Type: 200}
+	return nil
 }
 
-func GetUserCount() (int, *models.Response) {
-	if database.DB == nil {
-		return 0, &models.Response{Message: "Database connection is not initialized", Type: 400}
+func (h *DBHandler) RemoveUser(ctx context.Context, ID int) error { //硬删除用户数据，慎用
+	if h.DB == nil {
+		return errNotInitialized
+	}
+	return h.withTx(ctx, func(tx *DBHandler) error {
+		var username string
+		err := tx.DB.QueryRow(ctx, `SELECT username FROM users WHERE id = ?`+tx.DB.ForUpdate(), ID).Scan(&username)
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return storeError("Failed to query user", err)
+		}
+		//删除用户数据，以及以用户名或ID关联的MFA、通行密钥、重置与登录链接
+		if _, err := tx.DB.Exec(ctx, `DELETE FROM webauthn_credentials WHERE user_id = ?`, ID); err != nil {
+			return storeError("Failed to delete user", err)
+		}
+		for _, table := range []string{"user_mfa", "mfa_recovery_codes", "mfa_challenges", "password_resets", "magic_links"} {
+			if _, err := tx.DB.Exec(ctx, `DELETE FROM `+table+` WHERE username = ?`, username); err != nil {
+				return storeError("Failed to delete user", err)
+			}
+		}
+		if _, err := tx.DB.Exec(ctx, `DELETE FROM users WHERE id = ?`, ID); err != nil {
+			return storeError("Failed to delete user", err)
+		}
+		return revokeAll(ctx, username, tx.Tokens)
+	})
+}
+
+func (h *DBHandler) GetUserCount(ctx context.Context, filter *models.UserFilter) (int, error) { //filter为nil时统计全部用户
+	if h.DB == nil {
+		return 0, errNotInitialized
+	}
+	where, args := "", []any(nil)
+	if filter != nil {
+		where, args = whereClause(filter)
 	}
 	//查询用户数量
 	var count int
-	err := database.DB.QueryRow(`
-		SELECT COUNT(*) FROM users`,
+	err := h.DB.ReadOnly().QueryRow(ctx, `
+		SELECT COUNT(*) FROM users`+where, args...,
 	).Scan(&count)
 	if err != nil {
-		return 0, &models.Response{Message: fmt.Sprintf("Failed to query user count: %v", err), Type: 400}
+		return 0, storeError("Failed to query user count", err)
 	}
-	return count, &models.Response{Message: "User count retrieved successfully", Type: 200}
+	return count, nil
 }
 
-func GetUserInfoByID(ID uint) (*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
+func (h *DBHandler) GetUserInfoByID(ctx context.Context, ID uint) (*models.User, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
 	}
 	//查询用户数据
 	var userInfo models.User
-	err := database.DB.QueryRow(`
-        SELECT 
-            id, username, password, fullname, email, 
-            role, status, created_at, updated_at
+	err := h.DB.ReadConsistent().QueryRow(ctx, `
+        SELECT
+            id, username, password, fullname, email,
+            role, status, created_at, updated_at, version
         FROM users
         WHERE id = ?`, ID,
-	).Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
-	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query user: %v", err), Type: 400}
-	}
-	return &userInfo, &models.Response{Message: "User info retrieved successfully", Type: 200}
-}
-
-func GetAllUsers() ([]*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
+	).Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt, &userInfo.Version)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
 	}
-
-	// 查询所有用户数据
-	rows, err := database.DB.Query(`
-		SELECT 
-			id, username, password, fullname, email, 
-			role, status, created_at, updated_at
-		FROM users`)
 	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query users: %v", err), Type: 400}
+		return nil, storeError("Failed to query user", err)
 	}
-	defer rows.Close()
+	return &userInfo, nil
+}
 
+func (h *DBHandler) GetAllUsers(ctx context.Context) ([]*models.User, error) {
 	users := make([]*models.User, 0)
-	for rows.Next() {
-		var userInfo models.User
-		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
-		if err != nil {
-			return nil, &models.Response{Message: fmt.Sprintf("Failed to scan user: %v", err), Type: 400}
-		}
-		users = append(users, &userInfo)
-	}
-
-	// 检查是否在遍历过程中发生错误
-	if err := rows.Err(); err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Error during iteration: %v", err), Type: 400}
+	err := h.IterateUsers(ctx, 0, defaultBatchSize, func(user *models.User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return users, &models.Response{Message: "All users retrieved successfully", Type: 200}
+	return users, nil
 }
 
-func GetUsersByStatus(status string) ([]*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
-	}
-	//查询用户数据
-	rows, err := database.DB.Query(`
-		SELECT 
-			id, username, password, fullname, email,
-			role, status, created_at, updated_at
-		FROM users
-		WHERE status = ?`, status,
-	)
-	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query users: %v", err), Type: 400}
-	}
-	defer rows.Close()
-	users := make([]*models.User, 0)
-	for rows.Next() {
-		var userInfo models.User
-		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
+func (h *DBHandler) IterateUsers(ctx context.Context, afterID uint, batchSize int, fn func(user *models.User) error) error { //按id分批遍历，内存占用与总数无关；fn返回的错误原样返回
+	if h.DB == nil {
+		return errNotInitialized
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	db := h.DB.ReadOnly() //批量读取允许副本延迟
+	for {
+		// 每批都是独立的短查询，不会长时间占用连接
+		rows, err := db.Query(ctx, `
+			SELECT `+userColumns+`
+			FROM users
+			WHERE id > ?
+			ORDER BY id
+			LIMIT ?`, afterID, batchSize,
+		)
 		if err != nil {
-			return nil, &models.Response{Message: fmt.Sprintf("Failed to scan user: %v", err), Type: 400}
+			return storeError("Failed to query users", err)
 		}
-		users = append(users, &userInfo)
-	}
-	return users, &models.Response{Message: "Users retrieved successfully", Type: 200}
-}
-
-func GetUsersByRole(role string) ([]*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
-	}
-	//查询用户数据
-	rows, err := database.DB.Query(`
-		SELECT
-			id, username, password, fullname, email,
-			role, status, created_at, updated_at
-		FROM users
-		WHERE role = ?`, role,
-	)
-	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query users: %v", err), Type: 400}
-	}
-	defer rows.Close()
-	users := make([]*models.User, 0)
-	for rows.Next() {
-		var userInfo models.User
-		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
+		batch := make([]*models.User, 0, batchSize)
+		for rows.Next() {
+			var userInfo models.User
+			err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt, &userInfo.Version)
+			if err != nil {
+				rows.Close()
+				return storeError("Failed to scan user", err)
+			}
+			batch = append(batch, &userInfo)
+		}
+		err = rows.Err()
+		rows.Close()
 		if err != nil {
-			return nil, &models.Response{Message: fmt.Sprintf("Failed to scan user: %v", err), Type: 400}
+			return storeError("Error during iteration", err)
+		}
+		for _, user := range batch {
+			if err := fn(user); err != nil {
+				return err
+			}
 		}
-		users = append(users, &userInfo)
+		if len(batch) < batchSize {
+			return nil
+		}
+		afterID = batch[len(batch)-1].ID
 	}
-	return users, &models.Response{Message: "Users retrieved successfully", Type: 200}
 }
 
-func GetUserByUsername(username string) (*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
+func (h *DBHandler) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
 	}
 	//查询用户数据
 	var userInfo models.User
-	err := database.DB.QueryRow(`
+	err := h.DB.ReadConsistent().QueryRow(ctx, `
 		SELECT
 			id, username, password, fullname, email,
-			role, status, created_at, updated_at
+			role, status, created_at, updated_at, version
 		FROM users
 		WHERE username = ?`, username,
-	).Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
+	).Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt, &userInfo.Version)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query user: %v", err), Type: 400}
+		return nil, storeError("Failed to query user", err)
 	}
-	return &userInfo, &models.Response{Message: "User retrieved successfully", Type: 200}
+	return &userInfo, nil
 }
 
-func GetUsersByFullname(fullname string) ([]*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
+// 以下按单字段精确查询的方法与SearchUsers共用查询构造
+func (h *DBHandler) findUsers(ctx context.Context, filter *models.UserFilter) ([]*models.User, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
 	}
-	//查询用户数据
-	rows, err := database.DB.Query(`
-		SELECT
-			id, username, password, fullname, email,
-			role, status, created_at, updated_at
-		FROM users
-		WHERE fullname = ?`, fullname,
-	)
+	f, _, err := normalizeFilter(filter)
 	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query users: %v", err), Type: 400}
-	}
-	defer rows.Close()
-	users := make([]*models.User, 0)
-	for rows.Next() {
-		var userInfo models.User
-		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
-		if err != nil {
-			return nil, &models.Response{Message: fmt.Sprintf("Failed to scan user: %v", err), Type: 400}
-		}
-		users = append(users, &userInfo)
+		return nil, err
 	}
-	return users, &models.Response{Message: "Users retrieved successfully", Type: 200}
+	return h.queryUsers(ctx, f, nil)
 }
 
-func GetUsersByEmail(email string) ([]*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
-	}
-	//查询用户数据
-	rows, err := database.DB.Query(`
-		SELECT
-			id, username, password, fullname, email,
-			role, status, created_at, updated_at
-		FROM users
-		WHERE email = ?`, email,
-	)
-	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query users: %v", err), Type: 400}
-	}
-	defer rows.Close()
-	users := make([]*models.User, 0)
-	for rows.Next() {
-		var userInfo models.User
-		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
-		if err != nil {
-			return nil, &models.Response{Message: fmt.Sprintf("Failed to scan user: %v", err), Type: 400}
-		}
-		users = append(users, &userInfo)
-	}
-	return users, &models.Response{Message: "Users retrieved successfully", Type: 200}
+func (h *DBHandler) GetUsersByStatus(ctx context.Context, status string) ([]*models.User, error) {
+	return h.findUsers(ctx, &models.UserFilter{Status: status})
 }
 
-func GetUsersByCreatedAt(createdAt time.Time) ([]*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
-	}
-	//查询用户数据
-	rows, err := database.DB.Query(`
-		SELECT
-			id, username, password, fullname, email,
-			role, status, created_at, updated_at
-		FROM users
-		WHERE created_at = ?`, createdAt,
-	)
-	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query users: %v", err), Type: 400}
-	}
-	defer rows.Close()
-	users := make([]*models.User, 0)
-	for rows.Next() {
-		var userInfo models.User
-		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
-		if err != nil {
-			return nil, &models.Response{Message: fmt.Sprintf("Failed to scan user: %v", err), Type: 400}
-		}
-		users = append(users, &userInfo)
-	}
-	return users, &models.Response{Message: "Users retrieved successfully", Type: 200}
+func (h *DBHandler) GetUsersByRole(ctx context.Context, role string) ([]*models.User, error) {
+	return h.findUsers(ctx, &models.UserFilter{Role: role})
 }
 
-func GetUsersByUpdateAt(updateAt time.Time) ([]*models.User, *models.Response) {
-	if database.DB == nil {
-		return nil, &models.Response{Message: "Database connection is not initialized", Type: 400}
-	}
-	//查询用户数据
-	rows, err := database.DB.Query(`
-		SELECT
-			id, username, password, fullname, email,
-			role, status, created_at, updated_at
-		FROM users
-		WHERE updated_at = ?`, updateAt,
-	)
-	if err != nil {
-		return nil, &models.Response{Message: fmt.Sprintf("Failed to query users: %v", err), Type: 400}
-	}
-	defer rows.Close()
-	users := make([]*models.User, 0)
-	for rows.Next() {
-		var userInfo models.User
-		err := rows.Scan(&userInfo.ID, &userInfo.Username, &userInfo.Password, &userInfo.FullName, &userInfo.Email, &userInfo.Role, &userInfo.Status, &userInfo.CreatedAt, &userInfo.UpdatedAt)
-		if err != nil {
-			return nil, &models.Response{Message: fmt.Sprintf("Failed to scan user: %v", err), Type: 400}
-		}
-		users = append(users, &userInfo)
-	}
-	return users, &models.Response{Message: "Users retrieved successfully", Type: 200}
+func (h *DBHandler) GetUsersByFullname(ctx context.Context, fullname string) ([]*models.User, error) {
+	return h.findUsers(ctx, &models.UserFilter{FullName: fullname})
+}
+
+func (h *DBHandler) GetUsersByEmail(ctx context.Context, email string) ([]*models.User, error) {
+	return h.findUsers(ctx, &models.UserFilter{Email: email})
+}
+
+func (h *DBHandler) GetUsersByCreatedAt(ctx context.Context, createdAt time.Time) ([]*models.User, error) {
+	return h.findUsers(ctx, &models.UserFilter{CreatedFrom: &createdAt, CreatedTo: &createdAt})
+}
+
+func (h *DBHandler) GetUsersByUpdateAt(ctx context.Context, updateAt time.Time) ([]*models.User, error) {
+	return h.findUsers(ctx, &models.UserFilter{UpdatedFrom: &updateAt, UpdatedTo: &updateAt})
 }
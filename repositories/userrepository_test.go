@@ -0,0 +1,60 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"user_system/utils"
+)
+
+// 硬删除用户时吊销其会话与个人访问令牌，并清除以用户名关联的状态，同名新用户不会继承
+func TestRemoveUser(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			tokens := tokensOf(t, store)
+			createUser(t, store, "alice", "alice@example.com")
+			pair, _ := login(t, store, "alice")
+			pat, _, err := tokens.CreateAccessToken(ctx, &utils.CreateAccessTokenRequest{Name: "ci", Scopes: []string{"users:read"}, Username: "alice", Role: "user"})
+			if err != nil {
+				t.Fatalf("CreateAccessToken: %v", err)
+			}
+			if _, err := store.EnrollTOTP(ctx, "alice"); err != nil {
+				t.Fatalf("EnrollTOTP: %v", err)
+			}
+			if resets, err := store.CreatePasswordResets(ctx, "alice@example.com"); err != nil || len(resets) != 1 {
+				t.Fatalf("CreatePasswordResets = %v, %v", resets, err)
+			}
+			user, err := store.GetUserByUsername(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GetUserByUsername: %v", err)
+			}
+
+			if err := store.RemoveUser(ctx, int(user.ID)); err != nil {
+				t.Fatalf("RemoveUser: %v", err)
+			}
+			if err := store.RemoveUser(ctx, int(user.ID)); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("RemoveUser again: err = %v, want %v", err, ErrUserNotFound)
+			}
+			if _, err := tokens.GetInfobyToken(ctx, pair.AccessToken); err == nil {
+				t.Error("session still valid after removing the user")
+			}
+			if _, err := tokens.RotateRefreshToken(ctx, pair.RefreshToken, ""); err == nil {
+				t.Error("refresh token still valid after removing the user")
+			}
+			if _, err := tokens.GetInfoByAccessToken(ctx, pat); err == nil {
+				t.Error("personal access token still valid after removing the user")
+			}
+
+			createUser(t, store, "alice", "alice@example.com")
+			status, err := store.GetMFAStatus(ctx, "alice")
+			if err != nil || status.Enabled || status.Pending {
+				t.Errorf("GetMFAStatus = %+v, %v, want no enrollment", status, err)
+			}
+			//旧的重置链接已删除，不再触发发送间隔
+			if resets, err := store.CreatePasswordResets(ctx, "alice@example.com"); err != nil || len(resets) != 1 {
+				t.Errorf("CreatePasswordResets = %v, %v, want a new link", resets, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package repositories
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+	"user_system/models"
+)
+
+var (
+	EmailVerification          = false          //新注册的用户状态为pending_verification，验证邮箱后变为active
+	BlockUnverifiedLogin       = false          //pending_verification的用户不能登录
+	EmailVerificationTTL       = 24 * time.Hour //验证链接的有效期
+	VerificationResendInterval = time.Minute    //同一用户两次发送验证邮件的最短间隔
+	EmailVerificationKey       []byte           //验证链接的签名密钥，由main设置
+)
+
+const statusPendingVerification = "pending_verification"
+
+// loginAllowed 检查用户状态是否允许登录，未验证邮箱的用户按BlockUnverifiedLogin决定
+func loginAllowed(status string) error {
+	switch {
+	case status == "active":
+		return nil
+	case status == statusPendingVerification && !BlockUnverifiedLogin:
+		return nil
+	case status == statusPendingVerification:
+		return ErrEmailNotVerified
+	}
+	return ErrAccountDisabled
+}
+
+func newUserStatus() string {
+	if EmailVerification {
+		return statusPendingVerification
+	}
+	return "active"
+}
+
+var verificationEncoding = base64.RawURLEncoding
+
+func verificationMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, EmailVerificationKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signVerification 生成验证链接中的令牌：用户名、邮箱与过期时间加上HMAC签名，不需要保存在数据库中
+// 令牌绑定了邮箱，修改邮箱后旧链接自动失效
+func signVerification(username, email string, expiredAt time.Time) string {
+	payload := username + "\n" + email + "\n" + strconv.FormatInt(expiredAt.Unix(), 10)
+	return verificationEncoding.EncodeToString([]byte(payload)) + "." + verificationEncoding.EncodeToString(verificationMAC(payload))
+}
+
+func parseVerification(token string) (string, string, bool) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", false
+	}
+	raw, err := verificationEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	mac, err := verificationEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, verificationMAC(string(raw))) {
+		return "", "", false
+	}
+	fields := strings.Split(string(raw), "\n")
+	if len(fields) != 3 {
+		return "", "", false
+	}
+	expiredAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().Unix() > expiredAt {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
+func newEmailVerification(username, email string, now time.Time) *models.EmailVerification {
+	expiredAt := now.Add(EmailVerificationTTL)
+	return &models.EmailVerification{Username: username, Email: email, Token: signVerification(username, email, expiredAt), ExpiredAt: expiredAt}
+}
+
+// CreateEmailVerification 为用户当前的邮箱生成验证链接；throttle为true时限制发送频率（重发验证邮件）
+func (h *DBHandler) CreateEmailVerification(ctx context.Context, username string, throttle bool) (*models.EmailVerification, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	var verification *models.EmailVerification
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var email, status string
+		var verifiedAt, sentAt *time.Time
+		err := tx.DB.QueryRow(ctx, `
+			SELECT email, status, email_verified_at, verification_sent_at FROM users WHERE username = ?`+tx.DB.ForUpdate(), username,
+		).Scan(&email, &status, &verifiedAt, &sentAt)
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return storeError("Failed to query user", err)
+		}
+		if status != "active" && status != statusPendingVerification {
+			return ErrAccountDisabled
+		}
+		if verifiedAt != nil {
+			return ErrEmailAlreadyVerified
+		}
+		now := time.Now()
+		if throttle && sentAt != nil && sentAt.After(now.Add(-VerificationResendInterval)) {
+			return ErrVerificationThrottled
+		}
+		if _, err := tx.DB.Exec(ctx, `UPDATE users SET verification_sent_at = ? WHERE username = ?`, now, username); err != nil {
+			return storeError("Failed to update user", err)
+		}
+		verification = newEmailVerification(username, email, now)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+
+// VerifyEmail 校验验证链接，记录验证时间；pending_verification的用户变为active
+func (h *DBHandler) VerifyEmail(ctx context.Context, token string) (string, error) {
+	if h.DB == nil {
+		return "", errNotInitialized
+	}
+	username, email, ok := parseVerification(token)
+	if !ok {
+		return "", ErrInvalidVerificationToken
+	}
+	err := h.withTx(ctx, func(tx *DBHandler) error {
+		var current, status string
+		var verifiedAt *time.Time
+		err := tx.DB.QueryRow(ctx, `
+			SELECT email, status, email_verified_at FROM users WHERE username = ?`+tx.DB.ForUpdate(), username,
+		).Scan(&current, &status, &verifiedAt)
+		if err == sql.ErrNoRows || (err == nil && current != email) { //用户已删除或邮箱已修改
+			return ErrInvalidVerificationToken
+		}
+		if err != nil {
+			return storeError("Failed to query user", err)
+		}
+		if verifiedAt != nil {
+			return ErrEmailAlreadyVerified
+		}
+		if status != "active" && status != statusPendingVerification {
+			return ErrAccountDisabled
+		}
+		_, err = tx.DB.Exec(ctx, `
+			UPDATE users SET email_verified_at = ?, status = ?, version = version + 1 WHERE username = ?`,
+			time.Now(), "active", username,
+		)
+		if err != nil {
+			return storeError("Failed to update user", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+type emailState struct {
+	VerifiedAt *time.Time
+	SentAt     *time.Time
+}
+
+func (h *MemoryHandler) deleteEmailState(username string) { //调用方持有写锁
+	h.saveEmailState(username)
+	delete(h.emails, username)
+}
+
+func (h *MemoryHandler) CreateEmailVerification(ctx context.Context, username string, throttle bool) (*models.EmailVerification, error) {
+	var verification *models.EmailVerification
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		user := tx.findByUsername(username)
+		if user == nil {
+			return ErrUserNotFound
+		}
+		if user.Status != "active" && user.Status != statusPendingVerification {
+			return ErrAccountDisabled
+		}
+		tx.saveEmailState(username)
+		state := tx.emails[username]
+		if state == nil {
+			state = &emailState{}
+			tx.emails[username] = state
+		}
+		if state.VerifiedAt != nil {
+			return ErrEmailAlreadyVerified
+		}
+		now := time.Now()
+		if throttle && state.SentAt != nil && state.SentAt.After(now.Add(-VerificationResendInterval)) {
+			return ErrVerificationThrottled
+		}
+		state.SentAt = &now
+		verification = newEmailVerification(username, user.Email, now)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+
+func (h *MemoryHandler) VerifyEmail(ctx context.Context, token string) (string, error) {
+	username, email, ok := parseVerification(token)
+	if !ok {
+		return "", ErrInvalidVerificationToken
+	}
+	err := h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		user := tx.findByUsername(username)
+		if user == nil || user.Email != email {
+			return ErrInvalidVerificationToken
+		}
+		tx.saveEmailState(username)
+		state := tx.emails[username]
+		if state == nil {
+			state = &emailState{}
+			tx.emails[username] = state
+		}
+		if state.VerifiedAt != nil {
+			return ErrEmailAlreadyVerified
+		}
+		if user.Status != "active" && user.Status != statusPendingVerification {
+			return ErrAccountDisabled
+		}
+		now := time.Now()
+		state.VerifiedAt = &now
+		tx.saveUser(user.ID)
+		user.Status = "active"
+		user.UpdatedAt = now
+		user.Version++
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
@@ -0,0 +1,102 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"user_system/models"
+)
+
+func enableEmailVerification(t *testing.T) {
+	t.Helper()
+	set(t, &EmailVerification, true)
+	set(t, &EmailVerificationKey, []byte("email verification key"))
+}
+
+// signWith 用另一个密钥签名，模拟伪造的链接
+func signWith(key []byte, username, email string, expiredAt time.Time) string {
+	old := EmailVerificationKey
+	defer func() { EmailVerificationKey = old }()
+	EmailVerificationKey = key
+	return signVerification(username, email, expiredAt)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	enableEmailVerification(t)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			createUser(t, store, "alice", "alice@example.com")
+			createUser(t, store, "bob", "bob@example.com")
+			if user, _ := store.GetUserByUsername(ctx, "alice"); user.Status != statusPendingVerification {
+				t.Fatalf("status = %q, want %q", user.Status, statusPendingVerification)
+			}
+			alice, err := store.CreateEmailVerification(ctx, "alice", true)
+			if err != nil {
+				t.Fatalf("CreateEmailVerification: %v", err)
+			}
+			if _, err := store.CreateEmailVerification(ctx, "alice", true); !errors.Is(err, ErrVerificationThrottled) {
+				t.Errorf("resend: err = %v, want %v", err, ErrVerificationThrottled)
+			}
+			bob, err := store.CreateEmailVerification(ctx, "bob", false)
+			if err != nil {
+				t.Fatalf("CreateEmailVerification: %v", err)
+			}
+			//修改邮箱后旧链接失效
+			newEmail := "bob@example.org"
+			if err := store.UpdateUser(ctx, &models.UpdateUserRequest{Username: "bob", Email: &newEmail}); err != nil {
+				t.Fatalf("UpdateUser: %v", err)
+			}
+
+			payload, sig, _ := strings.Cut(alice.Token, ".")
+			forged := verificationEncoding.EncodeToString([]byte("bob\nalice@example.com\n"+strings.Split(decode(t, payload), "\n")[2])) + "." + sig
+			tests := []struct {
+				name    string
+				token   string
+				want    string
+				wantErr error
+			}{
+				{"malformed", "garbage", "", ErrInvalidVerificationToken},
+				{"payload tampered", forged, "", ErrInvalidVerificationToken},
+				{"signature tampered", payload + "." + verificationEncoding.EncodeToString([]byte("signature")), "", ErrInvalidVerificationToken},
+				{"signed with another key", signWith([]byte("other key"), "alice", "alice@example.com", time.Now().Add(time.Hour)), "", ErrInvalidVerificationToken},
+				{"expired", signVerification("alice", "alice@example.com", time.Now().Add(-time.Minute)), "", ErrInvalidVerificationToken},
+				{"email changed", bob.Token, "", ErrInvalidVerificationToken},
+				{"unknown user", signVerification("carol", "carol@example.com", time.Now().Add(time.Hour)), "", ErrInvalidVerificationToken},
+				{"valid", alice.Token, "alice", nil},
+				{"already verified", alice.Token, "", ErrEmailAlreadyVerified},
+			}
+			for _, tt := range tests {
+				username, err := store.VerifyEmail(ctx, tt.token)
+				if !errors.Is(err, tt.wantErr) || username != tt.want {
+					t.Errorf("%s: VerifyEmail = %q, %v, want %q, %v", tt.name, username, err, tt.want, tt.wantErr)
+				}
+			}
+			if user, _ := store.GetUserByUsername(ctx, "alice"); user.Status != "active" {
+				t.Errorf("alice status = %q, want active", user.Status)
+			}
+			if user, _ := store.GetUserByUsername(ctx, "bob"); user.Status != statusPendingVerification {
+				t.Errorf("bob status = %q, want %q", user.Status, statusPendingVerification)
+			}
+			//新邮箱的链接可以使用
+			bob, err = store.CreateEmailVerification(ctx, "bob", false)
+			if err != nil || bob.Email != newEmail {
+				t.Fatalf("CreateEmailVerification = %+v, %v", bob, err)
+			}
+			if _, err := store.VerifyEmail(ctx, bob.Token); err != nil {
+				t.Errorf("VerifyEmail(new email): %v", err)
+			}
+		})
+	}
+}
+
+func decode(t *testing.T, s string) string {
+	t.Helper()
+	raw, err := verificationEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return string(raw)
+}
@@ -0,0 +1,827 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"user_system/database"
+	"user_system/models"
+	"user_system/utils"
+	"user_system/webauthn"
+)
+
+var (
+	WebAuthn             *webauthn.RelyingParty //为nil时不支持WebAuthn
+	WebAuthnLoginIPLimit = 10                   //同一IP最多同时持有几个未完成的无密码登录挑战
+)
+
+// 挑战的用途
+const (
+	webauthnRegister = "register"
+	webauthnLogin    = "login" //无密码登录
+	webauthnMFA      = "mfa"   //密码正确后的第二步验证
+)
+
+var errWebAuthnChallenge = errors.New("Invalid or expired WebAuthn challenge")
+
+type webauthnChallenge struct {
+	Kind      string
+	UserID    uint
+	MFAToken  string //第二步验证时为登录挑战的摘要
+	IP        string //无密码登录时为请求的来源IP
+	ExpiredAt time.Time
+}
+
+type webauthnCredential struct {
+	models.WebAuthnCredential
+	UserID     uint
+	Credential webauthn.Credential
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func credentialList(list []*webauthnCredential) []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(list))
+	for _, c := range list {
+		credentials = append(credentials, c.Credential)
+	}
+	return credentials
+}
+
+func webauthnEnabled() error {
+	if WebAuthn == nil {
+		return invalidInput("WebAuthn is not enabled")
+	}
+	return nil
+}
+
+// registrationFailed 注册失败属于请求参数问题，登录失败按认证失败处理
+func registrationFailed(err error) error {
+	return fmt.Errorf("%w: %w", ErrInvalidInput, err)
+}
+
+func loginFailed(err error) error {
+	return fmt.Errorf("%w: %w", ErrWebAuthnFailed, err)
+}
+
+func newCredential(userID uint, name string, c *webauthn.Credential) *webauthnCredential {
+	return &webauthnCredential{
+		WebAuthnCredential: models.WebAuthnCredential{
+			Name:        name,
+			AAGUID:      c.AAGUID,
+			Attestation: c.Attestation,
+			Transports:  c.Transports,
+			SignCount:   c.SignCount,
+			CreatedAt:   time.Now(),
+		},
+		UserID:     userID,
+		Credential: *c,
+	}
+}
+
+const credentialColumns = "id, user_id, credential_id, public_key, sign_count, aaguid, attestation, transports, name, created_at, last_used_at"
+
+func scanCredential(row rowScanner) (*webauthnCredential, error) {
+	var c webauthnCredential
+	var credentialID, publicKey, transports string
+	var signCount int64
+	err := row.Scan(&c.ID, &c.UserID, &credentialID, &publicKey, &signCount, &c.AAGUID, &c.Attestation, &transports, &c.Name, &c.CreatedAt, &c.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.SignCount = uint32(signCount)
+	if transports != "" {
+		c.Transports = strings.Split(transports, ",")
+	}
+	c.Credential = webauthn.Credential{SignCount: c.SignCount, AAGUID: c.AAGUID, Transports: c.Transports, Attestation: c.Attestation}
+	if c.Credential.ID, err = webauthn.Encoding.DecodeString(credentialID); err != nil {
+		return nil, err
+	}
+	if c.Credential.PublicKey, err = webauthn.Encoding.DecodeString(publicKey); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// saveChallenge 无密码登录不需要认证，同一IP未完成的挑战达到WebAuthnLoginIPLimit时返回ErrWebAuthnThrottled
+func (h *DBHandler) saveChallenge(ctx context.Context, kind string, userID uint, mfaToken, ip string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	err = h.withTx(ctx, func(tx *DBHandler) error {
+		now := time.Now()
+		if kind == webauthnLogin {
+			var count int
+			err := tx.DB.QueryRow(ctx, `
+				SELECT COUNT(*) FROM webauthn_challenges WHERE ip = ? AND kind = ? AND expired_at > ?`, ip, kind, now,
+			).Scan(&count)
+			if err != nil {
+				return storeError("Failed to query WebAuthn challenges", err)
+			}
+			if count >= WebAuthnLoginIPLimit {
+				return ErrWebAuthnThrottled
+			}
+		}
+		_, err := tx.DB.Exec(ctx, `
+			INSERT INTO webauthn_challenges (challenge, kind, user_id, mfa_token, ip, expired_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			challenge, kind, userID, mfaToken, ip, now.Add(webauthn.Timeout),
+		)
+		if err != nil {
+			return storeError("Failed to save WebAuthn challenge", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// takeChallenge 取出并删除clientDataJSON中的挑战，每个挑战无论校验是否通过都只能使用一次
+func (h *DBHandler) takeChallenge(ctx context.Context, clientDataJSON, kind string) (string, *webauthnChallenge, error) {
+	challenge, err := webauthn.ChallengeOf(clientDataJSON)
+	if err != nil {
+		return "", nil, err
+	}
+	var c webauthnChallenge
+	err = h.DB.QueryRow(ctx, `
+		SELECT kind, user_id, mfa_token, expired_at FROM webauthn_challenges WHERE challenge = ?`, challenge,
+	).Scan(&c.Kind, &c.UserID, &c.MFAToken, &c.ExpiredAt)
+	if err == sql.ErrNoRows {
+		return "", nil, errWebAuthnChallenge
+	}
+	if err != nil {
+		return "", nil, storeError("Failed to query WebAuthn challenge", err)
+	}
+	result, err := h.DB.Exec(ctx, `DELETE FROM webauthn_challenges WHERE challenge = ?`, challenge)
+	if err != nil {
+		return "", nil, storeError("Failed to delete WebAuthn challenge", err)
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows != 1 { //其他请求已经使用了这个挑战
+		return "", nil, errWebAuthnChallenge
+	}
+	if c.Kind != kind || c.ExpiredAt.Before(time.Now()) {
+		return "", nil, errWebAuthnChallenge
+	}
+	return challenge, &c, nil
+}
+
+func (h *DBHandler) credentialsOf(ctx context.Context, userID uint) ([]*webauthnCredential, error) {
+	rows, err := h.DB.ReadConsistent().Query(ctx, `
+		SELECT `+credentialColumns+` FROM webauthn_credentials WHERE user_id = ? ORDER BY id`, userID,
+	)
+	if err != nil {
+		return nil, storeError("Failed to query WebAuthn credentials", err)
+	}
+	defer rows.Close()
+	list := make([]*webauthnCredential, 0)
+	for rows.Next() {
+		c, err := scanCredential(rows)
+		if err != nil {
+			return nil, storeError("Failed to scan WebAuthn credential", err)
+		}
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeError("Failed to iterate WebAuthn credentials", err)
+	}
+	return list, nil
+}
+
+func (h *DBHandler) credentialByID(ctx context.Context, credentialID string) (*webauthnCredential, error) {
+	c, err := scanCredential(h.DB.QueryRow(ctx, `
+		SELECT `+credentialColumns+` FROM webauthn_credentials WHERE credential_id = ?`, credentialID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebAuthnCredentialNotFound
+	}
+	if err != nil {
+		return nil, storeError("Failed to query WebAuthn credential", err)
+	}
+	return c, nil
+}
+
+// BeginWebAuthnRegistration 为已登录的用户生成注册参数
+func (h *DBHandler) BeginWebAuthnRegistration(ctx context.Context, username string) (*webauthn.CreationOptions, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	user, err := h.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := h.credentialsOf(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := h.saveChallenge(ctx, webauthnRegister, user.ID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return WebAuthn.CreationOptions(challenge, user.ID, user.Username, credentialList(existing)), nil
+}
+
+func (h *DBHandler) FinishWebAuthnRegistration(ctx context.Context, username, name string, resp *webauthn.AttestationResponse) (*models.WebAuthnCredential, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, c, err := h.takeChallenge(ctx, resp.Response.ClientDataJSON, webauthnRegister)
+	if err != nil {
+		return nil, registrationFailed(err)
+	}
+	user, err := h.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserID != user.ID { //挑战是为其他用户生成的
+		return nil, registrationFailed(errWebAuthnChallenge)
+	}
+	verified, err := WebAuthn.VerifyRegistration(resp, challenge, false)
+	if err != nil {
+		return nil, registrationFailed(err)
+	}
+	credential := newCredential(user.ID, name, verified)
+	credentialID := webauthn.Encoding.EncodeToString(verified.ID)
+	_, err = h.DB.Exec(ctx, `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, aaguid, attestation, transports, name, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, credentialID, webauthn.Encoding.EncodeToString(verified.PublicKey), int64(verified.SignCount),
+		verified.AAGUID, verified.Attestation, strings.Join(verified.Transports, ","), name, credential.CreatedAt,
+	)
+	if database.IsUniqueViolation(err) { //同一个认证器不能重复注册
+		return nil, ErrDuplicateCredential
+	}
+	if err != nil {
+		return nil, storeError("Failed to save WebAuthn credential", err)
+	}
+	err = h.DB.QueryRow(ctx, `SELECT id FROM webauthn_credentials WHERE credential_id = ?`, credentialID).Scan(&credential.ID)
+	if err != nil {
+		return nil, storeError("Failed to query WebAuthn credential", err)
+	}
+	return &credential.WebAuthnCredential, nil
+}
+
+// BeginWebAuthnLogin 生成无密码登录参数，由认证器选择可发现凭证
+// allowCredentials总是为空，按用户名列出凭证会泄露账号是否存在以及是否注册了凭证
+func (h *DBHandler) BeginWebAuthnLogin(ctx context.Context, ip string) (*webauthn.RequestOptions, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, err := h.saveChallenge(ctx, webauthnLogin, 0, "", ip)
+	if err != nil {
+		return nil, err
+	}
+	return WebAuthn.RequestOptions(challenge, nil, true), nil
+}
+
+// FinishWebAuthnLogin 校验无密码登录的签名，通过后签发与密码登录相同的token
+// 无密码登录要求认证器完成了用户验证，不再需要第二步验证
+func (h *DBHandler) FinishWebAuthnLogin(ctx context.Context, req *models.WebAuthnLoginRequest) (*utils.TokenPair, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, _, err := h.takeChallenge(ctx, req.Credential.Response.ClientDataJSON, webauthnLogin)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	credential, err := h.credentialByID(ctx, req.Credential.ID)
+	if errors.Is(err, ErrWebAuthnCredentialNotFound) {
+		return nil, loginFailed(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.Credential.Response.UserHandle != "" {
+		handle, err := webauthn.Encoding.DecodeString(req.Credential.Response.UserHandle)
+		if id, ok := webauthn.ParseUserHandle(handle); err != nil || !ok || id != credential.UserID {
+			return nil, loginFailed(webauthn.ErrInvalidResponse)
+		}
+	}
+	var pair *utils.TokenPair
+	err = h.withTx(ctx, func(tx *DBHandler) error {
+		var err error
+		pair, err = tx.webauthnLogin(ctx, &req.Credential, challenge, credential, true, &utils.CreateTokenRequset{
+			Device:    req.Device,
+			UserAgent: req.UserAgent,
+			IP:        req.IP,
+			Remember:  req.Remember,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// webauthnLogin 先锁住用户行再锁住凭证，校验签名、更新签名计数并签发token，Request中的用户名与角色由这里填写
+func (h *DBHandler) webauthnLogin(ctx context.Context, resp *webauthn.AssertionResponse, challenge string, stored *webauthnCredential, requireUV bool, Request *utils.CreateTokenRequset) (*utils.TokenPair, error) {
+	var status string
+	err := h.DB.QueryRow(ctx, `
+		SELECT username, status, role FROM users WHERE id = ?`+h.DB.ForUpdate(), stored.UserID,
+	).Scan(&Request.Username, &status, &Request.Role)
+	if err == sql.ErrNoRows {
+		return nil, loginFailed(ErrUserNotFound)
+	}
+	if err != nil {
+		return nil, storeError("Failed to query user", err)
+	}
+	if err := loginAllowed(status); err != nil {
+		return nil, err
+	}
+	//读取凭证后签名计数可能已被并发的登录更新，加锁后重新读取
+	credential, err := scanCredential(h.DB.QueryRow(ctx, `
+		SELECT `+credentialColumns+` FROM webauthn_credentials WHERE id = ?`+h.DB.ForUpdate(), stored.ID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, loginFailed(ErrWebAuthnCredentialNotFound)
+	}
+	if err != nil {
+		return nil, storeError("Failed to query WebAuthn credential", err)
+	}
+	signCount, err := WebAuthn.VerifyLogin(resp, challenge, &credential.Credential, requireUV)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	_, err = h.DB.Exec(ctx, `
+		UPDATE webauthn_credentials SET sign_count = ?, last_used_at = ? WHERE id = ?`, int64(signCount), time.Now(), credential.ID,
+	)
+	if err != nil {
+		return nil, storeError("Failed to update WebAuthn credential", err)
+	}
+	pair, err := utils.IssueTokenPair(ctx, h.Tokens, Request)
+	if err != nil {
+		return nil, storeError("Failed to create token", err)
+	}
+	return pair, nil
+}
+
+// hasWebAuthn 用户是否注册了WebAuthn凭证，有凭证时密码登录需要第二步验证
+func (h *DBHandler) hasWebAuthn(ctx context.Context, username string) (bool, error) {
+	if WebAuthn == nil {
+		return false, nil
+	}
+	var count int
+	err := h.DB.QueryRow(ctx, `
+		SELECT COUNT(*) FROM webauthn_credentials WHERE user_id IN (SELECT id FROM users WHERE username = ?)`, username,
+	).Scan(&count)
+	if err != nil {
+		return false, storeError("Failed to query WebAuthn credentials", err)
+	}
+	return count > 0, nil
+}
+
+// mfaUser 返回未过期的登录挑战对应的用户
+func (h *DBHandler) mfaUser(ctx context.Context, digest string) (*models.User, error) {
+	var username string
+	var expiredAt time.Time
+	err := h.DB.QueryRow(ctx, `
+		SELECT username, expired_at FROM mfa_challenges WHERE token = ?`, digest,
+	).Scan(&username, &expiredAt)
+	if err == sql.ErrNoRows || (err == nil && expiredAt.Before(time.Now())) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, storeError("Failed to query MFA challenge", err)
+	}
+	user, err := h.GetUserByUsername(ctx, username)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	return user, err
+}
+
+// BeginWebAuthnMFA 用密码登录得到的mfa_token生成第二步验证的参数
+func (h *DBHandler) BeginWebAuthnMFA(ctx context.Context, mfaToken string) (*webauthn.RequestOptions, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	digest := utils.HashToken(mfaToken)
+	user, err := h.mfaUser(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := h.credentialsOf(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 {
+		return nil, ErrMFANotEnabled
+	}
+	challenge, err := h.saveChallenge(ctx, webauthnMFA, user.ID, digest, "")
+	if err != nil {
+		return nil, err
+	}
+	return WebAuthn.RequestOptions(challenge, credentialList(allow), false), nil
+}
+
+// FinishWebAuthnMFA 校验第二步验证的签名，通过后删除登录挑战并签发token
+// 密码已经验证过，这里只要求用户在场，不要求用户验证
+func (h *DBHandler) FinishWebAuthnMFA(ctx context.Context, req *models.WebAuthnLoginRequest) (*utils.TokenPair, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, c, err := h.takeChallenge(ctx, req.Credential.Response.ClientDataJSON, webauthnMFA)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	digest := utils.HashToken(req.MFAToken)
+	if c.MFAToken != digest { //挑战属于另一次登录
+		return nil, ErrInvalidMFAChallenge
+	}
+	credential, err := h.credentialByID(ctx, req.Credential.ID)
+	if errors.Is(err, ErrWebAuthnCredentialNotFound) {
+		return nil, loginFailed(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if credential.UserID != c.UserID {
+		return nil, loginFailed(webauthn.ErrInvalidResponse)
+	}
+	var pair *utils.TokenPair
+	err = h.withTx(ctx, func(tx *DBHandler) error {
+		var username, device string
+		var remember bool
+		var expiredAt time.Time
+		err := tx.DB.QueryRow(ctx, `
+			SELECT username, remember, device, expired_at FROM mfa_challenges WHERE token = ?`+tx.DB.ForUpdate(), digest,
+		).Scan(&username, &remember, &device, &expiredAt)
+		if err == sql.ErrNoRows || (err == nil && expiredAt.Before(time.Now())) {
+			return ErrInvalidMFAChallenge
+		}
+		if err != nil {
+			return storeError("Failed to query MFA challenge", err)
+		}
+		Request := &utils.CreateTokenRequset{Device: device, UserAgent: req.UserAgent, IP: req.IP, Remember: remember}
+		if pair, err = tx.webauthnLogin(ctx, &req.Credential, challenge, credential, false, Request); err != nil {
+			return err
+		}
+		if Request.Username != username {
+			return ErrInvalidMFAChallenge
+		}
+		if _, err := tx.DB.Exec(ctx, `DELETE FROM mfa_challenges WHERE token = ?`, digest); err != nil {
+			return storeError("Failed to delete MFA challenge", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (h *DBHandler) GetWebAuthnCredentials(ctx context.Context, username string) ([]*models.WebAuthnCredential, error) {
+	if h.DB == nil {
+		return nil, errNotInitialized
+	}
+	user, err := h.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	list, err := h.credentialsOf(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make([]*models.WebAuthnCredential, 0, len(list))
+	for _, c := range list {
+		credentials = append(credentials, &c.WebAuthnCredential)
+	}
+	return credentials, nil
+}
+
+// DeleteWebAuthnCredential 删除用户自己的凭证，id属于其他用户时同样返回不存在
+func (h *DBHandler) DeleteWebAuthnCredential(ctx context.Context, username string, id int) error {
+	if h.DB == nil {
+		return errNotInitialized
+	}
+	result, err := h.DB.Exec(ctx, `
+		DELETE FROM webauthn_credentials WHERE id = ? AND user_id IN (SELECT id FROM users WHERE username = ?)`, id, username,
+	)
+	if err != nil {
+		return storeError("Failed to delete WebAuthn credential", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return storeError("Failed to get affected rows", err)
+	}
+	if rows == 0 {
+		return ErrWebAuthnCredentialNotFound
+	}
+	return nil
+}
+
+func (c *webauthnCredential) copy() *webauthnCredential {
+	copied := *c
+	return &copied
+}
+
+// saveChallenge 挑战不随事务回滚，回滚其他事务不会让用过的挑战重新生效
+func (h *MemoryHandler) saveChallenge(kind string, userID uint, mfaToken, ip string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if kind == webauthnLogin {
+		count := 0
+		for _, c := range h.webauthnChallenges {
+			if c.IP == ip && c.Kind == kind && c.ExpiredAt.After(now) {
+				count++
+			}
+		}
+		if count >= WebAuthnLoginIPLimit {
+			return "", ErrWebAuthnThrottled
+		}
+	}
+	h.webauthnChallenges[challenge] = &webauthnChallenge{Kind: kind, UserID: userID, MFAToken: mfaToken, IP: ip, ExpiredAt: now.Add(webauthn.Timeout)}
+	return challenge, nil
+}
+
+func (h *MemoryHandler) takeChallenge(clientDataJSON, kind string) (string, *webauthnChallenge, error) {
+	challenge, err := webauthn.ChallengeOf(clientDataJSON)
+	if err != nil {
+		return "", nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.webauthnChallenges[challenge]
+	if c == nil {
+		return "", nil, errWebAuthnChallenge
+	}
+	delete(h.webauthnChallenges, challenge)
+	if c.Kind != kind || c.ExpiredAt.Before(time.Now()) {
+		return "", nil, errWebAuthnChallenge
+	}
+	return challenge, c, nil
+}
+
+// credentialsOf 按id顺序返回用户的凭证，调用方持有锁
+func (h *MemoryHandler) credentialsOf(userID uint) []*webauthnCredential {
+	list := make([]*webauthnCredential, 0)
+	for _, c := range h.credentials {
+		if c.UserID == userID {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (h *MemoryHandler) credentialByID(credentialID string) *webauthnCredential { //调用方持有锁
+	for _, c := range h.credentials {
+		if webauthn.Encoding.EncodeToString(c.Credential.ID) == credentialID {
+			return c
+		}
+	}
+	return nil
+}
+
+func (h *MemoryHandler) BeginWebAuthnRegistration(ctx context.Context, username string) (*webauthn.CreationOptions, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	user, err := h.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	existing := credentialList(h.credentialsOf(user.ID))
+	h.mu.RUnlock()
+	challenge, err := h.saveChallenge(webauthnRegister, user.ID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return WebAuthn.CreationOptions(challenge, user.ID, user.Username, existing), nil
+}
+
+func (h *MemoryHandler) FinishWebAuthnRegistration(ctx context.Context, username, name string, resp *webauthn.AttestationResponse) (*models.WebAuthnCredential, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, c, err := h.takeChallenge(resp.Response.ClientDataJSON, webauthnRegister)
+	if err != nil {
+		return nil, registrationFailed(err)
+	}
+	user, err := h.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserID != user.ID {
+		return nil, registrationFailed(errWebAuthnChallenge)
+	}
+	verified, err := WebAuthn.VerifyRegistration(resp, challenge, false)
+	if err != nil {
+		return nil, registrationFailed(err)
+	}
+	credential := newCredential(user.ID, name, verified)
+	err = h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		if tx.credentialByID(webauthn.Encoding.EncodeToString(verified.ID)) != nil { //模拟唯一索引
+			return ErrDuplicateCredential
+		}
+		tx.nextCredentialID++
+		credential.ID = tx.nextCredentialID
+		tx.saveCredential(credential.ID)
+		tx.credentials[credential.ID] = credential.copy()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &credential.WebAuthnCredential, nil
+}
+
+func (h *MemoryHandler) BeginWebAuthnLogin(ctx context.Context, ip string) (*webauthn.RequestOptions, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, err := h.saveChallenge(webauthnLogin, 0, "", ip)
+	if err != nil {
+		return nil, err
+	}
+	return WebAuthn.RequestOptions(challenge, nil, true), nil
+}
+
+func (h *MemoryHandler) FinishWebAuthnLogin(ctx context.Context, req *models.WebAuthnLoginRequest) (*utils.TokenPair, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, _, err := h.takeChallenge(req.Credential.Response.ClientDataJSON, webauthnLogin)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	var pair *utils.TokenPair
+	err = h.withTx(ctx, func(tx *MemoryHandler) error {
+		Request, err := tx.webauthnLogin(req, challenge, 0, true)
+		if err != nil {
+			return err
+		}
+		Request.Device, Request.Remember = req.Device, req.Remember
+		if pair, err = utils.IssueTokenPair(ctx, tx.Tokens, Request); err != nil {
+			return fmt.Errorf("Failed to create token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// webauthnLogin 校验签名并更新签名计数，userID不为0时凭证必须属于该用户，返回签发token的请求
+func (h *MemoryHandler) webauthnLogin(req *models.WebAuthnLoginRequest, challenge string, userID uint, requireUV bool) (*utils.CreateTokenRequset, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	credential := h.credentialByID(req.Credential.ID)
+	if credential == nil {
+		return nil, loginFailed(ErrWebAuthnCredentialNotFound)
+	}
+	if userID != 0 && credential.UserID != userID {
+		return nil, loginFailed(webauthn.ErrInvalidResponse)
+	}
+	if req.Credential.Response.UserHandle != "" {
+		handle, err := webauthn.Encoding.DecodeString(req.Credential.Response.UserHandle)
+		if id, ok := webauthn.ParseUserHandle(handle); err != nil || !ok || id != credential.UserID {
+			return nil, loginFailed(webauthn.ErrInvalidResponse)
+		}
+	}
+	user := h.users[credential.UserID]
+	if user == nil {
+		return nil, loginFailed(ErrUserNotFound)
+	}
+	if err := loginAllowed(user.Status); err != nil {
+		return nil, err
+	}
+	signCount, err := WebAuthn.VerifyLogin(&req.Credential, challenge, &credential.Credential, requireUV)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	now := time.Now()
+	h.saveCredential(credential.ID)
+	credential.SignCount, credential.Credential.SignCount, credential.LastUsedAt = signCount, signCount, &now
+	return &utils.CreateTokenRequset{
+		Role:      user.Role,
+		Username:  user.Username,
+		UserAgent: req.UserAgent,
+		IP:        req.IP,
+	}, nil
+}
+
+func (h *MemoryHandler) BeginWebAuthnMFA(ctx context.Context, mfaToken string) (*webauthn.RequestOptions, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	digest := utils.HashToken(mfaToken)
+	h.mu.RLock()
+	var user *models.User
+	if c := h.challenges[digest]; c != nil && !c.ExpiredAt.Before(time.Now()) {
+		user = h.findByUsername(c.Username)
+	}
+	var allow []webauthn.Credential
+	if user != nil {
+		allow = credentialList(h.credentialsOf(user.ID))
+	}
+	h.mu.RUnlock()
+	if user == nil {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if len(allow) == 0 {
+		return nil, ErrMFANotEnabled
+	}
+	challenge, err := h.saveChallenge(webauthnMFA, user.ID, digest, "")
+	if err != nil {
+		return nil, err
+	}
+	return WebAuthn.RequestOptions(challenge, allow, false), nil
+}
+
+func (h *MemoryHandler) FinishWebAuthnMFA(ctx context.Context, req *models.WebAuthnLoginRequest) (*utils.TokenPair, error) {
+	if err := webauthnEnabled(); err != nil {
+		return nil, err
+	}
+	challenge, c, err := h.takeChallenge(req.Credential.Response.ClientDataJSON, webauthnMFA)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	digest := utils.HashToken(req.MFAToken)
+	if c.MFAToken != digest {
+		return nil, ErrInvalidMFAChallenge
+	}
+	var pair *utils.TokenPair
+	err = h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.RLock()
+		mfa := tx.challenges[digest]
+		tx.mu.RUnlock()
+		if mfa == nil || mfa.ExpiredAt.Before(time.Now()) {
+			return ErrInvalidMFAChallenge
+		}
+		Request, err := tx.webauthnLogin(req, challenge, c.UserID, false)
+		if err != nil {
+			return err
+		}
+		if Request.Username != mfa.Username {
+			return ErrInvalidMFAChallenge
+		}
+		tx.mu.Lock()
+		tx.saveMFAChallenge(digest)
+		delete(tx.challenges, digest)
+		tx.mu.Unlock()
+		Request.Device, Request.Remember = mfa.Device, mfa.Remember
+		if pair, err = utils.IssueTokenPair(ctx, tx.Tokens, Request); err != nil {
+			return fmt.Errorf("Failed to create token: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (h *MemoryHandler) GetWebAuthnCredentials(ctx context.Context, username string) ([]*models.WebAuthnCredential, error) {
+	user, err := h.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	credentials := make([]*models.WebAuthnCredential, 0)
+	for _, c := range h.credentialsOf(user.ID) {
+		credentials = append(credentials, &c.copy().WebAuthnCredential)
+	}
+	return credentials, nil
+}
+
+func (h *MemoryHandler) DeleteWebAuthnCredential(ctx context.Context, username string, id int) error {
+	return h.withTx(ctx, func(tx *MemoryHandler) error {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		user := tx.findByUsername(username)
+		if c := tx.credentials[id]; c == nil || user == nil || c.UserID != user.ID {
+			return ErrWebAuthnCredentialNotFound
+		}
+		tx.saveCredential(id)
+		delete(tx.credentials, id)
+		return nil
+	})
+}
+
+func (h *MemoryHandler) deleteCredentials(userID uint) { //调用方持有写锁
+	for id, c := range h.credentials {
+		if c.UserID == userID {
+			h.saveCredential(id)
+			delete(h.credentials, id)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"user_system/internal/webauthntest"
+	"user_system/models"
+	"user_system/webauthn"
+)
+
+const testOrigin = "https://example.com"
+
+func enableWebAuthn(t *testing.T) {
+	t.Helper()
+	set(t, &WebAuthn, &webauthn.RelyingParty{ID: "example.com", Name: "Example", Origins: []string{testOrigin}})
+}
+
+// registerPasskey 用软件认证器为用户注册一个凭证
+func registerPasskey(t *testing.T, store UserStore, username string) *webauthntest.Authenticator {
+	t.Helper()
+	ctx := context.Background()
+	a := webauthntest.New(testOrigin)
+	options, err := store.BeginWebAuthnRegistration(ctx, username)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration: %v", err)
+	}
+	resp, err := a.Create(options)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := store.FinishWebAuthnRegistration(ctx, username, "key", resp); err != nil {
+		t.Fatalf("FinishWebAuthnRegistration: %v", err)
+	}
+	return a
+}
+
+func passkeyLogin(t *testing.T, store UserStore, a *webauthntest.Authenticator) (*models.WebAuthnLoginRequest, error) {
+	t.Helper()
+	ctx := context.Background()
+	options, err := store.BeginWebAuthnLogin(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin: %v", err)
+	}
+	resp, err := a.Get(options)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	req := &models.WebAuthnLoginRequest{Credential: *resp}
+	_, err = store.FinishWebAuthnLogin(ctx, req)
+	return req, err
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	enableWebAuthn(t)
+	ctx := context.Background()
+	store := newMemoryStore(t)
+	createUser(t, store, "alice", "alice@example.com")
+
+	a := webauthntest.New(testOrigin)
+	options, err := store.BeginWebAuthnRegistration(ctx, "alice")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration: %v", err)
+	}
+	resp, err := a.Create(options)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	credential, err := store.FinishWebAuthnRegistration(ctx, "alice", "laptop", resp)
+	if err != nil {
+		t.Fatalf("FinishWebAuthnRegistration: %v", err)
+	}
+	if credential.Name != "laptop" || credential.Attestation != "none" {
+		t.Errorf("credential = %+v", credential)
+	}
+	//挑战只能使用一次
+	if _, err := store.FinishWebAuthnRegistration(ctx, "alice", "laptop", resp); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("replayed registration: err = %v, want %v", err, ErrInvalidInput)
+	}
+	//已注册的凭证出现在excludeCredentials中，认证器拒绝重复注册
+	options, err = store.BeginWebAuthnRegistration(ctx, "alice")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration: %v", err)
+	}
+	if len(options.ExcludeCredentials) != 1 {
+		t.Fatalf("ExcludeCredentials = %d, want 1", len(options.ExcludeCredentials))
+	}
+	if _, err := a.Create(options); err == nil {
+		t.Error("Create with excluded credential succeeded")
+	}
+	//挑战属于注册时的用户，其他用户不能用它完成注册
+	createUser(t, store, "bob", "bob@example.com")
+	options, _ = store.BeginWebAuthnRegistration(ctx, "alice")
+	resp, err = webauthntest.New(testOrigin).Create(options)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := store.FinishWebAuthnRegistration(ctx, "bob", "stolen", resp); !errors.Is(err, ErrInvalidInput) {
+		t.Errorf("cross-user registration: err = %v, want %v", err, ErrInvalidInput)
+	}
+	list, err := store.GetWebAuthnCredentials(ctx, "bob")
+	if err != nil || len(list) != 0 {
+		t.Errorf("bob credentials = %v, %v", list, err)
+	}
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	enableWebAuthn(t)
+	store := newMemoryStore(t)
+	createUser(t, store, "alice", "alice@example.com")
+	a := registerPasskey(t, store, "alice")
+
+	//登录参数不列出任何凭证，不能据此判断账号是否存在或是否注册了凭证
+	options, err := store.BeginWebAuthnLogin(context.Background(), "10.0.0.1")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin: %v", err)
+	}
+	if len(options.AllowCredentials) != 0 {
+		t.Errorf("AllowCredentials = %v, want empty", options.AllowCredentials)
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(a *webauthntest.Authenticator)
+		wantErr error
+	}{
+		{name: "user verified"},
+		{name: "presence only", setup: func(a *webauthntest.Authenticator) { a.UserVerified = false }, wantErr: ErrWebAuthnFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := a.Clone()
+			if tt.setup != nil {
+				tt.setup(a)
+			}
+			if _, err := passkeyLogin(t, store, a); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebAuthnChallengeSingleUse(t *testing.T) {
+	enableWebAuthn(t)
+	ctx := context.Background()
+	store := newMemoryStore(t)
+	createUser(t, store, "alice", "alice@example.com")
+	a := registerPasskey(t, store, "alice")
+
+	req, err := passkeyLogin(t, store, a)
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if _, err := store.FinishWebAuthnLogin(ctx, req); !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("replayed assertion: err = %v, want %v", err, ErrWebAuthnFailed)
+	}
+	//无密码登录的挑战不能用于第二步验证
+	options, _ := store.BeginWebAuthnLogin(ctx, "10.0.0.1")
+	resp, _ := a.Get(options)
+	_, challenge := login(t, store, "alice")
+	_, err = store.FinishWebAuthnMFA(ctx, &models.WebAuthnLoginRequest{MFAToken: challenge.Token, Credential: *resp})
+	if !errors.Is(err, ErrWebAuthnFailed) {
+		t.Errorf("login challenge used for MFA: err = %v, want %v", err, ErrWebAuthnFailed)
+	}
+}
+
+// 无密码登录不需要认证，同一IP未完成的挑战数量受限，其他IP不受影响
+func TestWebAuthnLoginThrottle(t *testing.T) {
+	enableWebAuthn(t)
+	set(t, &WebAuthnLoginIPLimit, 2)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := 0; i < 2; i++ {
+				if _, err := store.BeginWebAuthnLogin(ctx, "10.0.0.1"); err != nil {
+					t.Fatalf("BeginWebAuthnLogin #%d: %v", i+1, err)
+				}
+			}
+			if _, err := store.BeginWebAuthnLogin(ctx, "10.0.0.1"); !errors.Is(err, ErrWebAuthnThrottled) {
+				t.Errorf("third BeginWebAuthnLogin: err = %v, want %v", err, ErrWebAuthnThrottled)
+			}
+			if _, err := store.BeginWebAuthnLogin(ctx, "10.0.0.2"); err != nil {
+				t.Errorf("BeginWebAuthnLogin from another IP: %v", err)
+			}
+		})
+	}
+}
+
+func TestWebAuthnSignCountRegression(t *testing.T) {
+	enableWebAuthn(t)
+	store := newMemoryStore(t)
+	createUser(t, store, "alice", "alice@example.com")
+	a := registerPasskey(t, store, "alice")
+	clone := a.Clone()
+
+	if _, err := passkeyLogin(t, store, a); err != nil {
+		t.Fatalf("original: %v", err)
+	}
+	_, err := passkeyLogin(t, store, clone)
+	if !errors.Is(err, ErrWebAuthnFailed) || !errors.Is(err, webauthn.ErrSignCount) {
+		t.Errorf("clone: err = %v, want %v", err, webauthn.ErrSignCount)
+	}
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	enableWebAuthn(t)
+	ctx := context.Background()
+	store := newMemoryStore(t)
+	createUser(t, store, "alice", "alice@example.com")
+	createUser(t, store, "bob", "bob@example.com")
+	alice := registerPasskey(t, store, "alice")
+	bob := registerPasskey(t, store, "bob")
+
+	begin := func(mfaToken string) *webauthn.RequestOptions {
+		t.Helper()
+		options, err := store.BeginWebAuthnMFA(ctx, mfaToken)
+		if err != nil {
+			t.Fatalf("BeginWebAuthnMFA: %v", err)
+		}
+		return options
+	}
+	sign := func(a *webauthntest.Authenticator, options *webauthn.RequestOptions) webauthn.AssertionResponse {
+		t.Helper()
+		resp, err := a.Get(options)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		return *resp
+	}
+
+	pair, challenge := login(t, store, "alice")
+	if pair != nil || challenge == nil || len(challenge.Methods) != 1 || challenge.Methods[0] != "webauthn" {
+		t.Fatalf("password login = %v, %+v, want a webauthn challenge", pair, challenge)
+	}
+	_, bobChallenge := login(t, store, "bob")
+	stale := begin(challenge.Token) //在完成登录之前取得的参数
+
+	tests := []struct {
+		name    string
+		req     func() *models.WebAuthnLoginRequest
+		wantErr error
+	}{
+		{"other user's mfa_token", func() *models.WebAuthnLoginRequest {
+			return &models.WebAuthnLoginRequest{MFAToken: bobChallenge.Token, Credential: sign(alice, begin(challenge.Token))}
+		}, ErrInvalidMFAChallenge},
+		{"other user's credential", func() *models.WebAuthnLoginRequest {
+			options := begin(challenge.Token)
+			options.AllowCredentials = nil
+			return &models.WebAuthnLoginRequest{MFAToken: challenge.Token, Credential: sign(bob, options)}
+		}, ErrWebAuthnFailed},
+		{"ok", func() *models.WebAuthnLoginRequest {
+			return &models.WebAuthnLoginRequest{MFAToken: challenge.Token, Credential: sign(alice, begin(challenge.Token))}
+		}, nil},
+		{"mfa_token already used", func() *models.WebAuthnLoginRequest {
+			return &models.WebAuthnLoginRequest{MFAToken: challenge.Token, Credential: sign(alice, stale)}
+		}, ErrInvalidMFAChallenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair, err := store.FinishWebAuthnMFA(ctx, tt.req())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && pair == nil {
+				t.Error("no token pair issued")
+			}
+		})
+	}
+}
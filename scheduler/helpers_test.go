@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"user_system/database"
+	"user_system/migrations"
+
+	_ "modernc.org/sqlite"
+)
+
+// newSQLiteStore 在临时目录中创建SQLite数据库并执行全部迁移
+func newSQLiteStore(t *testing.T) *DBLeaseStore {
+	t.Helper()
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_integer_format=unix_micro&_inttotime=1&_txlock=immediate",
+		filepath.Join(t.TempDir(), "test.db"),
+	))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	conn := database.NewConn(db, database.DriverSQLite)
+	migrator, err := migrations.NewMigrator(conn)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	store, err := NewDBLeaseStore(conn)
+	if err != nil {
+		t.Fatalf("NewDBLeaseStore: %v", err)
+	}
+	return store
+}
+
+// stores 返回需要保持一致行为的LeaseStore实现
+func stores(t *testing.T) map[string]LeaseStore {
+	t.Helper()
+	return map[string]LeaseStore{
+		"memory": NewMemoryLeaseStore(),
+		"sqlite": newSQLiteStore(t),
+	}
+}
+
+// newScheduler 注册任务并启动；执行计划足够长，测试中由runOnce触发
+func newScheduler(t *testing.T, leases LeaseStore, run func(ctx context.Context) error) (*Scheduler, *Job) {
+	t.Helper()
+	s := New(leases)
+	if err := s.Register(Job{Name: "cleanup", Spec: "@every 24h", Run: run}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s, s.jobs[0]
+}
+
+func status(t *testing.T, s *Scheduler) Status {
+	t.Helper()
+	list, err := s.Status(context.Background())
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Status = %+v, %v", list, err)
+	}
+	return list[0]
+}
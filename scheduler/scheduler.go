@@ -0,0 +1,182 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Job 是注册到调度器的维护任务
+type Job struct {
+	Name     string
+	Spec     string //执行计划，格式见Parse
+	Timeout  time.Duration
+	Run      func(ctx context.Context) error
+	schedule Schedule
+}
+
+// Status 是返回给管理员的任务状态
+type Status struct {
+	Name           string     `json:"name"`
+	Schedule       string     `json:"schedule"`
+	NextRunAt      time.Time  `json:"next_run_at"`
+	LastRunAt      *time.Time `json:"last_run_at"`
+	LastDurationMS int64      `json:"last_duration_ms"`
+	LastStatus     string     `json:"last_status"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastRunner     string     `json:"last_runner,omitempty"`
+	Running        bool       `json:"running"`
+	RunningOn      string     `json:"running_on,omitempty"`
+}
+
+const defaultJobTimeout = 10 * time.Minute
+
+// Scheduler 按执行计划在后台运行任务；多个实例共享LeaseStore时，每个时间点只有一个实例运行
+type Scheduler struct {
+	Owner  string //实例标识，记录在租约与运行结果中
+	leases LeaseStore
+	jobs   []*Job
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func New(leases LeaseStore) *Scheduler {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &Scheduler{Owner: fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix)), leases: leases}
+}
+
+// Register 注册任务，需在Start之前调用；Spec为空时不注册，用于通过配置关闭任务
+func (s *Scheduler) Register(job Job) error {
+	if job.Spec == "" {
+		return nil
+	}
+	if s.stop != nil {
+		return fmt.Errorf("Register: Scheduler is already started")
+	}
+	schedule, err := Parse(job.Spec)
+	if err != nil {
+		return fmt.Errorf("Job %s: %w", job.Name, err)
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("Job %s: Schedule %q never fires", job.Name, job.Spec)
+	}
+	if job.Timeout <= 0 {
+		job.Timeout = defaultJobTimeout
+	}
+	job.schedule = schedule
+	s.jobs = append(s.jobs, &job)
+	return nil
+}
+
+func (s *Scheduler) Start(ctx context.Context) error {
+	for _, job := range s.jobs {
+		if err := s.leases.Register(ctx, job.Name); err != nil {
+			return fmt.Errorf("Failed to register job %s: %w", job.Name, err)
+		}
+	}
+	s.stop = make(chan struct{})
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(job)
+	}
+	return nil
+}
+
+// Close 停止调度，并等待正在运行的任务结束
+func (s *Scheduler) Close() {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+	}
+}
+
+func (s *Scheduler) loop(job *Job) {
+	defer s.wg.Done()
+	for {
+		slot := job.schedule.Next(time.Now())
+		timer := time.NewTimer(time.Until(slot))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.runOnce(job, slot)
+	}
+}
+
+// runOnce 先认领时间点，认领失败说明其他实例已经运行或正在运行
+func (s *Scheduler) runOnce(job *Job, slot time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout)
+	defer cancel()
+	acquired, err := s.leases.Acquire(ctx, job.Name, s.Owner, slot, job.Timeout)
+	if err != nil {
+		log.Printf("Job %s: failed to acquire lease: %v", job.Name, err)
+		return
+	}
+	if !acquired {
+		return
+	}
+	run := &Run{StartedAt: time.Now()}
+	run.Err = s.call(ctx, job)
+	run.Duration = time.Since(run.StartedAt)
+	if run.Err != nil {
+		log.Printf("Job %s failed after %s: %v", job.Name, run.Duration, run.Err)
+	} else {
+		log.Printf("Job %s finished in %s", job.Name, run.Duration)
+	}
+	//任务可能因超时结束，记录结果时使用新的ctx
+	releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer releaseCancel()
+	if err := s.leases.Release(releaseCtx, job.Name, s.Owner, run); err != nil {
+		log.Printf("Job %s: failed to record result: %v", job.Name, err)
+	}
+}
+
+func (s *Scheduler) call(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+// Status 合并本实例的执行计划与共享的运行记录
+func (s *Scheduler) Status(ctx context.Context) ([]Status, error) {
+	records, err := s.leases.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]JobRecord, len(records))
+	for _, r := range records {
+		byName[r.Name] = r
+	}
+	now := time.Now()
+	list := make([]Status, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		r := byName[job.Name]
+		status := Status{
+			Name:           job.Name,
+			Schedule:       job.Spec,
+			NextRunAt:      job.schedule.Next(now),
+			LastRunAt:      r.LastRunAt,
+			LastDurationMS: r.LastDuration.Milliseconds(),
+			LastStatus:     r.LastStatus,
+			LastError:      r.LastError,
+			LastRunner:     r.LastRunner,
+		}
+		if r.LeaseOwner != "" && r.LeaseExpiresAt != nil && r.LeaseExpiresAt.After(now) {
+			status.Running, status.RunningOn = true, r.LeaseOwner
+		}
+		list = append(list, status)
+	}
+	return list, nil
+}
@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 共享LeaseStore的多个实例同时触发同一时间点，任务只运行一次
+func TestRunOnceExactlyOnce(t *testing.T) {
+	for name, leases := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			var runs atomic.Int32
+			run := func(ctx context.Context) error {
+				runs.Add(1)
+				return nil
+			}
+			a, jobA := newScheduler(t, leases, run)
+			b, jobB := newScheduler(t, leases, run)
+
+			slot := time.Now().Truncate(time.Second)
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(2)
+				go func() { defer wg.Done(); a.runOnce(jobA, slot) }()
+				go func() { defer wg.Done(); b.runOnce(jobB, slot) }()
+			}
+			wg.Wait()
+			if n := runs.Load(); n != 1 {
+				t.Fatalf("job ran %d times for one slot, want 1", n)
+			}
+			st := status(t, b)
+			if st.LastStatus != "success" || st.LastRunAt == nil || (st.LastRunner != a.Owner && st.LastRunner != b.Owner) {
+				t.Errorf("Status = %+v", st)
+			}
+			//已经运行过的时间点不再运行，下一个时间点正常运行
+			b.runOnce(jobB, slot)
+			a.runOnce(jobA, slot.Add(time.Second))
+			if n := runs.Load(); n != 2 {
+				t.Errorf("job ran %d times for two slots, want 2", n)
+			}
+		})
+	}
+}
+
+// 任务返回错误或panic时记录为失败
+func TestRunOnceFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func(ctx context.Context) error
+		wantErr string
+	}{
+		{"error", func(ctx context.Context) error { return errors.New("disk full") }, "disk full"},
+		{"panic", func(ctx context.Context) error { panic("boom") }, "panic: boom"},
+	}
+	for name, leases := range stores(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				s := New(leases)
+				if err := s.Register(Job{Name: "job-" + tt.name, Spec: "@every 24h", Run: tt.run}); err != nil {
+					t.Fatalf("Register: %v", err)
+				}
+				if err := s.Start(context.Background()); err != nil {
+					t.Fatalf("Start: %v", err)
+				}
+				t.Cleanup(s.Close)
+				s.runOnce(s.jobs[0], time.Now().Truncate(time.Second))
+
+				records, err := leases.List(context.Background())
+				if err != nil {
+					t.Fatalf("List: %v", err)
+				}
+				var r *JobRecord
+				for j := range records {
+					if records[j].Name == "job-"+tt.name {
+						r = &records[j]
+					}
+				}
+				if r == nil || r.LastStatus != "failed" || !strings.Contains(r.LastError, tt.wantErr) || r.LastRunner != s.Owner || r.LeaseOwner != "" {
+					t.Errorf("record = %+v, want failed with %q", r, tt.wantErr)
+				}
+			})
+		}
+	}
+}
+
+// 持有租约期间所有实例都报告任务正在运行，结束后释放
+func TestStatusRunning(t *testing.T) {
+	for name, leases := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			started, done := make(chan struct{}), make(chan struct{})
+			a, job := newScheduler(t, leases, func(ctx context.Context) error {
+				close(started)
+				<-done
+				return nil
+			})
+			b, _ := newScheduler(t, leases, nil)
+
+			finished := make(chan struct{})
+			go func() {
+				defer close(finished)
+				a.runOnce(job, time.Now().Truncate(time.Second))
+			}()
+			<-started
+			for _, s := range []*Scheduler{a, b} {
+				if st := status(t, s); !st.Running || st.RunningOn != a.Owner {
+					t.Errorf("Status while running = %+v, want running on %s", st, a.Owner)
+				}
+			}
+			close(done)
+			<-finished
+			if st := status(t, b); st.Running || st.RunningOn != "" || st.LastStatus != "success" {
+				t.Errorf("Status after release = %+v", st)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"user_system/database"
+)
+
+// JobRecord 是保存在数据库中的任务状态，集群中各实例共享
+type JobRecord struct {
+	Name           string
+	LastSlot       *time.Time //最近一次被某个实例认领的计划时间点
+	LastRunAt      *time.Time
+	LastDuration   time.Duration
+	LastStatus     string //success、failed，从未运行过时为空
+	LastError      string
+	LastRunner     string
+	LeaseOwner     string //正在运行的实例，未运行时为空
+	LeaseExpiresAt *time.Time
+}
+
+// Run 是一次运行的结果
+type Run struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Err       error
+}
+
+// LeaseStore 保存任务租约与最近一次运行的结果
+type LeaseStore interface {
+	Register(ctx context.Context, name string) error
+	// Acquire 认领计划时间点slot：该时间点未被认领且没有其他实例持有未过期的租约时返回true
+	Acquire(ctx context.Context, name, owner string, slot time.Time, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, name, owner string, run *Run) error
+	List(ctx context.Context) ([]JobRecord, error)
+}
+
+func runStatus(run *Run) (status, message string) {
+	if run.Err != nil {
+		return "failed", truncate(run.Err.Error(), 500)
+	}
+	return "success", ""
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+// DBLeaseStore 把租约保存在scheduled_jobs表中，依靠条件UPDATE保证同一时间点只有一个实例认领成功
+type DBLeaseStore struct {
+	DB *database.Conn
+}
+
+func NewDBLeaseStore(db *database.Conn) (*DBLeaseStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("NewDBLeaseStore: Database connection is not initialized")
+	}
+	//表结构由migrations包维护
+	return &DBLeaseStore{DB: db}, nil
+}
+
+func (s *DBLeaseStore) Register(ctx context.Context, name string) error {
+	_, err := s.DB.Exec(ctx, `INSERT INTO scheduled_jobs (name) VALUES (?)`, name)
+	if err != nil && !database.IsUniqueViolation(err) { //其他实例已经注册过
+		return err
+	}
+	return nil
+}
+
+func (s *DBLeaseStore) Acquire(ctx context.Context, name, owner string, slot time.Time, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	result, err := s.DB.Exec(ctx, `
+	UPDATE scheduled_jobs SET lease_owner = ?, lease_expires_at = ?, last_slot = ?
+	WHERE name = ? AND (last_slot IS NULL OR last_slot < ?) AND (lease_expires_at IS NULL OR lease_expires_at < ?)`,
+		owner, now.Add(ttl), slot, name, slot, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *DBLeaseStore) Release(ctx context.Context, name, owner string, run *Run) error {
+	status, message := runStatus(run)
+	_, err := s.DB.Exec(ctx, `
+	UPDATE scheduled_jobs SET lease_owner = '', lease_expires_at = NULL,
+		last_run_at = ?, last_duration_ms = ?, last_status = ?, last_error = ?, last_runner = ?
+	WHERE name = ? AND lease_owner = ?`,
+		run.StartedAt, run.Duration.Milliseconds(), status, message, owner, name, owner,
+	)
+	return err
+}
+
+func (s *DBLeaseStore) List(ctx context.Context) ([]JobRecord, error) {
+	rows, err := s.DB.ReadOnly().Query(ctx, `
+	SELECT name, last_slot, last_run_at, last_duration_ms, last_status, last_error, last_runner, lease_owner, lease_expires_at
+	FROM scheduled_jobs ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []JobRecord
+	for rows.Next() {
+		var r JobRecord
+		var durationMS int64
+		err := rows.Scan(&r.Name, &r.LastSlot, &r.LastRunAt, &durationMS, &r.LastStatus, &r.LastError, &r.LastRunner, &r.LeaseOwner, &r.LeaseExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		r.LastDuration = time.Duration(durationMS) * time.Millisecond
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// MemoryLeaseStore 是LeaseStore的内存实现，只在单个进程内互斥
+type MemoryLeaseStore struct {
+	mu      sync.Mutex
+	records map[string]*JobRecord
+}
+
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{records: make(map[string]*JobRecord)}
+}
+
+func (s *MemoryLeaseStore) Register(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[name]; !ok {
+		s.records[name] = &JobRecord{Name: name}
+	}
+	return nil
+}
+
+func (s *MemoryLeaseStore) Acquire(ctx context.Context, name, owner string, slot time.Time, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[name]
+	now := time.Now()
+	if !ok || (r.LastSlot != nil && !r.LastSlot.Before(slot)) || (r.LeaseExpiresAt != nil && !r.LeaseExpiresAt.Before(now)) {
+		return false, nil
+	}
+	expires := now.Add(ttl)
+	r.LeaseOwner, r.LeaseExpiresAt, r.LastSlot = owner, &expires, &slot
+	return true, nil
+}
+
+func (s *MemoryLeaseStore) Release(ctx context.Context, name, owner string, run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[name]
+	if !ok || r.LeaseOwner != owner {
+		return nil
+	}
+	startedAt := run.StartedAt
+	r.LeaseOwner, r.LeaseExpiresAt = "", nil
+	r.LastRunAt, r.LastDuration, r.LastRunner = &startedAt, run.Duration, owner
+	r.LastStatus, r.LastError = runStatus(run)
+	return nil
+}
+
+func (s *MemoryLeaseStore) List(ctx context.Context) ([]JobRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]JobRecord, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
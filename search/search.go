@@ -0,0 +1,282 @@
+package search
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MinScore       = 0.5 //低于该分数的结果不返回
+	highlightScore = 0.6 //单词相似度达到该值才会被高亮
+)
+
+type Field struct {
+	Name   string
+	Value  string
+	Weight float64
+}
+
+type Match struct {
+	Score      float64
+	Highlights map[string]string //字段名 -> 用<mark>标记匹配部分的文本（已做HTML转义）
+}
+
+type span struct {
+	word       string //小写
+	start, end int    //在原文中的字节位置
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func tokenize(s string) []span { //按非字母数字切分，邮箱的@和.也作为分隔符；中日韩文字没有空格，每个字单独成词
+	var spans []span
+	start := -1
+	for i, r := range s {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isCJK(r) {
+			if start >= 0 {
+				spans = append(spans, span{word: strings.ToLower(s[start:i]), start: start, end: i})
+				start = -1
+			}
+			size := utf8.RuneLen(r)
+			spans = append(spans, span{word: s[i : i+size], start: i, end: i + size})
+			continue
+		}
+		if isWord && start < 0 {
+			start = i
+		}
+		if !isWord && start >= 0 {
+			spans = append(spans, span{word: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, span{word: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return spans
+}
+
+func Tokens(s string) []string {
+	var words []string
+	for _, sp := range tokenize(s) {
+		words = append(words, sp.word)
+	}
+	return words
+}
+
+func trigrams(word string) map[string]struct{} { //首尾补空格，让短词也能产生三元组
+	runes := []rune("  " + word + " ")
+	grams := make(map[string]struct{}, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = struct{}{}
+	}
+	return grams
+}
+
+func trigramSimilarity(a, b string) float64 {
+	ga, gb := trigrams(a), trigrams(b)
+	shared := 0
+	for g := range ga {
+		if _, ok := gb[g]; ok {
+			shared++
+		}
+	}
+	union := len(ga) + len(gb) - shared
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+func editDistance(a, b []rune) int { //Damerau-Levenshtein（OSA），相邻字母颠倒只算一次编辑
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func wordSimilarity(query, word string) float64 {
+	if query == word {
+		return 1
+	}
+	ql, wl := utf8.RuneCountInString(query), utf8.RuneCountInString(word)
+	best := trigramSimilarity(query, word)
+	if strings.HasPrefix(word, query) { //前缀匹配，越接近完整单词分数越高
+		best = max(best, 0.7+0.3*float64(ql)/float64(wl))
+	} else if ql >= 3 && strings.Contains(word, query) {
+		best = max(best, 0.6+0.2*float64(ql)/float64(wl))
+	}
+	if ql >= 3 { //太短的词不做拼写容错，否则几乎什么都能匹配
+		dist := editDistance([]rune(query), []rune(word))
+		allowed := 1
+		if ql >= 6 {
+			allowed = 2
+		}
+		if dist <= allowed {
+			best = max(best, 1-float64(dist)/float64(max(ql, wl)))
+		}
+	}
+	return best
+}
+
+// Rank 计算查询与各字段的相关度：每个查询词取所有字段中最相似的单词，再对查询词求平均
+func Rank(query string, fields []Field) (Match, bool) {
+	queryWords := Tokens(query)
+	if len(queryWords) == 0 {
+		return Match{}, false
+	}
+	fieldSpans := make([][]span, len(fields))
+	for i, field := range fields {
+		fieldSpans[i] = tokenize(field.Value)
+	}
+	total := 0.0
+	for _, q := range queryWords {
+		best := 0.0
+		for i, field := range fields {
+			for _, sp := range fieldSpans[i] {
+				best = max(best, field.Weight*wordSimilarity(q, sp.word))
+			}
+		}
+		total += best
+	}
+	score := total / float64(len(queryWords))
+	if score < MinScore {
+		return Match{}, false
+	}
+	match := Match{Score: score, Highlights: make(map[string]string)}
+	for i, field := range fields {
+		if highlighted, ok := highlight(field.Value, fieldSpans[i], queryWords); ok {
+			match.Highlights[field.Name] = highlighted
+		}
+	}
+	return match, true
+}
+
+func highlight(value string, spans []span, queryWords []string) (string, bool) {
+	var b strings.Builder
+	last := 0
+	found := false
+	for _, sp := range spans {
+		hit := false
+		for _, q := range queryWords {
+			if wordSimilarity(q, sp.word) >= highlightScore {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			continue
+		}
+		found = true
+		b.WriteString(html.EscapeString(value[last:sp.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(value[sp.start:sp.end]))
+		b.WriteString("</mark>")
+		last = sp.end
+	}
+	if !found {
+		return "", false
+	}
+	b.WriteString(html.EscapeString(value[last:]))
+	return b.String(), true
+}
+
+// Index 是按三元组建立的倒排索引，用于在内存中快速找出候选文档
+type Index struct {
+	mu    sync.RWMutex
+	grams map[string]map[uint]struct{}
+	docs  map[uint][]string //文档id -> 已索引的三元组，更新时用来撤销旧索引
+}
+
+func NewIndex() *Index {
+	return &Index{grams: make(map[string]map[uint]struct{}), docs: make(map[uint][]string)}
+}
+
+func (ix *Index) Put(id uint, values ...string) { //新增或覆盖文档
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.delete(id)
+	seen := make(map[string]struct{})
+	for _, value := range values {
+		for _, word := range Tokens(value) {
+			for g := range trigrams(word) {
+				seen[g] = struct{}{}
+			}
+		}
+	}
+	grams := make([]string, 0, len(seen))
+	for g := range seen {
+		if ix.grams[g] == nil {
+			ix.grams[g] = make(map[uint]struct{})
+		}
+		ix.grams[g][id] = struct{}{}
+		grams = append(grams, g)
+	}
+	ix.docs[id] = grams
+}
+
+func (ix *Index) Delete(id uint) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.delete(id)
+}
+
+func (ix *Index) delete(id uint) {
+	for _, g := range ix.docs[id] {
+		delete(ix.grams[g], id)
+		if len(ix.grams[g]) == 0 {
+			delete(ix.grams, g)
+		}
+	}
+	delete(ix.docs, id)
+}
+
+func (ix *Index) Candidates(query string, limit int) []uint { //按共享三元组数量返回前limit个候选
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	counts := make(map[uint]int)
+	for _, word := range Tokens(query) {
+		for g := range trigrams(word) {
+			for id := range ix.grams[g] {
+				counts[id]++
+			}
+		}
+	}
+	ids := make([]uint, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if counts[ids[i]] != counts[ids[j]] {
+			return counts[ids[i]] > counts[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids
+}
@@ -0,0 +1,66 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238附录B的SHA1测试向量（密钥为ASCII的12345678901234567890），取后6位
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil || got != tt.want {
+			t.Errorf("Code(%d) = %q, %v, want %q", tt.unix, got, err, tt.want)
+		}
+	}
+	if _, err := Code("not base32!", time.Now()); err != ErrInvalidSecret {
+		t.Errorf("invalid secret: err = %v, want %v", err, ErrInvalidSecret)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+	tests := []struct {
+		name   string
+		offset time.Duration //生成验证码的时刻相对now的偏移
+		after  int64
+		want   bool
+	}{
+		{"current step", 0, 0, true},
+		{"previous step", -Period, 0, true},
+		{"next step", Period, 0, true},
+		{"two steps behind", -2 * Period, 0, false},
+		{"two steps ahead", 2 * Period, 0, false},
+		{"replayed code", 0, step, false},
+		{"code older than last used", -Period, step, false},
+		{"newer code after last used", Period, step, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := Code(rfcSecret, now.Add(tt.offset))
+			got, ok := Validate(rfcSecret, code, now, tt.after)
+			if ok != tt.want {
+				t.Fatalf("Validate = %v, want %v", ok, tt.want)
+			}
+			if ok && got != Step(now.Add(tt.offset)) {
+				t.Errorf("step = %d, want %d", got, Step(now.Add(tt.offset)))
+			}
+		})
+	}
+	if _, ok := Validate(rfcSecret, "12345", now, 0); ok {
+		t.Error("short code accepted")
+	}
+}
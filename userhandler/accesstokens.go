@@ -0,0 +1,71 @@
+package userhandler
+
+import (
+	"strconv"
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CreateAccessToken(c *gin.Context) { //POST /api/tokens，创建个人访问令牌
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	current := info.(*utils.TokenInfo)
+	var req utils.CreateAccessTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	req.Username, req.Role = current.Username, current.Role
+	if err := req.Validate(); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	token, created, err := tokens.CreateAccessToken(c.Request.Context(), &req)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "Access token created successfully")
+	c.JSON(200, gin.H{
+		"message":      "Access token created successfully",
+		"token":        token, //只在创建时返回一次
+		"access_token": created,
+	})
+}
+
+func ListAccessTokens(c *gin.Context) { //GET /api/tokens，列出当前用户的个人访问令牌
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	list, err := tokens.GetAccessTokensByUsername(c.Request.Context(), info.(*utils.TokenInfo).Username)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "Access tokens retrieved successfully")
+	c.JSON(200, gin.H{"message": "Access tokens retrieved successfully", "access_tokens": list})
+}
+
+func DeleteAccessToken(c *gin.Context) { //DELETE /api/tokens/:id，吊销自己的个人访问令牌
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		SendResponse(c, 400, "Invalid access token id")
+		return
+	}
+	if err := tokens.DeleteAccessToken(c.Request.Context(), info.(*utils.TokenInfo).Username, id); err != nil {
+		SendError(c, err)
+		return
+	}
+	SendResponse(c, 200, "Access token deleted successfully")
+}
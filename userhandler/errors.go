@@ -0,0 +1,48 @@
+package userhandler
+
+import (
+	"errors"
+	"user_system/repositories"
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrForbidden 表示当前用户的角色不能执行该操作
+var ErrForbidden = errors.New("Forbidden: admin role required")
+
+// errorStatus 把存储层的错误映射为HTTP状态码，未识别的错误视为服务器内部错误
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, repositories.ErrInvalidInput), errors.Is(err, utils.ErrTooManyAccessTokens):
+		return 400
+	case errors.Is(err, repositories.ErrInvalidCredentials),
+		errors.Is(err, utils.ErrInvalidRefreshToken), errors.Is(err, utils.ErrRefreshTokenReused),
+		errors.Is(err, repositories.ErrInvalidMFACode), errors.Is(err, repositories.ErrInvalidMFAChallenge),
+		errors.Is(err, repositories.ErrWebAuthnFailed), errors.Is(err, repositories.ErrInvalidResetToken),
+		errors.Is(err, repositories.ErrInvalidVerificationToken), errors.Is(err, repositories.ErrInvalidMagicLink):
+		return 401
+	case errors.Is(err, ErrForbidden), errors.Is(err, repositories.ErrAccountDisabled), errors.Is(err, repositories.ErrEmailNotVerified):
+		return 403
+	case errors.Is(err, repositories.ErrUserNotFound), errors.Is(err, utils.ErrAccessTokenNotFound),
+		errors.Is(err, repositories.ErrWebAuthnCredentialNotFound):
+		return 404
+	case errors.Is(err, repositories.ErrDuplicateUsername), errors.Is(err, repositories.ErrMFAAlreadyEnabled),
+		errors.Is(err, repositories.ErrMFANotEnabled), errors.Is(err, repositories.ErrMFANotEnrolled),
+		errors.Is(err, repositories.ErrDuplicateCredential), errors.Is(err, repositories.ErrEmailAlreadyVerified):
+		return 409
+	case errors.Is(err, repositories.ErrVersionConflict):
+		return 412
+	case errors.Is(err, repositories.ErrVerificationThrottled), errors.Is(err, repositories.ErrMagicLinkThrottled),
+		errors.Is(err, repositories.ErrWebAuthnThrottled),
+		errors.Is(err, repositories.ErrMFALocked):
+		return 429
+	case errors.Is(err, repositories.ErrStoreUnavailable):
+		return 503
+	}
+	return 500
+}
+
+func SendError(c *gin.Context, err error) {
+	SendResponse(c, errorStatus(err), err.Error())
+}
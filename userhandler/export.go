@@ -0,0 +1,108 @@
+package userhandler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"user_system/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type exportedUser struct { //导出与列表返回的用户，不包含密码哈希
+	ID        uint      `json:"id"`
+	Username  string    `json:"username"`
+	FullName  string    `json:"fullname"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newExportedUser(user *models.User) exportedUser {
+	return exportedUser{
+		ID: user.ID, Username: user.Username, FullName: user.FullName, Email: user.Email,
+		Role: user.Role, Status: user.Status, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt,
+	}
+}
+
+const exportBatchSize = 500
+
+var exportHeader = []string{"id", "username", "fullname", "email", "role", "status", "created_at", "updated_at"}
+
+func ExportUsers(c *gin.Context) { //GET /api/users/export?format=ndjson|csv&after_id=，分块传输，内存占用恒定
+	if !requireAdmin(c, "export users") {
+		return
+	}
+	format := c.DefaultQuery("format", "ndjson")
+	if format != "ndjson" && format != "csv" {
+		SendResponse(c, 400, "Unsupported export format")
+		return
+	}
+	var afterID uint64
+	if c.Query("after_id") != "" { //从指定id之后继续导出，用于断点续传
+		var err error
+		afterID, err = strconv.ParseUint(c.Query("after_id"), 10, 64)
+		if err != nil {
+			SendResponse(c, 400, "Invalid after_id")
+			return
+		}
+	}
+
+	//不设置Content-Length，Gin会使用chunked传输
+	c.Status(200)
+	var write func(user *models.User) error
+	var flush func() error
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="users.csv"`)
+		w := csv.NewWriter(c.Writer)
+		if err := w.Write(exportHeader); err != nil {
+			return
+		}
+		write = func(user *models.User) error {
+			return w.Write([]string{
+				strconv.FormatUint(uint64(user.ID), 10), user.Username, user.FullName, user.Email, user.Role, user.Status,
+				user.CreatedAt.Format(time.RFC3339), user.UpdatedAt.Format(time.RFC3339),
+			})
+		}
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(c.Writer)
+		write = func(user *models.User) error {
+			return enc.Encode(newExportedUser(user))
+		}
+		flush = func() error { return nil }
+	}
+
+	count := 0
+	err := users.IterateUsers(c.Request.Context(), uint(afterID), exportBatchSize, func(user *models.User) error {
+		if err := write(user); err != nil {
+			return err
+		}
+		count++
+		if count%exportBatchSize == 0 { //每批刷新一次，让客户端尽早收到数据
+			if err := flush(); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+		}
+		return c.Request.Context().Err() //客户端断开后停止导出
+	})
+	if flushErr := flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	c.Writer.Flush()
+	if err != nil { //响应头已发送，只能记录日志
+		c.Set("message", fmt.Sprintf("Export aborted after %d users: %v", count, err))
+		return
+	}
+	c.Set("message", fmt.Sprintf("Exported %d users", count))
+}
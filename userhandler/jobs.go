@@ -0,0 +1,68 @@
+package userhandler
+
+import (
+	"fmt"
+	"strconv"
+	"user_system/scheduler"
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+var jobs *scheduler.Scheduler //为nil时未启用定时任务
+
+func SetScheduler(s *scheduler.Scheduler) {
+	jobs = s
+}
+
+func requireAdmin(c *gin.Context, action string) bool { //不是管理员时返回403
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return false
+	}
+	if role := info.(*utils.TokenInfo).Role; role != "admin" {
+		SendError(c, fmt.Errorf("Failed to %s,%s: %w", action, role, ErrForbidden))
+		return false
+	}
+	return true
+}
+
+func ListJobs(c *gin.Context) { //GET /api/admin/jobs，定时任务的执行计划与最近一次运行结果
+	if !requireAdmin(c, "list jobs") {
+		return
+	}
+	if jobs == nil {
+		SendResponse(c, 404, "Scheduler is not enabled")
+		return
+	}
+	list, err := jobs.Status(c.Request.Context())
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "Jobs retrieved successfully")
+	c.JSON(200, gin.H{"message": "Jobs retrieved successfully", "instance": jobs.Owner, "jobs": list})
+}
+
+func GetStats(c *gin.Context) { //GET /api/admin/stats?limit=，最近几天的用户统计
+	if !requireAdmin(c, "get stats") {
+		return
+	}
+	limit := 30
+	if c.Query("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > 366 {
+			SendResponse(c, 400, "Invalid limit")
+			return
+		}
+	}
+	stats, err := users.GetStats(c.Request.Context(), limit)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "Stats retrieved successfully")
+	c.JSON(200, gin.H{"message": "Stats retrieved successfully", "stats": stats})
+}
@@ -0,0 +1,18 @@
+package userhandler
+
+import (
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func JWKS(c *gin.Context) { //GET /.well-known/jwks.json，发布验证JWT用的公钥
+	if utils.JWT == nil {
+		SendResponse(c, 404, "JWT is not enabled")
+		return
+	}
+	//密钥会提前发布，客户端缓存几分钟即可及时拿到新密钥
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Set("message", "JWKS retrieved successfully")
+	c.JSON(200, gin.H{"keys": utils.JWT.Keys.JWKS()})
+}
@@ -0,0 +1,82 @@
+package userhandler
+
+import (
+	"fmt"
+	"time"
+	"user_system/mailer"
+	"user_system/models"
+	"user_system/repositories"
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func magicLinkEnabled(c *gin.Context) bool {
+	if !repositories.MagicLinkLogin || mail == nil {
+		SendResponse(c, 404, "Magic link login is not enabled")
+		return false
+	}
+	return true
+}
+
+func magicLinkMessage(link *models.MagicLink) *mailer.Message {
+	return &mailer.Message{
+		To:      link.Email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Open the link below to sign in:\n\n"+
+			"%s\n\n"+
+			"The link can be used once, only in the browser where you requested it, and expires at %s.\n"+
+			"If you did not request this, you can ignore this email.\n",
+			link.Username, withToken(links.MagicLogin, link.Token), link.ExpiredAt.UTC().Format(time.RFC1123)),
+	}
+}
+
+func RequestMagicLink(c *gin.Context) { //POST /api/login/magic，向用户的邮箱发送登录链接
+	if !magicLinkEnabled(c) {
+		return
+	}
+	var req models.MagicLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	//链接绑定到申请的设备：device_token只返回给当前请求，打开链接时需要一并提交
+	deviceToken, err := utils.GernerateToken()
+	if err != nil {
+		SendResponse(c, 500, err.Error())
+		return
+	}
+	req.DeviceToken = deviceToken
+	req.IP = c.ClientIP()
+	link, err := users.CreateMagicLink(c.Request.Context(), &req)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	if link != nil {
+		sendMail(magicLinkMessage(link))
+	}
+	//不区分用户是否存在，避免泄露注册信息
+	c.Set("message", "If the account exists, a login link has been sent")
+	c.JSON(200, gin.H{"message": "If the account exists, a login link has been sent", "device_token": deviceToken})
+}
+
+func MagicLogin(c *gin.Context) { //POST /api/login/magic/verify，提交登录链接中的token与device_token，与密码登录一样签发token
+	if !magicLinkEnabled(c) {
+		return
+	}
+	var req models.MagicLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	req.UserAgent = truncate(c.Request.UserAgent(), 255)
+	req.IP = c.ClientIP()
+	pair, challenge, err := users.MagicLogin(c.Request.Context(), &req)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	sendLogin(c, pair, challenge)
+}
@@ -0,0 +1,141 @@
+package userhandler
+
+import (
+	"fmt"
+	"user_system/models"
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required,max=20"` //验证器App中的6位数字，关闭两步验证与重新生成恢复码时也可以用恢复码
+}
+
+type resetMFARequest struct {
+	Username string `json:"username" binding:"required,max=50"`
+}
+
+func LoginMFA(c *gin.Context) { //POST /api/login/mfa，登录第二步，提交验证码或恢复码换取token
+	var req models.MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	req.UserAgent = truncate(c.Request.UserAgent(), 255)
+	req.IP = c.ClientIP()
+	pair, err := users.VerifyMFALogin(c.Request.Context(), &req)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	sendTokenPair(c, "Login successful", pair)
+}
+
+func GetMFA(c *gin.Context) { //GET /api/mfa，当前用户的两步验证状态
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	status, err := users.GetMFAStatus(c.Request.Context(), info.(*utils.TokenInfo).Username)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "MFA status retrieved successfully")
+	c.JSON(200, gin.H{"message": "MFA status retrieved successfully", "mfa": status})
+}
+
+func EnrollTOTP(c *gin.Context) { //POST /api/mfa/totp，生成TOTP密钥，确认后才生效
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	enrollment, err := users.EnrollTOTP(c.Request.Context(), info.(*utils.TokenInfo).Username)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "TOTP enrollment started")
+	c.JSON(200, gin.H{"message": "TOTP enrollment started", "secret": enrollment.Secret, "otpauth_uri": enrollment.URI})
+}
+
+func ConfirmTOTP(c *gin.Context) { //POST /api/mfa/totp/confirm，提交验证码开启两步验证，返回恢复码
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	codes, err := users.ConfirmTOTP(c.Request.Context(), info.(*utils.TokenInfo).Username, req.Code)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "MFA enabled")
+	c.JSON(200, gin.H{"message": "MFA enabled", "recovery_codes": codes}) //恢复码只在这里返回一次
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) { //POST /api/mfa/recovery_codes，旧的恢复码全部作废
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	codes, err := users.RegenerateRecoveryCodes(c.Request.Context(), info.(*utils.TokenInfo).Username, req.Code)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "Recovery codes regenerated")
+	c.JSON(200, gin.H{"message": "Recovery codes regenerated", "recovery_codes": codes})
+}
+
+func DisableMFA(c *gin.Context) { //POST /api/mfa/disable，校验验证码后关闭两步验证
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	if err := users.DisableMFA(c.Request.Context(), info.(*utils.TokenInfo).Username, req.Code); err != nil {
+		SendError(c, err)
+		return
+	}
+	SendResponse(c, 200, "MFA disabled")
+}
+
+func ResetMFA(c *gin.Context) { //POST /api/admin/mfa/reset，管理员为丢失设备的用户关闭两步验证
+	if !requireAdmin(c, "reset MFA") {
+		return
+	}
+	var req resetMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	if _, err := users.GetUserByUsername(c.Request.Context(), req.Username); err != nil {
+		SendError(c, err)
+		return
+	}
+	if err := users.ResetMFA(c.Request.Context(), req.Username); err != nil {
+		SendError(c, err)
+		return
+	}
+	SendResponse(c, 200, fmt.Sprintf("MFA of %s has been reset", req.Username))
+}
@@ -0,0 +1,101 @@
+package userhandler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+	"user_system/mailer"
+	"user_system/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var mail mailer.Mailer //为nil时不支持找回密码、邮箱验证与登录链接
+var links MailLinks
+
+// MailLinks 是邮件中链接指向的前端页面，令牌以token参数附加在后面
+type MailLinks struct {
+	PasswordReset     string
+	EmailVerification string
+	MagicLogin        string
+}
+
+func SetMailer(m mailer.Mailer, l MailLinks) {
+	mail = m
+	links = l
+}
+
+// sendMail 在后台发送邮件，发送耗时不会暴露邮箱是否存在，失败时只记录日志
+func sendMail(msg *mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := mail.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send mail to %s: %v", msg.To, err)
+		}
+	}()
+}
+
+func withToken(base, token string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base + "?token=" + url.QueryEscape(token)
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func passwordResetMessage(reset *models.PasswordReset) *mailer.Message {
+	return &mailer.Message{
+		To:      reset.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Someone requested a password reset for your account. Open the link below to choose a new password:\n\n"+
+			"%s\n\n"+
+			"The link can be used once and expires at %s. All devices will be signed out after the reset.\n"+
+			"If you did not request this, you can ignore this email.\n",
+			reset.Username, withToken(links.PasswordReset, reset.Token), reset.ExpiredAt.UTC().Format(time.RFC1123)),
+	}
+}
+
+func ForgotPassword(c *gin.Context) { //POST /api/password/forgot，向邮箱发送重置链接
+	if mail == nil {
+		SendResponse(c, 404, "Password reset is not enabled")
+		return
+	}
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	resets, err := users.CreatePasswordResets(c.Request.Context(), req.Email)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	for _, reset := range resets {
+		sendMail(passwordResetMessage(reset))
+	}
+	//不区分邮箱是否存在，避免泄露注册信息
+	SendResponse(c, 200, "If the email is registered, a password reset link has been sent")
+}
+
+func ResetPassword(c *gin.Context) { //POST /api/password/reset，用重置链接中的token设置新密码，所有设备退出登录
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	username, err := users.ResetPassword(c.Request.Context(), req.Token, req.Password)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	syncRevoked(c)
+	c.Set("message", "Password reset successfully")
+	c.JSON(200, gin.H{"message": "Password reset successfully", "username": username})
+}
@@ -0,0 +1,212 @@
+package userhandler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+	"unicode/utf8"
+	"user_system/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// session 是返回给用户的会话信息，不包含token本身
+type session struct {
+	ID               int        `json:"id"`
+	Device           string     `json:"device"`
+	TokenPrefix      string     `json:"token_prefix"` //明文token的前几位，便于用户辨认
+	UserAgent        string     `json:"user_agent"`
+	IP               string     `json:"ip"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiredAt        time.Time  `json:"expired_at"`
+	LastUsedAt       *time.Time `json:"last_used_at"`
+	SessionExpiredAt time.Time  `json:"session_expired_at"`
+	RememberMe       bool       `json:"remember_me"`
+	Current          bool       `json:"current"` //是否为本次请求使用的会话
+}
+
+func truncate(s string, max int) string { //按字符截断，避免截断多字节字符
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+func ListSessions(c *gin.Context) { //GET /api/sessions，列出当前用户未过期的会话
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	current := info.(*utils.TokenInfo)
+	list, err := tokens.GetTokensByUsername(c.Request.Context(), current.Username)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	sessions := make([]session, 0, len(list))
+	for _, t := range list {
+		if t.ExpiredAt.Before(time.Now()) {
+			continue
+		}
+		sessions = append(sessions, session{
+			ID:               t.ID,
+			Device:           t.Device,
+			TokenPrefix:      t.TokenPrefix,
+			UserAgent:        t.UserAgent,
+			IP:               t.IP,
+			CreatedAt:        t.CreatedAt,
+			ExpiredAt:        t.ExpiredAt,
+			LastUsedAt:       t.LastUsedAt,
+			SessionExpiredAt: t.SessionExpiredAt,
+			RememberMe:       t.Remember,
+			Current:          t.Token == current.Token,
+		})
+	}
+	c.Set("message", "Sessions retrieved successfully")
+	c.JSON(200, gin.H{"message": "Sessions retrieved successfully", "sessions": sessions})
+}
+
+func DeleteSession(c *gin.Context) { //DELETE /api/sessions/:id，只能删除自己的会话
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	current := info.(*utils.TokenInfo)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		SendResponse(c, 400, "Invalid session id")
+		return
+	}
+	if id == current.ID { //删除当前会话，相当于退出登录
+		if err := tokens.DeleteTokenByToken(c.Request.Context(), current.Token); err != nil {
+			SendError(c, err)
+			return
+		}
+		syncRevoked(c)
+		SendResponse(c, 200, "Session deleted successfully")
+		return
+	}
+	list, err := tokens.GetTokensByUsername(c.Request.Context(), current.Username)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	for _, t := range list {
+		if t.ID != id {
+			continue
+		}
+		if err := tokens.DeleteTokenByID(c.Request.Context(), id); err != nil {
+			SendError(c, err)
+			return
+		}
+		syncRevoked(c)
+		SendResponse(c, 200, "Session deleted successfully")
+		return
+	}
+	SendResponse(c, 404, "Session not found") //不属于当前用户的会话也按不存在处理
+}
+
+func Logout(c *gin.Context) { //POST /api/logout，吊销本次请求使用的token
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	if err := tokens.DeleteToken(c.Request.Context(), info.(*utils.TokenInfo).Token); err != nil {
+		SendError(c, err)
+		return
+	}
+	syncRevoked(c)
+	SendResponse(c, 200, "Logout successful")
+}
+
+type logoutAllRequest struct {
+	Username string `json:"username" binding:"max=50"` //为空时退出自己的所有会话，指定其他用户需要管理员权限
+}
+
+func LogoutAll(c *gin.Context) { //POST /api/logout/all，吊销某个用户的所有会话
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	current := info.(*utils.TokenInfo)
+	var req logoutAllRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) { //请求体可以为空
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	if req.Username == "" || req.Username == current.Username {
+		if err := tokens.DeleteTokenByUsername(c.Request.Context(), current.Username); err != nil {
+			SendError(c, err)
+			return
+		}
+		syncRevoked(c)
+		SendResponse(c, 200, "All sessions logged out")
+		return
+	}
+	if current.Role != "admin" {
+		SendResponse(c, 403, fmt.Sprintf("Failed to logout user %s,%s", req.Username, current.Role))
+		return
+	}
+	if _, err := users.GetUserByUsername(c.Request.Context(), req.Username); err != nil {
+		SendError(c, err)
+		return
+	}
+	if err := tokens.DeleteTokenByUsername(c.Request.Context(), req.Username); err != nil {
+		SendError(c, err)
+		return
+	}
+	syncRevoked(c)
+	SendResponse(c, 200, fmt.Sprintf("All sessions of %s logged out", req.Username))
+}
+
+func sendTokenPair(c *gin.Context, message string, pair *utils.TokenPair) {
+	c.Set("message", message)
+	c.JSON(200, gin.H{
+		"message":            message,
+		"token":              pair.AccessToken,
+		"expired_at":         pair.ExpiredAt,
+		"refresh_token":      pair.RefreshToken,
+		"refresh_expired_at": pair.RefreshExpiredAt,
+		"session_expired_at": pair.SessionExpiredAt,
+		"idle_timeout":       int(pair.IdleTimeout.Seconds()), //秒
+		"remember_me":        pair.RememberMe,
+	})
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required,max=64"`
+}
+
+func RefreshToken(c *gin.Context) { //POST /api/token/refresh，用refresh token换取新的一对token
+	var req refreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	pair, err := tokens.RotateRefreshToken(c.Request.Context(), req.RefreshToken, c.ClientIP())
+	if err == nil || errors.Is(err, utils.ErrRefreshTokenReused) { //轮换和重放检测都会吊销旧的访问token
+		syncRevoked(c)
+	}
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	sendTokenPair(c, "Token refreshed successfully", pair)
+}
+
+// syncRevoked 吊销会话后立即同步吊销列表，本实例不必等到下一次定期同步
+func syncRevoked(c *gin.Context) {
+	if utils.JWT == nil {
+		return
+	}
+	if err := utils.JWT.Sync(c.Request.Context()); err != nil {
+		log.Printf("Failed to sync revoked tokens: %v", err)
+	}
+}
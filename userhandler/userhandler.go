@@ -1,8 +1,10 @@
 package userhandler
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"user_system/models"
 	"user_system/repositories"
 	"user_system/utils"
@@ -10,13 +12,19 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func Init() error {
-	//初始化数据库连接
-	err := repositories.NewDBHandler()
-	if err != nil {
-		return err
+var users repositories.UserStore
+var tokens utils.TokenStore
+
+func Init(store repositories.UserStore, tokenStore utils.TokenStore) error {
+	if store == nil {
+		return fmt.Errorf("Init: User store is not initialized")
 	}
-	return utils.NewAuthDBHandler()
+	if tokenStore == nil {
+		return fmt.Errorf("Init: Token store is not initialized")
+	}
+	users = store
+	tokens = tokenStore
+	return nil
 }
 
 func SendResponse(c *gin.Context, status int, message string) { //规范返回
@@ -29,6 +37,47 @@ func SendResponse(c *gin.Context, status int, message string) { //规范返回
 	c.JSON(status, gin.H{"error": "Failed to execute request"})
 }
 
+func etag(version uint) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatch 读取If-Match中的版本号，缺少时返回428；为*时不检查版本
+func ifMatch(c *gin.Context) (*uint, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		SendResponse(c, 428, "If-Match header is required")
+		return nil, false
+	}
+	if header == "*" {
+		return nil, true
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' { //只接受强校验的ETag
+		SendResponse(c, 400, "Invalid If-Match header")
+		return nil, false
+	}
+	version, err := strconv.ParseUint(header[1:len(header)-1], 10, 64)
+	if err != nil {
+		SendResponse(c, 400, "Invalid If-Match header")
+		return nil, false
+	}
+	v := uint(version)
+	return &v, true
+}
+
+func sendUpdateResponse(c *gin.Context, username string, err error) {
+	if err == nil {
+		syncRevoked(c) //角色或状态变化时会吊销该用户的会话
+		SendResponse(c, 200, "User updated successfully")
+		return
+	}
+	if errors.Is(err, repositories.ErrVersionConflict) { //版本冲突时返回当前ETag，客户端重新读取后再提交
+		if userInfo, _ := users.GetUserByUsername(c.Request.Context(), username); userInfo != nil {
+			c.Header("ETag", etag(userInfo.Version))
+		}
+	}
+	SendError(c, err)
+}
+
 func RegisterUser(c *gin.Context) {
 	var userInfo models.CreateUserRequest
 	err := c.ShouldBindJSON(&userInfo)
@@ -36,8 +85,17 @@ func RegisterUser(c *gin.Context) {
 		SendResponse(c, 400, err.Error())
 		return
 	}
-	response := repositories.CreateUser(&userInfo)
-	SendResponse(c, response.Type, response.Message)
+	if err := users.CreateUser(c.Request.Context(), &userInfo); err != nil {
+		SendError(c, err)
+		return
+	}
+	if repositories.EmailVerification { //新用户验证邮箱前状态为pending_verification
+		sendVerification(c, userInfo.Username)
+		c.Set("message", "User created successfully")
+		c.JSON(200, gin.H{"message": "User created successfully", "status": "pending_verification"})
+		return
+	}
+	SendResponse(c, 200, "User created successfully")
 }
 
 func LoginUser(c *gin.Context) {
@@ -47,17 +105,23 @@ func LoginUser(c *gin.Context) {
 		SendResponse(c, 400, err.Error())
 		return
 	}
-	response, token := repositories.UserLogin(&userInfo)
-	if token == "" {
-		SendResponse(c, response.Type, response.Message)
+	userInfo.UserAgent = truncate(c.Request.UserAgent(), 255)
+	userInfo.IP = c.ClientIP()
+	pair, challenge, err := users.UserLogin(c.Request.Context(), &userInfo)
+	if err != nil {
+		SendError(c, err)
 		return
 	}
-	c.Set("message", response.Message)
-	if response.Type == 200 {
-		c.JSON(response.Type, gin.H{"message": response.Message, "token": token})
+	sendLogin(c, pair, challenge)
+}
+
+func sendLogin(c *gin.Context, pair *utils.TokenPair, challenge *models.MFAChallenge) {
+	if challenge != nil { //开启了两步验证，凭mfa_token到/api/login/mfa提交验证码，或到/api/login/mfa/webauthn使用安全密钥
+		c.Set("message", "MFA required")
+		c.JSON(200, gin.H{"message": "MFA required", "mfa_required": true, "mfa_token": challenge.Token, "methods": challenge.Methods, "expired_at": challenge.ExpiredAt})
 		return
 	}
-	c.JSON(response.Type, gin.H{"error": "Failed to execute request"})
+	sendTokenPair(c, "Login successful", pair)
 }
 
 func DeleteUser(c *gin.Context) {
@@ -76,10 +140,15 @@ func DeleteUser(c *gin.Context) {
 		SendResponse(c, 400, err.Error())
 		return
 	}
+	version, ok := ifMatch(c)
+	if !ok {
+		return
+	}
 	status := "deleted"
 	userInfo.Status = &status
-	response := repositories.UpdateUser(&userInfo)
-	SendResponse(c, response.Type, response.Message)
+	userInfo.Version = version
+	err = users.UpdateUser(c.Request.Context(), &userInfo)
+	sendUpdateResponse(c, userInfo.Username, err)
 }
 
 func ChangePassword(c *gin.Context) {
@@ -98,26 +167,37 @@ func ChangePassword(c *gin.Context) {
 		SendResponse(c, 400, "Failed to change password")
 		return
 	}
-	response := repositories.UpdateUser(&userInfo)
-	SendResponse(c, response.Type, response.Message)
+	version, ok := ifMatch(c)
+	if !ok {
+		return
+	}
+	userInfo.Version = version
+	err = users.UpdateUser(c.Request.Context(), &userInfo)
+	if err == nil && userInfo.Email != nil && repositories.EmailVerification { //邮箱变化时向新邮箱发送验证链接
+		sendVerification(c, userInfo.Username)
+	}
+	sendUpdateResponse(c, userInfo.Username, err)
 }
 
 func GetUser(c *gin.Context) {
-	info, exist := c.Get("info")
-	if !exist {
-		SendResponse(c, 400, "Failed to get info by token")
+	if !requireAdmin(c, "get user") {
 		return
 	}
-	if info.(*utils.TokenInfo).Role != "admin" {
-		SendResponse(c, 400, fmt.Sprintf("Failed to get user,%s", info.(*utils.TokenInfo).Role))
+	Username := c.Query("username")
+	if Username == "" && c.Query("id") == "" { //未指定用户时按条件列出用户
+		listUsers(c)
 		return
 	}
-	Username := c.Query("username")
 
 	if Username != "" {
-		userInfo, response := repositories.GetUserByUsername(Username)
-		c.Set("message", response.Message)
-		c.JSON(response.Type, gin.H{"message": response.Message, "user": userInfo})
+		userInfo, err := users.GetUserByUsername(c.Request.Context(), Username)
+		if err != nil {
+			SendError(c, err)
+			return
+		}
+		c.Header("ETag", etag(userInfo.Version))
+		c.Set("message", "User retrieved successfully")
+		c.JSON(200, gin.H{"message": "User retrieved successfully", "user": userInfo})
 		return
 	}
 	ID, err := strconv.ParseUint(c.Query("id"), 10, 64)
@@ -127,10 +207,77 @@ func GetUser(c *gin.Context) {
 	}
 	if ID != 0 {
 		ID := uint(ID)
-		userInfo, response := repositories.GetUserInfoByID(ID)
-		c.Set("message", response.Message)
-		c.JSON(response.Type, gin.H{"message": response.Message, "user": userInfo})
+		userInfo, err := users.GetUserInfoByID(c.Request.Context(), ID)
+		if err != nil {
+			SendError(c, err)
+			return
+		}
+		c.Header("ETag", etag(userInfo.Version))
+		c.Set("message", "User info retrieved successfully")
+		c.JSON(200, gin.H{"message": "User info retrieved successfully", "user": userInfo})
 		return
 	}
 	SendResponse(c, 400, "Failed to get user")
 }
+
+const defaultPageSize = 20
+
+func listUsers(c *gin.Context) { //GET /api/users 的列表模式，调用方需已校验管理员权限
+	var filter models.UserFilter
+	err := c.ShouldBindQuery(&filter)
+	if err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultPageSize
+	}
+	page, err := users.SearchUsers(c.Request.Context(), &filter)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	result := make([]exportedUser, 0, len(page.Users))
+	for _, user := range page.Users {
+		result = append(result, newExportedUser(user))
+	}
+	c.Set("message", "Users retrieved successfully")
+	c.JSON(200, gin.H{"message": "Users retrieved successfully", "users": result, "total": page.Total, "next_cursor": page.NextCursor})
+}
+
+type searchHit struct { //搜索结果中的用户同样不包含密码哈希
+	User       exportedUser      `json:"user"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+func SearchUsers(c *gin.Context) { //GET /api/users/search?q=，按相关度返回模糊匹配的用户
+	if !requireAdmin(c, "search users") {
+		return
+	}
+	query := c.Query("q")
+	if query == "" || len(query) > 100 {
+		SendResponse(c, 400, "Invalid search query")
+		return
+	}
+	limit := defaultPageSize
+	if c.Query("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > 100 {
+			SendResponse(c, 400, "Invalid limit")
+			return
+		}
+	}
+	hits, err := users.FuzzySearchUsers(c.Request.Context(), query, limit)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	results := make([]searchHit, 0, len(hits))
+	for _, hit := range hits {
+		results = append(results, searchHit{User: newExportedUser(hit.User), Score: hit.Score, Highlights: hit.Highlights})
+	}
+	c.Set("message", "Users searched successfully")
+	c.JSON(200, gin.H{"message": "Users searched successfully", "results": results})
+}
@@ -0,0 +1,81 @@
+package userhandler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"user_system/mailer"
+	"user_system/models"
+	"user_system/repositories"
+
+	"github.com/gin-gonic/gin"
+)
+
+func verificationMessage(v *models.EmailVerification) *mailer.Message {
+	return &mailer.Message{
+		To:      v.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Please confirm that %s is your email address by opening the link below:\n\n"+
+			"%s\n\n"+
+			"The link expires at %s.\n"+
+			"If you did not create an account or change your email, you can ignore this email.\n",
+			v.Username, v.Email, withToken(links.EmailVerification, v.Token), v.ExpiredAt.UTC().Format(time.RFC1123)),
+	}
+}
+
+// sendVerification 注册或修改邮箱后发送验证链接，失败时只记录日志，用户可以稍后重发
+func sendVerification(c *gin.Context, username string) {
+	if mail == nil {
+		return
+	}
+	v, err := users.CreateEmailVerification(c.Request.Context(), username, false)
+	if err != nil {
+		if !errors.Is(err, repositories.ErrEmailAlreadyVerified) {
+			log.Printf("Failed to create email verification for %s: %v", username, err)
+		}
+		return
+	}
+	sendMail(verificationMessage(v))
+}
+
+func VerifyEmail(c *gin.Context) { //POST /api/email/verify，提交验证链接中的token
+	var req models.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	username, err := users.VerifyEmail(c.Request.Context(), req.Token)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "Email verified successfully")
+	c.JSON(200, gin.H{"message": "Email verified successfully", "username": username})
+}
+
+func ResendVerification(c *gin.Context) { //POST /api/email/verify/resend，重新发送验证邮件
+	if mail == nil {
+		SendResponse(c, 404, "Email verification is not enabled")
+		return
+	}
+	var req models.ResendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	v, err := users.CreateEmailVerification(c.Request.Context(), req.Username, true)
+	switch {
+	case err == nil:
+		sendMail(verificationMessage(v))
+	case errors.Is(err, repositories.ErrVerificationThrottled):
+		SendError(c, err)
+		return
+	case errors.Is(err, repositories.ErrStoreUnavailable):
+		SendError(c, err)
+		return
+	}
+	//用户不存在、已验证或已停用时返回相同的结果，避免泄露注册信息
+	SendResponse(c, 200, "If the account needs verification, a verification link has been sent")
+}
@@ -0,0 +1,175 @@
+package userhandler
+
+import (
+	"strconv"
+	"user_system/models"
+	"user_system/repositories"
+	"user_system/utils"
+	"user_system/webauthn"
+
+	"github.com/gin-gonic/gin"
+)
+
+type webauthnRegisterRequest struct {
+	Name       string                       `json:"name" binding:"max=100"` //凭证名称，方便用户区分多个安全密钥
+	Credential webauthn.AttestationResponse `json:"credential"`
+}
+
+type webauthnMFABeginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required,max=64"`
+}
+
+func webauthnEnabled(c *gin.Context) bool {
+	if repositories.WebAuthn == nil {
+		SendResponse(c, 404, "WebAuthn is not enabled")
+		return false
+	}
+	return true
+}
+
+func BeginWebAuthnRegistration(c *gin.Context) { //POST /api/webauthn/register/begin，返回navigator.credentials.create()的参数
+	if !webauthnEnabled(c) {
+		return
+	}
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	options, err := users.BeginWebAuthnRegistration(c.Request.Context(), info.(*utils.TokenInfo).Username)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "WebAuthn registration started")
+	c.JSON(200, gin.H{"message": "WebAuthn registration started", "publicKey": options})
+}
+
+func FinishWebAuthnRegistration(c *gin.Context) { //POST /api/webauthn/register/finish，保存认证器返回的凭证
+	if !webauthnEnabled(c) {
+		return
+	}
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	var req webauthnRegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	credential, err := users.FinishWebAuthnRegistration(c.Request.Context(), info.(*utils.TokenInfo).Username, req.Name, &req.Credential)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "WebAuthn credential registered successfully")
+	c.JSON(200, gin.H{"message": "WebAuthn credential registered successfully", "credential": credential})
+}
+
+func BeginWebAuthnLogin(c *gin.Context) { //POST /api/webauthn/login/begin，无密码登录，返回navigator.credentials.get()的参数
+	if !webauthnEnabled(c) {
+		return
+	}
+	options, err := users.BeginWebAuthnLogin(c.Request.Context(), c.ClientIP())
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "WebAuthn login started")
+	c.JSON(200, gin.H{"message": "WebAuthn login started", "publicKey": options})
+}
+
+func FinishWebAuthnLogin(c *gin.Context) { //POST /api/webauthn/login/finish，校验签名后签发token
+	if !webauthnEnabled(c) {
+		return
+	}
+	var req models.WebAuthnLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	req.UserAgent = truncate(c.Request.UserAgent(), 255)
+	req.IP = c.ClientIP()
+	pair, err := users.FinishWebAuthnLogin(c.Request.Context(), &req)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	sendTokenPair(c, "Login successful", pair)
+}
+
+func BeginWebAuthnMFA(c *gin.Context) { //POST /api/login/mfa/webauthn/begin，登录第二步，用mfa_token换取安全密钥的参数
+	if !webauthnEnabled(c) {
+		return
+	}
+	var req webauthnMFABeginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	options, err := users.BeginWebAuthnMFA(c.Request.Context(), req.MFAToken)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "WebAuthn verification started")
+	c.JSON(200, gin.H{"message": "WebAuthn verification started", "publicKey": options})
+}
+
+func FinishWebAuthnMFA(c *gin.Context) { //POST /api/login/mfa/webauthn/finish，校验安全密钥的签名后签发token
+	if !webauthnEnabled(c) {
+		return
+	}
+	var req models.WebAuthnLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		SendResponse(c, 400, err.Error())
+		return
+	}
+	if req.MFAToken == "" {
+		SendResponse(c, 400, "mfa_token is required")
+		return
+	}
+	req.UserAgent = truncate(c.Request.UserAgent(), 255)
+	req.IP = c.ClientIP()
+	pair, err := users.FinishWebAuthnMFA(c.Request.Context(), &req)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	sendTokenPair(c, "Login successful", pair)
+}
+
+func ListWebAuthnCredentials(c *gin.Context) { //GET /api/webauthn/credentials，列出当前用户的WebAuthn凭证
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	list, err := users.GetWebAuthnCredentials(c.Request.Context(), info.(*utils.TokenInfo).Username)
+	if err != nil {
+		SendError(c, err)
+		return
+	}
+	c.Set("message", "WebAuthn credentials retrieved successfully")
+	c.JSON(200, gin.H{"message": "WebAuthn credentials retrieved successfully", "credentials": list})
+}
+
+func DeleteWebAuthnCredential(c *gin.Context) { //DELETE /api/webauthn/credentials/:id，删除自己的WebAuthn凭证
+	info, exist := c.Get("info")
+	if !exist {
+		SendResponse(c, 400, "Failed to get info by token")
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		SendResponse(c, 400, "Invalid credential id")
+		return
+	}
+	if err := users.DeleteWebAuthnCredential(c.Request.Context(), info.(*utils.TokenInfo).Username, id); err != nil {
+		SendError(c, err)
+		return
+	}
+	SendResponse(c, 200, "WebAuthn credential deleted successfully")
+}
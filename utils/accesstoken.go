@@ -0,0 +1,370 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"user_system/database"
+)
+
+var (
+	ErrAccessTokenNotFound = errors.New("Access token not found")
+	ErrTooManyAccessTokens = errors.New("Too many access tokens")
+)
+
+// AccessTokenPrefix 个人访问令牌以此开头，认证时据此与会话token区分
+const AccessTokenPrefix = "pat_"
+
+const MaxAccessTokens = 50 //每个用户最多保留的个人访问令牌数量
+
+// scopes 是个人访问令牌可以申请的权限，值为true的只有管理员可以申请
+var scopes = map[string]bool{
+	"users:read":    false,
+	"users:write":   false,
+	"sessions:read": false,
+	"admin:read":    true,
+}
+
+// AccessToken 是返回给用户的个人访问令牌信息，不包含令牌本身
+type AccessToken struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	TokenPrefix string     `json:"token_prefix"`
+	Username    string     `json:"-"`
+	Role        string     `json:"-"`
+	Scopes      []string   `json:"scopes"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiredAt   *time.Time `json:"expired_at"` //为nil表示永不过期
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	LastUsedIP  string     `json:"last_used_ip"`
+}
+
+type CreateAccessTokenRequest struct {
+	Name      string     `json:"name" binding:"required,max=100"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1,max=10"`
+	ExpiredAt *time.Time `json:"expired_at"`
+	Username  string     `json:"-"` //由服务端根据当前会话填写
+	Role      string     `json:"-"`
+}
+
+// Validate 检查scope是否存在、角色是否有权申请，以及过期时间
+func (r *CreateAccessTokenRequest) Validate() error {
+	seen := make(map[string]bool, len(r.Scopes))
+	for _, scope := range r.Scopes {
+		adminOnly, ok := scopes[scope]
+		if !ok {
+			return fmt.Errorf("Unknown scope %q", scope)
+		}
+		if adminOnly && r.Role != "admin" {
+			return fmt.Errorf("Scope %q requires admin role", scope)
+		}
+		seen[scope] = true
+	}
+	r.Scopes = r.Scopes[:0]
+	for scope := range seen {
+		r.Scopes = append(r.Scopes, scope)
+	}
+	sort.Strings(r.Scopes)
+	if r.ExpiredAt != nil && !r.ExpiredAt.After(time.Now()) {
+		return fmt.Errorf("expired_at must be in the future")
+	}
+	return nil
+}
+
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+// HasScope 会话token（Scopes为nil）拥有全部权限，个人访问令牌只拥有申请时选择的scope
+func (t *TokenInfo) HasScope(scope string) bool {
+	if t.Scopes == nil {
+		return true
+	}
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func generateAccessToken() (string, error) {
+	token, err := GernerateToken()
+	if err != nil {
+		return "", err
+	}
+	return AccessTokenPrefix + token, nil
+}
+
+func (a *AccessToken) info() *TokenInfo { //认证中间件使用的会话信息
+	info := &TokenInfo{
+		ID:          a.ID,
+		TokenPrefix: a.TokenPrefix,
+		Username:    a.Username,
+		Role:        a.Role,
+		CreatedAt:   a.CreatedAt,
+		LastUsedAt:  a.LastUsedAt,
+		IP:          a.LastUsedIP,
+		Scopes:      a.Scopes,
+	}
+	if a.ExpiredAt != nil {
+		info.ExpiredAt = *a.ExpiredAt
+	}
+	return info
+}
+
+const accessTokenColumns = "id, token, token_prefix, username, role, name, scopes, created_at, expired_at, last_used_at, last_used_ip"
+
+func scanAccessToken(row rowScanner) (*AccessToken, string, error) {
+	var a AccessToken
+	var digest, scopeList string
+	err := row.Scan(&a.ID, &digest, &a.TokenPrefix, &a.Username, &a.Role, &a.Name, &scopeList, &a.CreatedAt, &a.ExpiredAt, &a.LastUsedAt, &a.LastUsedIP)
+	if err != nil {
+		return nil, "", err
+	}
+	a.Scopes = strings.Split(scopeList, ",")
+	return &a, digest, nil
+}
+
+// CreateAccessToken 创建个人访问令牌，返回的明文令牌只在创建时出现一次
+func (h *AuthDBHandler) CreateAccessToken(ctx context.Context, Info *CreateAccessTokenRequest) (string, *AccessToken, error) {
+	if h.DB == nil {
+		return "", nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	token, err := generateAccessToken()
+	if err != nil {
+		return "", nil, err
+	}
+	var created *AccessToken
+	err = h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		//先锁住用户行，同一用户并发创建时依次计数，不会一起越过上限
+		var id int64
+		err := tx.QueryRow(ctx, `SELECT id FROM users WHERE username = ?`+tx.ForUpdate(), Info.Username).Scan(&id)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		var count int
+		err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM access_tokens WHERE username = ?`, Info.Username).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count >= MaxAccessTokens {
+			return ErrTooManyAccessTokens
+		}
+		_, err = tx.Exec(ctx, `
+		INSERT INTO access_tokens (token, token_prefix, username, role, name, scopes, expired_at) VALUES(?, ?, ?, ?, ?, ?, ?)`,
+			HashToken(token), TokenPrefix(token), Info.Username, Info.Role, Info.Name, strings.Join(Info.Scopes, ","), Info.ExpiredAt,
+		)
+		if err != nil {
+			return err
+		}
+		created, _, err = scanAccessToken(tx.QueryRow(ctx, `SELECT `+accessTokenColumns+` FROM access_tokens WHERE token = ?`, HashToken(token)))
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, created, nil
+}
+
+// GetInfoByAccessToken 校验个人访问令牌，返回的TokenInfo中Scopes不为nil
+func (h *AuthDBHandler) GetInfoByAccessToken(ctx context.Context, Token string) (*TokenInfo, error) {
+	if h.DB == nil {
+		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	db := h.DB.ReadConsistent()
+	query := `SELECT ` + accessTokenColumns + ` FROM access_tokens WHERE token = ?`
+	a, digest, err := scanAccessToken(db.QueryRow(ctx, query, HashToken(Token)))
+	if err == sql.ErrNoRows && db.IsReplica() { //刚创建的令牌副本可能还没有同步
+		a, digest, err = scanAccessToken(db.Primary().QueryRow(ctx, query, HashToken(Token)))
+	}
+	if err == sql.ErrNoRows {
+		return nil, ErrAccessTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := a.info()
+	info.Token = digest
+	return info, nil
+}
+
+func (h *AuthDBHandler) GetAccessTokensByUsername(ctx context.Context, username string) ([]AccessToken, error) {
+	if h.DB == nil {
+		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	rows, err := h.DB.ReadConsistent().Query(ctx, `
+	SELECT `+accessTokenColumns+` FROM access_tokens WHERE username = ? ORDER BY created_at DESC, id DESC`, username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]AccessToken, 0)
+	for rows.Next() {
+		a, _, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// DeleteAccessToken 删除username名下的令牌，不存在或属于其他用户时返回ErrAccessTokenNotFound
+func (h *AuthDBHandler) DeleteAccessToken(ctx context.Context, username string, id int) error {
+	if h.DB == nil {
+		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	result, err := h.DB.Exec(ctx, `DELETE FROM access_tokens WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAccessTokenNotFound
+	}
+	return nil
+}
+
+func (h *AuthDBHandler) DeleteAccessTokensByUsername(ctx context.Context, username string) error {
+	if h.DB == nil {
+		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	_, err := h.DB.Exec(ctx, `DELETE FROM access_tokens WHERE username = ?`, username)
+	return err
+}
+
+func (h *AuthDBHandler) TouchAccessToken(ctx context.Context, Info *TokenInfo, IP string) error { //记录令牌最近一次使用的时间和IP
+	if h.DB == nil {
+		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	now := time.Now()
+	_, err := h.DB.Untracked().Exec(ctx, `
+	UPDATE access_tokens SET last_used_at = ?, last_used_ip = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`,
+		now, IP, Info.ID, now.Add(-TouchInterval),
+	)
+	return err
+}
+
+// accessToken 是内存实现中保存的个人访问令牌
+type accessToken struct {
+	AccessToken
+	digest string
+}
+
+func (h *AuthMemoryHandler) CreateAccessToken(ctx context.Context, Info *CreateAccessTokenRequest) (string, *AccessToken, error) {
+	token, err := generateAccessToken()
+	if err != nil {
+		return "", nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	count := 0
+	for _, a := range h.access {
+		if a.Username == Info.Username {
+			count++
+		}
+	}
+	if count >= MaxAccessTokens {
+		return "", nil, ErrTooManyAccessTokens
+	}
+	h.nextAccessID++
+	a := &accessToken{
+		AccessToken: AccessToken{
+			ID:          h.nextAccessID,
+			Name:        Info.Name,
+			TokenPrefix: TokenPrefix(token),
+			Username:    Info.Username,
+			Role:        Info.Role,
+			Scopes:      append([]string(nil), Info.Scopes...),
+			CreatedAt:   time.Now(),
+			ExpiredAt:   Info.ExpiredAt,
+		},
+		digest: HashToken(token),
+	}
+	Save(h.undo, h.access, a.digest, Copy)
+	h.access[a.digest] = a
+	created := a.AccessToken
+	return token, &created, nil
+}
+
+func (h *AuthMemoryHandler) GetInfoByAccessToken(ctx context.Context, Token string) (*TokenInfo, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	a, ok := h.access[HashToken(Token)]
+	if !ok {
+		return nil, ErrAccessTokenNotFound
+	}
+	info := a.info()
+	info.Token = a.digest
+	return info, nil
+}
+
+func (h *AuthMemoryHandler) GetAccessTokensByUsername(ctx context.Context, username string) ([]AccessToken, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]AccessToken, 0)
+	for _, a := range h.access {
+		if a.Username == username {
+			list = append(list, a.AccessToken)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { //与SQL实现保持一致，按创建时间倒序
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.After(list[j].CreatedAt)
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list, nil
+}
+
+func (h *AuthMemoryHandler) DeleteAccessToken(ctx context.Context, username string, id int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for digest, a := range h.access {
+		if a.ID == id && a.Username == username {
+			Save(h.undo, h.access, digest, Copy)
+			delete(h.access, digest)
+			return nil
+		}
+	}
+	return ErrAccessTokenNotFound
+}
+
+func (h *AuthMemoryHandler) DeleteAccessTokensByUsername(ctx context.Context, username string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for digest, a := range h.access {
+		if a.Username == username {
+			Save(h.undo, h.access, digest, Copy)
+			delete(h.access, digest)
+		}
+	}
+	return nil
+}
+
+func (h *AuthMemoryHandler) TouchAccessToken(ctx context.Context, Info *TokenInfo, IP string) error { //与TouchToken一样不随事务回滚
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	a, ok := h.access[Info.Token]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if a.LastUsedAt == nil || a.LastUsedAt.Before(now.Add(-TouchInterval)) {
+		a.LastUsedAt = &now
+		a.LastUsedIP = IP
+	}
+	return nil
+}
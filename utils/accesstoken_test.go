@@ -0,0 +1,149 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"user_system/utils"
+)
+
+func createAccessToken(t *testing.T, tokens utils.TokenStore, username string, scopes ...string) (string, *utils.AccessToken) {
+	t.Helper()
+	token, created, err := tokens.CreateAccessToken(context.Background(), &utils.CreateAccessTokenRequest{Name: "ci", Scopes: scopes, Username: username, Role: "user"})
+	if err != nil {
+		t.Fatalf("CreateAccessToken(%s): %v", username, err)
+	}
+	return token, created
+}
+
+func TestAccessTokens(t *testing.T) {
+	for name, tokens := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			token, created := createAccessToken(t, tokens, "alice", "users:read")
+			if !utils.IsAccessToken(token) || created.TokenPrefix != token[:8] {
+				t.Errorf("CreateAccessToken = %q, %+v", token, created)
+			}
+			info, err := tokens.GetInfoByAccessToken(ctx, token)
+			if err != nil {
+				t.Fatalf("GetInfoByAccessToken: %v", err)
+			}
+			if info.Username != "alice" || !info.HasScope("users:read") || info.HasScope("users:write") || !info.ExpiredAt.IsZero() {
+				t.Errorf("GetInfoByAccessToken = %+v", info)
+			}
+			//令牌只能由本人吊销
+			if err := tokens.DeleteAccessToken(ctx, "bob", created.ID); !errors.Is(err, utils.ErrAccessTokenNotFound) {
+				t.Errorf("DeleteAccessToken by another user: err = %v, want %v", err, utils.ErrAccessTokenNotFound)
+			}
+			if err := tokens.DeleteAccessToken(ctx, "alice", created.ID); err != nil {
+				t.Fatalf("DeleteAccessToken: %v", err)
+			}
+			if _, err := tokens.GetInfoByAccessToken(ctx, token); !errors.Is(err, utils.ErrAccessTokenNotFound) {
+				t.Errorf("revoked token: err = %v, want %v", err, utils.ErrAccessTokenNotFound)
+			}
+			if err := tokens.DeleteAccessToken(ctx, "alice", created.ID); !errors.Is(err, utils.ErrAccessTokenNotFound) {
+				t.Errorf("DeleteAccessToken again: err = %v, want %v", err, utils.ErrAccessTokenNotFound)
+			}
+		})
+	}
+}
+
+// 最近使用时间与IP每个TouchInterval最多更新一次
+func TestTouchAccessToken(t *testing.T) {
+	for name, tokens := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			token, _ := createAccessToken(t, tokens, "alice", "users:read")
+			for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+				info, err := tokens.GetInfoByAccessToken(ctx, token)
+				if err != nil {
+					t.Fatalf("GetInfoByAccessToken: %v", err)
+				}
+				if err := tokens.TouchAccessToken(ctx, info, ip); err != nil {
+					t.Fatalf("TouchAccessToken(%s): %v", ip, err)
+				}
+			}
+			list, err := tokens.GetAccessTokensByUsername(ctx, "alice")
+			if err != nil || len(list) != 1 {
+				t.Fatalf("GetAccessTokensByUsername = %v, %v", list, err)
+			}
+			if list[0].LastUsedAt == nil || list[0].LastUsedIP != "10.0.0.1" {
+				t.Errorf("last used %v from %q, want now from 10.0.0.1", list[0].LastUsedAt, list[0].LastUsedIP)
+			}
+		})
+	}
+}
+
+// 并发创建时也不能超过每个用户的上限，其他用户不受影响
+func TestAccessTokenLimit(t *testing.T) {
+	for name, tokens := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var wg sync.WaitGroup
+			errs := make(chan error, utils.MaxAccessTokens+10)
+			for i := 0; i < utils.MaxAccessTokens+10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, _, err := tokens.CreateAccessToken(ctx, &utils.CreateAccessTokenRequest{Name: fmt.Sprintf("ci-%d", i), Scopes: []string{"users:read"}, Username: "alice", Role: "user"})
+					errs <- err
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			rejected := 0
+			for err := range errs {
+				switch {
+				case errors.Is(err, utils.ErrTooManyAccessTokens):
+					rejected++
+				case err != nil:
+					t.Fatalf("CreateAccessToken: %v", err)
+				}
+			}
+			list, err := tokens.GetAccessTokensByUsername(ctx, "alice")
+			if err != nil {
+				t.Fatalf("GetAccessTokensByUsername: %v", err)
+			}
+			if len(list) != utils.MaxAccessTokens || rejected != 10 {
+				t.Errorf("created %d and rejected %d tokens, want %d and 10", len(list), rejected, utils.MaxAccessTokens)
+			}
+			createAccessToken(t, tokens, "bob", "users:read")
+
+			//吊销全部后可以重新创建
+			if err := tokens.DeleteAccessTokensByUsername(ctx, "alice"); err != nil {
+				t.Fatalf("DeleteAccessTokensByUsername: %v", err)
+			}
+			createAccessToken(t, tokens, "alice", "users:read")
+		})
+	}
+}
+
+func TestCreateAccessTokenRequestValidate(t *testing.T) {
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		req     utils.CreateAccessTokenRequest
+		wantErr bool
+	}{
+		{"valid", utils.CreateAccessTokenRequest{Scopes: []string{"users:read", "users:read"}, Role: "user", ExpiredAt: &future}, false},
+		{"unknown scope", utils.CreateAccessTokenRequest{Scopes: []string{"users:delete"}, Role: "user"}, true},
+		{"admin scope", utils.CreateAccessTokenRequest{Scopes: []string{"admin:read"}, Role: "user"}, true},
+		{"admin scope by admin", utils.CreateAccessTokenRequest{Scopes: []string{"admin:read"}, Role: "admin"}, false},
+		{"expired", utils.CreateAccessTokenRequest{Scopes: []string{"users:read"}, Role: "user", ExpiredAt: &past}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	req := utils.CreateAccessTokenRequest{Scopes: []string{"users:write", "users:read", "users:write"}, Role: "user"}
+	if err := req.Validate(); err != nil || len(req.Scopes) != 2 || req.Scopes[0] != "users:read" {
+		t.Errorf("Validate() = %v, scopes %v, want deduplicated and sorted", err, req.Scopes)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
@@ -9,108 +10,140 @@ import (
 	"user_system/database"
 )
 
+// TokenInfo 是一次登录产生的会话，同一用户可以同时有多个
 type TokenInfo struct {
-	ID        int       `json:"id"`
-	Token     string    `json:"token"`
-	Username  string    `json:"username" binding:"required,max=50"`
-	Role      string    `json:"role" binding:"required,oneof=admin user"`
-	CreatedAt time.Time `json:"created_at"`
-	ExpiredAt time.Time `json:"expired_at"`
+	ID               int        `json:"id"`
+	Token            string     `json:"-"`            //token的摘要，不是token本身，用于在各方法中指定会话
+	TokenPrefix      string     `json:"token_prefix"` //明文token的前几位，只用于辨认
+	Username         string     `json:"username" binding:"required,max=50"`
+	Role             string     `json:"role" binding:"required,oneof=admin user"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiredAt        time.Time  `json:"expired_at"`
+	Device           string     `json:"device"`
+	UserAgent        string     `json:"user_agent"`
+	IP               string     `json:"ip"`
+	LastUsedAt       *time.Time `json:"last_used_at"` //从未使用过时为nil
+	Family           string     `json:"-"`            //签发时所属的refresh token family，吊销会话时一起吊销
+	Stateless        bool       `json:"-"`            //以JWT签发，token只作为jti，不能直接用于认证
+	Remember         bool       `json:"remember_me"`
+	SessionExpiredAt time.Time  `json:"session_expired_at"` //会话的绝对截止时间，ExpiredAt随使用顺延但不超过它
+	Scopes           []string   `json:"-"`                  //个人访问令牌的scope，会话token为nil；永不过期的令牌ExpiredAt为零值
 }
 
 type CreateTokenRequset struct {
-	Username  string    `json:"username" binding:"required,max=50"`
-	Role      string    `json:"role" binding:"required,oneof=admin user"`
-	ExpiredAt time.Time `json:"expired_at"`
+	Username         string    `json:"username" binding:"required,max=50"`
+	Role             string    `json:"role" binding:"required,oneof=admin user"`
+	ExpiredAt        time.Time `json:"expired_at"`
+	Device           string    `json:"device" binding:"max=100"`
+	UserAgent        string    `json:"user_agent"`
+	IP               string    `json:"ip"`
+	Family           string    `json:"-"`
+	Stateless        bool      `json:"-"`
+	Remember         bool      `json:"-"` //登录时为请求的值，签发后为会话策略实际采用的值
+	SessionExpiredAt time.Time `json:"-"`
 }
 
-func NewAuthDBHandler() error {
-	if database.DB == nil {
-		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
-	}
-	//新建Tokens表
-	_, err := database.DB.Exec(`
-    CREATE TABLE IF NOT EXISTS tokens (
-        id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
-		token VARCHAR(64) NOT NULL UNIQUE,
-        username VARCHAR(50) NOT NULL UNIQUE,
-		role VARCHAR(5) NOT NULL DEFAULT 'user',
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-		expired_at TIMESTAMP
-    ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci
-	`) //FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+// TouchInterval 内不重复更新last_used_at，避免每个请求都写数据库
+const TouchInterval = time.Minute
+
+const tokenColumns = "id, token, token_prefix, username, role, created_at, expired_at, device, user_agent, ip, last_used_at, family, remember, session_expired_at, stateless"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row rowScanner) (*TokenInfo, error) {
+	var tokeninfo TokenInfo
+	var deadline *time.Time
+	err := row.Scan(&tokeninfo.ID, &tokeninfo.Token, &tokeninfo.TokenPrefix, &tokeninfo.Username, &tokeninfo.Role, &tokeninfo.CreatedAt, &tokeninfo.ExpiredAt, &tokeninfo.Device, &tokeninfo.UserAgent, &tokeninfo.IP, &tokeninfo.LastUsedAt, &tokeninfo.Family, &tokeninfo.Remember, &deadline, &tokeninfo.Stateless)
 	if err != nil {
-		return fmt.Errorf("Failed to create tokens table: %w", err)
+		return nil, err
 	}
-	return nil
+	tokeninfo.SessionExpiredAt = orExpiry(deadline, tokeninfo.ExpiredAt)
+	return &tokeninfo, nil
+}
+
+type AuthDBHandler struct {
+	DB *database.Conn
+}
+
+func NewAuthDBHandler(db *database.Conn) (*AuthDBHandler, error) {
+	if db == nil {
+		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	//表结构由migrations包维护
+	return &AuthDBHandler{DB: db}, nil
 }
 
-func GetToken(Info *CreateTokenRequset) (string, error) {
+func (h *AuthDBHandler) WithConn(conn *database.Conn) *AuthDBHandler { //返回使用指定连接（通常是事务）的副本
+	return &AuthDBHandler{DB: conn}
+}
+
+func (h *AuthDBHandler) GetToken(ctx context.Context, Info *CreateTokenRequset) (string, error) {
 	if time.Now().After(Info.ExpiredAt) {
 		return "", fmt.Errorf("CreateToken: ExpiredAt must be after now")
 	}
-	if database.DB == nil {
+	if h.DB == nil {
 		return "", fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
+	//清理过期会话和插入新会话放在同一个事务里，已在事务中时加入外层事务
 	var token string
-	err := database.DB.QueryRow(`
-		SELECT token, expired_at FROM tokens WHERE username = ?`,
-		Info.Username,
-	).Scan(&token, &Info.ExpiredAt)
+	err := h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		var err error
+		token, err = h.WithConn(tx).getToken(ctx, Info)
+		return err
+	})
+	return token, err
+}
+
+func (h *AuthDBHandler) getToken(ctx context.Context, Info *CreateTokenRequset) (string, error) {
+	//每次登录都新建会话，顺便清理该用户已过期的会话
+	_, err := h.DB.Exec(ctx, `
+	DELETE FROM tokens WHERE username = ? AND expired_at < ?`, Info.Username, time.Now(),
+	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			//token不存在，生成token
-			token, err = GernerateToken()
-			if err != nil {
-				return "", err
-			}
-			_, err = database.DB.Exec(`
-			INSERT INTO tokens (token, username, role, expired_at) VALUES(?, ?, ?, ?)`,
-				token, Info.Username, Info.Role, Info.ExpiredAt,
-			)
-			if err != nil {
-				return "", err
-			}
-			return token, nil
-		}
 		return "", err
 	}
-	//token存在，判断是否过期
-	if time.Now().Before(Info.ExpiredAt) {
-		return token, nil
-	}
-	//token过期，更新token
-	token, err = GernerateToken()
+	token, err := GernerateToken()
 	if err != nil {
 		return "", err
 	}
-	Info.ExpiredAt = time.Now().Add(15 * time.Minute)
-	err = UpdateToken(token, Info)
+	_, err = h.DB.Exec(ctx, `
+	INSERT INTO tokens (token, token_prefix, hashed, username, role, expired_at, device, user_agent, ip, family, remember, session_expired_at, stateless) VALUES(?, ?, 1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		HashToken(token), TokenPrefix(token), Info.Username, Info.Role, Info.ExpiredAt, Info.Device, Info.UserAgent, Info.IP, Info.Family, Info.Remember, sessionDeadline(Info), Info.Stateless,
+	)
 	if err != nil {
 		return "", err
 	}
 	return token, nil
 }
 
-func GetInfobyToken(Token string) (*TokenInfo, error) {
-	if database.DB == nil {
+func (h *AuthDBHandler) GetInfobyToken(ctx context.Context, Token string) (*TokenInfo, error) {
+	if h.DB == nil {
 		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
-	var tokeninfo TokenInfo
-	err := database.DB.QueryRow(`
-	SELECT 
-	id, username, role, created_at, expired_at
-	FROM tokens
-	WHERE token = ?`, Token,
-	).Scan(&tokeninfo.ID, &tokeninfo.Username, &tokeninfo.Role, &tokeninfo.CreatedAt, &tokeninfo.ExpiredAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("Token not found")
+	db := h.DB.ReadConsistent()
+	query := `SELECT ` + tokenColumns + ` FROM tokens WHERE token = ?`
+	digest := HashToken(Token) //数据库中只保存摘要
+	tokeninfo, err := scanToken(db.QueryRow(ctx, query, digest))
+	if err == sql.ErrNoRows && db.IsReplica() {
+		//token可能刚在其他实例登录签发，副本还没有同步，回主库再查一次
+		tokeninfo, err = scanToken(db.Primary().QueryRow(ctx, query, digest))
+	}
+	if err == sql.ErrNoRows {
+		if converted, herr := h.hashLegacy(ctx, "tokens", Token); herr != nil {
+			return nil, herr
+		} else if converted {
+			tokeninfo, err = scanToken(h.DB.QueryRow(ctx, query, digest))
 		}
+	}
+	if err == sql.ErrNoRows || (err == nil && tokeninfo.Stateless) { //JWT的jti不能当作不透明token使用
+		return nil, fmt.Errorf("Token not found")
+	}
+	if err != nil {
 		return nil, err
 	}
-	tokeninfo.Token = Token
-	return &tokeninfo, nil
+	return tokeninfo, nil
 }
 
 func GernerateToken() (string, error) {
@@ -122,25 +155,16 @@ func GernerateToken() (string, error) {
 	return token, nil
 }
 
-func DeleteToken(Token string) error {
-	if database.DB == nil {
-		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
-	}
-	_, err := database.DB.Exec(`
-	DELETE FROM tokens WHERE token = ?`, Token,
-	)
-	if err != nil {
-		return err
-	}
-	return nil
+func (h *AuthDBHandler) DeleteToken(ctx context.Context, Token string) error {
+	return h.DeleteTokenByToken(ctx, Token)
 }
 
-func GetTokenCount() (int, error) {
-	if database.DB == nil {
+func (h *AuthDBHandler) GetTokenCount(ctx context.Context) (int, error) {
+	if h.DB == nil {
 		return 0, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
 	var count int
-	err := database.DB.QueryRow(`
+	err := h.DB.ReadOnly().QueryRow(ctx, `
 	SELECT COUNT(*) FROM tokens`,
 	).Scan(&count)
 	if err != nil {
@@ -149,28 +173,43 @@ func GetTokenCount() (int, error) {
 	return count, nil
 }
 
-func GetAllTokens() ([]TokenInfo, error) {
-	if database.DB == nil {
+func (h *AuthDBHandler) GetAllTokens(ctx context.Context) ([]TokenInfo, error) {
+	if h.DB == nil {
 		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
-	rows, err := database.DB.Query(`
-	SELECT 
-	id, token, username, role, created_at, expired_at
+	return h.queryTokens(ctx, h.DB.ReadOnly(), `
+	SELECT `+tokenColumns+`
 	FROM tokens
 	ORDER BY created_at DESC`,
 	)
+}
+
+func (h *AuthDBHandler) GetTokensByUsername(ctx context.Context, username string) ([]TokenInfo, error) {
+	if h.DB == nil {
+		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	//用户刚登录或刚删除会话后立即查看列表，需要一致性的读
+	return h.queryTokens(ctx, h.DB.ReadConsistent(), `
+	SELECT `+tokenColumns+`
+	FROM tokens
+	WHERE username = ?
+	ORDER BY created_at DESC, id DESC`, username,
+	)
+}
+
+func (h *AuthDBHandler) queryTokens(ctx context.Context, db *database.Conn, query string, args ...any) ([]TokenInfo, error) {
+	rows, err := db.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var tokens []TokenInfo
 	for rows.Next() {
-		var tokeninfo TokenInfo
-		err := rows.Scan(&tokeninfo.ID, &tokeninfo.Token, &tokeninfo.Username, &tokeninfo.Role, &tokeninfo.CreatedAt, &tokeninfo.ExpiredAt)
+		tokeninfo, err := scanToken(rows)
 		if err != nil {
 			return nil, err
 		}
-		tokens = append(tokens, tokeninfo)
+		tokens = append(tokens, *tokeninfo)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -178,12 +217,12 @@ func GetAllTokens() ([]TokenInfo, error) {
 	return tokens, nil
 }
 
-func UpdateToken(Token string, Info *CreateTokenRequset) error {
-	if database.DB == nil {
+func (h *AuthDBHandler) UpdateToken(ctx context.Context, Token string, Info *CreateTokenRequset) error {
+	if h.DB == nil {
 		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
-	_, err := database.DB.Exec(`
-	UPDATE tokens SET role = ?, expired_at = ?, token = ? WHERE username = ?`,
+	_, err := h.DB.Exec(ctx, `
+	UPDATE tokens SET role = ?, expired_at = ? WHERE token = ? AND username = ?`,
 		Info.Role, Info.ExpiredAt, Token, Info.Username,
 	)
 	if err != nil {
@@ -192,12 +231,37 @@ func UpdateToken(Token string, Info *CreateTokenRequset) error {
 	return nil
 }
 
-func DeleteAllTokens() error {
-	if database.DB == nil {
+// TouchToken 记录会话最近一次使用的时间和IP，并按会话策略顺延访问token和同一family的refresh token
+func (h *AuthDBHandler) TouchToken(ctx context.Context, Info *TokenInfo, IP string) error {
+	if h.DB == nil {
 		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
-	_, err := database.DB.Exec(`
-	DELETE FROM tokens`,
+	now := time.Now()
+	db := h.DB.Untracked() //顺延的有效期在副本上晚一点可见也不影响使用
+	//JWT中没有计算有效期需要的会话字段，从会话行读取
+	if Info.Stateless {
+		stored, err := scanToken(db.QueryRow(ctx, `SELECT `+tokenColumns+` FROM tokens WHERE token = ?`, Info.Token))
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		Info = stored
+	}
+	access, refresh := slideSession(Info.Role, Info.Remember, Info.SessionExpiredAt)
+	result, err := db.Exec(ctx, `
+	UPDATE tokens SET last_used_at = ?, ip = ?, expired_at = ? WHERE token = ? AND (last_used_at IS NULL OR last_used_at < ?)`,
+		now, IP, access, Info.Token, now.Add(-TouchInterval),
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 || Info.Family == "" {
+		return err //其他请求刚更新过，不必重复顺延
+	}
+	_, err = db.Exec(ctx, `
+	UPDATE refresh_tokens SET expired_at = ? WHERE family = ? AND used_at IS NULL`, refresh, Info.Family,
 	)
 	if err != nil {
 		return err
@@ -205,25 +269,48 @@ func DeleteAllTokens() error {
 	return nil
 }
 
-func DeleteExpiredTokens() error {
-	if database.DB == nil {
+func (h *AuthDBHandler) DeleteAllTokens(ctx context.Context) error {
+	if h.DB == nil {
+		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	return h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM refresh_tokens`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM access_tokens`); err != nil {
+			return err
+		}
+		return h.WithConn(tx).deleteTokens(ctx, "1 = 1")
+	})
+}
+
+func (h *AuthDBHandler) DeleteExpiredTokens(ctx context.Context) error {
+	if h.DB == nil {
 		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
-	_, err := database.DB.Exec(`
+	//已轮换的记录保留到会话截止时间，期间被重放仍能识别出来
+	now := time.Now()
+	_, err := h.DB.Exec(ctx, `
+	DELETE FROM refresh_tokens WHERE (used_at IS NULL AND expired_at < ?) OR COALESCE(session_expired_at, expired_at) < ?`, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = h.DB.Exec(ctx, `
 	DELETE FROM tokens WHERE expired_at < ?`, time.Now(),
 	)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func DeleteTokenByUsername(username string) error {
-	if database.DB == nil {
-		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	_, err = h.DB.Exec(ctx, `
+	DELETE FROM access_tokens WHERE expired_at < ?`, time.Now(),
+	)
+	if err != nil {
+		return err
 	}
-	_, err := database.DB.Exec(`
-	DELETE FROM tokens WHERE username = ?`, username,
+	//token过期后签名验证就会失败，不需要再留在吊销列表中
+	_, err = h.DB.Exec(ctx, `
+	DELETE FROM revoked_tokens WHERE expired_at < ?`, time.Now(),
 	)
 	if err != nil {
 		return err
@@ -231,28 +318,77 @@ func DeleteTokenByUsername(username string) error {
 	return nil
 }
 
-func DeleteTokenByID(id int) error {
-	if database.DB == nil {
+func (h *AuthDBHandler) DeleteTokenByUsername(ctx context.Context, username string) error {
+	if h.DB == nil {
+		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	return h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM refresh_tokens WHERE username = ?`, username); err != nil {
+			return err
+		}
+		return h.WithConn(tx).deleteTokens(ctx, "username = ?", username)
+	})
+}
+
+func (h *AuthDBHandler) DeleteTokenByID(ctx context.Context, id int) error {
+	return h.deleteSession(ctx, "id = ?", id)
+}
+
+func (h *AuthDBHandler) DeleteTokenByToken(ctx context.Context, token string) error {
+	return h.deleteSession(ctx, "token = ?", token)
+}
+
+// deleteSession 删除访问token，同时吊销它所属family的refresh token，避免被删除的会话再刷新出新token
+func (h *AuthDBHandler) deleteSession(ctx context.Context, where string, arg any) error {
+	if h.DB == nil {
 		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
-	_, err := database.DB.Exec(`
-	DELETE FROM tokens WHERE id = ?`, id,
+	return h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		_, err := tx.Exec(ctx, `
+		DELETE FROM refresh_tokens WHERE family IN (SELECT family FROM tokens WHERE `+where+` AND family <> '')`, arg,
+		)
+		if err != nil {
+			return err
+		}
+		return h.WithConn(tx).deleteTokens(ctx, where, arg)
+	})
+}
+
+// deleteTokens 删除匹配的访问token，未过期的记入吊销列表，使已签发的JWT也失效；调用方需在事务中
+func (h *AuthDBHandler) deleteTokens(ctx context.Context, where string, args ...any) error {
+	_, err := h.DB.Exec(ctx, `
+	INSERT INTO revoked_tokens (jti, expired_at, hashed)
+	SELECT token, expired_at, hashed FROM tokens WHERE expired_at > ? AND (`+where+`)`,
+		append([]any{time.Now()}, args...)...,
 	)
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = h.DB.Exec(ctx, `DELETE FROM tokens WHERE `+where, args...)
+	return err
 }
 
-func DeleteTokenByToken(token string) error {
-	if database.DB == nil {
-		return fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+func (h *AuthDBHandler) GetRevokedTokens(ctx context.Context, since time.Time) ([]RevokedToken, error) {
+	if h.DB == nil {
+		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
 	}
-	_, err := database.DB.Exec(`
-	DELETE FROM tokens WHERE token = ?`, token,
+	rows, err := h.DB.Query(ctx, `
+	SELECT jti, expired_at, revoked_at FROM revoked_tokens WHERE revoked_at >= ? AND expired_at > ?`, since, time.Now(),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+	var revoked []RevokedToken
+	for rows.Next() {
+		var r RevokedToken
+		if err := rows.Scan(&r.JTI, &r.ExpiredAt, &r.RevokedAt); err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revoked, nil
 }
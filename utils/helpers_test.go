@@ -0,0 +1,65 @@
+package utils_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"user_system/database"
+	"user_system/migrations"
+	"user_system/utils"
+
+	_ "modernc.org/sqlite"
+)
+
+// newSQLiteStore 在临时目录中创建SQLite数据库并执行全部迁移
+func newSQLiteStore(t *testing.T) *utils.AuthDBHandler {
+	t.Helper()
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_integer_format=unix_micro&_inttotime=1&_txlock=immediate",
+		filepath.Join(t.TempDir(), "test.db"),
+	))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	conn := database.NewConn(db, database.DriverSQLite)
+	migrator, err := migrations.NewMigrator(conn)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	store, err := utils.NewAuthDBHandler(conn)
+	if err != nil {
+		t.Fatalf("NewAuthDBHandler: %v", err)
+	}
+	return store
+}
+
+// stores 返回需要保持一致行为的TokenStore实现
+func stores(t *testing.T) map[string]utils.TokenStore {
+	t.Helper()
+	return map[string]utils.TokenStore{
+		"memory": utils.NewAuthMemoryHandler(),
+		"sqlite": newSQLiteStore(t),
+	}
+}
+
+func issue(t *testing.T, tokens utils.TokenStore, username string) *utils.TokenPair {
+	t.Helper()
+	pair, err := utils.IssueTokenPair(context.Background(), tokens, &utils.CreateTokenRequset{Username: username, Role: "user"})
+	if err != nil {
+		t.Fatalf("IssueTokenPair(%s): %v", username, err)
+	}
+	return pair
+}
+
+// set 在测试期间修改包级配置，结束后恢复
+func set[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
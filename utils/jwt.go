@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"user_system/jwt"
+)
+
+var JWT *JWTIssuer //为nil时签发不透明的随机token
+
+const revocationOverlap = time.Minute //同步吊销列表时向前多取一段，避免漏掉提交较晚的事务
+
+// JWTIssuer 把会话签成JWT，验证时不查数据库，只检查定期同步到内存的吊销列表
+// jti是会话的随机token，tokens表中保存其摘要，会话列表、退出登录等仍按原来的方式工作；该行标记为stateless，jti不能作为不透明token通过认证
+type JWTIssuer struct {
+	Keys   *jwt.KeySet
+	Issuer string
+	tokens TokenStore
+
+	mu       sync.RWMutex
+	revoked  map[string]time.Time //jti -> 过期时间
+	touched  map[string]time.Time //jti摘要 -> 本实例最近一次记录会话使用的时间
+	syncedAt time.Time
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewJWTIssuer(keys *jwt.KeySet, issuer string, tokens TokenStore) *JWTIssuer {
+	return &JWTIssuer{Keys: keys, Issuer: issuer, tokens: tokens, revoked: make(map[string]time.Time), touched: make(map[string]time.Time)}
+}
+
+// Start 先同步一次吊销列表，再在后台定期同步并轮换密钥
+func (j *JWTIssuer) Start(ctx context.Context, syncInterval time.Duration) error {
+	if err := j.Sync(ctx); err != nil {
+		return fmt.Errorf("Failed to load revoked tokens: %w", err)
+	}
+	if syncInterval <= 0 {
+		syncInterval = 5 * time.Second
+	}
+	j.stop = make(chan struct{})
+	j.wg.Add(2)
+	go j.every(syncInterval, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), syncInterval)
+		defer cancel()
+		if err := j.Sync(ctx); err != nil {
+			log.Printf("Failed to sync revoked tokens: %v", err)
+		}
+	})
+	go j.every(j.Keys.CheckInterval(), func() {
+		if err := j.Keys.Rotate(); err != nil {
+			log.Printf("Failed to rotate signing keys: %v", err)
+		}
+	})
+	return nil
+}
+
+func (j *JWTIssuer) every(interval time.Duration, fn func()) {
+	defer j.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+func (j *JWTIssuer) Close() {
+	if j.stop != nil {
+		close(j.stop)
+		j.wg.Wait()
+		j.stop = nil
+	}
+}
+
+// Sync 拉取上次同步以来新增的吊销记录，并清理已过期的记录
+func (j *JWTIssuer) Sync(ctx context.Context) error {
+	j.mu.RLock()
+	since := j.syncedAt
+	j.mu.RUnlock()
+	now := time.Now()
+	if !since.IsZero() {
+		since = since.Add(-revocationOverlap)
+	}
+	revoked, err := j.tokens.GetRevokedTokens(ctx, since)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, r := range revoked {
+		j.revoked[r.JTI] = r.ExpiredAt
+	}
+	for jti, expiredAt := range j.revoked {
+		if expiredAt.Before(now) {
+			delete(j.revoked, jti)
+		}
+	}
+	for digest, touchedAt := range j.touched {
+		if touchedAt.Before(now.Add(-TouchInterval)) {
+			delete(j.touched, digest)
+		}
+	}
+	j.syncedAt = now
+	return nil
+}
+
+func (j *JWTIssuer) Sign(jti string, Info *CreateTokenRequset) (string, error) {
+	now := time.Now()
+	return j.Keys.Sign(&jwt.Claims{
+		Issuer:    j.Issuer,
+		Subject:   Info.Username,
+		Role:      Info.Role,
+		ID:        jti,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: Info.ExpiredAt.Unix(),
+	})
+}
+
+// Verify 校验签名和有效期，再检查吊销列表；返回的TokenInfo中Token为jti的摘要
+func (j *JWTIssuer) Verify(token string) (*TokenInfo, error) {
+	claims, err := j.Keys.Verify(token, j.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	digest := HashToken(claims.ID) //吊销列表与tokens表一样按摘要记录
+	j.mu.RLock()
+	_, revoked := j.revoked[digest]
+	j.mu.RUnlock()
+	if revoked {
+		return nil, fmt.Errorf("Token has been revoked")
+	}
+	return &TokenInfo{
+		Token:     digest,
+		Username:  claims.Subject,
+		Role:      claims.Role,
+		CreatedAt: time.Unix(claims.IssuedAt, 0),
+		ExpiredAt: time.Unix(claims.ExpiresAt, 0),
+		Stateless: true,
+	}, nil
+}
+
+// Touch 记录会话最近使用的时间并顺延有效期，与不透明token一样按TouchInterval节流
+// JWT中没有最近使用时间，间隔在本实例内存中判断，多个实例之间由TouchToken的条件更新去重
+func (j *JWTIssuer) Touch(ctx context.Context, info *TokenInfo, IP string) error {
+	now := time.Now()
+	j.mu.Lock()
+	if touchedAt, ok := j.touched[info.Token]; ok && !touchedAt.Before(now.Add(-TouchInterval)) {
+		j.mu.Unlock()
+		return nil
+	}
+	j.touched[info.Token] = now
+	j.mu.Unlock()
+	return j.tokens.TouchToken(ctx, info, IP)
+}
+
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,74 @@
+package utils_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"user_system/jwt"
+	"user_system/utils"
+)
+
+// 以JWT签发的会话只能通过JWT认证，jti不能当作不透明token查到会话
+func TestStatelessSessionNotOpaque(t *testing.T) {
+	keys, err := jwt.NewKeySet(jwt.EdDSA, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	for name, tokens := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			utils.JWT = utils.NewJWTIssuer(keys, "test", tokens)
+			t.Cleanup(func() { utils.JWT = nil })
+
+			pair := issue(t, tokens, "alice")
+			info, err := utils.JWT.Verify(pair.AccessToken)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if _, err := tokens.GetInfobyToken(ctx, info.Token); err == nil {
+				t.Error("jti accepted as an opaque token")
+			}
+			sessions, err := tokens.GetTokensByUsername(ctx, "alice")
+			if err != nil || len(sessions) != 1 {
+				t.Fatalf("GetTokensByUsername: %v, %v", sessions, err)
+			}
+		})
+	}
+}
+
+// JWT请求同样记录会话最近使用的时间，并在本实例按TouchInterval节流
+func TestJWTTouch(t *testing.T) {
+	keys, err := jwt.NewKeySet(jwt.EdDSA, "", 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewKeySet: %v", err)
+	}
+	for name, tokens := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			utils.JWT = utils.NewJWTIssuer(keys, "test", tokens)
+			t.Cleanup(func() { utils.JWT = nil })
+
+			pair := issue(t, tokens, "alice")
+			info, err := utils.JWT.Verify(pair.AccessToken)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			for _, ip := range []string{"10.0.0.1", "10.0.0.2"} { //第二次在间隔内，不再写入
+				if err := utils.JWT.Touch(ctx, info, ip); err != nil {
+					t.Fatalf("Touch(%s): %v", ip, err)
+				}
+			}
+			sessions, err := tokens.GetTokensByUsername(ctx, "alice")
+			if err != nil || len(sessions) != 1 {
+				t.Fatalf("GetTokensByUsername: %v, %v", sessions, err)
+			}
+			if sessions[0].LastUsedAt == nil || sessions[0].IP != "10.0.0.1" {
+				t.Errorf("session after Touch: last used %v from %q, want now from 10.0.0.1", sessions[0].LastUsedAt, sessions[0].IP)
+			}
+			//按会话行中的策略顺延，不能用JWT中缺少的字段计算
+			if !sessions[0].ExpiredAt.After(time.Now()) || sessions[0].ExpiredAt.After(pair.SessionExpiredAt) {
+				t.Errorf("ExpiredAt after Touch = %v, want between now and %v", sessions[0].ExpiredAt, pair.SessionExpiredAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"user_system/database"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("Refresh token reuse detected, all sessions of this login have been revoked")
+)
+
+var AccessTokenTTL = 15 * time.Minute //单个访问token的最长有效期，由main根据配置设置
+
+// TokenPair 是登录或刷新后返回给客户端的token
+type TokenPair struct {
+	AccessToken      string        `json:"token"`
+	RefreshToken     string        `json:"refresh_token"`
+	ExpiredAt        time.Time     `json:"expired_at"`
+	RefreshExpiredAt time.Time     `json:"refresh_expired_at"`
+	SessionExpiredAt time.Time     `json:"session_expired_at"` //会话的绝对截止时间，刷新也不能延长
+	IdleTimeout      time.Duration `json:"-"`
+	RememberMe       bool          `json:"remember_me"`
+}
+
+// IssueTokenPair 为一次新的登录签发访问token和refresh token，二者属于一个新的family
+// Info.Remember为请求的值，按角色的会话策略确定是否支持记住我以及会话的截止时间
+func IssueTokenPair(ctx context.Context, tokens TokenStore, Info *CreateTokenRequset) (*TokenPair, error) {
+	family, err := GernerateToken()
+	if err != nil {
+		return nil, err
+	}
+	request := *Info
+	request.Family = family
+	policy, remember := Sessions.For(Info.Role, Info.Remember)
+	request.Remember = remember
+	request.SessionExpiredAt = time.Now().Add(policy.AbsoluteTimeout)
+	return issueTokenPair(ctx, tokens, &request)
+}
+
+func issueTokenPair(ctx context.Context, tokens TokenStore, Info *CreateTokenRequset) (*TokenPair, error) {
+	policy, _ := Sessions.For(Info.Role, Info.Remember)
+	now := time.Now()
+	access := *Info
+	access.ExpiredAt = sessionExpiry(now, accessWindow(policy), Info.SessionExpiredAt)
+	access.Stateless = JWT != nil
+	accessToken, err := tokens.GetToken(ctx, &access)
+	if err != nil {
+		return nil, err
+	}
+	if JWT != nil { //tokens表中保存的随机token作为jti
+		accessToken, err = JWT.Sign(accessToken, &access)
+		if err != nil {
+			return nil, err
+		}
+	}
+	refresh := *Info
+	refresh.ExpiredAt = sessionExpiry(now, policy.IdleTimeout, Info.SessionExpiredAt)
+	refreshToken, err := tokens.CreateRefreshToken(ctx, &refresh)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		ExpiredAt:        access.ExpiredAt,
+		RefreshExpiredAt: refresh.ExpiredAt,
+		SessionExpiredAt: Info.SessionExpiredAt,
+		IdleTimeout:      policy.IdleTimeout,
+		RememberMe:       Info.Remember,
+	}, nil
+}
+
+func (h *AuthDBHandler) CreateRefreshToken(ctx context.Context, Info *CreateTokenRequset) (string, error) {
+	if h.DB == nil {
+		return "", fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	if Info.Family == "" {
+		return "", fmt.Errorf("CreateRefreshToken: Family is required")
+	}
+	token, err := GernerateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = h.DB.Exec(ctx, `
+	INSERT INTO refresh_tokens (token, token_prefix, hashed, family, username, role, device, user_agent, expired_at, remember, session_expired_at) VALUES(?, ?, 1, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		HashToken(token), TokenPrefix(token), Info.Family, Info.Username, Info.Role, Info.Device, Info.UserAgent, Info.ExpiredAt, Info.Remember, sessionDeadline(Info),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken 用refresh token换取新的访问token和refresh token，旧的refresh token随即失效
+// 已经轮换过的refresh token再次出现时吊销整个family并返回ErrRefreshTokenReused
+func (h *AuthDBHandler) RotateRefreshToken(ctx context.Context, Token string, IP string) (*TokenPair, error) {
+	if h.DB == nil {
+		return nil, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	var pair *TokenPair
+	var reused bool
+	err := h.DB.WithTx(ctx, func(tx *database.Conn) error {
+		var err error
+		pair, reused, err = h.WithConn(tx).rotateRefreshToken(ctx, Token, IP)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused { //吊销family的修改需要提交，所以在事务外返回错误
+		return nil, ErrRefreshTokenReused
+	}
+	return pair, nil
+}
+
+func (h *AuthDBHandler) rotateRefreshToken(ctx context.Context, Token string, IP string) (*TokenPair, bool, error) {
+	var id int
+	var usedAt, deadline *time.Time
+	var Info CreateTokenRequset
+	query := `
+	SELECT id, family, username, role, device, user_agent, expired_at, used_at, remember, session_expired_at
+	FROM refresh_tokens
+	WHERE token = ?` + h.DB.ForUpdate()
+	scan := func() error {
+		return h.DB.QueryRow(ctx, query, HashToken(Token)).Scan(&id, &Info.Family, &Info.Username, &Info.Role, &Info.Device, &Info.UserAgent, &Info.ExpiredAt, &usedAt, &Info.Remember, &deadline)
+	}
+	err := scan()
+	if err == sql.ErrNoRows {
+		if converted, herr := h.hashLegacy(ctx, "refresh_tokens", Token); herr != nil {
+			return nil, false, herr
+		} else if converted {
+			err = scan()
+		}
+	}
+	if err == sql.ErrNoRows {
+		return nil, false, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	Info.SessionExpiredAt = orExpiry(deadline, Info.ExpiredAt)
+	if usedAt != nil { //旧token被重放，说明refresh token可能已泄露
+		if err := h.revokeFamily(ctx, Info.Family); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	if time.Now().After(Info.ExpiredAt) {
+		return nil, false, ErrInvalidRefreshToken
+	}
+	_, err = h.DB.Exec(ctx, `
+	UPDATE refresh_tokens SET used_at = ? WHERE id = ?`, time.Now(), id,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	//旧的访问token随轮换失效，每个family只保留最新的一个会话
+	if err := h.deleteTokens(ctx, "family = ?", Info.Family); err != nil {
+		return nil, false, err
+	}
+	Info.IP = IP
+	pair, err := issueTokenPair(ctx, h, &Info)
+	if err != nil {
+		return nil, false, err
+	}
+	return pair, false, nil
+}
+
+func (h *AuthDBHandler) revokeFamily(ctx context.Context, family string) error {
+	_, err := h.DB.Exec(ctx, `
+	DELETE FROM refresh_tokens WHERE family = ?`, family,
+	)
+	if err != nil {
+		return err
+	}
+	return h.deleteTokens(ctx, "family = ?", family)
+}
+
+// refreshToken 是内存实现中保存的refresh token
+type refreshToken struct {
+	Info   CreateTokenRequset
+	UsedAt *time.Time
+}
+
+func (h *AuthMemoryHandler) CreateRefreshToken(ctx context.Context, Info *CreateTokenRequset) (string, error) {
+	if Info.Family == "" {
+		return "", fmt.Errorf("CreateRefreshToken: Family is required")
+	}
+	token, err := GernerateToken()
+	if err != nil {
+		return "", err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	digest := HashToken(token)
+	Save(h.undo, h.refresh, digest, Copy)
+	h.refresh[digest] = &refreshToken{Info: *Info}
+	return token, nil
+}
+
+func (h *AuthMemoryHandler) RotateRefreshToken(ctx context.Context, Token string, IP string) (*TokenPair, error) {
+	h.rotateMu.Lock() //与SQL实现的行锁对应，同一时间只处理一个轮换
+	defer h.rotateMu.Unlock()
+	h.mu.Lock()
+	digest := HashToken(Token)
+	stored, ok := h.refresh[digest]
+	if !ok || (stored.UsedAt == nil && time.Now().After(stored.Info.ExpiredAt)) {
+		h.mu.Unlock()
+		return nil, ErrInvalidRefreshToken
+	}
+	Info := stored.Info
+	if stored.UsedAt != nil { //旧token被重放，吊销整个family
+		h.deleteFamilyLocked(Info.Family)
+		h.mu.Unlock()
+		return nil, ErrRefreshTokenReused
+	}
+	now := time.Now()
+	Save(h.undo, h.refresh, digest, Copy)
+	stored.UsedAt = &now
+	for token, info := range h.tokens { //旧的访问token随轮换失效
+		if info.Family == Info.Family {
+			h.removeLocked(token)
+		}
+	}
+	h.mu.Unlock()
+	Info.IP = IP
+	return issueTokenPair(ctx, h, &Info)
+}
+
+func (h *AuthMemoryHandler) deleteFamilyLocked(family string) { //调用方需持有h.mu
+	if family == "" {
+		return
+	}
+	for token, stored := range h.refresh {
+		if stored.Info.Family == family {
+			Save(h.undo, h.refresh, token, Copy)
+			delete(h.refresh, token)
+		}
+	}
+	for token, info := range h.tokens {
+		if info.Family == family {
+			h.removeLocked(token)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"user_system/utils"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	for name, tokens := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			first := issue(t, tokens, "alice")
+			other := issue(t, tokens, "alice") //同一用户的另一次登录属于不同的family
+			second, err := tokens.RotateRefreshToken(ctx, first.RefreshToken, "127.0.0.1")
+			if err != nil {
+				t.Fatalf("RotateRefreshToken: %v", err)
+			}
+			if second.RefreshToken == first.RefreshToken || second.AccessToken == first.AccessToken {
+				t.Fatal("rotation returned the old tokens")
+			}
+			if second.SessionExpiredAt.Sub(first.SessionExpiredAt).Abs() > time.Millisecond { //数据库只保存到微秒
+				t.Errorf("SessionExpiredAt = %v, want %v", second.SessionExpiredAt, first.SessionExpiredAt)
+			}
+			//轮换后旧的访问token立即失效
+			if _, err := tokens.GetInfobyToken(ctx, first.AccessToken); err == nil {
+				t.Error("old access token still valid after rotation")
+			}
+			info, err := tokens.GetInfobyToken(ctx, second.AccessToken)
+			if err != nil || info.Username != "alice" || info.IP != "127.0.0.1" {
+				t.Fatalf("new access token: %+v, %v", info, err)
+			}
+
+			//旧refresh token被重放，整个family被吊销，其他登录不受影响
+			steps := []struct {
+				name    string
+				token   string
+				wantErr error
+			}{
+				{"unknown token", "unknown", utils.ErrInvalidRefreshToken},
+				{"reused token", first.RefreshToken, utils.ErrRefreshTokenReused},
+				{"rotated token after reuse", second.RefreshToken, utils.ErrInvalidRefreshToken},
+				{"reused token again", first.RefreshToken, utils.ErrInvalidRefreshToken},
+				{"other family", other.RefreshToken, nil},
+			}
+			for _, step := range steps {
+				if _, err := tokens.RotateRefreshToken(ctx, step.token, ""); !errors.Is(err, step.wantErr) {
+					t.Errorf("%s: err = %v, want %v", step.name, err, step.wantErr)
+				}
+			}
+			if _, err := tokens.GetInfobyToken(ctx, second.AccessToken); err == nil {
+				t.Error("access token of the revoked family still valid")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SessionPolicy 规定一次登录（一个refresh token family）的有效期
+type SessionPolicy struct {
+	IdleTimeout     time.Duration //超过该时间未使用则会话失效，每次使用后顺延
+	AbsoluteTimeout time.Duration //自登录起的最长有效期，使用和刷新都不能延长
+}
+
+// SessionPolicies 按角色和是否"记住我"选择会话策略
+type SessionPolicies struct {
+	Default       SessionPolicy
+	Remember      SessionPolicy //IdleTimeout为0时不支持记住我
+	Roles         map[string]SessionPolicy
+	RememberRoles map[string]SessionPolicy
+}
+
+// Sessions 由main根据配置设置
+var Sessions = &SessionPolicies{
+	Default:  SessionPolicy{IdleTimeout: 2 * time.Hour, AbsoluteTimeout: 24 * time.Hour},
+	Remember: SessionPolicy{IdleTimeout: 30 * 24 * time.Hour, AbsoluteTimeout: 90 * 24 * time.Hour},
+}
+
+// For 返回角色对应的策略；请求记住我但该角色不支持时使用普通策略，第二个返回值为false
+func (p *SessionPolicies) For(role string, remember bool) (SessionPolicy, bool) {
+	if remember {
+		policy, ok := p.RememberRoles[role]
+		if !ok {
+			policy = p.Remember
+		}
+		if policy.IdleTimeout > 0 {
+			return policy, true
+		}
+	}
+	if policy, ok := p.Roles[role]; ok {
+		return policy, false
+	}
+	return p.Default, false
+}
+
+// ParseRoles 解析按角色覆盖的策略，格式为 role=空闲超时/绝对超时[/记住我空闲超时/记住我绝对超时]，多个角色用逗号分隔
+// 记住我的两项省略时沿用全局设置，都为0表示该角色不支持记住我
+func (p *SessionPolicies) ParseRoles(spec string) error {
+	p.Roles = make(map[string]SessionPolicy)
+	p.RememberRoles = make(map[string]SessionPolicy)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		role, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("Invalid session policy %q", item)
+		}
+		parts := strings.Split(value, "/")
+		if len(parts) != 2 && len(parts) != 4 {
+			return fmt.Errorf("Invalid session policy %q", item)
+		}
+		durations := make([]time.Duration, len(parts))
+		for i, part := range parts {
+			d, err := time.ParseDuration(strings.TrimSpace(part))
+			if err != nil || d < 0 {
+				return fmt.Errorf("Invalid session policy %q", item)
+			}
+			durations[i] = d
+		}
+		role = strings.TrimSpace(role)
+		p.Roles[role] = SessionPolicy{IdleTimeout: durations[0], AbsoluteTimeout: durations[1]}
+		if len(durations) == 4 {
+			p.RememberRoles[role] = SessionPolicy{IdleTimeout: durations[2], AbsoluteTimeout: durations[3]}
+		}
+	}
+	return p.Validate()
+}
+
+// Validate 检查超时设置：空闲超时必须为正且不超过绝对超时，记住我的空闲超时为0时表示关闭
+func (p *SessionPolicies) Validate() error {
+	check := func(name string, policy SessionPolicy, optional bool) error {
+		if optional && policy.IdleTimeout == 0 && policy.AbsoluteTimeout == 0 {
+			return nil
+		}
+		if policy.IdleTimeout <= 0 || policy.AbsoluteTimeout < policy.IdleTimeout {
+			return fmt.Errorf("Invalid session policy for %s: idle timeout must be positive and not exceed absolute timeout", name)
+		}
+		return nil
+	}
+	if err := check("default", p.Default, false); err != nil {
+		return err
+	}
+	if err := check("remember me", p.Remember, true); err != nil {
+		return err
+	}
+	for role, policy := range p.Roles {
+		if err := check(role, policy, false); err != nil {
+			return err
+		}
+	}
+	for role, policy := range p.RememberRoles {
+		if err := check(role+" remember me", policy, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionExpiry 返回now之后window时长与会话截止时间中较早的一个
+func sessionExpiry(now time.Time, window time.Duration, deadline time.Time) time.Time {
+	if expiry := now.Add(window); expiry.Before(deadline) {
+		return expiry
+	}
+	return deadline
+}
+
+// accessWindow 是访问token一次签发或顺延的时长，取空闲超时与AccessTokenTTL中较短的一个
+func accessWindow(policy SessionPolicy) time.Duration {
+	if AccessTokenTTL > 0 && AccessTokenTTL < policy.IdleTimeout {
+		return AccessTokenTTL
+	}
+	return policy.IdleTimeout
+}
+
+// sessionDeadline 返回签发请求中会话的截止时间，未指定时与token同时过期
+func sessionDeadline(Info *CreateTokenRequset) time.Time {
+	if Info.SessionExpiredAt.IsZero() {
+		return Info.ExpiredAt
+	}
+	return Info.SessionExpiredAt
+}
+
+// orExpiry 旧版本实例写入的记录没有会话截止时间，以token的过期时间代替
+func orExpiry(deadline *time.Time, expiredAt time.Time) time.Time {
+	if deadline == nil {
+		return expiredAt
+	}
+	return *deadline
+}
+
+// slideSession 计算会话被使用后访问token和refresh token新的过期时间
+func slideSession(role string, remember bool, deadline time.Time) (access, refresh time.Time) {
+	policy, _ := Sessions.For(role, remember)
+	now := time.Now()
+	return sessionExpiry(now, accessWindow(policy), deadline), sessionExpiry(now, policy.IdleTimeout, deadline)
+}
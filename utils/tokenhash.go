@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+var TokenHashKey []byte //由main根据配置设置，非空时用HMAC-SHA256，更换后所有会话失效
+
+// LegacyTokens 为true时查询不到摘要会尝试转换明文保存的token；启动时HashStoredTokens没有找到明文行说明升级已完成，由main关闭
+var LegacyTokens = true
+
+const tokenPrefixLength = 8
+
+// HashToken 返回token保存在数据库中的摘要，数据库泄露后无法据此还原出可用的token
+func HashToken(token string) string {
+	var sum []byte
+	if len(TokenHashKey) > 0 {
+		mac := hmac.New(sha256.New, TokenHashKey)
+		mac.Write([]byte(token))
+		sum = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256([]byte(token))
+		sum = digest[:]
+	}
+	return hex.EncodeToString(sum)
+}
+
+// TokenPrefix 返回token的前几位，只用于在会话列表中辨认
+func TokenPrefix(token string) string {
+	if len(token) > tokenPrefixLength {
+		return token[:tokenPrefixLength]
+	}
+	return token
+}
+
+// HashStoredTokens 把升级前以明文保存的token转换为摘要，返回转换的行数
+func (h *AuthDBHandler) HashStoredTokens(ctx context.Context) (int, error) {
+	if h.DB == nil {
+		return 0, fmt.Errorf("NewAuthDBHandler: Database connection is not initialized")
+	}
+	total := 0
+	for _, table := range []struct{ name, column string }{
+		{"tokens", "token"},
+		{"refresh_tokens", "token"},
+		{"revoked_tokens", "jti"},
+	} {
+		for {
+			n, err := h.hashBatch(ctx, table.name, table.column)
+			if err != nil {
+				return total, fmt.Errorf("Failed to hash %s: %w", table.name, err)
+			}
+			total += n
+			if n == 0 {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+func (h *AuthDBHandler) hashBatch(ctx context.Context, table, column string) (int, error) {
+	rows, err := h.DB.Query(ctx, `SELECT id, `+column+` FROM `+table+` WHERE hashed = 0 ORDER BY id LIMIT 500`)
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id    int64
+		token string
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.token); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, r)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range batch {
+		set := column + ` = ?, hashed = 1`
+		args := []any{HashToken(r.token)}
+		if table != "revoked_tokens" {
+			set += `, token_prefix = ?`
+			args = append(args, TokenPrefix(r.token))
+		}
+		//hashed = 0 保证多个实例同时转换时同一行只转换一次
+		_, err := h.DB.Exec(ctx, `UPDATE `+table+` SET `+set+` WHERE id = ? AND hashed = 0`, append(args, r.id)...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), nil
+}
+
+// hashLegacy 查询不到摘要时调用：升级过程中旧版本实例可能仍在写入明文，找到后就地转换
+// 无效token也会走到这里，用Untracked避免每次未命中都让ReadConsistent改走主库
+func (h *AuthDBHandler) hashLegacy(ctx context.Context, table, token string) (bool, error) {
+	if !LegacyTokens {
+		return false, nil
+	}
+	result, err := h.DB.Untracked().Exec(ctx, `
+	UPDATE `+table+` SET token = ?, token_prefix = ?, hashed = 1 WHERE token = ? AND hashed = 0`,
+		HashToken(token), TokenPrefix(token), token,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
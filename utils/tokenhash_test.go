@@ -0,0 +1,130 @@
+package utils_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"user_system/utils"
+)
+
+func TestTokenDigests(t *testing.T) {
+	tests := []struct {
+		name string
+		key  []byte
+	}{
+		{"sha256", nil},
+		{"hmac", []byte("token hash key")},
+	}
+	for _, tt := range tests {
+		set(t, &utils.TokenHashKey, tt.key)
+		for name, tokens := range stores(t) {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
+				pair := issue(t, tokens, "alice")
+				list, err := tokens.GetTokensByUsername(ctx, "alice")
+				if err != nil || len(list) != 1 {
+					t.Fatalf("GetTokensByUsername = %v, %v", list, err)
+				}
+				//只保存摘要和用于辨认的前缀
+				if list[0].Token != utils.HashToken(pair.AccessToken) || list[0].Token == pair.AccessToken {
+					t.Errorf("stored token = %q, want digest of the issued token", list[0].Token)
+				}
+				if list[0].TokenPrefix != pair.AccessToken[:8] {
+					t.Errorf("TokenPrefix = %q, want %q", list[0].TokenPrefix, pair.AccessToken[:8])
+				}
+				if _, err := tokens.GetInfobyToken(ctx, pair.AccessToken); err != nil {
+					t.Errorf("lookup by token: %v", err)
+				}
+				//泄露的摘要不能当作token使用
+				if _, err := tokens.GetInfobyToken(ctx, list[0].Token); err == nil {
+					t.Error("lookup by digest succeeded")
+				}
+				if _, err := tokens.RotateRefreshToken(ctx, utils.HashToken(pair.RefreshToken), ""); err == nil {
+					t.Error("rotation by refresh token digest succeeded")
+				}
+			})
+		}
+	}
+}
+
+// 升级前以明文保存的token在HashStoredTokens之后仍然可用
+func TestHashStoredTokens(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	expiredAt := time.Now().Add(time.Hour)
+	legacy := func(t *testing.T) (access, refresh, jti string) {
+		t.Helper()
+		access, _ = utils.GernerateToken()
+		refresh, _ = utils.GernerateToken()
+		jti, _ = utils.GernerateToken()
+		statements := []struct {
+			query string
+			args  []any
+		}{
+			{`INSERT INTO tokens (token, username, role, expired_at, family) VALUES(?, 'alice', 'user', ?, ?)`, []any{access, expiredAt, jti}},
+			{`INSERT INTO refresh_tokens (token, family, username, role, expired_at) VALUES(?, ?, 'alice', 'user', ?)`, []any{refresh, jti, expiredAt}},
+			{`INSERT INTO revoked_tokens (jti, expired_at) VALUES(?, ?)`, []any{jti, expiredAt}},
+		}
+		for _, s := range statements {
+			if _, err := store.DB.Exec(ctx, s.query, s.args...); err != nil {
+				t.Fatalf("insert legacy row: %v", err)
+			}
+		}
+		return access, refresh, jti
+	}
+
+	access, refresh, jti := legacy(t)
+	n, err := store.HashStoredTokens(ctx)
+	if err != nil || n != 3 {
+		t.Fatalf("HashStoredTokens = %d, %v, want 3", n, err)
+	}
+	if n, err := store.HashStoredTokens(ctx); err != nil || n != 0 {
+		t.Errorf("second HashStoredTokens = %d, %v, want 0", n, err)
+	}
+	var plaintext int
+	store.DB.QueryRow(ctx, `SELECT COUNT(*) FROM tokens WHERE token = ?`, access).Scan(&plaintext)
+	if plaintext != 0 {
+		t.Error("plaintext token still stored")
+	}
+	info, err := store.GetInfobyToken(ctx, access)
+	if err != nil || info.TokenPrefix != access[:8] {
+		t.Errorf("GetInfobyToken = %+v, %v", info, err)
+	}
+	if _, err := store.RotateRefreshToken(ctx, refresh, ""); err != nil {
+		t.Errorf("RotateRefreshToken: %v", err)
+	}
+	revoked, err := store.GetRevokedTokens(ctx, time.Time{})
+	if err != nil {
+		t.Fatalf("GetRevokedTokens: %v", err)
+	}
+	found := false
+	for _, r := range revoked {
+		found = found || r.JTI == utils.HashToken(jti)
+	}
+	if !found {
+		t.Errorf("GetRevokedTokens = %v, want digest of %q", revoked, jti)
+	}
+
+	//升级过程中旧版本实例写入的明文在查询时就地转换
+	access, refresh, _ = legacy(t)
+	if _, err := store.GetInfobyToken(ctx, access); err != nil {
+		t.Errorf("GetInfobyToken(legacy): %v", err)
+	}
+	if _, err := store.RotateRefreshToken(ctx, refresh, ""); err != nil {
+		t.Errorf("RotateRefreshToken(legacy): %v", err)
+	}
+
+	//启动时已没有明文行，查询不到摘要时不再尝试转换
+	set(t, &utils.LegacyTokens, false)
+	access, refresh, _ = legacy(t)
+	if _, err := store.GetInfobyToken(ctx, access); err == nil {
+		t.Error("GetInfobyToken(legacy) succeeded with LegacyTokens disabled")
+	}
+	if _, err := store.RotateRefreshToken(ctx, refresh, ""); err == nil {
+		t.Error("RotateRefreshToken(legacy) succeeded with LegacyTokens disabled")
+	}
+	store.DB.QueryRow(ctx, `SELECT COUNT(*) FROM tokens WHERE token = ?`, access).Scan(&plaintext)
+	if plaintext != 1 {
+		t.Error("plaintext token converted with LegacyTokens disabled")
+	}
+}
@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TokenStore 只保存token的摘要：GetInfobyToken和RotateRefreshToken接收客户端提交的明文token，
+// 其余按token操作的方法接收TokenInfo.Token中的摘要
+type TokenStore interface {
+	GetToken(ctx context.Context, Info *CreateTokenRequset) (string, error)
+	GetInfobyToken(ctx context.Context, Token string) (*TokenInfo, error)
+	DeleteToken(ctx context.Context, Token string) error
+	GetTokenCount(ctx context.Context) (int, error)
+	GetAllTokens(ctx context.Context) ([]TokenInfo, error)
+	UpdateToken(ctx context.Context, Token string, Info *CreateTokenRequset) error
+	TouchToken(ctx context.Context, Info *TokenInfo, IP string) error
+	GetTokensByUsername(ctx context.Context, username string) ([]TokenInfo, error)
+	CreateRefreshToken(ctx context.Context, Info *CreateTokenRequset) (string, error)
+	RotateRefreshToken(ctx context.Context, Token string, IP string) (*TokenPair, error)
+	DeleteAllTokens(ctx context.Context) error
+	DeleteExpiredTokens(ctx context.Context) error
+	DeleteTokenByUsername(ctx context.Context, username string) error
+	DeleteTokenByID(ctx context.Context, id int) error
+	DeleteTokenByToken(ctx context.Context, token string) error
+	GetRevokedTokens(ctx context.Context, since time.Time) ([]RevokedToken, error)
+	CreateAccessToken(ctx context.Context, Info *CreateAccessTokenRequest) (string, *AccessToken, error)
+	GetInfoByAccessToken(ctx context.Context, Token string) (*TokenInfo, error)
+	GetAccessTokensByUsername(ctx context.Context, username string) ([]AccessToken, error)
+	DeleteAccessToken(ctx context.Context, username string, id int) error
+	DeleteAccessTokensByUsername(ctx context.Context, username string) error
+	TouchAccessToken(ctx context.Context, Info *TokenInfo, IP string) error
+}
+
+// RevokedToken 是提前删除的会话，已签发的JWT在过期前需要据此拒绝
+type RevokedToken struct {
+	JTI       string
+	ExpiredAt time.Time
+	RevokedAt time.Time
+}
+
+// AuthMemoryHandler 是TokenStore的内存实现，进程退出后数据丢失，用于测试、演示与临时环境
+type AuthMemoryHandler struct {
+	mu       sync.RWMutex
+	rotateMu sync.Mutex
+	nextID   int
+	tokens   map[string]*TokenInfo    //token摘要 -> info
+	refresh  map[string]*refreshToken //refresh token摘要 -> info
+	revoked  []RevokedToken
+	access   map[string]*accessToken //个人访问令牌摘要 -> 令牌
+
+	nextAccessID int
+	undo         *UndoLog //事务进行中记录修改，不在事务中为nil
+}
+
+func NewAuthMemoryHandler() *AuthMemoryHandler {
+	return &AuthMemoryHandler{tokens: make(map[string]*TokenInfo), refresh: make(map[string]*refreshToken), access: make(map[string]*accessToken)}
+}
+
+// Begin 开始事务：之后的修改记入撤销日志，rollback撤销这些修改，commit丢弃日志，二者只调用其一
+// 同一时间只能有一个事务，由调用方保证；只复制修改过的条目，不复制全部数据
+func (h *AuthMemoryHandler) Begin() (commit, rollback func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	undo := &UndoLog{}
+	h.undo = undo
+	nextID, nextAccessID := h.nextID, h.nextAccessID
+	commit = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.undo = nil
+	}
+	rollback = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.undo = nil
+		undo.Rollback()
+		h.nextID, h.nextAccessID = nextID, nextAccessID
+	}
+	return commit, rollback
+}
+
+func (h *AuthMemoryHandler) GetToken(ctx context.Context, Info *CreateTokenRequset) (string, error) {
+	if time.Now().After(Info.ExpiredAt) {
+		return "", fmt.Errorf("CreateToken: ExpiredAt must be after now")
+	}
+	token, err := GernerateToken()
+	if err != nil {
+		return "", err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	//每次登录都新建会话，顺便清理该用户已过期的会话
+	for existing, info := range h.tokens {
+		if info.Username == Info.Username && info.ExpiredAt.Before(time.Now()) {
+			Save(h.undo, h.tokens, existing, Copy)
+			delete(h.tokens, existing)
+		}
+	}
+	h.nextID++
+	digest := HashToken(token) //与SQL实现一致，只保存摘要
+	Save(h.undo, h.tokens, digest, Copy)
+	h.tokens[digest] = &TokenInfo{
+		ID:               h.nextID,
+		Token:            digest,
+		TokenPrefix:      TokenPrefix(token),
+		Username:         Info.Username,
+		Role:             Info.Role,
+		CreatedAt:        time.Now(),
+		ExpiredAt:        Info.ExpiredAt,
+		Device:           Info.Device,
+		UserAgent:        Info.UserAgent,
+		IP:               Info.IP,
+		Family:           Info.Family,
+		Stateless:        Info.Stateless,
+		Remember:         Info.Remember,
+		SessionExpiredAt: sessionDeadline(Info),
+	}
+	return token, nil
+}
+
+func (h *AuthMemoryHandler) GetInfobyToken(ctx context.Context, Token string) (*TokenInfo, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	info, ok := h.tokens[HashToken(Token)]
+	if !ok || info.Stateless { //JWT的jti不能当作不透明token使用
+		return nil, fmt.Errorf("Token not found")
+	}
+	tokeninfo := *info
+	return &tokeninfo, nil
+}
+
+func (h *AuthMemoryHandler) DeleteToken(ctx context.Context, Token string) error {
+	return h.DeleteTokenByToken(ctx, Token)
+}
+
+func (h *AuthMemoryHandler) GetTokenCount(ctx context.Context) (int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.tokens), nil
+}
+
+func (h *AuthMemoryHandler) GetAllTokens(ctx context.Context) ([]TokenInfo, error) {
+	return h.findWhere(func(info *TokenInfo) bool { return true }), nil
+}
+
+func (h *AuthMemoryHandler) GetTokensByUsername(ctx context.Context, username string) ([]TokenInfo, error) {
+	return h.findWhere(func(info *TokenInfo) bool { return info.Username == username }), nil
+}
+
+func (h *AuthMemoryHandler) findWhere(match func(info *TokenInfo) bool) []TokenInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var tokens []TokenInfo
+	for _, info := range h.tokens {
+		if match(info) {
+			tokens = append(tokens, *info)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { //与SQL实现保持一致，按创建时间倒序
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens
+}
+
+func (h *AuthMemoryHandler) UpdateToken(ctx context.Context, Token string, Info *CreateTokenRequset) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if existing, ok := h.tokens[Token]; ok && existing.Username == Info.Username {
+		Save(h.undo, h.tokens, Token, Copy)
+		existing.Role = Info.Role
+		existing.ExpiredAt = Info.ExpiredAt
+	}
+	return nil
+}
+
+// TouchToken 与SQL实现使用Untracked连接一致，不记入撤销日志，不随事务回滚
+func (h *AuthMemoryHandler) TouchToken(ctx context.Context, Info *TokenInfo, IP string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	existing, ok := h.tokens[Info.Token]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if existing.LastUsedAt != nil && !existing.LastUsedAt.Before(now.Add(-TouchInterval)) {
+		return nil
+	}
+	access, refresh := slideSession(existing.Role, existing.Remember, existing.SessionExpiredAt)
+	existing.LastUsedAt = &now
+	existing.IP = IP
+	existing.ExpiredAt = access
+	if existing.Family == "" {
+		return nil
+	}
+	for _, stored := range h.refresh {
+		if stored.Info.Family == existing.Family && stored.UsedAt == nil {
+			stored.Info.ExpiredAt = refresh
+		}
+	}
+	return nil
+}
+
+func (h *AuthMemoryHandler) DeleteAllTokens(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for token := range h.tokens {
+		h.removeLocked(token)
+	}
+	for token := range h.refresh {
+		Save(h.undo, h.refresh, token, Copy)
+		delete(h.refresh, token)
+	}
+	for digest := range h.access {
+		Save(h.undo, h.access, digest, Copy)
+		delete(h.access, digest)
+	}
+	return nil
+}
+
+func (h *AuthMemoryHandler) DeleteExpiredTokens(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for token, info := range h.tokens {
+		if info.ExpiredAt.Before(now) {
+			Save(h.undo, h.tokens, token, Copy)
+			delete(h.tokens, token)
+		}
+	}
+	for token, stored := range h.refresh {
+		if stored.UsedAt == nil && stored.Info.ExpiredAt.Before(now) || sessionDeadline(&stored.Info).Before(now) {
+			Save(h.undo, h.refresh, token, Copy)
+			delete(h.refresh, token)
+		}
+	}
+	for digest, a := range h.access {
+		if a.ExpiredAt != nil && a.ExpiredAt.Before(now) {
+			Save(h.undo, h.access, digest, Copy)
+			delete(h.access, digest)
+		}
+	}
+	//新建切片，原来的切片留给撤销日志恢复
+	var revoked []RevokedToken
+	for _, r := range h.revoked {
+		if !r.ExpiredAt.Before(now) {
+			revoked = append(revoked, r)
+		}
+	}
+	if h.undo != nil {
+		old := h.revoked
+		h.undo.Push(func() { h.revoked = old })
+	}
+	h.revoked = revoked
+	return nil
+}
+
+func (h *AuthMemoryHandler) DeleteTokenByUsername(ctx context.Context, username string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for token, info := range h.tokens {
+		if info.Username == username {
+			h.removeLocked(token)
+		}
+	}
+	for token, stored := range h.refresh {
+		if stored.Info.Username == username {
+			Save(h.undo, h.refresh, token, Copy)
+			delete(h.refresh, token)
+		}
+	}
+	return nil
+}
+
+func (h *AuthMemoryHandler) DeleteTokenByID(ctx context.Context, id int) error {
+	h.deleteSession(func(info *TokenInfo) bool { return info.ID == id })
+	return nil
+}
+
+func (h *AuthMemoryHandler) DeleteTokenByToken(ctx context.Context, token string) error {
+	h.deleteSession(func(info *TokenInfo) bool { return info.Token == token })
+	return nil
+}
+
+// deleteSession 删除匹配的访问token，同时吊销其family的refresh token
+func (h *AuthMemoryHandler) deleteSession(match func(info *TokenInfo) bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for token, info := range h.tokens {
+		if match(info) {
+			h.removeLocked(token)
+			h.deleteFamilyLocked(info.Family)
+		}
+	}
+}
+
+// removeLocked 删除访问token，未过期的记入吊销列表；调用方需持有h.mu
+func (h *AuthMemoryHandler) removeLocked(token string) {
+	info, ok := h.tokens[token]
+	if !ok {
+		return
+	}
+	Save(h.undo, h.tokens, token, Copy)
+	delete(h.tokens, token)
+	if now := time.Now(); info.ExpiredAt.After(now) {
+		if h.undo != nil {
+			n := len(h.revoked)
+			h.undo.Push(func() { h.revoked = h.revoked[:n] })
+		}
+		h.revoked = append(h.revoked, RevokedToken{JTI: token, ExpiredAt: info.ExpiredAt, RevokedAt: now})
+	}
+}
+
+func (h *AuthMemoryHandler) GetRevokedTokens(ctx context.Context, since time.Time) ([]RevokedToken, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var revoked []RevokedToken
+	now := time.Now()
+	for _, r := range h.revoked {
+		if !r.RevokedAt.Before(since) && r.ExpiredAt.After(now) {
+			revoked = append(revoked, r)
+		}
+	}
+	return revoked, nil
+}
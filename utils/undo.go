@@ -0,0 +1,45 @@
+package utils
+
+// UndoLog 记录内存存储在事务中的修改，回滚时逆序撤销；代价与修改的条目数成正比，与数据总量无关
+// 不是并发安全的，调用方持有存储的写锁
+type UndoLog struct {
+	undo []func()
+}
+
+// Push 记录撤销一次修改的函数
+func (l *UndoLog) Push(undo func()) {
+	l.undo = append(l.undo, undo)
+}
+
+// Rollback 逆序执行记录的函数，同一条目多次修改时恢复到最早的值
+func (l *UndoLog) Rollback() {
+	for i := len(l.undo) - 1; i >= 0; i-- {
+		l.undo[i]()
+	}
+	l.undo = nil
+}
+
+// Save 在修改m[key]之前调用，记录原值的副本，回滚时放回或删除新增的key；l为nil（不在事务中）时什么都不做
+// 修改前后m不能被替换成另一个map
+func Save[K comparable, V any](l *UndoLog, m map[K]V, key K, clone func(V) V) {
+	if l == nil {
+		return
+	}
+	old, ok := m[key]
+	if ok {
+		old = clone(old)
+	}
+	l.Push(func() {
+		if ok {
+			m[key] = old
+		} else {
+			delete(m, key)
+		}
+	})
+}
+
+// Copy 浅复制，用作Save的clone参数
+func Copy[T any](v *T) *T {
+	copied := *v
+	return &copied
+}
@@ -0,0 +1,116 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// 只实现WebAuthn用到的CBOR子集：整数、字节串、文本、数组、映射、布尔与null，不支持不定长编码与浮点数
+
+var errCBOR = errors.New("Malformed CBOR")
+
+const maxCBORDepth = 16
+
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errCBOR
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return major, uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, 0, nil, errCBOR
+}
+
+func decodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errCBOR
+	}
+	major, n, rest, err := decodeHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		if major == 2 {
+			return append([]byte(nil), rest[:n]...), rest[n:], nil
+		}
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		if n > uint64(len(rest)) { //每个元素至少占1字节
+			return nil, nil, errCBOR
+		}
+		list := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item any
+			if item, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			list = append(list, item)
+		}
+		return list, rest, nil
+	case 5:
+		if n > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[any]any, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value any
+			if key, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key", errCBOR)
+			}
+			if value, rest, err = decodeItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			if _, exist := m[key]; exist {
+				return nil, nil, fmt.Errorf("%w: duplicate map key", errCBOR)
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	case 7:
+		switch n {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
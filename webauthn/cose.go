@@ -0,0 +1,131 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE算法编号，见RFC 9053与IANA COSE Algorithms
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// 支持的算法，按偏好排列，注册时告知认证器
+var algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+var ErrUnsupportedKey = errors.New("Unsupported credential public key")
+
+// 主要用到的COSE_Key参数
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 //EC2、OKP的曲线；RSA的n
+	coseX   = -2 //EC2、OKP的x；RSA的e
+	coseY   = -3
+)
+
+// PublicKey 是解析后的凭证公钥
+type PublicKey struct {
+	Alg int
+	key crypto.PublicKey
+}
+
+func intField(m map[any]any, key int64) (int64, bool) {
+	v, ok := m[key].(int64)
+	return v, ok
+}
+
+func bytesField(m map[any]any, key int64) []byte {
+	v, _ := m[key].([]byte)
+	return v
+}
+
+// ParsePublicKey 解析CBOR编码的COSE_Key，只接受ES256（P-256）、EdDSA（Ed25519）与RS256
+func ParsePublicKey(data []byte) (*PublicKey, error) {
+	v, rest, err := decodeCBOR(data)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, errCBOR)
+	}
+	return parseCOSEKey(v)
+}
+
+func parseCOSEKey(v any) (*PublicKey, error) {
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	kty, _ := intField(m, coseKty)
+	alg, _ := intField(m, coseAlg)
+	crv, _ := intField(m, coseCrv)
+	switch {
+	case kty == 2 && alg == AlgES256 && crv == 1:
+		x, y := bytesField(m, coseX), bytesField(m, coseY)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, ErrUnsupportedKey
+		}
+		uncompressed := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), uncompressed)
+		if err != nil { //不在曲线上的点
+			return nil, ErrUnsupportedKey
+		}
+		return &PublicKey{Alg: AlgES256, key: key}, nil
+	case kty == 1 && alg == AlgEdDSA && crv == 6:
+		x := bytesField(m, coseX)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		return &PublicKey{Alg: AlgEdDSA, key: ed25519.PublicKey(x)}, nil
+	case kty == 3 && alg == AlgRS256:
+		n, e := bytesField(m, coseCrv), bytesField(m, coseX)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 { //至少2048位
+			return nil, ErrUnsupportedKey
+		}
+		return &PublicKey{Alg: AlgRS256, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	}
+	return nil, fmt.Errorf("%w: kty %d, alg %d", ErrUnsupportedKey, kty, alg)
+}
+
+// Verify 校验对data的签名，ES256的签名为ASN.1 DER编码
+func (k *PublicKey) Verify(data, sig []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
+
+func verifyWith(pub crypto.PublicKey, alg int, data, sig []byte) bool { //packed证明中证书的公钥
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if alg != AlgES256 {
+			return false
+		}
+		return (&PublicKey{Alg: alg, key: key}).Verify(data, sig)
+	case ed25519.PublicKey:
+		if alg != AlgEdDSA {
+			return false
+		}
+		return (&PublicKey{Alg: alg, key: key}).Verify(data, sig)
+	case *rsa.PublicKey:
+		if alg != AlgRS256 {
+			return false
+		}
+		return (&PublicKey{Alg: alg, key: key}).Verify(data, sig)
+	}
+	return false
+}
@@ -0,0 +1,449 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Timeout 是一次注册或登录仪式的有效期，也是服务端保存挑战的时间
+const Timeout = 5 * time.Minute
+
+var (
+	ErrInvalidResponse        = errors.New("Invalid WebAuthn response")
+	ErrChallengeMismatch      = errors.New("WebAuthn challenge mismatch")
+	ErrOriginMismatch         = errors.New("WebAuthn origin is not allowed")
+	ErrRPIDMismatch           = errors.New("WebAuthn RP ID mismatch")
+	ErrUserNotPresent         = errors.New("User presence is required")
+	ErrUserNotVerified        = errors.New("User verification is required")
+	ErrBadSignature           = errors.New("Invalid WebAuthn signature")
+	ErrSignCount              = errors.New("Authenticator sign count did not increase, it may be cloned")
+	ErrUnsupportedAttestation = errors.New("Unsupported attestation format")
+)
+
+// authenticatorData中的标志位
+const (
+	flagUP = 0x01 //用户在场
+	flagUV = 0x04 //用户已验证（PIN、指纹等）
+	flagAT = 0x40 //包含凭证数据
+	flagED = 0x80 //包含扩展数据
+)
+
+const maxCredentialIDLength = 384
+
+// Encoding 是浏览器序列化PublicKeyCredential时使用的base64url编码
+var Encoding = base64.RawURLEncoding
+
+// RelyingParty 是依赖方（本服务）的配置
+type RelyingParty struct {
+	ID      string   //通常是站点的域名，凭证与之绑定
+	Name    string   //显示在认证器提示中
+	Origins []string //允许发起仪式的页面源，如 https://example.com
+}
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"` //base64url编码的用户句柄
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"` //base64url
+	Transports []string `json:"transports,omitempty"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions 是注册仪式的参数，对应浏览器的PublicKeyCredentialCreationOptionsJSON
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credParam            `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"` //毫秒
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions 是登录仪式的参数，对应PublicKeyCredentialRequestOptionsJSON
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"` //为空时由认证器选择可发现凭证
+	UserVerification string                 `json:"userVerification"`
+}
+
+// AttestationResponse 是注册时浏览器返回的凭证，字段均为base64url编码
+type AttestationResponse struct {
+	ID       string `json:"id" binding:"required"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type" binding:"required"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON" binding:"required"`
+		AttestationObject string   `json:"attestationObject" binding:"required"`
+		Transports        []string `json:"transports"`
+	} `json:"response" binding:"required"`
+}
+
+// AssertionResponse 是登录时浏览器返回的签名
+type AssertionResponse struct {
+	ID       string `json:"id" binding:"required"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type" binding:"required"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" binding:"required"`
+		AuthenticatorData string `json:"authenticatorData" binding:"required"`
+		Signature         string `json:"signature" binding:"required"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response" binding:"required"`
+}
+
+// Credential 是注册成功后需要保存的凭证信息
+type Credential struct {
+	ID          []byte
+	PublicKey   []byte //CBOR编码的COSE_Key
+	SignCount   uint32
+	AAGUID      string //认证器型号，全零表示未提供
+	Transports  []string
+	Attestation string //none 或 packed
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authData struct {
+	raw        []byte
+	rpIDHash   []byte
+	flags      byte
+	signCount  uint32
+	aaguid     []byte
+	credID     []byte
+	credPubKey []byte
+}
+
+// NewChallenge 生成32字节的随机挑战，返回base64url编码
+func NewChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	return Encoding.EncodeToString(challenge), nil
+}
+
+// UserHandle 把用户ID编码为用户句柄，不包含用户名等个人信息
+func UserHandle(userID uint) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userID))
+}
+
+func ParseUserHandle(handle []byte) (uint, bool) {
+	if len(handle) != 8 {
+		return 0, false
+	}
+	return uint(binary.BigEndian.Uint64(handle)), true
+}
+
+func descriptors(credentials []Credential) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, 0, len(credentials))
+	for _, c := range credentials {
+		list = append(list, CredentialDescriptor{Type: "public-key", ID: Encoding.EncodeToString(c.ID), Transports: c.Transports})
+	}
+	return list
+}
+
+// CreationOptions 生成注册参数，exclude中的凭证不会在同一个认证器上重复注册
+func (rp *RelyingParty) CreationOptions(challenge string, userID uint, username string, exclude []Credential) *CreationOptions {
+	params := make([]credParam, 0, len(algorithms))
+	for _, alg := range algorithms {
+		params = append(params, credParam{Type: "public-key", Alg: alg})
+	}
+	return &CreationOptions{
+		Challenge:              challenge,
+		RP:                     rpEntity{ID: rp.ID, Name: rp.Name},
+		User:                   userEntity{ID: Encoding.EncodeToString(UserHandle(userID)), Name: username, DisplayName: username},
+		PubKeyCredParams:       params,
+		Timeout:                Timeout.Milliseconds(),
+		ExcludeCredentials:     descriptors(exclude),
+		AuthenticatorSelection: authenticatorSelection{ResidentKey: "preferred", UserVerification: "preferred"},
+		Attestation:            "none",
+	}
+}
+
+// RequestOptions 生成登录参数；无密码登录需要用户验证，作为第二步验证时只需要用户在场
+func (rp *RelyingParty) RequestOptions(challenge string, allow []Credential, requireUV bool) *RequestOptions {
+	uv := "preferred"
+	if requireUV {
+		uv = "required"
+	}
+	return &RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          Timeout.Milliseconds(),
+		AllowCredentials: descriptors(allow),
+		UserVerification: uv,
+	}
+}
+
+func decodeField(s string) ([]byte, error) {
+	b, err := Encoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	return b, nil
+}
+
+// ChallengeOf 从clientDataJSON中取出挑战，用于在校验之前找到服务端保存的仪式
+func ChallengeOf(clientDataJSON string) (string, error) {
+	raw, err := decodeField(clientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil || cd.Challenge == "" {
+		return "", ErrInvalidResponse
+	}
+	return cd.Challenge, nil
+}
+
+// verifyClientData 校验类型、挑战与来源，返回clientDataJSON的SHA-256
+func (rp *RelyingParty) verifyClientData(encoded, typ, challenge string) ([]byte, error) {
+	raw, err := decodeField(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if cd.Type != typ {
+		return nil, fmt.Errorf("%w: unexpected type %q", ErrInvalidResponse, cd.Type)
+	}
+	if cd.Challenge != challenge {
+		return nil, ErrChallengeMismatch
+	}
+	if !slices.Contains(rp.Origins, cd.Origin) {
+		return nil, fmt.Errorf("%w: %s", ErrOriginMismatch, cd.Origin)
+	}
+	sum := sha256.Sum256(raw)
+	return sum[:], nil
+}
+
+func parseAuthData(raw []byte) (*authData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+	ad := &authData{raw: raw, rpIDHash: raw[:32], flags: raw[32], signCount: binary.BigEndian.Uint32(raw[33:37])}
+	rest := raw[37:]
+	if ad.flags&flagAT != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+		}
+		ad.aaguid = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > maxCredentialIDLength || len(rest) < n {
+			return nil, fmt.Errorf("%w: invalid credential id", ErrInvalidResponse)
+		}
+		ad.credID, rest = rest[:n], rest[n:]
+		_, after, err := decodeCBOR(rest) //公钥之后可能还有扩展数据
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		ad.credPubKey, rest = rest[:len(rest)-len(after)], after
+	}
+	if ad.flags&flagED != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing authenticator data", ErrInvalidResponse)
+	}
+	return ad, nil
+}
+
+func (rp *RelyingParty) checkAuthData(ad *authData, requireUV bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return ErrRPIDMismatch
+	}
+	if ad.flags&flagUP == 0 {
+		return ErrUserNotPresent
+	}
+	if requireUV && ad.flags&flagUV == 0 {
+		return ErrUserNotVerified
+	}
+	return nil
+}
+
+func formatAAGUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// VerifyRegistration 校验注册响应，成功时返回需要保存的凭证
+// 支持none与packed证明；packed带证书时只校验签名，不校验证书链
+func (rp *RelyingParty) VerifyRegistration(resp *AttestationResponse, challenge string, requireUV bool) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, fmt.Errorf("%w: unexpected credential type %q", ErrInvalidResponse, resp.Type)
+	}
+	clientDataHash, err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeField(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	v, rest, err := decodeCBOR(raw)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidResponse)
+	}
+	obj, ok := v.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidResponse)
+	}
+	format, _ := obj["fmt"].(string)
+	attStmt, _ := obj["attStmt"].(map[any]any)
+	rawAuthData, _ := obj["authData"].([]byte)
+	if attStmt == nil {
+		return nil, fmt.Errorf("%w: missing attStmt", ErrInvalidResponse)
+	}
+	ad, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkAuthData(ad, requireUV); err != nil {
+		return nil, err
+	}
+	if ad.credID == nil {
+		return nil, fmt.Errorf("%w: missing attested credential data", ErrInvalidResponse)
+	}
+	if resp.ID != Encoding.EncodeToString(ad.credID) {
+		return nil, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+	pub, err := ParsePublicKey(ad.credPubKey)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "none":
+		if len(attStmt) != 0 {
+			return nil, fmt.Errorf("%w: none attestation with statement", ErrInvalidResponse)
+		}
+	case "packed":
+		if err := verifyPacked(attStmt, pub, append(append([]byte(nil), rawAuthData...), clientDataHash...)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAttestation, format)
+	}
+	return &Credential{
+		ID:          ad.credID,
+		PublicKey:   ad.credPubKey,
+		SignCount:   ad.signCount,
+		AAGUID:      formatAAGUID(ad.aaguid),
+		Transports:  resp.Response.Transports,
+		Attestation: format,
+	}, nil
+}
+
+// verifyPacked 校验packed证明：有x5c时用证书的公钥，否则为自签名，用凭证自身的公钥
+func verifyPacked(attStmt map[any]any, credKey *PublicKey, signed []byte) error {
+	alg, ok := attStmt["alg"].(int64)
+	sig, _ := attStmt["sig"].([]byte)
+	if !ok || len(sig) == 0 {
+		return fmt.Errorf("%w: malformed packed statement", ErrInvalidResponse)
+	}
+	if x5c, exist := attStmt["x5c"].([]any); exist {
+		if len(x5c) == 0 {
+			return fmt.Errorf("%w: empty x5c", ErrInvalidResponse)
+		}
+		der, _ := x5c[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		if !verifyWith(cert.PublicKey, int(alg), signed, sig) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	if int(alg) != credKey.Alg {
+		return fmt.Errorf("%w: self attestation algorithm mismatch", ErrInvalidResponse)
+	}
+	if !credKey.Verify(signed, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// VerifyLogin 校验登录签名，返回认证器新的签名计数
+// 存储的计数与新计数有一个不为0时，新计数必须更大，否则认证器可能被克隆
+func (rp *RelyingParty) VerifyLogin(resp *AssertionResponse, challenge string, credential *Credential, requireUV bool) (uint32, error) {
+	if resp.Type != "public-key" {
+		return 0, fmt.Errorf("%w: unexpected credential type %q", ErrInvalidResponse, resp.Type)
+	}
+	if resp.ID != Encoding.EncodeToString(credential.ID) {
+		return 0, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+	clientDataHash, err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	rawAuthData, err := decodeField(resp.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkAuthData(ad, requireUV); err != nil {
+		return 0, err
+	}
+	sig, err := decodeField(resp.Response.Signature)
+	if err != nil {
+		return 0, err
+	}
+	pub, err := ParsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	if !pub.Verify(append(append([]byte(nil), rawAuthData...), clientDataHash...), sig) {
+		return 0, ErrBadSignature
+	}
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+	return ad.signCount, nil
+}
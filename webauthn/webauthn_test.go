@@ -0,0 +1,140 @@
+package webauthn_test
+
+import (
+	"errors"
+	"testing"
+	"user_system/internal/webauthntest"
+	"user_system/webauthn"
+)
+
+const origin = "https://example.com"
+
+var rp = &webauthn.RelyingParty{ID: "example.com", Name: "Example", Origins: []string{origin}}
+
+func register(t *testing.T, a *webauthntest.Authenticator) (*webauthn.Credential, error) {
+	t.Helper()
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge: %v", err)
+	}
+	resp, err := a.Create(rp.CreationOptions(challenge, 1, "alice", nil))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return rp.VerifyRegistration(resp, challenge, false)
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	tests := []struct {
+		name        string
+		attestation string
+		origin      string
+		wantErr     error
+	}{
+		{"none", "none", origin, nil},
+		{"packed self attestation", "packed", origin, nil},
+		{"foreign origin", "none", "https://evil.example", webauthn.ErrOriginMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := webauthntest.New(tt.origin)
+			a.Attestation = tt.attestation
+			credential, err := register(t, a)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && credential.Attestation != tt.attestation {
+				t.Errorf("Attestation = %q, want %q", credential.Attestation, tt.attestation)
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationChallengeMismatch(t *testing.T) {
+	a := webauthntest.New(origin)
+	resp, err := a.Create(rp.CreationOptions("issued", 1, "alice", nil))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := rp.VerifyRegistration(resp, "expected", false); !errors.Is(err, webauthn.ErrChallengeMismatch) {
+		t.Errorf("err = %v, want %v", err, webauthn.ErrChallengeMismatch)
+	}
+}
+
+func TestVerifyLogin(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(a *webauthntest.Authenticator)
+		requireUV bool
+		stored    func(c *webauthn.Credential) //修改服务端保存的凭证
+		wantErr   error
+	}{
+		{name: "ok", requireUV: true},
+		{name: "presence only", setup: func(a *webauthntest.Authenticator) { a.UserVerified = false }},
+		{name: "verification required", setup: func(a *webauthntest.Authenticator) { a.UserVerified = false }, requireUV: true, wantErr: webauthn.ErrUserNotVerified},
+		{name: "zero counter", setup: func(a *webauthntest.Authenticator) { a.ZeroCounter = true }},
+		{name: "sign count regression", stored: func(c *webauthn.Credential) { c.SignCount = 100 }, wantErr: webauthn.ErrSignCount},
+		{name: "wrong public key", stored: func(c *webauthn.Credential) {
+			other, err := register(t, webauthntest.New(origin))
+			if err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			c.PublicKey = other.PublicKey
+		}, wantErr: webauthn.ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := webauthntest.New(origin)
+			if tt.setup != nil {
+				tt.setup(a)
+			}
+			credential, err := register(t, a)
+			if err != nil {
+				t.Fatalf("register: %v", err)
+			}
+			if tt.stored != nil {
+				tt.stored(credential)
+			}
+			challenge, _ := webauthn.NewChallenge()
+			resp, err := a.Get(rp.RequestOptions(challenge, []webauthn.Credential{*credential}, tt.requireUV))
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			count, err := rp.VerifyLogin(resp, challenge, credential, tt.requireUV)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !a.ZeroCounter && count <= credential.SignCount {
+				t.Errorf("sign count = %d, want > %d", count, credential.SignCount)
+			}
+		})
+	}
+}
+
+// 克隆的认证器落后于服务端记录的计数，登录失败
+func TestVerifyLoginClonedAuthenticator(t *testing.T) {
+	a := webauthntest.New(origin)
+	credential, err := register(t, a)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	clone := a.Clone()
+	login := func(a *webauthntest.Authenticator) error {
+		challenge, _ := webauthn.NewChallenge()
+		resp, err := a.Get(rp.RequestOptions(challenge, nil, false))
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		count, err := rp.VerifyLogin(resp, challenge, credential, false)
+		if err == nil {
+			credential.SignCount = count
+		}
+		return err
+	}
+	if err := login(a); err != nil {
+		t.Fatalf("original: %v", err)
+	}
+	if err := login(clone); !errors.Is(err, webauthn.ErrSignCount) {
+		t.Errorf("clone: err = %v, want %v", err, webauthn.ErrSignCount)
+	}
+}